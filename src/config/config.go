@@ -0,0 +1,337 @@
+package config
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Used when neither -config nor CONFIG_FILE is set. It's fine for it not to
+// exist, the defaults and environment are enough to run locally.
+const defaultConfigFile = "config.yaml"
+
+type ServerConfig struct {
+	Port        string   `yaml:"port" env:"PORT"`
+	CORSOrigins []string `yaml:"corsOrigins" env:"CORS_ORIGINS"`
+	// Date (YYYY-MM-DD) after which the pre-/v1 routes may go away.
+	LegacySunset string `yaml:"legacySunset" env:"LEGACY_SUNSET"`
+	// iso, or ms to keep sending millisecond strings on /v1 too. The legacy
+	// routes always send ms.
+	Timestamps string `yaml:"timestamps" env:"TIMESTAMP_FORMAT"`
+}
+
+// LegacySunsetTime parses Server.LegacySunset, Validate has already checked it.
+func (config *Config) LegacySunsetTime() time.Time {
+	sunset, _ := time.Parse(time.DateOnly, config.Server.LegacySunset)
+	return sunset
+}
+
+type RateLimitConfig struct {
+	Rate      float64       `yaml:"rate" env:"RATE_LIMIT_RATE"`   // requests per second
+	Burst     int           `yaml:"burst" env:"RATE_LIMIT_BURST"` // requests allowed at once
+	ExpiresIn time.Duration `yaml:"expiresIn" env:"RATE_LIMIT_EXPIRES_IN"`
+}
+
+// Config holds every setting the server reads at startup. Each section is
+// owned by the package that uses it, this package only loads and checks
+// them.
+type Config struct {
+	Server        ServerConfig             `yaml:"server"`
+	RateLimit     RateLimitConfig          `yaml:"rateLimit"`
+	Mongo         infra.MongoConfig        `yaml:"mongo"`
+	Storage       infra.StorageConfig      `yaml:"storage"`
+	Uploads       utils.UploadLimits       `yaml:"uploads"`
+	DirectUploads lib.DirectUploadConfig   `yaml:"directUploads"`
+	Recaptcha     utils.RecaptchaConfig    `yaml:"recaptcha"`
+	Duplicates    lib.DuplicateImagePolicy `yaml:"duplicateImages"`
+	Leaderboards  lib.LeaderboardConfig    `yaml:"leaderboards"`
+	Wars          lib.WarsConfig           `yaml:"wars"`
+	Tournaments   lib.TournamentConfig     `yaml:"tournaments"`
+
+	// Moderators as name:token pairs, sent as "Authorization: Bearer <token>".
+	Moderators []string `yaml:"moderators" env:"MODERATOR_TOKENS" secret:"true"`
+}
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:         "1323",
+			CORSOrigins:  []string{"http://localhost:5173", "http://localhost:4173", "http://localhost:3000", "https://animoshi-svelte-frontend-zvxn.vercel.app/"},
+			LegacySunset: "2027-04-30",
+			Timestamps:   string(utils.TimestampISO),
+		},
+		RateLimit: RateLimitConfig{
+			Rate:      5,
+			Burst:     10,
+			ExpiresIn: 5 * time.Minute,
+		},
+		Mongo:         infra.DefaultMongoConfig,
+		Storage:       infra.DefaultStorageConfig,
+		Uploads:       utils.DefaultUploadLimits,
+		DirectUploads: lib.DefaultDirectUploadConfig,
+		Recaptcha:     utils.DefaultRecaptchaConfig,
+		Duplicates:    lib.DefaultDuplicateImagePolicy,
+		Leaderboards:  lib.DefaultLeaderboardConfig,
+		Wars:          lib.DefaultWarsConfig,
+		Tournaments:   lib.DefaultTournamentConfig,
+	}
+}
+
+// Load builds the config from the defaults, then the YAML file at path, then
+// environment variables, and validates the result. An empty path falls back
+// to config.yaml if there is one.
+func Load(path string) (*Config, error) {
+	config := Default()
+
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if explicit || !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&config).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// applyEnv overrides every field with an env tag whose variable is set.
+func applyEnv(value reflect.Value) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := value.Type().Field(i)
+
+		if fieldType.Type.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := fieldType.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(field, raw); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(number)
+	case reflect.Float64:
+		number, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(number)
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(flag)
+	case reflect.Slice:
+		// Comma separated, an empty variable clears the list.
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+func (config *Config) Validate() error {
+	var problems []string
+
+	if port, err := strconv.Atoi(config.Server.Port); err != nil || port <= 0 || port > 65535 {
+		problems = append(problems, "server.port must be a port number")
+	}
+
+	if _, err := time.Parse(time.DateOnly, config.Server.LegacySunset); err != nil {
+		problems = append(problems, "server.legacySunset must be a date like 2027-04-30")
+	}
+
+	switch utils.TimestampFormat(config.Server.Timestamps) {
+	case utils.TimestampISO, utils.TimestampMillis:
+	default:
+		problems = append(problems, "server.timestamps must be iso or ms")
+	}
+
+	if config.RateLimit.Rate <= 0 || config.RateLimit.Burst <= 0 || config.RateLimit.ExpiresIn <= 0 {
+		problems = append(problems, "rateLimit rate, burst and expiresIn must be positive")
+	}
+
+	if config.Mongo.URI == "" || config.Mongo.Database == "" {
+		problems = append(problems, "mongo.uri and mongo.database are required")
+	}
+
+	switch config.Storage.Backend {
+	case "s3":
+		if config.Storage.S3Region == "" || config.Storage.S3Bucket == "" || config.Storage.S3PublicURL == "" {
+			problems = append(problems, "storage.s3Region, storage.s3Bucket and storage.s3PublicUrl are required for the s3 backend")
+		}
+	case "local":
+		if config.Storage.LocalDir == "" || config.Storage.LocalBaseURL == "" {
+			problems = append(problems, "storage.localDir and storage.localBaseUrl are required for the local backend")
+		}
+	case "memory":
+	default:
+		problems = append(problems, "storage.backend must be s3, local or memory")
+	}
+
+	limits := config.Uploads
+	if limits.MaxImageBytes <= 0 || limits.MaxVideoBytes <= 0 || limits.MaxVideoDuration <= 0 ||
+		limits.MaxImageDimension <= 0 || limits.MaxImagePixels <= 0 || limits.MaxFrames <= 0 || limits.MaxTotalPixels <= 0 {
+		problems = append(problems, "every uploads limit must be positive")
+	}
+
+	if config.DirectUploads.SweepInterval <= 0 {
+		problems = append(problems, "directUploads.sweepInterval must be positive")
+	}
+
+	if config.Recaptcha.MinScore < 0 || config.Recaptcha.MinScore > 1 {
+		problems = append(problems, "recaptcha.minScore must be between 0 and 1")
+	}
+	if !strings.HasPrefix(config.Recaptcha.VerifyURL, "https://") {
+		problems = append(problems, "recaptcha.verifyUrl must start with https://")
+	}
+
+	switch config.Duplicates.Mode {
+	case lib.DuplicatesOff, lib.DuplicatesMark, lib.DuplicatesReject:
+	default:
+		problems = append(problems, "duplicateImages.mode must be off, mark or reject")
+	}
+	if config.Duplicates.MaxDistance < 0 || config.Duplicates.MaxDistance > 64 || config.Duplicates.RecentPosts <= 0 {
+		problems = append(problems, "duplicateImages.maxDistance must be between 0 and 64 and recentPosts positive")
+	}
+
+	if config.Leaderboards.RefreshInterval <= 0 || config.Leaderboards.Size <= 0 {
+		problems = append(problems, "leaderboards refreshInterval and size must be positive")
+	}
+
+	if config.Wars.VoteCooldown < 0 {
+		problems = append(problems, "wars.voteCooldown can't be negative")
+	}
+
+	if config.Tournaments.CheckInterval <= 0 {
+		problems = append(problems, "tournaments.checkInterval must be positive")
+	}
+
+	if _, err := utils.ParseModerators(config.Moderators); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Redacted returns the config as YAML with every secret field masked, for
+// printing at startup.
+func (config Config) Redacted() string {
+	redact(reflect.ValueOf(&config).Elem())
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(out)
+}
+
+func redact(value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := value.Type().Field(i)
+
+		if fieldType.Type.Kind() == reflect.Struct {
+			redact(field)
+			continue
+		}
+
+		if fieldType.Tag.Get("secret") != "true" {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			if field.String() != "" {
+				field.SetString("[redacted]")
+			}
+		case reflect.Slice:
+			// Keep the part before ":" so moderator names still show up.
+			masked := make([]string, field.Len())
+			for j := range masked {
+				if name, _, ok := strings.Cut(field.Index(j).String(), ":"); ok {
+					masked[j] = name + ":[redacted]"
+				} else {
+					masked[j] = "[redacted]"
+				}
+			}
+			field.Set(reflect.ValueOf(masked))
+		}
+	}
+}
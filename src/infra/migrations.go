@@ -0,0 +1,273 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Migration changes the database once: creating indexes, backfilling
+// fields and so on. Versions are applied in increasing order and recorded in
+// schema_migrations so they never run twice. Up must be safe to re-run if it
+// failed half way, nothing is recorded until it returns nil.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, database *mongo.Database) error
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied     bool
+	AppliedTime time.Time
+}
+
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Name        string    `bson:"name"`
+	AppliedTime time.Time `bson:"appliedTime"`
+	DurationMs  int64     `bson:"durationMs"`
+}
+
+type migrationLock struct {
+	ID          string    `bson:"_id"`
+	Owner       string    `bson:"owner"`
+	LockedTime  time.Time `bson:"lockedTime"`
+	ExpiresTime time.Time `bson:"expiresTime"`
+}
+
+const (
+	migrationsCollection    = "schema_migrations"
+	migrationLockCollection = "schema_migrations_lock"
+	migrationLockID         = "migrations"
+
+	// A lock older than this belongs to an instance that died mid-run. It's
+	// refreshed before every migration, so one migration gets this long.
+	migrationLockTTL = 10 * time.Minute
+	// How long another instance waits for the lock before giving up.
+	migrationLockWait = 15 * time.Minute
+	migrationLockPoll = 2 * time.Second
+)
+
+var (
+	ErrMigrationLockTimeout = errors.New("timed out waiting for the migration lock")
+	ErrMigrationLockLost    = errors.New("lost the migration lock")
+)
+
+func checkMigrationOrder(migrations []Migration) error {
+	for i, migration := range migrations {
+		if migration.Version <= 0 {
+			return fmt.Errorf("migration %q has no version", migration.Name)
+		}
+		if i > 0 && migration.Version <= migrations[i-1].Version {
+			return fmt.Errorf("migration %d (%s) is out of order", migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+func appliedMigrations(ctx context.Context, database *mongo.Database) (map[int]appliedMigration, error) {
+	// Records written before appliedTime was a date hold milliseconds as a
+	// string, they're read as dates too.
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"appliedTime": bson.M{"$cond": bson.M{
+			"if":   bson.M{"$eq": bson.A{bson.M{"$type": "$appliedTime"}, "string"}},
+			"then": bson.M{"$toDate": bson.M{"$toLong": "$appliedTime"}},
+			"else": "$appliedTime",
+		}}}}},
+	}
+
+	cur, err := database.Collection(migrationsCollection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []appliedMigration
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]appliedMigration{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// GetMigrationStatus lists every migration and whether it has been applied.
+func GetMigrationStatus(ctx context.Context, client *mongo.Client, migrations []Migration) ([]MigrationStatus, error) {
+	if err := checkMigrationOrder(migrations); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, Database(client))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		record, ok := applied[migration.Version]
+		statuses = append(statuses, MigrationStatus{Migration: migration, Applied: ok, AppliedTime: record.AppliedTime})
+	}
+	return statuses, nil
+}
+
+// RunMigrations applies every pending migration in order and returns the
+// ones it ran. Only one instance migrates at a time, the others wait for the
+// lock and then find nothing left to do.
+func RunMigrations(ctx context.Context, client *mongo.Client, migrations []Migration) ([]Migration, error) {
+	if err := checkMigrationOrder(migrations); err != nil {
+		return nil, err
+	}
+
+	database := Database(client)
+	return runMigrations(ctx, database, newMigrationLocker(database), migrations)
+}
+
+func runMigrations(ctx context.Context, database *mongo.Database, lock *migrationLocker, migrations []Migration) ([]Migration, error) {
+	if err := lock.wait(ctx); err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	applied, err := appliedMigrations(ctx, database)
+	if err != nil {
+		return nil, err
+	}
+
+	var ran []Migration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		// Keep the lock for as long as we keep working.
+		ok, err := lock.acquire(ctx)
+		if err != nil {
+			return ran, fmt.Errorf("extending the migration lock before %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		if !ok {
+			return ran, fmt.Errorf("%w before %d (%s)", ErrMigrationLockLost, migration.Version, migration.Name)
+		}
+
+		log.Printf("Applying migration %d: %s", migration.Version, migration.Name)
+		start := time.Now()
+
+		if err := migration.Up(ctx, database); err != nil {
+			return ran, fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Name, err)
+		}
+
+		record := appliedMigration{
+			Version:     migration.Version,
+			Name:        migration.Name,
+			AppliedTime: time.Now(),
+			DurationMs:  time.Since(start).Milliseconds(),
+		}
+		if _, err := database.Collection(migrationsCollection).InsertOne(ctx, record); err != nil {
+			return ran, fmt.Errorf("recording migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		ran = append(ran, migration)
+	}
+
+	return ran, nil
+}
+
+type migrationLocker struct {
+	collection *mongo.Collection
+	owner      string
+	ttl        time.Duration
+	waitFor    time.Duration
+	poll       time.Duration
+}
+
+func newMigrationLocker(database *mongo.Database) *migrationLocker {
+	hostname, _ := os.Hostname()
+	return &migrationLocker{
+		collection: database.Collection(migrationLockCollection),
+		owner:      hostname + "/" + strconv.Itoa(os.Getpid()) + "/" + uuid.New().String(),
+		ttl:        migrationLockTTL,
+		waitFor:    migrationLockWait,
+		poll:       migrationLockPoll,
+	}
+}
+
+// acquire takes the lock if it's free or expired, or extends it if we
+// already hold it. Someone else holding it makes the upsert hit the unique
+// _id, which just means "not yours".
+func (l *migrationLocker) acquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+
+	filter := bson.M{
+		"_id": migrationLockID,
+		"$or": []bson.M{
+			{"owner": l.owner},
+			{"expiresTime": bson.M{"$lt": now}},
+			// Locks taken before expiresTime was a date hold milliseconds.
+			{"expiresTime": bson.M{"$lt": now.UnixMilli()}},
+		},
+	}
+	update := bson.M{"$set": migrationLock{
+		ID:          migrationLockID,
+		Owner:       l.owner,
+		LockedTime:  now,
+		ExpiresTime: now.Add(l.ttl),
+	}}
+
+	_, err := l.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (l *migrationLocker) wait(ctx context.Context) error {
+	deadline := time.Now().Add(l.waitFor)
+	logged := false
+
+	for {
+		ok, err := l.acquire(ctx)
+		if err != nil {
+			return fmt.Errorf("taking the migration lock: %w", err)
+		}
+		if ok {
+			return nil
+		}
+
+		if !logged {
+			log.Println("Another instance is running migrations, waiting for it to finish")
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			return ErrMigrationLockTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.poll):
+		}
+	}
+}
+
+func (l *migrationLocker) release() {
+	// The caller's context may already be cancelled, the lock should still go.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := l.collection.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": l.owner}); err != nil {
+		log.Println("Error releasing the migration lock:", err)
+	}
+}
@@ -0,0 +1,289 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The runner only runs against a server named by MONGODB_TEST_URI, in its
+// own scratch database so it doesn't race the store tests in lib.
+const testMigrationsDatabase = "animoshiApiMigrationsTest"
+
+func testMongo(t *testing.T) *mongo.Client {
+	t.Helper()
+
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	client := ConnectToMongo(MongoConfig{URI: uri, Database: testMigrationsDatabase})
+
+	drop := func() {
+		if err := Database(client).Drop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drop()
+	t.Cleanup(func() {
+		drop()
+		client.Disconnect(context.Background())
+	})
+
+	return client
+}
+
+// testLocker is a lock with timings short enough for tests.
+func testLocker(database *mongo.Database) *migrationLocker {
+	lock := newMigrationLocker(database)
+	lock.ttl = 200 * time.Millisecond
+	lock.waitFor = 300 * time.Millisecond
+	lock.poll = 50 * time.Millisecond
+	return lock
+}
+
+func migrationVersions(migrations []Migration) []int {
+	versions := []int{}
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	return versions
+}
+
+func TestCheckMigrationOrder(t *testing.T) {
+	tests := []struct {
+		versions []int
+		ok       bool
+	}{
+		{[]int{1, 2, 5}, true},
+		{[]int{}, true},
+		{[]int{0}, false},
+		{[]int{1, 3, 2}, false},
+		{[]int{1, 1}, false},
+	}
+
+	for _, test := range tests {
+		var migrations []Migration
+		for _, version := range test.versions {
+			migrations = append(migrations, Migration{Version: version, Name: "test"})
+		}
+
+		if err := checkMigrationOrder(migrations); (err == nil) != test.ok {
+			t.Errorf("%v: got %v", test.versions, err)
+		}
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	client := testMongo(t)
+	ctx := context.Background()
+	database := Database(client)
+
+	var order []int
+	migration := func(version int) Migration {
+		return Migration{Version: version, Name: "test", Up: func(ctx context.Context, database *mongo.Database) error {
+			order = append(order, version)
+			return nil
+		}}
+	}
+	migrations := []Migration{migration(1), migration(2), migration(3)}
+
+	// Version 2 was applied by an older release, which kept the time as a
+	// millisecond string.
+	legacy := bson.M{"_id": 2, "name": "test", "appliedTime": "1704067200000", "durationMs": 1}
+	if _, err := database.Collection(migrationsCollection).InsertOne(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	ran, err := RunMigrations(ctx, client, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(ran); !reflect.DeepEqual(got, []int{1, 3}) || !reflect.DeepEqual(order, []int{1, 3}) {
+		t.Errorf("ran %v in order %v, want [1 3]", got, order)
+	}
+
+	// A second run only applies what is new.
+	ran, err = RunMigrations(ctx, client, append(migrations, migration(4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(ran); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("second run ran %v, want [4]", got)
+	}
+
+	statuses, err := GetMigrationStatus(ctx, client, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedTime.IsZero() {
+			t.Errorf("migration %d: %+v", status.Version, status)
+		}
+	}
+	if want := time.UnixMilli(1704067200000); !statuses[1].AppliedTime.Equal(want) {
+		t.Errorf("legacy appliedTime = %v, want %v", statuses[1].AppliedTime, want)
+	}
+
+	// The lock is gone once the run is over.
+	if count, err := database.Collection(migrationLockCollection).CountDocuments(ctx, bson.M{}); err != nil || count != 0 {
+		t.Errorf("%d locks left after the run, %v", count, err)
+	}
+}
+
+func TestRunMigrationsStopsOnFailure(t *testing.T) {
+	client := testMongo(t)
+	ctx := context.Background()
+
+	failure := errors.New("boom")
+	ran3 := false
+	migrations := []Migration{
+		{Version: 1, Name: "ok", Up: func(ctx context.Context, database *mongo.Database) error { return nil }},
+		{Version: 2, Name: "fails", Up: func(ctx context.Context, database *mongo.Database) error { return failure }},
+		{Version: 3, Name: "after", Up: func(ctx context.Context, database *mongo.Database) error { ran3 = true; return nil }},
+	}
+
+	ran, err := RunMigrations(ctx, client, migrations)
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the migration's error", err)
+	}
+	if got := migrationVersions(ran); !reflect.DeepEqual(got, []int{1}) || ran3 {
+		t.Errorf("ran %v, and 3: %v", got, ran3)
+	}
+
+	statuses, err := GetMigrationStatus(ctx, client, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Applied || statuses[1].Applied || statuses[2].Applied {
+		t.Errorf("only migration 1 should be recorded: %+v", statuses)
+	}
+}
+
+func TestMigrationLock(t *testing.T) {
+	client := testMongo(t)
+	ctx := context.Background()
+	database := Database(client)
+
+	first, second := testLocker(database), testLocker(database)
+
+	readLock := func() migrationLock {
+		var lock migrationLock
+		if err := first.collection.FindOne(ctx, bson.M{"_id": migrationLockID}).Decode(&lock); err != nil {
+			t.Fatal(err)
+		}
+		return lock
+	}
+
+	if ok, err := first.acquire(ctx); err != nil || !ok {
+		t.Fatalf("first acquire: %v, %v", ok, err)
+	}
+	held := readLock()
+
+	if ok, err := second.acquire(ctx); err != nil || ok {
+		t.Fatalf("second acquire while held: %v, %v", ok, err)
+	}
+
+	// Acquiring again extends the lock.
+	time.Sleep(20 * time.Millisecond)
+	if ok, err := first.acquire(ctx); err != nil || !ok {
+		t.Fatalf("extend: %v, %v", ok, err)
+	}
+	if extended := readLock(); !extended.ExpiresTime.After(held.ExpiresTime) || extended.Owner != first.owner {
+		t.Errorf("extended lock %+v, was %+v", extended, held)
+	}
+
+	// Releasing someone else's lock leaves it alone.
+	second.release()
+	if lock := readLock(); lock.Owner != first.owner {
+		t.Errorf("lock owner %s after the other instance released", lock.Owner)
+	}
+
+	// An expired lock is up for grabs.
+	time.Sleep(first.ttl + 50*time.Millisecond)
+	if ok, err := second.acquire(ctx); err != nil || !ok {
+		t.Fatalf("acquire of an expired lock: %v, %v", ok, err)
+	}
+	if ok, err := first.acquire(ctx); err != nil || ok {
+		t.Fatalf("old owner acquire after losing it: %v, %v", ok, err)
+	}
+
+	// So is an expired one written before expiresTime was a date.
+	second.release()
+	legacy := bson.M{"_id": migrationLockID, "owner": "old", "expiresTime": time.Now().Add(-time.Minute).UnixMilli()}
+	if _, err := first.collection.InsertOne(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := first.acquire(ctx); err != nil || !ok {
+		t.Fatalf("acquire of an expired legacy lock: %v, %v", ok, err)
+	}
+}
+
+func TestMigrationLockTimeout(t *testing.T) {
+	client := testMongo(t)
+	ctx := context.Background()
+	database := Database(client)
+
+	holder := testLocker(database)
+	holder.ttl = time.Minute
+	if ok, err := holder.acquire(ctx); err != nil || !ok {
+		t.Fatalf("acquire: %v, %v", ok, err)
+	}
+
+	ran := false
+	migrations := []Migration{{Version: 1, Name: "test", Up: func(ctx context.Context, database *mongo.Database) error {
+		ran = true
+		return nil
+	}}}
+
+	_, err := runMigrations(ctx, database, testLocker(database), migrations)
+	if !errors.Is(err, ErrMigrationLockTimeout) || ran {
+		t.Errorf("got %v and ran: %v, want ErrMigrationLockTimeout", err, ran)
+	}
+
+	// The holder still has it.
+	if ok, err := holder.acquire(ctx); err != nil || !ok {
+		t.Errorf("holder lost the lock: %v, %v", ok, err)
+	}
+}
+
+func TestRunMigrationsLosesLock(t *testing.T) {
+	client := testMongo(t)
+	ctx := context.Background()
+	database := Database(client)
+
+	lock := testLocker(database)
+	thief := testLocker(database)
+
+	// The first migration takes longer than the lock lasts and another
+	// instance takes over, so the second one must not run.
+	ran2 := false
+	migrations := []Migration{
+		{Version: 1, Name: "slow", Up: func(ctx context.Context, database *mongo.Database) error {
+			time.Sleep(lock.ttl + 50*time.Millisecond)
+			if ok, err := thief.acquire(ctx); err != nil || !ok {
+				t.Errorf("thief acquire: %v, %v", ok, err)
+			}
+			return nil
+		}},
+		{Version: 2, Name: "next", Up: func(ctx context.Context, database *mongo.Database) error {
+			ran2 = true
+			return nil
+		}},
+	}
+
+	ran, err := runMigrations(ctx, database, lock, migrations)
+	if !errors.Is(err, ErrMigrationLockLost) || ran2 {
+		t.Errorf("got %v and ran 2: %v, want ErrMigrationLockLost", err, ran2)
+	}
+	if got := migrationVersions(ran); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("ran %v, want [1]", got)
+	}
+}
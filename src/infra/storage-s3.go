@@ -0,0 +1,155 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type S3Storage struct {
+	client        *s3.S3
+	bucket        string
+	stagingBucket string
+	publicURL     string
+}
+
+// NewS3Storage creates the session once, it is reused by every request.
+// endpoint may be empty to talk to AWS itself, stagingBucket to turn direct
+// uploads off.
+func NewS3Storage(region, bucket, stagingBucket, endpoint, publicURL string) (*S3Storage, error) {
+	config := &aws.Config{
+		Region: aws.String(region),
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{
+		client:        s3.New(sess),
+		bucket:        bucket,
+		stagingBucket: stagingBucket,
+		publicURL:     strings.TrimSuffix(publicURL, "/"),
+	}, nil
+}
+
+// Objects have always been written with a leading slash in this bucket and
+// the CDN is set up for it, so keep doing that.
+func (s *S3Storage) objectKey(key string) string {
+	return "/" + key
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	_, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.objectKey(key)),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	if err := checkKey(key); err != nil {
+		return nil, "", err
+	}
+
+	return s.getObject(ctx, s.bucket, s.objectKey(key))
+}
+
+func (s *S3Storage) getObject(ctx context.Context, bucket string, objectKey string) (io.ReadCloser, string, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", ErrObjectNotFound
+		}
+		return nil, "", err
+	}
+
+	return output.Body, aws.StringValue(output.ContentType), nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return s.deleteObject(ctx, s.bucket, s.objectKey(key))
+}
+
+func (s *S3Storage) deleteObject(ctx context.Context, bucket string, objectKey string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	return err
+}
+
+// PresignPut works against AWS and any S3-compatible endpoint (MinIO etc.).
+// Content-Type and Content-Length are signed, so the client has to send
+// exactly what it asked for. The staging bucket isn't behind the CDN, keys
+// are used as they are there.
+func (s *S3Storage) PresignPut(key string, contentType string, size int64, expires time.Duration) (string, error) {
+	if s.stagingBucket == "" {
+		return "", ErrNoStaging
+	}
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+
+	request, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(s.stagingBucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	})
+
+	return request.Presign(expires)
+}
+
+func (s *S3Storage) GetStaged(ctx context.Context, key string) (io.ReadCloser, error) {
+	if s.stagingBucket == "" {
+		return nil, ErrNoStaging
+	}
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	body, _, err := s.getObject(ctx, s.stagingBucket, key)
+	return body, err
+}
+
+func (s *S3Storage) DeleteStaged(ctx context.Context, key string) error {
+	if s.stagingBucket == "" {
+		return ErrNoStaging
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return s.deleteObject(ctx, s.stagingBucket, key)
+}
+
+func (s *S3Storage) URL(key string) string {
+	return s.publicURL + s.objectKey(key)
+}
@@ -0,0 +1,84 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Storage is where uploaded media ends up. Keys are relative object names
+// like "3f1c...e2.jpg", URL returns the public address of a stored key.
+type Storage interface {
+	Put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	ErrInvalidKey     = errors.New("invalid object key")
+	ErrNoStaging      = errors.New("no staging bucket configured")
+)
+
+type StorageConfig struct {
+	Backend string `yaml:"backend" env:"STORAGE_BACKEND"` // "s3", "local" or "memory"
+
+	S3Region    string `yaml:"s3Region" env:"S3_REGION"`
+	S3Bucket    string `yaml:"s3Bucket" env:"S3_BUCKET"`
+	S3Endpoint  string `yaml:"s3Endpoint" env:"S3_ENDPOINT"` // optional, for S3-compatible services
+	S3PublicURL string `yaml:"s3PublicUrl" env:"S3_PUBLIC_URL"`
+	// Private bucket direct uploads are put in before they're sanitized.
+	// Direct uploads are off without one.
+	S3StagingBucket string `yaml:"s3StagingBucket" env:"S3_STAGING_BUCKET"`
+
+	LocalDir     string `yaml:"localDir" env:"MEDIA_DIR"`
+	LocalBaseURL string `yaml:"localBaseUrl" env:"MEDIA_BASE_URL"`
+}
+
+var DefaultStorageConfig = StorageConfig{
+	Backend:      "s3",
+	S3Region:     "us-east-2",
+	S3Bucket:     "cdn.animoshi.com",
+	S3PublicURL:  "https://cdn.animoshi.com",
+	LocalDir:     "./media",
+	LocalBaseURL: "http://localhost:1323/media",
+}
+
+func NewStorage(config StorageConfig) (Storage, error) {
+	switch config.Backend {
+	case "s3":
+		return NewS3Storage(config.S3Region, config.S3Bucket, config.S3StagingBucket, config.S3Endpoint, config.S3PublicURL)
+	case "local":
+		return NewLocalStorage(config.LocalDir, config.LocalBaseURL)
+	case "memory":
+		return NewMemoryStorage("memory://"), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+var validKey = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+
+func checkKey(key string) error {
+	if !validKey.MatchString(key) || strings.Contains(key, "..") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// Presigner is implemented by backends that let clients upload straight to
+// a private staging area with a time limited URL. Staged objects are never
+// served, they're read back once the upload is completed and deleted after.
+type Presigner interface {
+	// PresignPut signs a PUT of exactly size bytes of contentType, or
+	// returns ErrNoStaging.
+	PresignPut(key string, contentType string, size int64, expires time.Duration) (string, error)
+	GetStaged(ctx context.Context, key string) (io.ReadCloser, error)
+	// DeleteStaged is not an error for a key that was never put.
+	DeleteStaged(ctx context.Context, key string) error
+}
@@ -0,0 +1,90 @@
+package infra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// The memory backend stands in for the others in tests, so it has to
+// behave like them, here like the local one.
+func TestStorageRoundTrip(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost/media/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := map[string]Storage{
+		"memory": NewMemoryStorage("http://localhost/media/"),
+		"local":  local,
+	}
+
+	for name, storage := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "images/abc.jpg"
+
+			if err := storage.Put(ctx, key, strings.NewReader("jpeg bytes"), "image/jpeg"); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			body, contentType, err := storage.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			data, err := io.ReadAll(body)
+			body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "jpeg bytes" || contentType != "image/jpeg" {
+				t.Errorf("Get = %q, %q, want the stored bytes as image/jpeg", data, contentType)
+			}
+
+			if url := storage.URL(key); url != "http://localhost/media/images/abc.jpg" {
+				t.Errorf("URL = %q", url)
+			}
+
+			if err := storage.Delete(ctx, key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, _, err := storage.Get(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+				t.Errorf("Get after Delete = %v, want ErrObjectNotFound", err)
+			}
+			// Deleting what isn't there is not an error.
+			if err := storage.Delete(ctx, key); err != nil {
+				t.Errorf("second Delete: %v", err)
+			}
+		})
+	}
+}
+
+func TestStorageRejectsInvalidKeys(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost/media")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := map[string]Storage{
+		"memory": NewMemoryStorage("http://localhost/media"),
+		"local":  local,
+	}
+
+	for name, storage := range backends {
+		for _, key := range []string{"", "../secret", "a/../b", "/abs", ".hidden"} {
+			ctx := context.Background()
+
+			if err := storage.Put(ctx, key, strings.NewReader("x"), "text/plain"); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("%s Put(%q) = %v, want ErrInvalidKey", name, key, err)
+			}
+			if _, _, err := storage.Get(ctx, key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("%s Get(%q) = %v, want ErrInvalidKey", name, key, err)
+			}
+			if err := storage.Delete(ctx, key); !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("%s Delete(%q) = %v, want ErrInvalidKey", name, key, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+)
+
+type CommentTargetType string
+
+const (
+	CommentOnPost  CommentTargetType = "post"
+	CommentOnWaifu CommentTargetType = "waifu"
+)
+
+// CommentTarget is what a comment was left on.
+type CommentTarget struct {
+	Type CommentTargetType
+	ID   string
+}
+
+// commentTarget is how comments on one type of target are checked and
+// counted. find returns a problem when the target can't be commented on.
+type commentTarget struct {
+	find  func(c echo.Context, stores Stores, id string) (primitive.ObjectID, error)
+	count func(ctx context.Context, stores Stores, id primitive.ObjectID, updatedTime utils.Timestamp) error
+}
+
+var commentTargets = map[CommentTargetType]commentTarget{
+	CommentOnPost: {
+		find: func(c echo.Context, stores Stores, id string) (primitive.ObjectID, error) {
+			postID, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return primitive.NilObjectID, utils.ValidationFailed("postId", "Invalid post ID")
+			}
+
+			if _, err := stores.Posts.Get(c.Request().Context(), postID); err != nil {
+				if errors.Is(err, ErrNotFound) {
+					return primitive.NilObjectID, utils.NotFound("Post not found")
+				}
+				return primitive.NilObjectID, utils.InternalError(err, "Error fetching post data")
+			}
+
+			return postID, nil
+		},
+		count: func(ctx context.Context, stores Stores, id primitive.ObjectID, updatedTime utils.Timestamp) error {
+			return stores.Posts.Increment(ctx, id, PostCommentsCounter, updatedTime)
+		},
+	},
+	CommentOnWaifu: {
+		find: func(c echo.Context, stores Stores, id string) (primitive.ObjectID, error) {
+			waifu, err := approvedWaifu(c, stores, id)
+			if err != nil {
+				return primitive.NilObjectID, err
+			}
+			return waifu.ID, nil
+		},
+		count: func(ctx context.Context, stores Stores, id primitive.ObjectID, updatedTime utils.Timestamp) error {
+			_, err := stores.Waifus.AddComments(ctx, id, 1, updatedTime)
+			return err
+		},
+	},
+}
+
+// GetComments lists a target's comments, newest first.
+func GetComments(c echo.Context, stores Stores, target CommentTarget) error {
+	if target.ID == "" || !utils.ValidateQueryParams(c, []string{"limit", "offset"}) {
+		return utils.BadRequest("Invalid params")
+	}
+
+	listOptions, err := parseListOptions(c.QueryParam("limit"), c.QueryParam("offset"))
+	if err != nil {
+		return utils.BadRequest("Invalid params")
+	}
+
+	if listOptions.Limit > 20 {
+		return utils.ValidationFailed("limit", "Limit cant be more than 20")
+	}
+
+	comments, err := stores.Comments.ListByTarget(c.Request().Context(), target, listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	responses := make([]PostCommentResponse, 0, len(comments))
+	for _, comment := range comments {
+		responses = append(responses, newPostCommentResponse(comment, utils.ResponseTimestampFormat(c)))
+	}
+
+	return c.JSON(http.StatusOK, responses)
+}
+
+// NewComment leaves a comment on the target and bumps its comments counter.
+func NewComment(c echo.Context, stores Stores, target CommentTarget, comment *PostComment) error {
+	now := utils.Now()
+
+	targetType, ok := commentTargets[target.Type]
+	if !ok {
+		return utils.BadRequest("Unknown comment target")
+	}
+
+	if len(comment.Text) > 1000 {
+		return utils.ValidationFailed("text", "Text is too long! Only 1000 characters are allowed!")
+	}
+
+	if len(comment.UserID) > 128 {
+		return utils.ValidationFailed("userId", "UserId is too long")
+	}
+
+	if err := utils.CheckRecaptcha(comment.RecaptchaToken); err != nil {
+		return err
+	}
+
+	if err := validate.Struct(comment); err != nil {
+		return utils.FromValidationError(err)
+	}
+
+	targetID, err := targetType.find(c, stores, target.ID)
+	if err != nil {
+		return err
+	}
+
+	comment.ID = primitive.NewObjectID()
+	comment.TargetType = target.Type
+	comment.TargetId = target.ID
+	comment.PostId = ""
+	if target.Type == CommentOnPost {
+		comment.PostId = target.ID
+	}
+	comment.UserIP = utils.GetUserIP(c)
+	comment.CreatedTime = now
+	comment.UpdatedTime = now
+
+	if err := stores.Comments.Insert(c.Request().Context(), comment); err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	if err := targetType.count(c.Request().Context(), stores, targetID, now); err != nil {
+		return utils.InternalError(err, "Failed to update comment counters")
+	}
+
+	return c.JSON(http.StatusOK, newPostCommentResponse(*comment, utils.ResponseTimestampFormat(c)))
+}
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	DuplicatesOff    = "off"
+	DuplicatesMark   = "mark"
+	DuplicatesReject = "reject"
+)
+
+type DuplicateImagePolicy struct {
+	Mode        string `yaml:"mode" env:"DUPLICATE_IMAGE_MODE"`                // off, mark or reject
+	MaxDistance int    `yaml:"maxDistance" env:"DUPLICATE_IMAGE_DISTANCE"`     // max Hamming distance between two hashes to count as a repost
+	RecentPosts int64  `yaml:"recentPosts" env:"DUPLICATE_IMAGE_RECENT_POSTS"` // how many of the latest posts a new upload is compared against
+}
+
+var DefaultDuplicateImagePolicy = DuplicateImagePolicy{
+	Mode:        DuplicatesMark,
+	MaxDistance: 5,
+	RecentPosts: 1000,
+}
+
+// Searches from GET /similarPosts look further back than the upload check.
+const similarPostsWindow = 5000
+
+type SimilarPost struct {
+	ID          primitive.ObjectID `json:"_id"`
+	Title       string             `json:"title"`
+	Image       string             `json:"image"`
+	Images      *utils.ImageSet    `json:"images,omitempty"`
+	CreatedTime utils.Timestamp    `json:"createdTime"`
+	Distance    int                `json:"distance"`
+}
+
+var duplicateImagePolicy = DefaultDuplicateImagePolicy
+
+func ConfigureDuplicateImages(policy DuplicateImagePolicy) {
+	duplicateImagePolicy = policy
+}
+
+// findSimilarPosts compares hash against the latest posts that have one and
+// returns those within maxDistance, closest first.
+func findSimilarPosts(ctx context.Context, posts PostStore, hash uint64, maxDistance int, window int64, excludeID primitive.ObjectID) ([]SimilarPost, error) {
+	candidates, err := posts.RecentImageHashes(ctx, window, excludeID)
+	if err != nil {
+		return nil, err
+	}
+
+	distances := map[primitive.ObjectID]int{}
+	var ids []primitive.ObjectID
+
+	for _, candidate := range candidates {
+		candidateHash, err := utils.ParseImageHash(candidate.ImageHash)
+		if err != nil {
+			continue
+		}
+
+		if distance := utils.HammingDistance(hash, candidateHash); distance <= maxDistance {
+			distances[candidate.ID] = distance
+			ids = append(ids, candidate.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return []SimilarPost{}, nil
+	}
+
+	matches, err := posts.GetMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	similar := make([]SimilarPost, 0, len(matches))
+	for _, post := range matches {
+		similar = append(similar, SimilarPost{
+			ID:          post.ID,
+			Title:       post.Title,
+			Image:       post.Image,
+			Images:      post.Images,
+			CreatedTime: post.CreatedTime,
+			Distance:    distances[post.ID],
+		})
+	}
+
+	// Closest first, newest first among equally close posts.
+	sort.SliceStable(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].CreatedTime.After(similar[j].CreatedTime.Time)
+	})
+
+	return similar, nil
+}
+
+func GetSimilarPosts(c echo.Context, stores Stores, id string) error {
+	if id == "" {
+		return utils.ValidationFailed("id", "ID is required")
+	}
+
+	postID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.ValidationFailed("id", "Invalid ID")
+	}
+
+	maxDistance := duplicateImagePolicy.MaxDistance * 2
+	if distanceParam := c.QueryParam("maxDistance"); distanceParam != "" {
+		maxDistance, err = strconv.Atoi(distanceParam)
+		if err != nil || maxDistance < 0 || maxDistance > 20 {
+			return utils.ValidationFailed("maxDistance", "maxDistance must be between 0 and 20")
+		}
+	}
+
+	post, err := stores.Posts.Get(c.Request().Context(), postID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Post not found")
+		}
+		return utils.InternalError(err, "Error fetching post data")
+	}
+
+	hash, err := utils.ParseImageHash(post.ImageHash)
+	if err != nil {
+		return c.JSON(http.StatusOK, []SimilarPost{})
+	}
+
+	similar, err := findSimilarPosts(c.Request().Context(), stores.Posts, hash, maxDistance, similarPostsWindow, post.ID)
+	if err != nil {
+		return utils.InternalError(err, "Error fetching similar posts")
+	}
+
+	if len(similar) > 20 {
+		similar = similar[:20]
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	for i := range similar {
+		similar[i].CreatedTime = similar[i].CreatedTime.In(format)
+	}
+
+	return c.JSON(http.StatusOK, similar)
+}
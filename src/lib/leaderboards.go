@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+type LeaderboardMetric string
+
+const (
+	LeaderboardRating    LeaderboardMetric = "rating"    // Bayesian score of the ratings given or changed in the window
+	LeaderboardFavorites LeaderboardMetric = "favorites" // favorites added in the window and still there
+	LeaderboardComments  LeaderboardMetric = "comments"  // comments posted on the waifu in the window
+)
+
+var LeaderboardMetrics = []LeaderboardMetric{LeaderboardRating, LeaderboardFavorites, LeaderboardComments}
+
+type LeaderboardWindow string
+
+const (
+	LeaderboardWeek    LeaderboardWindow = "week"
+	LeaderboardMonth   LeaderboardWindow = "month"
+	LeaderboardAllTime LeaderboardWindow = "all"
+)
+
+var LeaderboardWindows = []LeaderboardWindow{LeaderboardWeek, LeaderboardMonth, LeaderboardAllTime}
+
+// bounds returns where the window starts and where the period it's compared
+// with starts, the previous period ends where the window starts. All time
+// is compared with the standings of a week ago. A zero time is unbounded.
+func (w LeaderboardWindow) bounds(now time.Time) (from time.Time, previousFrom time.Time, previousTo time.Time) {
+	const day = 24 * time.Hour
+
+	switch w {
+	case LeaderboardWeek:
+		from = now.Add(-7 * day)
+		return from, from.Add(-7 * day), from
+	case LeaderboardMonth:
+		from = now.Add(-30 * day)
+		return from, from.Add(-30 * day), from
+	default:
+		return time.Time{}, time.Time{}, now.Add(-7 * day)
+	}
+}
+
+type RankChange string
+
+const (
+	RankUp   RankChange = "up"
+	RankDown RankChange = "down"
+	RankSame RankChange = "same"
+	RankNew  RankChange = "new" // not ranked in the previous period
+)
+
+type LeaderboardConfig struct {
+	RefreshInterval time.Duration `yaml:"refreshInterval" env:"LEADERBOARD_REFRESH_INTERVAL"`
+	Size            int           `yaml:"size" env:"LEADERBOARD_SIZE"` // entries kept per leaderboard
+}
+
+var DefaultLeaderboardConfig = LeaderboardConfig{
+	RefreshInterval: 15 * time.Minute,
+	Size:            100,
+}
+
+// WaifuTally is a waifu's events of one metric within a period.
+type WaifuTally struct {
+	WaifuId string `bson:"_id"`
+	Count   int64  `bson:"count"`
+	Sum     int64  `bson:"sum"` // stars, for ratings
+}
+
+func (t WaifuTally) value(metric LeaderboardMetric) float64 {
+	if metric == LeaderboardRating {
+		return bayesianScore(t.Sum, t.Count)
+	}
+	return float64(t.Count)
+}
+
+type LeaderboardEntry struct {
+	Rank         int64      `bson:"rank" json:"rank"`
+	WaifuId      string     `bson:"waifuId" json:"waifuId"`
+	Name         string     `bson:"name" json:"name"`
+	Image        string     `bson:"image" json:"image"`
+	Value        float64    `bson:"value" json:"value"`
+	Count        int64      `bson:"count" json:"count"` // ratings, favorites or comments counted
+	PreviousRank int64      `bson:"previousRank,omitempty" json:"previousRank,omitempty"`
+	Change       RankChange `bson:"change" json:"change"`
+}
+
+type Leaderboard struct {
+	ID           string             `bson:"_id" json:"-"`
+	By           LeaderboardMetric  `bson:"by" json:"by"`
+	Window       LeaderboardWindow  `bson:"window" json:"window"`
+	ComputedTime utils.Timestamp    `bson:"computedTime" json:"computedTime"`
+	Entries      []LeaderboardEntry `bson:"entries" json:"entries"`
+}
+
+func leaderboardID(by LeaderboardMetric, window LeaderboardWindow) string {
+	return string(by) + ":" + string(window)
+}
+
+func leaderboardInFormat(board Leaderboard, format utils.TimestampFormat) Leaderboard {
+	board.ComputedTime = board.ComputedTime.In(format)
+	return board
+}
+
+type rankedTally struct {
+	WaifuTally
+	rank  int64
+	value float64
+}
+
+// rankTallies orders the tallies of public waifus, best first. Equal values
+// share a rank and the next one skips ahead, 1, 2, 2, 4.
+func rankTallies(metric LeaderboardMetric, tallies []WaifuTally, waifus map[string]Waifu) []rankedTally {
+	ranked := make([]rankedTally, 0, len(tallies))
+	for _, tally := range tallies {
+		if waifu, ok := waifus[tally.WaifuId]; !ok || waifu.Status != WaifuApproved {
+			continue
+		}
+		ranked = append(ranked, rankedTally{WaifuTally: tally, value: tally.value(metric)})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].value != ranked[j].value {
+			return ranked[i].value > ranked[j].value
+		}
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].WaifuId < ranked[j].WaifuId
+	})
+
+	for i := range ranked {
+		if i > 0 && ranked[i].value == ranked[i-1].value {
+			ranked[i].rank = ranked[i-1].rank
+		} else {
+			ranked[i].rank = int64(i + 1)
+		}
+	}
+
+	return ranked
+}
+
+// ComputeLeaderboard ranks waifus by their events in the window and compares
+// each rank with the previous period.
+func ComputeLeaderboard(ctx context.Context, stores Stores, by LeaderboardMetric, window LeaderboardWindow, now time.Time, size int) (*Leaderboard, error) {
+	from, previousFrom, previousTo := window.bounds(now)
+
+	current, err := stores.Leaderboards.Tally(ctx, by, from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := stores.Leaderboards.Tally(ctx, by, previousFrom, previousTo)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[primitive.ObjectID]bool{}
+	var ids []primitive.ObjectID
+	for _, tally := range append(append([]WaifuTally{}, current...), previous...) {
+		id, err := primitive.ObjectIDFromHex(tally.WaifuId)
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	found, err := stores.Waifus.GetMany(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	waifus := make(map[string]Waifu, len(found))
+	for _, waifu := range found {
+		waifus[waifu.ID.Hex()] = waifu
+	}
+
+	previousRanks := map[string]int64{}
+	for _, ranked := range rankTallies(by, previous, waifus) {
+		previousRanks[ranked.WaifuId] = ranked.rank
+	}
+
+	board := &Leaderboard{
+		ID:           leaderboardID(by, window),
+		By:           by,
+		Window:       window,
+		ComputedTime: utils.NewTimestamp(now),
+		Entries:      []LeaderboardEntry{},
+	}
+
+	for _, ranked := range rankTallies(by, current, waifus) {
+		if len(board.Entries) >= size {
+			break
+		}
+
+		waifu := waifus[ranked.WaifuId]
+		entry := LeaderboardEntry{
+			Rank:    ranked.rank,
+			WaifuId: ranked.WaifuId,
+			Name:    waifu.Name,
+			Image:   waifu.Image,
+			Value:   ranked.value,
+			Count:   ranked.Count,
+			Change:  RankNew,
+		}
+
+		if previousRank, ok := previousRanks[ranked.WaifuId]; ok {
+			entry.PreviousRank = previousRank
+			switch {
+			case previousRank > ranked.rank:
+				entry.Change = RankUp
+			case previousRank < ranked.rank:
+				entry.Change = RankDown
+			default:
+				entry.Change = RankSame
+			}
+		}
+
+		board.Entries = append(board.Entries, entry)
+	}
+
+	return board, nil
+}
+
+// RefreshLeaderboards recomputes and stores every leaderboard.
+func RefreshLeaderboards(ctx context.Context, stores Stores, config LeaderboardConfig) error {
+	now := time.Now()
+
+	for _, by := range LeaderboardMetrics {
+		for _, window := range LeaderboardWindows {
+			board, err := ComputeLeaderboard(ctx, stores, by, window, now, config.Size)
+			if err != nil {
+				return fmt.Errorf("computing the %s leaderboard: %w", leaderboardID(by, window), err)
+			}
+
+			if err := stores.Leaderboards.Save(ctx, board); err != nil {
+				return fmt.Errorf("saving the %s leaderboard: %w", leaderboardID(by, window), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RunLeaderboardRefresher refreshes the leaderboards right away and then
+// every RefreshInterval until ctx is done. Every instance runs it, a refresh
+// overwrites the same documents so that's only duplicate work.
+func RunLeaderboardRefresher(ctx context.Context, stores Stores, config LeaderboardConfig) {
+	ticker := time.NewTicker(config.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := RefreshLeaderboards(ctx, stores, config); err != nil {
+			log.Println("Error refreshing leaderboards:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetLeaderboard serves a precomputed leaderboard, by defaults to rating and
+// window to week.
+func GetLeaderboard(c echo.Context, stores Stores) error {
+	by := LeaderboardMetric(c.QueryParam("by"))
+	if by == "" {
+		by = LeaderboardRating
+	}
+	if !slices.Contains(LeaderboardMetrics, by) {
+		return utils.ValidationFailed("by", "By must be rating, favorites or comments")
+	}
+
+	window := LeaderboardWindow(c.QueryParam("window"))
+	if window == "" {
+		window = LeaderboardWeek
+	}
+	if !slices.Contains(LeaderboardWindows, window) {
+		return utils.ValidationFailed("window", "Window must be week, month or all")
+	}
+
+	board, err := stores.Leaderboards.Get(c.Request().Context(), by, window)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("The leaderboard hasn't been computed yet")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, leaderboardInFormat(*board, utils.ResponseTimestampFormat(c)))
+}
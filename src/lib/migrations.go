@@ -0,0 +1,381 @@
+package lib
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/utils"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strconv"
+)
+
+// Migrations is every schema change, in order. Append new ones at the end
+// with the next version, never edit or reorder one that has shipped.
+var Migrations = []infra.Migration{
+	{Version: 1, Name: "create indexes", Up: createIndexes},
+	{Version: 2, Name: "store timestamps as dates", Up: timestampsToDates},
+	{Version: 3, Name: "waifu status enum", Up: waifuStatusEnum},
+	{Version: 4, Name: "index waifu submissions", Up: indexWaifuSubmissions},
+	{Version: 5, Name: "waifu star ratings", Up: waifuStarRatings},
+	{Version: 6, Name: "index waifu favorites", Up: indexWaifuFavorites},
+	{Version: 7, Name: "index leaderboard events", Up: indexLeaderboardEvents},
+	{Version: 8, Name: "waifu wars elo", Up: waifuWarsElo},
+	{Version: 9, Name: "index tournaments", Up: indexTournaments},
+	{Version: 10, Name: "generic comment targets", Up: genericCommentTargets},
+	{Version: 11, Name: "waifu trait meters", Up: waifuTraitMeters},
+	{Version: 12, Name: "banned media hash bands", Up: bannedMediaHashBands},
+	{Version: 13, Name: "index upload expiry", Up: indexUploadExpiry},
+	{Version: 14, Name: "unique war votes", Up: uniqueWarVotes},
+}
+
+func index(keys bson.D) mongo.IndexModel {
+	return mongo.IndexModel{Keys: keys}
+}
+
+// Indexes for the queries the stores and handlers run. CreateMany is a
+// no-op for indexes that already exist with the same keys.
+func createIndexes(ctx context.Context, database *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		"posts": {
+			index(bson.D{{Key: "createdTime", Value: -1}}),
+			index(bson.D{{Key: "userId", Value: 1}, {Key: "createdTime", Value: -1}}),
+		},
+		"postComments": {
+			index(bson.D{{Key: "postId", Value: 1}, {Key: "createdTime", Value: -1}}),
+		},
+		// HasVoted looks a vote up by post and either the IP or the token.
+		"postLikes": {
+			index(bson.D{{Key: "postId", Value: 1}, {Key: "userIp", Value: 1}}),
+			index(bson.D{{Key: "postId", Value: 1}, {Key: "aniToken", Value: 1}}),
+		},
+		"postDislikes": {
+			index(bson.D{{Key: "postId", Value: 1}, {Key: "userIp", Value: 1}}),
+			index(bson.D{{Key: "postId", Value: 1}, {Key: "aniToken", Value: 1}}),
+		},
+		"waifus": {
+			index(bson.D{{Key: "status", Value: 1}, {Key: "createdTime", Value: -1}}),
+		},
+		"bannedMedia": {
+			{Keys: bson.D{{Key: "sha256", Value: 1}}, Options: options.Index().SetSparse(true)},
+			index(bson.D{{Key: "createdTime", Value: -1}}),
+		},
+		"blockedUploads": {
+			index(bson.D{{Key: "createdTime", Value: -1}}),
+			index(bson.D{{Key: "reviewed", Value: 1}, {Key: "createdTime", Value: -1}}),
+		},
+	}
+
+	for collection, models := range indexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Timestamps used to be millisecond strings. utils.Timestamp reads both, so
+// this can run while the server is up. Documents without one of the fields
+// don't match its filter.
+func timestampsToDates(ctx context.Context, database *mongo.Database) error {
+	collections := []string{"posts", "postComments", "postLikes", "postDislikes", "waifus", "uploads", "bannedMedia", "blockedUploads"}
+	for _, collection := range collections {
+		for _, field := range []string{"createdTime", "updatedTime", "expiresTime"} {
+			filter := bson.M{field: bson.M{"$type": "string", "$regex": "^[0-9]+$"}}
+			update := mongo.Pipeline{
+				{{Key: "$set", Value: bson.M{field: bson.M{"$toDate": bson.M{"$toLong": "$" + field}}}}},
+			}
+
+			if _, err := database.Collection(collection).UpdateMany(ctx, filter, update); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Waifus used to hold "APPROVED" or arbitrary other values. Approved ones
+// stay public, everything else goes back to review so a moderator decides.
+// The change is recorded in the history like any other transition.
+func waifuStatusEnum(ctx context.Context, database *mongo.Database) error {
+	valid := make([]string, 0, len(WaifuStatuses))
+	for _, status := range WaifuStatuses {
+		valid = append(valid, string(status))
+	}
+
+	newStatus := bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{bson.M{"$toUpper": bson.M{"$toString": "$status"}}, "APPROVED"}},
+		string(WaifuApproved),
+		string(WaifuPending),
+	}}
+	change := bson.M{
+		"from":   bson.M{"$toString": "$status"},
+		"to":     newStatus,
+		"by":     "migration",
+		"reason": "status moved to the new enum",
+		"time":   "$$NOW",
+	}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"status": newStatus,
+			"statusHistory": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$statusHistory", bson.A{}}},
+				bson.A{change},
+			}},
+		}}},
+	}
+
+	_, err := database.Collection("waifus").UpdateMany(ctx, bson.M{"status": bson.M{"$nin": valid}}, update)
+	return err
+}
+
+// GET /v1/waifus/submissions lists a token's waifus, newest first.
+func indexWaifuSubmissions(ctx context.Context, database *mongo.Database) error {
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: "aniToken", Value: 1}, {Key: "createdTime", Value: -1}},
+		Options: options.Index().SetSparse(true),
+	}
+
+	_, err := database.Collection("waifus").Indexes().CreateOne(ctx, model)
+	return err
+}
+
+// Rating used to be an integer nothing wrote to. Unrated waifus start at the
+// prior so they sort between well and badly rated ones.
+func waifuStarRatings(ctx context.Context, database *mongo.Database) error {
+	filter := bson.M{"ratingCount": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{
+		"rating":      0.0,
+		"ratingCount": 0,
+		"ratingSum":   0,
+		"ratingScore": bayesianScore(0, 0),
+	}}
+
+	if _, err := database.Collection("waifus").UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+
+	indexes := map[string][]mongo.IndexModel{
+		"waifus": {
+			index(bson.D{{Key: "status", Value: 1}, {Key: "ratingScore", Value: -1}, {Key: "createdTime", Value: -1}}),
+		},
+		// Find looks a rating up by waifu and either the IP or the token.
+		"waifuRatings": {
+			index(bson.D{{Key: "waifuId", Value: 1}, {Key: "userIp", Value: 1}}),
+			index(bson.D{{Key: "waifuId", Value: 1}, {Key: "aniToken", Value: 1}}),
+		},
+	}
+
+	for collection, models := range indexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The unique index is what keeps a token from favoriting a waifu twice, and
+// with it the favorites counter from drifting.
+func indexWaifuFavorites(ctx context.Context, database *mongo.Database) error {
+	models := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "waifuId", Value: 1}, {Key: "aniToken", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		index(bson.D{{Key: "aniToken", Value: 1}, {Key: "createdTime", Value: -1}}),
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "createdTime", Value: -1}},
+			Options: options.Index().SetSparse(true),
+		},
+	}
+
+	_, err := database.Collection("waifuFavorites").Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// Leaderboards tally ratings and favorites by when they happened.
+func indexLeaderboardEvents(ctx context.Context, database *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		"waifuRatings":   {index(bson.D{{Key: "updatedTime", Value: 1}})},
+		"waifuFavorites": {index(bson.D{{Key: "createdTime", Value: 1}})},
+	}
+
+	for collection, models := range indexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Every waifu enters the wars at the starting Elo. Matchups look waifus up
+// by status and Elo, and votes by pair and either the IP or the token.
+func waifuWarsElo(ctx context.Context, database *mongo.Database) error {
+	filter := bson.M{"elo": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"elo": initialElo, "wins": 0, "losses": 0}}
+
+	if _, err := database.Collection("waifus").UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+
+	indexes := map[string][]mongo.IndexModel{
+		"waifus": {
+			index(bson.D{{Key: "status", Value: 1}, {Key: "elo", Value: -1}, {Key: "createdTime", Value: -1}}),
+		},
+		"waifuWarVotes": {
+			index(bson.D{{Key: "pair", Value: 1}, {Key: "userIp", Value: 1}, {Key: "createdTime", Value: -1}}),
+			index(bson.D{{Key: "pair", Value: 1}, {Key: "aniToken", Value: 1}, {Key: "createdTime", Value: -1}}),
+		},
+	}
+
+	for collection, models := range indexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The scheduler looks for active tournaments by when their round ends.
+func indexTournaments(ctx context.Context, database *mongo.Database) error {
+	indexes := map[string][]mongo.IndexModel{
+		"tournaments": {
+			index(bson.D{{Key: "status", Value: 1}, {Key: "roundEndTime", Value: 1}}),
+			index(bson.D{{Key: "createdTime", Value: -1}}),
+		},
+		"tournamentVotes": {
+			index(bson.D{{Key: "tournamentId", Value: 1}, {Key: "matchId", Value: 1}, {Key: "userIp", Value: 1}}),
+			index(bson.D{{Key: "tournamentId", Value: 1}, {Key: "matchId", Value: 1}, {Key: "aniToken", Value: 1}}),
+		},
+	}
+
+	for collection, models := range indexes {
+		if _, err := database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Comments used to belong to posts only, through postId. Post comments get
+// that as their target and keep postId for older clients. The waifu
+// comments field was free text and becomes a counter, whatever it held is
+// kept as commentsText.
+func genericCommentTargets(ctx context.Context, database *mongo.Database) error {
+	comments := database.Collection("postComments")
+	filter := bson.M{"targetType": bson.M{"$exists": false}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"targetType": CommentOnPost, "targetId": "$postId"}}},
+	}
+
+	if _, err := comments.UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+
+	waifus := database.Collection("waifus")
+	filter = bson.M{"comments": bson.M{"$not": bson.M{"$type": "number"}}}
+	update = mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"commentsText": "$comments", "comments": 0}}},
+	}
+
+	if _, err := waifus.UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+
+	models := []mongo.IndexModel{
+		index(bson.D{{Key: "targetType", Value: 1}, {Key: "targetId", Value: 1}, {Key: "createdTime", Value: -1}}),
+		// Leaderboards tally comments on waifus by when they were posted.
+		index(bson.D{{Key: "targetType", Value: 1}, {Key: "createdTime", Value: 1}}),
+	}
+
+	_, err := comments.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// Trait keys are unique, and the mommy meter that used to be free text on
+// each waifu is the first community trait. The old mommyMeter field is
+// left as it was.
+func waifuTraitMeters(ctx context.Context, database *mongo.Database) error {
+	traits := database.Collection("waifuTraits")
+	model := mongo.IndexModel{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)}
+
+	if _, err := traits.Indexes().CreateOne(ctx, model); err != nil {
+		return err
+	}
+
+	mommyMeter := Trait{
+		Key:         "mommyMeter",
+		Name:        "Mommy meter",
+		CreatedBy:   "migration",
+		CreatedTime: utils.Now(),
+	}
+	filter := bson.M{"key": mommyMeter.Key}
+	update := bson.M{"$setOnInsert": mommyMeter}
+
+	if _, err := traits.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	// Find looks a vote up by waifu, trait and either the IP or the token.
+	models := []mongo.IndexModel{
+		index(bson.D{{Key: "waifuId", Value: 1}, {Key: "trait", Value: 1}, {Key: "userIp", Value: 1}}),
+		index(bson.D{{Key: "waifuId", Value: 1}, {Key: "trait", Value: 1}, {Key: "aniToken", Value: 1}}),
+	}
+
+	_, err := database.Collection("waifuTraitVotes").Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// Bans from before hash bands get them computed the way imageHashBands does,
+// from the hex digits of the stored hash.
+func bannedMediaHashBands(ctx context.Context, database *mongo.Database) error {
+	bannedMedia := database.Collection("bannedMedia")
+
+	bands := bson.A{}
+	for i, bounds := range imageHashBandBounds {
+		band := bson.M{"$substrCP": bson.A{"$imageHash", bounds[0], bounds[1] - bounds[0]}}
+		bands = append(bands, bson.M{"$concat": bson.A{strconv.Itoa(i) + ":", band}})
+	}
+
+	filter := bson.M{
+		"imageHash":      bson.M{"$type": "string", "$regex": "^[0-9a-f]{16}$"},
+		"imageHashBands": bson.M{"$exists": false},
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"imageHashBands": bands}}},
+	}
+
+	if _, err := bannedMedia.UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+
+	_, err := bannedMedia.Indexes().CreateOne(ctx, index(bson.D{{Key: "imageHashBands", Value: 1}}))
+	return err
+}
+
+// The upload sweeper looks for pending uploads past their expiry.
+func indexUploadExpiry(ctx context.Context, database *mongo.Database) error {
+	_, err := database.Collection("uploads").Indexes().CreateOne(ctx, index(bson.D{{Key: "status", Value: 1}, {Key: "expiresTime", Value: 1}}))
+	return err
+}
+
+// One vote per token, pair and cooldown bucket, so racing votes can't both
+// move Elo. Votes from before buckets, or without a cooldown, have none and
+// aren't limited by it.
+func uniqueWarVotes(ctx context.Context, database *mongo.Database) error {
+	model := mongo.IndexModel{
+		Keys: bson.D{{Key: "pair", Value: 1}, {Key: "aniToken", Value: 1}, {Key: "bucket", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"bucket": bson.M{"$exists": true}}),
+	}
+
+	_, err := database.Collection("waifuWarVotes").Indexes().CreateOne(ctx, model)
+	return err
+}
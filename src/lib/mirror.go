@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/utils"
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// MirrorRemoteImage fetches a user supplied image URL and stores it through
+// the same sanitize, blocklist and variant path as a direct upload, so posts
+// never hotlink other hosts. Errors wrap utils.ErrRemoteFetch,
+// utils.ErrInvalidUpload or ErrBannedMedia when they are the client's fault.
+func MirrorRemoteImage(ctx context.Context, stores Stores, store infra.Storage, rawURL string, check MediaCheck) (*utils.ImageSet, *utils.SanitizedUpload, error) {
+	data, err := utils.FetchRemoteImage(ctx, rawURL, utils.CurrentUploadLimits().MaxImageBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upload, err := utils.SanitizeUpload(bytes.NewReader(data), utils.CurrentUploadLimits())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if upload.IsVideo() {
+		return nil, nil, fmt.Errorf("%w: URL is not an image", utils.ErrRemoteFetch)
+	}
+
+	check.SHA256 = upload.SHA256
+	check.ImageHash = upload.PerceptualHash
+	check.Source = MediaSourceRemote
+	check.SourceURL = rawURL
+
+	if err := CheckBannedMedia(ctx, stores, check); err != nil {
+		return nil, nil, err
+	}
+
+	images, err := utils.UploadImageSet(ctx, store, upload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return images, upload, nil
+}
@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	MediaSourceUpload = "upload"
+	MediaSourceRemote = "remote"
+)
+
+// Banned images are matched a bit more strictly than reposts, a false
+// positive here silently blocks someone's upload.
+const bannedImageDistance = 4
+
+// imageHashBandBounds splits the 16 hex digits of a perceptual hash into
+// more bands than bannedImageDistance. Flipping that many bits changes at
+// most that many digits, so a banned image within the distance always
+// shares a band with the upload and the bands index finds it.
+var imageHashBandBounds = [][2]int{{0, 4}, {4, 7}, {7, 10}, {10, 13}, {13, 16}}
+
+func imageHashBands(hash uint64) []string {
+	digits := utils.FormatImageHash(hash)
+
+	bands := make([]string, 0, len(imageHashBandBounds))
+	for i, bounds := range imageHashBandBounds {
+		bands = append(bands, strconv.Itoa(i)+":"+digits[bounds[0]:bounds[1]])
+	}
+
+	return bands
+}
+
+var ErrBannedMedia = errors.New("file is on the banned media list")
+
+type BannedMedia struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	SHA256       string             `bson:"sha256,omitempty" json:"sha256"`
+	ImageHash    string             `bson:"imageHash,omitempty" json:"imageHash"`
+	Reason       string             `bson:"reason" json:"reason"`
+	Moderator    string             `bson:"moderator" json:"moderator"`
+	SourcePostId string             `bson:"sourcePostId,omitempty" json:"sourcePostId"`
+	CreatedTime  utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+
+	// The imageHashBands of ImageHash, indexed to find similar images.
+	ImageHashBands []string `bson:"imageHashBands,omitempty" json:"-"`
+}
+
+type BannedMediaRequest struct {
+	PostId string `json:"postId"`
+	Reason string `json:"reason"`
+}
+
+type BlockedUpload struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	BannedMediaId string             `bson:"bannedMediaId" json:"bannedMediaId"`
+	Source        string             `bson:"source" json:"source"`
+	SourceURL     string             `bson:"sourceUrl,omitempty" json:"sourceUrl,omitempty"`
+	SHA256        string             `bson:"sha256,omitempty" json:"sha256"`
+	ImageHash     string             `bson:"imageHash,omitempty" json:"imageHash"`
+	Reviewed      bool               `bson:"reviewed" json:"reviewed"`
+	ReviewedBy    string             `bson:"reviewedBy,omitempty" json:"reviewedBy,omitempty"`
+	CreatedTime   utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime   utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
+	UserID        string             `bson:"userId" json:"userId"`
+
+	// Never sent, not even to moderators.
+	UserIP   string `bson:"userIp" json:"-"`
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+// MediaCheck describes a file that is about to be stored.
+type MediaCheck struct {
+	SHA256    string
+	ImageHash string
+	Source    string // MediaSourceUpload or MediaSourceRemote
+	SourceURL string
+	UserID    string
+	UserIP    string
+	AniToken  string
+}
+
+// CheckBannedMedia looks the file up in the blocklist by exact SHA-256 and
+// then by perceptual hash, comparing only the bans that share a hash band
+// with it. A hit is recorded in blockedUploads for moderators
+// and reported as ErrBannedMedia.
+func CheckBannedMedia(ctx context.Context, stores Stores, check MediaCheck) error {
+	var banned *BannedMedia
+
+	if check.SHA256 != "" {
+		found, err := stores.BannedMedia.FindBySHA256(ctx, check.SHA256)
+		if err == nil {
+			banned = found
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	if banned == nil && check.ImageHash != "" {
+		hash, err := utils.ParseImageHash(check.ImageHash)
+		if err != nil {
+			return err
+		}
+
+		candidates, err := stores.BannedMedia.FindByImageHashBands(ctx, imageHashBands(hash))
+		if err != nil {
+			return err
+		}
+
+		for _, candidate := range candidates {
+			candidateHash, err := utils.ParseImageHash(candidate.ImageHash)
+			if err != nil {
+				continue
+			}
+
+			if utils.HammingDistance(hash, candidateHash) <= bannedImageDistance {
+				banned = &candidate
+				break
+			}
+		}
+	}
+
+	if banned == nil {
+		return nil
+	}
+
+	currentTime := utils.Now()
+
+	blocked := BlockedUpload{
+		ID:            primitive.NewObjectID(),
+		BannedMediaId: banned.ID.Hex(),
+		Source:        check.Source,
+		SourceURL:     check.SourceURL,
+		SHA256:        check.SHA256,
+		ImageHash:     check.ImageHash,
+		CreatedTime:   currentTime,
+		UpdatedTime:   currentTime,
+		UserID:        check.UserID,
+		UserIP:        check.UserIP,
+		AniToken:      check.AniToken,
+	}
+
+	if err := stores.BlockedUploads.Insert(ctx, &blocked); err != nil {
+		log.Println("Error recording blocked upload:", err)
+	}
+
+	return ErrBannedMedia
+}
+
+func BanPostMedia(c echo.Context, stores Stores, bannedMediaRequest *BannedMediaRequest) error {
+	if len(bannedMediaRequest.Reason) > 500 {
+		return utils.ValidationFailed("reason", "Reason is too long")
+	}
+
+	postID, err := primitive.ObjectIDFromHex(bannedMediaRequest.PostId)
+	if err != nil {
+		return utils.ValidationFailed("postId", "Invalid post ID")
+	}
+
+	post, err := stores.Posts.Get(c.Request().Context(), postID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Post not found")
+		}
+		return utils.InternalError(err, "Error fetching post data")
+	}
+
+	if post.MediaSha256 == "" && post.ImageHash == "" {
+		return utils.BadRequest("Post has no uploaded media")
+	}
+
+	banned := BannedMedia{
+		ID:           primitive.NewObjectID(),
+		SHA256:       post.MediaSha256,
+		ImageHash:    post.ImageHash,
+		Reason:       sanitizeInput(bannedMediaRequest.Reason),
+		Moderator:    utils.GetModerator(c),
+		SourcePostId: post.ID.Hex(),
+		CreatedTime:  utils.Now(),
+	}
+
+	if hash, err := utils.ParseImageHash(post.ImageHash); err == nil {
+		banned.ImageHashBands = imageHashBands(hash)
+	}
+
+	if err := stores.BannedMedia.Insert(c.Request().Context(), &banned); err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	banned.CreatedTime = banned.CreatedTime.In(utils.ResponseTimestampFormat(c))
+	return c.JSON(http.StatusOK, banned)
+}
+
+func GetBannedMedia(c echo.Context, stores Stores) error {
+	listOptions, err := waifuListOptions(c)
+	if err != nil {
+		return err
+	}
+
+	bannedMedia, err := stores.BannedMedia.List(c.Request().Context(), listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	for i := range bannedMedia {
+		bannedMedia[i].CreatedTime = bannedMedia[i].CreatedTime.In(format)
+	}
+
+	return c.JSON(http.StatusOK, bannedMedia)
+}
+
+func GetBlockedUploads(c echo.Context, stores Stores) error {
+	listOptions, err := waifuListOptions(c)
+	if err != nil {
+		return err
+	}
+
+	var filter BlockedUploadFilter
+	if reviewed := c.QueryParam("reviewed"); reviewed != "" {
+		value := reviewed == "true"
+		filter.Reviewed = &value
+	}
+
+	blockedUploads, err := stores.BlockedUploads.List(c.Request().Context(), filter, listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	for i := range blockedUploads {
+		blockedUploads[i].CreatedTime = blockedUploads[i].CreatedTime.In(format)
+		blockedUploads[i].UpdatedTime = blockedUploads[i].UpdatedTime.In(format)
+	}
+
+	return c.JSON(http.StatusOK, blockedUploads)
+}
+
+func ReviewBlockedUpload(c echo.Context, stores Stores, id string) error {
+	blockedID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Blocked upload not found")
+	}
+
+	err = stores.BlockedUploads.MarkReviewed(c.Request().Context(), blockedID, utils.GetModerator(c), utils.Now())
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Blocked upload not found")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "OK"})
+}
@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func banImage(t *testing.T, stores Stores, sha256 string, hash uint64) {
+	t.Helper()
+
+	banned := BannedMedia{
+		SHA256:         sha256,
+		ImageHash:      utils.FormatImageHash(hash),
+		ImageHashBands: imageHashBands(hash),
+		CreatedTime:    utils.Now(),
+	}
+	if err := stores.BannedMedia.Insert(context.Background(), &banned); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckBannedMedia(t *testing.T) {
+	ctx := context.Background()
+	stores := NewMemoryStores()
+
+	const banned = uint64(0x0123456789abcdef)
+	banImage(t, stores, "banned-sha", banned)
+
+	check := func(sha256 string, hash uint64) error {
+		return CheckBannedMedia(ctx, stores, MediaCheck{SHA256: sha256, ImageHash: utils.FormatImageHash(hash), Source: MediaSourceUpload})
+	}
+
+	if err := check("banned-sha", ^banned); !errors.Is(err, ErrBannedMedia) {
+		t.Errorf("same file: got %v, want ErrBannedMedia", err)
+	}
+
+	// Every way of flipping up to bannedImageDistance bits must still find
+	// the ban through one of its bands, wherever the bits are.
+	random := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 1000; i++ {
+		hash := banned
+		for _, bit := range random.Perm(64)[:1+random.IntN(bannedImageDistance)] {
+			hash ^= 1 << bit
+		}
+
+		if err := check("other-sha", hash); !errors.Is(err, ErrBannedMedia) {
+			t.Fatalf("%016x is %d bits from the ban: got %v, want ErrBannedMedia", hash, utils.HammingDistance(hash, banned), err)
+		}
+	}
+
+	if err := check("other-sha", banned^0x1f); err != nil {
+		t.Errorf("5 bits away: got %v, want nil", err)
+	}
+
+	blocked, err := stores.BlockedUploads.List(ctx, BlockedUploadFilter{}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocked) != 1001 {
+		t.Errorf("recorded %d blocked uploads, want 1001", len(blocked))
+	}
+}
@@ -1,60 +1,71 @@
 package lib
 
 import (
-	"animoshi-api-go/src/infra"
 	"animoshi-api-go/src/utils"
-	"context"
 	"errors"
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"log"
 	"net/http"
 	"regexp"
-	"strconv"
 	"strings"
-	"time"
 )
 
 type PostRequest struct {
 	Title          string `bson:"title" json:"title"`
 	Content        string `bson:"content" json:"content"`
 	Image          string `bson:"image" json:"image"`
+	SourceURL      string `bson:"sourceUrl,omitempty" json:"sourceUrl,omitempty"`
+	Video          string `bson:"video" json:"video"`
 	NsfwToggle     int64  `bson:"nsfwToggle" json:"nsfwToggle"`
 	UserID         string `bson:"userId" json:"userId"`
 	RecaptchaToken string `bson:"recaptchaToken,omitempty" json:"recaptchaToken"`
 	AniToken       string `bson:"aniToken" json:"aniToken"`
+
+	VideoMeta *utils.VideoMetadata `bson:"videoMeta,omitempty" json:"videoMeta,omitempty"`
+	Images    *utils.ImageSet      `bson:"images,omitempty" json:"images,omitempty"`
+
+	MediaSha256 string `bson:"mediaSha256,omitempty" json:"-"`
 }
 
 type Post struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
-	Title       string             `bson:"title" json:"title"`
-	Content     string             `bson:"content" json:"content"`
-	Image       string             `bson:"image" json:"image"`
-	Video       string             `bson:"video" json:"video"`
-	Likes       int64              `bson:"likes" json:"likes"`
-	Dislikes    int64              `bson:"dislikes" json:"dislikes"`
-	NsfwToggle  int64              `bson:"nsfwToggle" json:"nsfwToggle"`
-	Comments    int64              `bson:"comments" json:"comments"`
-	UserID      string             `bson:"userId" json:"userId"`
-	UserName    string             `bson:"userName" json:"userName"`
-	CreatedTime string             `bson:"createdTime" json:"createdTime"`
-	UpdatedTime string             `bson:"updatedTime" json:"updatedTime"`
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"_id"`
+	Title       string               `bson:"title" json:"title"`
+	Content     string               `bson:"content" json:"content"`
+	Image       string               `bson:"image" json:"image"`
+	SourceURL   string               `bson:"sourceUrl,omitempty" json:"sourceUrl,omitempty"`
+	Video       string               `bson:"video" json:"video"`
+	VideoMeta   *utils.VideoMetadata `bson:"videoMeta,omitempty" json:"videoMeta,omitempty"`
+	Images      *utils.ImageSet      `bson:"images,omitempty" json:"images,omitempty"`
+	ImageHash   string               `bson:"imageHash,omitempty" json:"imageHash,omitempty"`
+	DuplicateOf string               `bson:"duplicateOf,omitempty" json:"duplicateOf,omitempty"`
+	MediaSha256 string               `bson:"mediaSha256,omitempty" json:"-"`
+	Likes       int64                `bson:"likes" json:"likes"`
+	Dislikes    int64                `bson:"dislikes" json:"dislikes"`
+	NsfwToggle  int64                `bson:"nsfwToggle" json:"nsfwToggle"`
+	Comments    int64                `bson:"comments" json:"comments"`
+	UserID      string               `bson:"userId" json:"userId"`
+	UserName    string               `bson:"userName" json:"userName"`
+	CreatedTime utils.Timestamp      `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp      `bson:"updatedTime" json:"updatedTime"`
 
 	UserIP         string `bson:"userIp" json:"userIp"`
 	RecaptchaToken string `bson:"recaptchaToken,omitempty" json:"recaptchaToken"`
 	AniToken       string `bson:"aniToken" json:"aniToken"`
 }
 
+// PostComment is a comment on any target, see CommentTarget. Comments on
+// posts still carry PostId for older clients.
 type PostComment struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
-	PostId      string             `bson:"postId" json:"postId"`
+	TargetType  CommentTargetType  `bson:"targetType" json:"targetType"`
+	TargetId    string             `bson:"targetId" json:"targetId"`
+	PostId      string             `bson:"postId,omitempty" json:"postId"`
 	UserID      string             `bson:"userId" json:"userId"`
 	Text        string             `bson:"text" json:"text"`
-	CreatedTime string             `bson:"createdTime" json:"createdTime"`
-	UpdatedTime string             `bson:"updatedTime" json:"updatedTime"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
 
 	UserIP         string `bson:"userIp" json:"userIp"`
 	RecaptchaToken string `bson:"recaptchaToken,omitempty" json:"recaptchaToken"`
@@ -65,8 +76,8 @@ type PostLike struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
 	PostId      string             `bson:"postId" json:"postId"`
 	UserID      string             `bson:"userId" json:"userId"`
-	CreatedTime string             `bson:"createdTime" json:"createdTime"`
-	UpdatedTime string             `bson:"updatedTime" json:"updatedTime"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
 
 	UserIP         string `bson:"userIp" json:"userIp"`
 	RecaptchaToken string `bson:"recaptchaToken,omitempty" json:"recaptchaToken"`
@@ -77,8 +88,8 @@ type PostDislike struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
 	PostId      string             `bson:"postId" json:"postId"`
 	UserID      string             `bson:"userId" json:"userId"`
-	CreatedTime string             `bson:"createdTime" json:"createdTime"`
-	UpdatedTime string             `bson:"updatedTime" json:"updatedTime"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
 
 	UserIP         string `bson:"userIp" json:"userIp"`
 	RecaptchaToken string `bson:"recaptchaToken,omitempty" json:"recaptchaToken"`
@@ -89,16 +100,96 @@ type PostLikeResponse struct {
 	ID          primitive.ObjectID `json:"_id"`
 	PostId      string             `json:"postId"`
 	UserID      string             `json:"userId"`
-	CreatedTime string             `json:"createdTime"`
-	UpdatedTime string             `json:"updatedTime"`
+	CreatedTime utils.Timestamp    `json:"createdTime"`
+	UpdatedTime utils.Timestamp    `json:"updatedTime"`
+}
+
+// PostResponse is what clients get for a post, it never carries userIp,
+// aniToken or recaptchaToken.
+type PostResponse struct {
+	ID          primitive.ObjectID   `json:"_id"`
+	Title       string               `json:"title"`
+	Content     string               `json:"content"`
+	Image       string               `json:"image"`
+	SourceURL   string               `json:"sourceUrl,omitempty"`
+	Video       string               `json:"video"`
+	VideoMeta   *utils.VideoMetadata `json:"videoMeta,omitempty"`
+	Images      *utils.ImageSet      `json:"images,omitempty"`
+	ImageHash   string               `json:"imageHash,omitempty"`
+	DuplicateOf string               `json:"duplicateOf,omitempty"`
+	Likes       int64                `json:"likes"`
+	Dislikes    int64                `json:"dislikes"`
+	NsfwToggle  int64                `json:"nsfwToggle"`
+	Comments    int64                `json:"comments"`
+	UserID      string               `json:"userId"`
+	UserName    string               `json:"userName"`
+	CreatedTime utils.Timestamp      `json:"createdTime"`
+	UpdatedTime utils.Timestamp      `json:"updatedTime"`
+}
+
+type PostCommentResponse struct {
+	ID          primitive.ObjectID `json:"_id"`
+	TargetType  CommentTargetType  `json:"targetType"`
+	TargetId    string             `json:"targetId"`
+	PostId      string             `json:"postId,omitempty"`
+	UserID      string             `json:"userId"`
+	Text        string             `json:"text"`
+	CreatedTime utils.Timestamp    `json:"createdTime"`
+	UpdatedTime utils.Timestamp    `json:"updatedTime"`
 }
 
 type PostDislikeResponse struct {
 	ID          primitive.ObjectID `json:"_id"`
 	PostId      string             `json:"postId"`
 	UserID      string             `json:"userId"`
-	CreatedTime string             `json:"createdTime"`
-	UpdatedTime string             `json:"updatedTime"`
+	CreatedTime utils.Timestamp    `json:"createdTime"`
+	UpdatedTime utils.Timestamp    `json:"updatedTime"`
+}
+
+// The response builders take the timestamp format of the request, see
+// utils.ResponseTimestampFormat.
+func newPostResponse(post Post, format utils.TimestampFormat) PostResponse {
+	return PostResponse{
+		ID:          post.ID,
+		Title:       post.Title,
+		Content:     post.Content,
+		Image:       post.Image,
+		SourceURL:   post.SourceURL,
+		Video:       post.Video,
+		VideoMeta:   post.VideoMeta,
+		Images:      post.Images,
+		ImageHash:   post.ImageHash,
+		DuplicateOf: post.DuplicateOf,
+		Likes:       post.Likes,
+		Dislikes:    post.Dislikes,
+		NsfwToggle:  post.NsfwToggle,
+		Comments:    post.Comments,
+		UserID:      post.UserID,
+		UserName:    post.UserName,
+		CreatedTime: post.CreatedTime.In(format),
+		UpdatedTime: post.UpdatedTime.In(format),
+	}
+}
+
+func newPostResponses(posts []Post, format utils.TimestampFormat) []PostResponse {
+	responses := make([]PostResponse, 0, len(posts))
+	for _, post := range posts {
+		responses = append(responses, newPostResponse(post, format))
+	}
+	return responses
+}
+
+func newPostCommentResponse(comment PostComment, format utils.TimestampFormat) PostCommentResponse {
+	return PostCommentResponse{
+		ID:          comment.ID,
+		TargetType:  comment.TargetType,
+		TargetId:    comment.TargetId,
+		PostId:      comment.PostId,
+		UserID:      comment.UserID,
+		Text:        comment.Text,
+		CreatedTime: comment.CreatedTime.In(format),
+		UpdatedTime: comment.UpdatedTime.In(format),
+	}
 }
 
 func sanitizeInput(input string) string {
@@ -108,178 +199,128 @@ func sanitizeInput(input string) string {
 
 var validate = validator.New()
 
-func GetPost(c echo.Context, client *mongo.Client) error {
-	collection := client.Database("animoshiApi").Collection("posts")
-
-	if !utils.ValidateQueryParams(c, []string{"id"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID is required"})
+func GetPost(c echo.Context, stores Stores, id string) error {
+	if id == "" {
+		return utils.ValidationFailed("id", "ID is required")
 	}
 
-	idParam := c.QueryParam("id")
-	postID, err := primitive.ObjectIDFromHex(idParam)
+	postID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Post not found")
+	}
 
-	var post map[string]interface{}
-	err = collection.FindOne(context.TODO(), bson.M{"_id": postID}).Decode(&post)
+	post, err := stores.Posts.Get(c.Request().Context(), postID)
 	if err != nil {
-		log.Println(err)
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Post not found")
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching post data"})
+		return utils.InternalError(err, "Error fetching post data")
 	}
 
-	return c.JSON(http.StatusOK, post)
+	return c.JSON(http.StatusOK, newPostResponse(*post, utils.ResponseTimestampFormat(c)))
 }
 
-func GetPosts(c echo.Context, client *mongo.Client) error {
-	offset := c.QueryParam("offset")
-	limit := c.QueryParam("limit")
-
+func GetPosts(c echo.Context, stores Stores) error {
 	if !utils.ValidateQueryParams(c, []string{"limit", "offset"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid params"})
+		return utils.BadRequest("Invalid params")
 	}
 
-	limitInt, err := strconv.Atoi(limit)
+	listOptions, err := parseListOptions(c.QueryParam("limit"), c.QueryParam("offset"))
 	if err != nil {
-		return err
+		return utils.BadRequest("Invalid params")
 	}
 
-	if limitInt > 20 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Limit cant be more than 20"})
+	if listOptions.Limit > 20 {
+		return utils.ValidationFailed("limit", "Limit cant be more than 20")
 	}
 
-	posts, err := infra.FindAllFromCollection(infra.FindAllCollectionsParams{
-		CollectionName: "posts",
-		Client:         client,
-		Filter:         bson.D{},
-		Limit:          limit,
-		Offset:         offset,
-	})
+	posts, err := stores.Posts.List(c.Request().Context(), PostFilter{}, listOptions)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return utils.InternalError(err, "Database error")
 	}
 
-	return c.JSON(http.StatusOK, posts)
+	return c.JSON(http.StatusOK, newPostResponses(posts, utils.ResponseTimestampFormat(c)))
 }
 
-func GetPostsByUserId(c echo.Context, client *mongo.Client) error {
-	offset := c.QueryParam("offset")
-	limit := c.QueryParam("limit")
-	userId := c.QueryParam("userId")
-
-	if !utils.ValidateQueryParams(c, []string{"limit", "offset", "userId"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid params"})
+func GetPostsByUserId(c echo.Context, stores Stores, userId string) error {
+	if userId == "" || !utils.ValidateQueryParams(c, []string{"limit", "offset"}) {
+		return utils.BadRequest("Invalid params")
 	}
 
-	limitInt, err := strconv.Atoi(limit)
+	listOptions, err := parseListOptions(c.QueryParam("limit"), c.QueryParam("offset"))
 	if err != nil {
-		return err
+		return utils.BadRequest("Invalid params")
 	}
 
-	if limitInt > 20 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Limit cant be more than 20"})
+	if listOptions.Limit > 20 {
+		return utils.ValidationFailed("limit", "Limit cant be more than 20")
 	}
 
-	posts, err := infra.FindAllFromCollection(infra.FindAllCollectionsParams{
-		CollectionName: "posts",
-		Client:         client,
-		Filter:         bson.D{{"userId", userId}},
-		Limit:          limit,
-		Offset:         offset,
-	})
+	posts, err := stores.Posts.List(c.Request().Context(), PostFilter{UserID: userId}, listOptions)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return utils.InternalError(err, "Database error")
 	}
 
-	return c.JSON(http.StatusOK, posts)
+	return c.JSON(http.StatusOK, newPostResponses(posts, utils.ResponseTimestampFormat(c)))
 }
 
-func GetPostCountByUserId(c echo.Context, client *mongo.Client) error {
-	userId := c.QueryParam("userId")
-
-	if !utils.ValidateQueryParams(c, []string{"userId"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid params"})
+func GetPostCountByUserId(c echo.Context, stores Stores, userId string) error {
+	if userId == "" {
+		return utils.BadRequest("Invalid params")
 	}
 
-	postCount, err := infra.CountCollection(infra.CountCollectionParams{
-		CollectionName: "posts",
-		Client:         client,
-		Filter:         bson.D{{"userId", userId}},
-	})
+	postCount, err := stores.Posts.Count(c.Request().Context(), PostFilter{UserID: userId})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return utils.InternalError(err, "Database error")
 	}
 
 	return c.JSON(http.StatusOK, postCount)
 }
 
-func GetPostCommentsByPostId(c echo.Context, client *mongo.Client) error {
-	offset := c.QueryParam("offset")
-	limit := c.QueryParam("limit")
-	postId := c.QueryParam("postId")
-
-	if !utils.ValidateQueryParams(c, []string{"postId", "limit", "offset"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid params"})
-	}
-
-	limitInt, err := strconv.Atoi(limit)
-	if err != nil {
-		return err
-	}
-
-	if limitInt > 20 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Limit cant be more than 20"})
-	}
-
-	postComments, err := infra.FindAllFromCollection(infra.FindAllCollectionsParams{
-		CollectionName: "postComments",
-		Client:         client,
-		Filter:         bson.D{{"postId", postId}},
-		Limit:          limit,
-		Offset:         offset,
-	})
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
-	}
-
-	return c.JSON(http.StatusOK, postComments)
-}
-
-func NewPost(c echo.Context, client *mongo.Client, postRequest *PostRequest) error {
-	currentTime := time.Now().UnixNano() / int64(time.Millisecond)
+func NewPost(c echo.Context, stores Stores, postRequest *PostRequest) error {
+	now := utils.Now()
 
 	if err := validate.Struct(postRequest); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Validation failed"})
+		return utils.FromValidationError(err)
 	}
 
 	if len(postRequest.Title) == 0 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Title is required!"})
+		return utils.ValidationFailed("title", "Title is required!")
 	}
 
 	if len(postRequest.Title) > 100 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Title is too long"})
+		return utils.ValidationFailed("title", "Title is too long")
 	}
 
 	if len(postRequest.Content) > 1000 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Text is too long! Only 1000 characters are allowed!"})
+		return utils.ValidationFailed("content", "Text is too long! Only 1000 characters are allowed!")
 	}
 
-	if len(postRequest.Image) > 500 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Image is too long"})
+	if len(postRequest.SourceURL) > 500 {
+		return utils.ValidationFailed("image", "Image is too long")
 	}
 
-	if len(postRequest.Image) > 0 && !strings.HasPrefix(postRequest.Image, "https://") {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Image URL must start with https://"})
+	if len(postRequest.SourceURL) > 0 && !strings.HasPrefix(postRequest.SourceURL, "https://") {
+		return utils.ValidationFailed("image", "Image URL must start with https://")
 	}
 
 	if len(postRequest.UserID) > 128 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "UserId is too long"})
+		return utils.ValidationFailed("userId", "UserId is too long")
+	}
+
+	if len(postRequest.Video) > 0 && postRequest.VideoMeta == nil {
+		return utils.ValidationFailed("videoMeta", "Video metadata is required")
 	}
 
 	post := Post{
 		Title:          postRequest.Title,
 		Content:        postRequest.Content,
 		Image:          postRequest.Image,
+		SourceURL:      postRequest.SourceURL,
+		Video:          postRequest.Video,
+		VideoMeta:      postRequest.VideoMeta,
+		Images:         postRequest.Images,
+		MediaSha256:    postRequest.MediaSha256,
 		NsfwToggle:     postRequest.NsfwToggle,
 		UserID:         postRequest.UserID,
 		RecaptchaToken: postRequest.RecaptchaToken,
@@ -291,8 +332,8 @@ func NewPost(c echo.Context, client *mongo.Client, postRequest *PostRequest) err
 	post.UserID = sanitizeInput(post.UserID)
 
 	post.UserIP = utils.GetUserIP(c)
-	post.CreatedTime = strconv.FormatInt(currentTime, 10)
-	post.UpdatedTime = strconv.FormatInt(currentTime, 10)
+	post.CreatedTime = now
+	post.UpdatedTime = now
 
 	post.Likes = 0
 	post.Dislikes = 0
@@ -301,270 +342,148 @@ func NewPost(c echo.Context, client *mongo.Client, postRequest *PostRequest) err
 
 	post.ID = primitive.NewObjectID()
 
-	insertErr := infra.InsertOne("posts", client, post)
-	if insertErr != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": insertErr.Error()})
-	}
-
-	return c.JSON(http.StatusOK, post)
-}
-
-func NewPostComment(c echo.Context, client *mongo.Client, postComment *PostComment) error {
-	currentTime := time.Now().UnixNano() / int64(time.Millisecond)
-
-	if postComment.RecaptchaToken == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Recaptcha token is required"})
-	}
-
-	if len(postComment.Text) > 1000 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Text is too long! Only 1000 characters are allowed!"})
+	if post.Images != nil {
+		post.ImageHash = post.Images.Hash
 	}
 
-	if len(postComment.UserID) > 128 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "UserId is too long"})
-	}
-
-	valid, err := utils.VerifyRecaptcha(postComment.RecaptchaToken)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
-	}
+	if post.ImageHash != "" && duplicateImagePolicy.Mode != DuplicatesOff {
+		hash, _ := utils.ParseImageHash(post.ImageHash)
 
-	if !valid {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
-	}
-
-	if err := validate.Struct(postComment); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Validation failed"})
-	}
-
-	postComment.UserIP = utils.GetUserIP(c)
-	postComment.CreatedTime = strconv.FormatInt(currentTime, 10)
-	postComment.UpdatedTime = strconv.FormatInt(currentTime, 10)
-
-	postComment.ID = primitive.NewObjectID()
-
-	collection := client.Database("animoshiApi").Collection("posts")
-
-	postObjectID, err := primitive.ObjectIDFromHex(postComment.PostId)
-	if err != nil {
-		return err
-	}
-
-	var post bson.M
-	err = collection.FindOne(context.TODO(), bson.M{"_id": postObjectID}).Decode(&post)
-	if err != nil {
-		print(err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Post not found"})
-	}
-
-	currentCommentCount, ok := post["comments"].(int64)
-	if !ok {
-		currentCommentCount = 0
-	}
-
-	newCommentCount := currentCommentCount + 1
-
-	update := bson.M{
-		"$set": bson.M{
-			"comments":    newCommentCount,
-			"updatedTime": strconv.FormatInt(currentTime, 10),
-		},
+		similar, err := findSimilarPosts(c.Request().Context(), stores.Posts, hash, duplicateImagePolicy.MaxDistance, duplicateImagePolicy.RecentPosts, post.ID)
+		if err != nil {
+			log.Println("Error checking for duplicate images:", err)
+		} else if len(similar) > 0 {
+			if duplicateImagePolicy.Mode == DuplicatesReject {
+				return utils.Conflict(utils.CodeDuplicateImage, "This image has already been posted").
+					With("duplicateOf", similar[0].ID.Hex())
+			}
+			post.DuplicateOf = similar[0].ID.Hex()
+		}
 	}
 
-	insertErr := infra.InsertOne("postComments", client, postComment)
+	insertErr := stores.Posts.Insert(c.Request().Context(), &post)
 	if insertErr != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": insertErr.Error()})
-	}
-
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": postObjectID}, update)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update comment count"})
+		return utils.InternalError(insertErr, "Database error")
 	}
 
-	return c.JSON(http.StatusOK, postComment)
+	return c.JSON(http.StatusOK, newPostResponse(post, utils.ResponseTimestampFormat(c)))
 }
 
-func LikePost(c echo.Context, client *mongo.Client, postLike *PostLike) error {
-	currentTime := time.Now().UnixNano() / int64(time.Millisecond)
+func LikePost(c echo.Context, stores Stores, postLike *PostLike) error {
+	now := utils.Now()
 
-	if postLike.RecaptchaToken == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Recaptcha token is required"})
-	}
-
-	valid, err := utils.VerifyRecaptcha(postLike.RecaptchaToken)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
-	}
-
-	if !valid {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
+	if err := utils.CheckRecaptcha(postLike.RecaptchaToken); err != nil {
+		return err
 	}
 
 	if err := validate.Struct(postLike); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Validation failed"})
+		return utils.FromValidationError(err)
 	}
 
 	postLike.UserID = "Anonymous"
 	postLike.UserIP = utils.GetUserIP(c)
-	postLike.CreatedTime = strconv.FormatInt(currentTime, 10)
-	postLike.UpdatedTime = strconv.FormatInt(currentTime, 10)
+	postLike.CreatedTime = now
+	postLike.UpdatedTime = now
 
 	postLike.ID = primitive.NewObjectID()
 
-	postCollection := client.Database("animoshiApi").Collection("posts")
-	postLikesCollection := client.Database("animoshiApi").Collection("postLikes")
-
-	existingLikeFilter := bson.M{
-		"postId": postLike.PostId,
-		"$or": []bson.M{
-			{"userIp": postLike.UserIP},
-			{"aniToken": postLike.AniToken},
-		},
+	voted, err := stores.Votes.HasVoted(c.Request().Context(), VoteLike, postLike.PostId, postLike.UserIP, postLike.AniToken)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
 	}
-
-	var existingLike PostLike
-	err = postLikesCollection.FindOne(c.Request().Context(), existingLikeFilter).Decode(&existingLike)
-	if err == nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "You have already liked this post!"})
-	} else if err != mongo.ErrNoDocuments {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	if voted {
+		return utils.Conflict(utils.CodeAlreadyVoted, "You have already liked this post!")
 	}
 
 	postObjectID, err := primitive.ObjectIDFromHex(postLike.PostId)
 	if err != nil {
-		return err
-	}
-
-	var post bson.M
-	err = postCollection.FindOne(context.TODO(), bson.M{"_id": postObjectID}).Decode(&post)
-	if err != nil {
-		print(err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Post not found"})
-	}
-
-	currentLikeCount, ok := post["likes"].(int64)
-	if !ok {
-		currentLikeCount = 0
+		return utils.ValidationFailed("postId", "Invalid post ID")
 	}
 
-	newLikeCount := currentLikeCount + 1
-
-	update := bson.M{
-		"$set": bson.M{
-			"likes":       newLikeCount,
-			"updatedTime": strconv.FormatInt(currentTime, 10),
-		},
+	if _, err := stores.Posts.Get(c.Request().Context(), postObjectID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Post not found")
+		}
+		return utils.InternalError(err, "Error fetching post data")
 	}
 
-	insertErr := infra.InsertOne("postLikes", client, postLike)
+	vote := PostVote(*postLike)
+	insertErr := stores.Votes.Insert(c.Request().Context(), VoteLike, &vote)
 	if insertErr != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": insertErr.Error()})
+		return utils.InternalError(insertErr, "Database error")
 	}
 
-	_, err = postCollection.UpdateOne(context.TODO(), bson.M{"_id": postObjectID}, update)
+	err = stores.Posts.Increment(c.Request().Context(), postObjectID, PostLikesCounter, now)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update comment count"})
+		return utils.InternalError(err, "Failed to update post counters")
 	}
 
 	response := PostLikeResponse{
 		ID:          postLike.ID,
 		PostId:      postLike.PostId,
 		UserID:      postLike.UserID,
-		CreatedTime: postLike.CreatedTime,
-		UpdatedTime: postLike.UpdatedTime,
+		CreatedTime: postLike.CreatedTime.In(utils.ResponseTimestampFormat(c)),
+		UpdatedTime: postLike.UpdatedTime.In(utils.ResponseTimestampFormat(c)),
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
-func DislikePost(c echo.Context, client *mongo.Client, postDislike *PostDislike) error {
-	currentTime := time.Now().UnixNano() / int64(time.Millisecond)
+func DislikePost(c echo.Context, stores Stores, postDislike *PostDislike) error {
+	now := utils.Now()
 
-	if postDislike.RecaptchaToken == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Recaptcha token is required"})
-	}
-
-	valid, err := utils.VerifyRecaptcha(postDislike.RecaptchaToken)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
-	}
-
-	if !valid {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
+	if err := utils.CheckRecaptcha(postDislike.RecaptchaToken); err != nil {
+		return err
 	}
 
 	if err := validate.Struct(postDislike); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Validation failed"})
+		return utils.FromValidationError(err)
 	}
 
 	postDislike.UserID = "Anonymous"
 	postDislike.UserIP = utils.GetUserIP(c)
-	postDislike.CreatedTime = strconv.FormatInt(currentTime, 10)
-	postDislike.UpdatedTime = strconv.FormatInt(currentTime, 10)
+	postDislike.CreatedTime = now
+	postDislike.UpdatedTime = now
 
 	postDislike.ID = primitive.NewObjectID()
 
-	postCollection := client.Database("animoshiApi").Collection("posts")
-	postDislikesCollection := client.Database("animoshiApi").Collection("postDislikes")
-
-	existingDislikeFilter := bson.M{
-		"postId": postDislike.PostId,
-		"$or": []bson.M{
-			{"userIp": postDislike.UserIP},
-			{"aniToken": postDislike.AniToken},
-		},
+	voted, err := stores.Votes.HasVoted(c.Request().Context(), VoteDislike, postDislike.PostId, postDislike.UserIP, postDislike.AniToken)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
 	}
-
-	var existingDislike PostDislike
-	err = postDislikesCollection.FindOne(c.Request().Context(), existingDislikeFilter).Decode(&existingDislike)
-	if err == nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "You have already disliked this post!"})
-	} else if err != mongo.ErrNoDocuments {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	if voted {
+		return utils.Conflict(utils.CodeAlreadyVoted, "You have already disliked this post!")
 	}
 
 	postObjectID, err := primitive.ObjectIDFromHex(postDislike.PostId)
 	if err != nil {
-		return err
+		return utils.ValidationFailed("postId", "Invalid post ID")
 	}
 
-	var post bson.M
-	err = postCollection.FindOne(context.TODO(), bson.M{"_id": postObjectID}).Decode(&post)
-	if err != nil {
-		print(err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Post not found"})
-	}
-
-	currentDislikeCount, ok := post["dislikes"].(int64)
-	if !ok {
-		currentDislikeCount = 0
-	}
-
-	newDislikeCount := currentDislikeCount + 1
-
-	update := bson.M{
-		"$set": bson.M{
-			"dislikes":    newDislikeCount,
-			"updatedTime": strconv.FormatInt(currentTime, 10),
-		},
+	if _, err := stores.Posts.Get(c.Request().Context(), postObjectID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Post not found")
+		}
+		return utils.InternalError(err, "Error fetching post data")
 	}
 
-	insertErr := infra.InsertOne("postDislikes", client, postDislike)
+	vote := PostVote(*postDislike)
+	insertErr := stores.Votes.Insert(c.Request().Context(), VoteDislike, &vote)
 	if insertErr != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": insertErr.Error()})
+		return utils.InternalError(insertErr, "Database error")
 	}
 
-	_, err = postCollection.UpdateOne(context.TODO(), bson.M{"_id": postObjectID}, update)
+	err = stores.Posts.Increment(c.Request().Context(), postObjectID, PostDislikesCounter, now)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update comment count"})
+		return utils.InternalError(err, "Failed to update post counters")
 	}
 
 	response := PostDislikeResponse{
 		ID:          postDislike.ID,
 		PostId:      postDislike.PostId,
 		UserID:      postDislike.UserID,
-		CreatedTime: postDislike.CreatedTime,
-		UpdatedTime: postDislike.UpdatedTime,
+		CreatedTime: postDislike.CreatedTime.In(utils.ResponseTimestampFormat(c)),
+		UpdatedTime: postDislike.UpdatedTime.In(utils.ResponseTimestampFormat(c)),
 	}
 
 	return c.JSON(http.StatusOK, response)
@@ -0,0 +1,1194 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errDuplicateID = errors.New("an item with this id already exists")
+
+// NewMemoryStores keeps everything in maps, it's meant for tests and local
+// experiments without a database.
+func NewMemoryStores() Stores {
+	ratings := &memoryRatingStore{ratings: map[primitive.ObjectID]WaifuRating{}}
+	favorites := &memoryFavoriteStore{}
+	comments := &memoryCommentStore{comments: map[primitive.ObjectID]PostComment{}}
+
+	return Stores{
+		Posts:           &memoryPostStore{posts: map[primitive.ObjectID]Post{}},
+		Comments:        comments,
+		Votes:           &memoryVoteStore{votes: map[VoteKind][]PostVote{}},
+		Waifus:          &memoryWaifuStore{waifus: map[primitive.ObjectID]Waifu{}},
+		Ratings:         ratings,
+		Favorites:       favorites,
+		Traits:          &memoryTraitStore{},
+		TraitVotes:      &memoryTraitVoteStore{votes: map[primitive.ObjectID]WaifuTraitVote{}},
+		Leaderboards:    &memoryLeaderboardStore{ratings: ratings, favorites: favorites, comments: comments, boards: map[string]Leaderboard{}},
+		WarVotes:        &memoryWarVoteStore{},
+		Tournaments:     &memoryTournamentStore{tournaments: map[primitive.ObjectID]Tournament{}},
+		TournamentVotes: &memoryTournamentVoteStore{},
+		Uploads:         &memoryUploadStore{uploads: map[primitive.ObjectID]Upload{}},
+		BannedMedia:     &memoryBannedMediaStore{},
+		BlockedUploads:  &memoryBlockedUploadStore{},
+	}
+}
+
+// newestPage sorts items by createdTime, newest first, and cuts out the
+// requested page.
+func newestPage[T any](items []T, createdTime func(T) time.Time, listOptions ListOptions) []T {
+	sort.SliceStable(items, func(i, j int) bool {
+		return createdTime(items[i]).After(createdTime(items[j]))
+	})
+
+	return page(items, listOptions)
+}
+
+// page cuts the requested page out of sorted items the way skip and limit
+// do in Mongo.
+func page[T any](items []T, listOptions ListOptions) []T {
+	if listOptions.Offset >= int64(len(items)) {
+		return []T{}
+	}
+	items = items[listOptions.Offset:]
+
+	if listOptions.Limit > 0 && listOptions.Limit < int64(len(items)) {
+		items = items[:listOptions.Limit]
+	}
+
+	return items
+}
+
+// The Mongo stores project these out when reading, do the same here so
+// nothing behaves differently in tests.
+func withoutPrivatePostFields(post Post) Post {
+	post.UserIP, post.AniToken, post.RecaptchaToken = "", "", ""
+	return post
+}
+
+func withoutPrivateCommentFields(comment PostComment) PostComment {
+	comment.UserIP, comment.AniToken, comment.RecaptchaToken = "", "", ""
+	return comment
+}
+
+type memoryPostStore struct {
+	mu    sync.RWMutex
+	posts map[primitive.ObjectID]Post
+}
+
+func (s *memoryPostStore) matching(filter PostFilter) []Post {
+	posts := []Post{}
+	for _, post := range s.posts {
+		if filter.UserID == "" || post.UserID == filter.UserID {
+			posts = append(posts, withoutPrivatePostFields(post))
+		}
+	}
+	return posts
+}
+
+func (s *memoryPostStore) Get(ctx context.Context, id primitive.ObjectID) (*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	post, ok := s.posts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	post = withoutPrivatePostFields(post)
+	return &post, nil
+}
+
+func (s *memoryPostStore) GetMany(ctx context.Context, ids []primitive.ObjectID) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := []Post{}
+	for _, id := range ids {
+		if post, ok := s.posts[id]; ok {
+			posts = append(posts, withoutPrivatePostFields(post))
+		}
+	}
+
+	return posts, nil
+}
+
+func (s *memoryPostStore) List(ctx context.Context, filter PostFilter, listOptions ListOptions) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return newestPage(s.matching(filter), func(post Post) time.Time { return post.CreatedTime.Time }, listOptions), nil
+}
+
+func (s *memoryPostStore) Count(ctx context.Context, filter PostFilter) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.matching(filter))), nil
+}
+
+func (s *memoryPostStore) Insert(ctx context.Context, post *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if post.ID.IsZero() {
+		post.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.posts[post.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.posts[post.ID] = *post
+	return nil
+}
+
+func (s *memoryPostStore) Increment(ctx context.Context, id primitive.ObjectID, counter PostCounter, updatedTime utils.Timestamp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	switch counter {
+	case PostLikesCounter:
+		post.Likes++
+	case PostDislikesCounter:
+		post.Dislikes++
+	case PostCommentsCounter:
+		post.Comments++
+	}
+	post.UpdatedTime = updatedTime
+
+	s.posts[id] = post
+	return nil
+}
+
+func (s *memoryPostStore) RecentImageHashes(ctx context.Context, window int64, excludeID primitive.ObjectID) ([]PostImageHash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withHash := []Post{}
+	for _, post := range s.posts {
+		if post.ImageHash != "" && post.ID != excludeID {
+			withHash = append(withHash, post)
+		}
+	}
+
+	recent := newestPage(withHash, func(post Post) time.Time { return post.CreatedTime.Time }, ListOptions{Limit: window})
+
+	hashes := make([]PostImageHash, 0, len(recent))
+	for _, post := range recent {
+		hashes = append(hashes, PostImageHash{ID: post.ID, ImageHash: post.ImageHash})
+	}
+
+	return hashes, nil
+}
+
+type memoryCommentStore struct {
+	mu       sync.RWMutex
+	comments map[primitive.ObjectID]PostComment
+}
+
+func (s *memoryCommentStore) ListByTarget(ctx context.Context, target CommentTarget, listOptions ListOptions) ([]PostComment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := []PostComment{}
+	for _, comment := range s.comments {
+		if comment.TargetType == target.Type && comment.TargetId == target.ID {
+			comments = append(comments, withoutPrivateCommentFields(comment))
+		}
+	}
+
+	return newestPage(comments, func(comment PostComment) time.Time { return comment.CreatedTime.Time }, listOptions), nil
+}
+
+func (s *memoryCommentStore) Insert(ctx context.Context, comment *PostComment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if comment.ID.IsZero() {
+		comment.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.comments[comment.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.comments[comment.ID] = *comment
+	return nil
+}
+
+type memoryVoteStore struct {
+	mu    sync.RWMutex
+	votes map[VoteKind][]PostVote
+}
+
+func (s *memoryVoteStore) HasVoted(ctx context.Context, kind VoteKind, postId string, userIP string, aniToken string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, vote := range s.votes[kind] {
+		if vote.PostId == postId && (vote.UserIP == userIP || vote.AniToken == aniToken) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryVoteStore) Insert(ctx context.Context, kind VoteKind, vote *PostVote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+	for _, existing := range s.votes[kind] {
+		if existing.ID == vote.ID {
+			return errDuplicateID
+		}
+	}
+
+	s.votes[kind] = append(s.votes[kind], *vote)
+	return nil
+}
+
+type memoryWaifuStore struct {
+	mu     sync.RWMutex
+	waifus map[primitive.ObjectID]Waifu
+}
+
+func (s *memoryWaifuStore) Get(ctx context.Context, id primitive.ObjectID) (*Waifu, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	waifu, ok := s.waifus[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &waifu, nil
+}
+
+func (s *memoryWaifuStore) GetMany(ctx context.Context, ids []primitive.ObjectID) ([]Waifu, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	waifus := []Waifu{}
+	for _, id := range ids {
+		if waifu, ok := s.waifus[id]; ok {
+			waifus = append(waifus, waifu)
+		}
+	}
+
+	return waifus, nil
+}
+
+func (s *memoryWaifuStore) List(ctx context.Context, filter WaifuFilter, listOptions ListOptions) ([]Waifu, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	waifus := []Waifu{}
+	for _, waifu := range s.waifus {
+		if filter.Status != "" && waifu.Status != filter.Status {
+			continue
+		}
+		if filter.AniToken != "" && waifu.AniToken != filter.AniToken {
+			continue
+		}
+		waifus = append(waifus, waifu)
+	}
+
+	var score func(Waifu) float64
+	switch filter.Sort {
+	case WaifuSortTopRated:
+		score = func(waifu Waifu) float64 { return waifu.RatingScore }
+	case WaifuSortElo:
+		score = func(waifu Waifu) float64 { return waifu.Elo }
+	}
+
+	if score != nil {
+		sort.SliceStable(waifus, func(i, j int) bool {
+			if score(waifus[i]) != score(waifus[j]) {
+				return score(waifus[i]) > score(waifus[j])
+			}
+			return waifus[i].CreatedTime.After(waifus[j].CreatedTime.Time)
+		})
+		return page(waifus, listOptions), nil
+	}
+
+	return newestPage(waifus, func(waifu Waifu) time.Time { return waifu.CreatedTime.Time }, listOptions), nil
+}
+
+func (s *memoryWaifuStore) Insert(ctx context.Context, waifu *Waifu) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if waifu.ID.IsZero() {
+		waifu.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.waifus[waifu.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.waifus[waifu.ID] = *waifu
+	return nil
+}
+
+func (s *memoryWaifuStore) Transition(ctx context.Context, id primitive.ObjectID, change WaifuStatusChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waifu, ok := s.waifus[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if waifu.Status != change.From {
+		return ErrWaifuStatusChanged
+	}
+
+	waifu.Status = change.To
+	waifu.UpdatedTime = change.Time
+	waifu.StatusHistory = append(append([]WaifuStatusChange{}, waifu.StatusHistory...), change)
+
+	s.waifus[id] = waifu
+	return nil
+}
+
+func (s *memoryWaifuStore) AddRating(ctx context.Context, id primitive.ObjectID, stars int64, count int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waifu, ok := s.waifus[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	waifu.RatingSum += stars
+	waifu.RatingCount += count
+	waifu.Rating = averageRating(waifu.RatingSum, waifu.RatingCount)
+	waifu.RatingScore = bayesianScore(waifu.RatingSum, waifu.RatingCount)
+	waifu.UpdatedTime = updatedTime
+
+	s.waifus[id] = waifu
+	return &waifu, nil
+}
+
+func (s *memoryWaifuStore) AddFavorites(ctx context.Context, id primitive.ObjectID, delta int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waifu, ok := s.waifus[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	waifu.Favorites += delta
+	waifu.UpdatedTime = updatedTime
+
+	s.waifus[id] = waifu
+	return &waifu, nil
+}
+
+func (s *memoryWaifuStore) AddComments(ctx context.Context, id primitive.ObjectID, delta int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waifu, ok := s.waifus[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	waifu.Comments += delta
+	waifu.UpdatedTime = updatedTime
+
+	s.waifus[id] = waifu
+	return &waifu, nil
+}
+
+func (s *memoryWaifuStore) Random(ctx context.Context, status WaifuStatus) (*Waifu, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matching := []Waifu{}
+	for _, waifu := range s.waifus {
+		if waifu.Status == status {
+			matching = append(matching, waifu)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, ErrNotFound
+	}
+
+	waifu := matching[rand.IntN(len(matching))]
+	return &waifu, nil
+}
+
+func (s *memoryWaifuStore) NearestElo(ctx context.Context, status WaifuStatus, elo float64, excludeID primitive.ObjectID, n int64) ([]Waifu, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var above, below []Waifu
+	for _, waifu := range s.waifus {
+		if waifu.Status != status || waifu.ID == excludeID {
+			continue
+		}
+		if waifu.Elo >= elo {
+			above = append(above, waifu)
+		} else {
+			below = append(below, waifu)
+		}
+	}
+
+	sort.Slice(above, func(i, j int) bool { return above[i].Elo < above[j].Elo })
+	sort.Slice(below, func(i, j int) bool { return below[i].Elo > below[j].Elo })
+
+	return append(page(below, ListOptions{Limit: n}), page(above, ListOptions{Limit: n})...), nil
+}
+
+func (s *memoryWaifuStore) RecordMatch(ctx context.Context, winnerID primitive.ObjectID, loserID primitive.ObjectID, updatedTime utils.Timestamp) (*MatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	winner, ok := s.waifus[winnerID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	loser, ok := s.waifus[loserID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	change := eloChange(winner.Elo, loser.Elo)
+	winner.Elo += change
+	winner.Wins++
+	winner.UpdatedTime = updatedTime
+	loser.Elo -= change
+	loser.Losses++
+	loser.UpdatedTime = updatedTime
+
+	s.waifus[winnerID] = winner
+	s.waifus[loserID] = loser
+	return &MatchResult{EloChange: change, Winner: winner, Loser: loser}, nil
+}
+
+func (s *memoryWaifuStore) AddTraitVote(ctx context.Context, id primitive.ObjectID, trait string, score int64, replaced int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	waifu, ok := s.waifus[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// Copies handed out earlier share the map and histograms, so both are
+	// replaced rather than changed.
+	traits := maps.Clone(waifu.Traits)
+	if traits == nil {
+		traits = map[string]TraitMeter{}
+	}
+
+	meter := traits[trait]
+	histogram := emptyHistogram()
+	copy(histogram, meter.Histogram)
+
+	histogram[score]++
+	if replaced == noTraitScore {
+		meter.Votes++
+	} else {
+		histogram[replaced]--
+	}
+	meter.Histogram = histogram
+	meter.Median = traitMedian(histogram)
+
+	traits[trait] = meter
+	waifu.Traits = traits
+	waifu.UpdatedTime = updatedTime
+
+	s.waifus[id] = waifu
+	return &waifu, nil
+}
+
+type memoryRatingStore struct {
+	mu      sync.RWMutex
+	ratings map[primitive.ObjectID]WaifuRating
+}
+
+func (s *memoryRatingStore) Find(ctx context.Context, waifuId string, userIP string, aniToken string) (*WaifuRating, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, rating := range s.ratings {
+		if rating.WaifuId == waifuId && (rating.UserIP == userIP || rating.AniToken == aniToken) {
+			return &rating, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryRatingStore) Insert(ctx context.Context, rating *WaifuRating) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rating.ID.IsZero() {
+		rating.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.ratings[rating.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.ratings[rating.ID] = *rating
+	return nil
+}
+
+func (s *memoryRatingStore) SetStars(ctx context.Context, id primitive.ObjectID, from int64, to int64, updatedTime utils.Timestamp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rating, ok := s.ratings[id]
+	if !ok || rating.Stars != from {
+		return ErrRatingChanged
+	}
+
+	rating.Stars = to
+	rating.UpdatedTime = updatedTime
+
+	s.ratings[id] = rating
+	return nil
+}
+
+type memoryTraitStore struct {
+	mu     sync.RWMutex
+	traits []Trait
+}
+
+func (s *memoryTraitStore) List(ctx context.Context) ([]Trait, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.traits), nil
+}
+
+func (s *memoryTraitStore) Insert(ctx context.Context, trait *Trait) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.ContainsFunc(s.traits, func(existing Trait) bool { return existing.Key == trait.Key }) {
+		return ErrTraitExists
+	}
+	if trait.ID.IsZero() {
+		trait.ID = primitive.NewObjectID()
+	}
+
+	s.traits = append(s.traits, *trait)
+	return nil
+}
+
+type memoryTraitVoteStore struct {
+	mu    sync.RWMutex
+	votes map[primitive.ObjectID]WaifuTraitVote
+}
+
+func (s *memoryTraitVoteStore) Find(ctx context.Context, waifuId string, trait string, userIP string, aniToken string) (*WaifuTraitVote, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, vote := range s.votes {
+		if vote.WaifuId == waifuId && vote.Trait == trait && (vote.UserIP == userIP || vote.AniToken == aniToken) {
+			return &vote, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryTraitVoteStore) Insert(ctx context.Context, vote *WaifuTraitVote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.votes[vote.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.votes[vote.ID] = *vote
+	return nil
+}
+
+func (s *memoryTraitVoteStore) SetScore(ctx context.Context, id primitive.ObjectID, from int64, to int64, updatedTime utils.Timestamp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vote, ok := s.votes[id]
+	if !ok || vote.Score != from {
+		return ErrTraitVoteChanged
+	}
+
+	vote.Score = to
+	vote.UpdatedTime = updatedTime
+
+	s.votes[id] = vote
+	return nil
+}
+
+type memoryFavoriteStore struct {
+	mu        sync.RWMutex
+	favorites []WaifuFavorite
+}
+
+func (s *memoryFavoriteStore) Add(ctx context.Context, favorite *WaifuFavorite) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.favorites {
+		if existing.WaifuId == favorite.WaifuId && existing.AniToken == favorite.AniToken {
+			return false, nil
+		}
+	}
+
+	if favorite.ID.IsZero() {
+		favorite.ID = primitive.NewObjectID()
+	}
+
+	s.favorites = append(s.favorites, *favorite)
+	return true, nil
+}
+
+func (s *memoryFavoriteStore) Remove(ctx context.Context, waifuId string, aniToken string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, favorite := range s.favorites {
+		if favorite.WaifuId == waifuId && favorite.AniToken == aniToken {
+			s.favorites = append(s.favorites[:i:i], s.favorites[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryFavoriteStore) Has(ctx context.Context, waifuId string, aniToken string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, favorite := range s.favorites {
+		if favorite.WaifuId == waifuId && favorite.AniToken == aniToken {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryFavoriteStore) List(ctx context.Context, filter FavoriteFilter, listOptions ListOptions) ([]WaifuFavorite, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	favorites := []WaifuFavorite{}
+	for _, favorite := range s.favorites {
+		if filter.AniToken != "" && favorite.AniToken != filter.AniToken {
+			continue
+		}
+		if filter.UserID != "" && favorite.UserID != filter.UserID {
+			continue
+		}
+		favorites = append(favorites, favorite)
+	}
+
+	return newestPage(favorites, func(favorite WaifuFavorite) time.Time { return favorite.CreatedTime.Time }, listOptions), nil
+}
+
+// memoryLeaderboardStore tallies straight from the other memory stores.
+type memoryWarVoteStore struct {
+	mu    sync.RWMutex
+	votes []WarVote
+}
+
+func (s *memoryWarVoteStore) HasVoted(ctx context.Context, pair string, userIP string, aniToken string, since time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, vote := range s.votes {
+		if vote.Pair == pair && (vote.UserIP == userIP || vote.AniToken == aniToken) && !vote.CreatedTime.Before(since) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryWarVoteStore) Insert(ctx context.Context, vote *WarVote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+	for _, existing := range s.votes {
+		if existing.ID == vote.ID {
+			return errDuplicateID
+		}
+		if vote.Bucket != 0 && existing.Bucket == vote.Bucket && existing.Pair == vote.Pair && existing.AniToken == vote.AniToken {
+			return ErrWarVoteExists
+		}
+	}
+
+	s.votes = append(s.votes, *vote)
+	return nil
+}
+
+func (s *memoryWarVoteStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.votes = slices.DeleteFunc(s.votes, func(vote WarVote) bool { return vote.ID == id })
+	return nil
+}
+
+func (s *memoryWarVoteStore) SetEloChange(ctx context.Context, id primitive.ObjectID, eloChange float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.votes {
+		if s.votes[i].ID == id {
+			s.votes[i].EloChange = eloChange
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// The bracket is cloned going in and out, so callers can't change a stored
+// tournament behind the lock.
+type memoryTournamentStore struct {
+	mu          sync.RWMutex
+	tournaments map[primitive.ObjectID]Tournament
+}
+
+func (s *memoryTournamentStore) Get(ctx context.Context, id primitive.ObjectID) (*Tournament, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tournament, ok := s.tournaments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	tournament = tournament.clone()
+	return &tournament, nil
+}
+
+func (s *memoryTournamentStore) List(ctx context.Context, listOptions ListOptions) ([]Tournament, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tournaments := []Tournament{}
+	for _, tournament := range s.tournaments {
+		tournaments = append(tournaments, tournament.clone())
+	}
+
+	return newestPage(tournaments, func(tournament Tournament) time.Time { return tournament.CreatedTime.Time }, listOptions), nil
+}
+
+func (s *memoryTournamentStore) Insert(ctx context.Context, tournament *Tournament) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tournament.ID.IsZero() {
+		tournament.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.tournaments[tournament.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.tournaments[tournament.ID] = tournament.clone()
+	return nil
+}
+
+func (s *memoryTournamentStore) Due(ctx context.Context, now time.Time) ([]Tournament, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	due := []Tournament{}
+	for _, tournament := range s.tournaments {
+		if tournament.Status == TournamentActive && !tournament.RoundEndTime.After(now) {
+			due = append(due, tournament.clone())
+		}
+	}
+
+	return due, nil
+}
+
+func (s *memoryTournamentStore) Replace(ctx context.Context, tournament *Tournament, round int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.tournaments[tournament.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if existing.Status != TournamentActive || existing.CurrentRound != round {
+		return ErrTournamentChanged
+	}
+
+	s.tournaments[tournament.ID] = tournament.clone()
+	return nil
+}
+
+func (s *memoryTournamentStore) AddVote(ctx context.Context, id primitive.ObjectID, round int64, match int, slot int, votedTime utils.Timestamp) (*Tournament, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tournament, ok := s.tournaments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if tournament.Status != TournamentActive || tournament.CurrentRound != round || !tournament.RoundEndTime.After(votedTime.Time) {
+		return nil, ErrVotingClosed
+	}
+
+	tournament = tournament.clone()
+	tournament.Rounds[round-1].Matches[match].Slots[slot].Votes++
+
+	s.tournaments[id] = tournament
+	tournament = tournament.clone()
+	return &tournament, nil
+}
+
+type memoryTournamentVoteStore struct {
+	mu    sync.RWMutex
+	votes []TournamentVote
+}
+
+func (s *memoryTournamentVoteStore) HasVoted(ctx context.Context, tournamentId string, matchId string, userIP string, aniToken string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, vote := range s.votes {
+		if vote.TournamentId == tournamentId && vote.MatchId == matchId && (vote.UserIP == userIP || vote.AniToken == aniToken) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryTournamentVoteStore) Insert(ctx context.Context, vote *TournamentVote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+	for _, existing := range s.votes {
+		if existing.ID == vote.ID {
+			return errDuplicateID
+		}
+	}
+
+	s.votes = append(s.votes, *vote)
+	return nil
+}
+
+type memoryLeaderboardStore struct {
+	ratings   *memoryRatingStore
+	favorites *memoryFavoriteStore
+	comments  *memoryCommentStore
+
+	mu     sync.RWMutex
+	boards map[string]Leaderboard
+}
+
+func (s *memoryLeaderboardStore) Tally(ctx context.Context, metric LeaderboardMetric, from time.Time, to time.Time) ([]WaifuTally, error) {
+	inPeriod := func(t utils.Timestamp) bool {
+		return t.Before(to) && (from.IsZero() || !t.Before(from))
+	}
+
+	byWaifu := map[string]*WaifuTally{}
+	add := func(waifuId string, stars int64) {
+		tally, ok := byWaifu[waifuId]
+		if !ok {
+			tally = &WaifuTally{WaifuId: waifuId}
+			byWaifu[waifuId] = tally
+		}
+		tally.Count++
+		tally.Sum += stars
+	}
+
+	switch metric {
+	case LeaderboardRating:
+		s.ratings.mu.RLock()
+		for _, rating := range s.ratings.ratings {
+			if inPeriod(rating.UpdatedTime) {
+				add(rating.WaifuId, rating.Stars)
+			}
+		}
+		s.ratings.mu.RUnlock()
+	case LeaderboardFavorites:
+		s.favorites.mu.RLock()
+		for _, favorite := range s.favorites.favorites {
+			if inPeriod(favorite.CreatedTime) {
+				add(favorite.WaifuId, 0)
+			}
+		}
+		s.favorites.mu.RUnlock()
+	case LeaderboardComments:
+		s.comments.mu.RLock()
+		for _, comment := range s.comments.comments {
+			if comment.TargetType == CommentOnWaifu && inPeriod(comment.CreatedTime) {
+				add(comment.TargetId, 0)
+			}
+		}
+		s.comments.mu.RUnlock()
+	}
+
+	tallies := make([]WaifuTally, 0, len(byWaifu))
+	for _, tally := range byWaifu {
+		tallies = append(tallies, *tally)
+	}
+
+	return tallies, nil
+}
+
+func (s *memoryLeaderboardStore) Save(ctx context.Context, board *Leaderboard) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.boards[board.ID] = *board
+	return nil
+}
+
+func (s *memoryLeaderboardStore) Get(ctx context.Context, by LeaderboardMetric, window LeaderboardWindow) (*Leaderboard, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	board, ok := s.boards[leaderboardID(by, window)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &board, nil
+}
+
+type memoryUploadStore struct {
+	mu      sync.RWMutex
+	uploads map[primitive.ObjectID]Upload
+}
+
+func (s *memoryUploadStore) Insert(ctx context.Context, upload *Upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if upload.ID.IsZero() {
+		upload.ID = primitive.NewObjectID()
+	}
+	if _, ok := s.uploads[upload.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.uploads[upload.ID] = *upload
+	return nil
+}
+
+func (s *memoryUploadStore) Find(ctx context.Context, id primitive.ObjectID, aniToken string) (*Upload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.AniToken != aniToken {
+		return nil, ErrNotFound
+	}
+
+	return &upload, nil
+}
+
+func (s *memoryUploadStore) Complete(ctx context.Context, upload *Upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.uploads[upload.ID]
+	if !ok || existing.Status != UploadPending {
+		return ErrUploadCompleted
+	}
+
+	existing.Status = UploadComplete
+	existing.Size = upload.Size
+	existing.URL = upload.URL
+	existing.Images = upload.Images
+	existing.VideoMeta = upload.VideoMeta
+	existing.SHA256 = upload.SHA256
+	existing.UpdatedTime = upload.UpdatedTime
+
+	s.uploads[upload.ID] = existing
+	return nil
+}
+
+func (s *memoryUploadStore) Claim(ctx context.Context, id primitive.ObjectID, aniToken string, updatedTime utils.Timestamp) (*Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.AniToken != aniToken || upload.Status != UploadComplete {
+		return nil, ErrUploadNotReady
+	}
+
+	upload.Status = UploadAttached
+	upload.UpdatedTime = updatedTime
+
+	s.uploads[id] = upload
+	return &upload, nil
+}
+
+func (s *memoryUploadStore) ListExpired(ctx context.Context, before time.Time, limit int64) ([]Upload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expired := []Upload{}
+	for _, upload := range s.uploads {
+		if upload.Status == UploadPending && upload.ExpiresTime.Before(before) {
+			expired = append(expired, upload)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ExpiresTime.Before(expired[j].ExpiresTime.Time) })
+	return page(expired, ListOptions{Limit: limit}), nil
+}
+
+func (s *memoryUploadStore) Expire(ctx context.Context, id primitive.ObjectID, updatedTime utils.Timestamp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.Status != UploadPending {
+		return ErrUploadCompleted
+	}
+
+	upload.Status = UploadExpired
+	upload.UpdatedTime = updatedTime
+
+	s.uploads[id] = upload
+	return nil
+}
+
+type memoryBannedMediaStore struct {
+	mu     sync.RWMutex
+	banned []BannedMedia
+}
+
+func (s *memoryBannedMediaStore) Insert(ctx context.Context, banned *BannedMedia) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if banned.ID.IsZero() {
+		banned.ID = primitive.NewObjectID()
+	}
+	for _, existing := range s.banned {
+		if existing.ID == banned.ID {
+			return errDuplicateID
+		}
+	}
+
+	s.banned = append(s.banned, *banned)
+	return nil
+}
+
+func (s *memoryBannedMediaStore) List(ctx context.Context, listOptions ListOptions) ([]BannedMedia, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return newestPage(slices.Clone(s.banned), func(banned BannedMedia) time.Time { return banned.CreatedTime.Time }, listOptions), nil
+}
+
+func (s *memoryBannedMediaStore) FindBySHA256(ctx context.Context, sha256 string) (*BannedMedia, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, banned := range s.banned {
+		if banned.SHA256 != "" && banned.SHA256 == sha256 {
+			return &banned, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryBannedMediaStore) FindByImageHashBands(ctx context.Context, bands []string) ([]BannedMedia, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matching := []BannedMedia{}
+	for _, banned := range s.banned {
+		if slices.ContainsFunc(banned.ImageHashBands, func(band string) bool { return slices.Contains(bands, band) }) {
+			matching = append(matching, banned)
+		}
+	}
+
+	return matching, nil
+}
+
+type memoryBlockedUploadStore struct {
+	mu      sync.RWMutex
+	blocked []BlockedUpload
+}
+
+func (s *memoryBlockedUploadStore) Insert(ctx context.Context, blocked *BlockedUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if blocked.ID.IsZero() {
+		blocked.ID = primitive.NewObjectID()
+	}
+	for _, existing := range s.blocked {
+		if existing.ID == blocked.ID {
+			return errDuplicateID
+		}
+	}
+
+	s.blocked = append(s.blocked, *blocked)
+	return nil
+}
+
+func (s *memoryBlockedUploadStore) List(ctx context.Context, filter BlockedUploadFilter, listOptions ListOptions) ([]BlockedUpload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blocked := []BlockedUpload{}
+	for _, upload := range s.blocked {
+		if filter.Reviewed == nil || upload.Reviewed == *filter.Reviewed {
+			blocked = append(blocked, upload)
+		}
+	}
+
+	return newestPage(blocked, func(upload BlockedUpload) time.Time { return upload.CreatedTime.Time }, listOptions), nil
+}
+
+func (s *memoryBlockedUploadStore) MarkReviewed(ctx context.Context, id primitive.ObjectID, moderator string, updatedTime utils.Timestamp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, upload := range s.blocked {
+		if upload.ID == id {
+			upload.Reviewed = true
+			upload.ReviewedBy = moderator
+			upload.UpdatedTime = updatedTime
+			s.blocked[i] = upload
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
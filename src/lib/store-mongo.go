@@ -0,0 +1,1054 @@
+package lib
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+func NewMongoStores(client *mongo.Client) Stores {
+	database := infra.Database(client)
+
+	return Stores{
+		Posts:    &mongoPostStore{collection: database.Collection("posts")},
+		Comments: &mongoCommentStore{collection: database.Collection("postComments")},
+		Votes: &mongoVoteStore{collections: map[VoteKind]*mongo.Collection{
+			VoteLike:    database.Collection("postLikes"),
+			VoteDislike: database.Collection("postDislikes"),
+		}},
+		Waifus:     &mongoWaifuStore{collection: database.Collection("waifus")},
+		Ratings:    &mongoRatingStore{collection: database.Collection("waifuRatings")},
+		Favorites:  &mongoFavoriteStore{collection: database.Collection("waifuFavorites")},
+		Traits:     &mongoTraitStore{collection: database.Collection("waifuTraits")},
+		TraitVotes: &mongoTraitVoteStore{collection: database.Collection("waifuTraitVotes")},
+		Leaderboards: &mongoLeaderboardStore{
+			database:   database,
+			collection: database.Collection("waifuLeaderboards"),
+		},
+		WarVotes:        &mongoWarVoteStore{collection: database.Collection("waifuWarVotes")},
+		Tournaments:     &mongoTournamentStore{collection: database.Collection("tournaments")},
+		TournamentVotes: &mongoTournamentVoteStore{collection: database.Collection("tournamentVotes")},
+		Uploads:         &mongoUploadStore{collection: database.Collection("uploads")},
+		BannedMedia:     &mongoBannedMediaStore{collection: database.Collection("bannedMedia")},
+		BlockedUploads:  &mongoBlockedUploadStore{collection: database.Collection("blockedUploads")},
+	}
+}
+
+// Posts and comments are read without the fields that identify who wrote
+// them, nothing that lists them needs those.
+var withoutPrivateFields = bson.M{"userIp": 0, "aniToken": 0, "recaptchaToken": 0}
+
+func newestFirst(listOptions ListOptions) *options.FindOptions {
+	return options.Find().
+		SetSort(bson.D{{Key: "createdTime", Value: -1}}).
+		SetLimit(listOptions.Limit).
+		SetSkip(listOptions.Offset)
+}
+
+func findOne[T any](ctx context.Context, collection *mongo.Collection, filter bson.M, findOptions ...*options.FindOneOptions) (*T, error) {
+	var item T
+	err := collection.FindOne(ctx, filter, findOptions...).Decode(&item)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+func findAll[T any](ctx context.Context, collection *mongo.Collection, filter bson.M, findOptions ...*options.FindOptions) ([]T, error) {
+	cur, err := collection.Find(ctx, filter, findOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []T{}
+	if err := cur.All(ctx, &items); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+type mongoPostStore struct {
+	collection *mongo.Collection
+}
+
+func postFilter(filter PostFilter) bson.M {
+	query := bson.M{}
+	if filter.UserID != "" {
+		query["userId"] = filter.UserID
+	}
+	return query
+}
+
+func (s *mongoPostStore) Get(ctx context.Context, id primitive.ObjectID) (*Post, error) {
+	return findOne[Post](ctx, s.collection, bson.M{"_id": id}, options.FindOne().SetProjection(withoutPrivateFields))
+}
+
+func (s *mongoPostStore) GetMany(ctx context.Context, ids []primitive.ObjectID) ([]Post, error) {
+	return findAll[Post](ctx, s.collection, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(withoutPrivateFields))
+}
+
+func (s *mongoPostStore) List(ctx context.Context, filter PostFilter, listOptions ListOptions) ([]Post, error) {
+	return findAll[Post](ctx, s.collection, postFilter(filter), newestFirst(listOptions).SetProjection(withoutPrivateFields))
+}
+
+func (s *mongoPostStore) Count(ctx context.Context, filter PostFilter) (int64, error) {
+	return s.collection.CountDocuments(ctx, postFilter(filter))
+}
+
+func (s *mongoPostStore) Insert(ctx context.Context, post *Post) error {
+	if post.ID.IsZero() {
+		post.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, post)
+	return err
+}
+
+func (s *mongoPostStore) Increment(ctx context.Context, id primitive.ObjectID, counter PostCounter, updatedTime utils.Timestamp) error {
+	update := bson.M{
+		"$inc": bson.M{string(counter): 1},
+		"$set": bson.M{"updatedTime": updatedTime},
+	}
+
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Hamming distance can't be queried in Mongo, so only the id and hash of each
+// candidate are loaded.
+func (s *mongoPostStore) RecentImageHashes(ctx context.Context, window int64, excludeID primitive.ObjectID) ([]PostImageHash, error) {
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "createdTime", Value: -1}}).
+		SetLimit(window).
+		SetProjection(bson.M{"_id": 1, "imageHash": 1})
+
+	filter := bson.M{"imageHash": bson.M{"$exists": true}, "_id": bson.M{"$ne": excludeID}}
+
+	return findAll[PostImageHash](ctx, s.collection, filter, findOptions)
+}
+
+type mongoCommentStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoCommentStore) ListByTarget(ctx context.Context, target CommentTarget, listOptions ListOptions) ([]PostComment, error) {
+	filter := bson.M{"targetType": target.Type, "targetId": target.ID}
+	return findAll[PostComment](ctx, s.collection, filter, newestFirst(listOptions).SetProjection(withoutPrivateFields))
+}
+
+func (s *mongoCommentStore) Insert(ctx context.Context, comment *PostComment) error {
+	if comment.ID.IsZero() {
+		comment.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, comment)
+	return err
+}
+
+type mongoVoteStore struct {
+	collections map[VoteKind]*mongo.Collection
+}
+
+func (s *mongoVoteStore) HasVoted(ctx context.Context, kind VoteKind, postId string, userIP string, aniToken string) (bool, error) {
+	filter := bson.M{
+		"postId": postId,
+		"$or": []bson.M{
+			{"userIp": userIP},
+			{"aniToken": aniToken},
+		},
+	}
+
+	err := s.collections[kind].FindOne(ctx, filter).Err()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *mongoVoteStore) Insert(ctx context.Context, kind VoteKind, vote *PostVote) error {
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collections[kind].InsertOne(ctx, vote)
+	return err
+}
+
+type mongoWaifuStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoWaifuStore) Get(ctx context.Context, id primitive.ObjectID) (*Waifu, error) {
+	return findOne[Waifu](ctx, s.collection, bson.M{"_id": id})
+}
+
+func (s *mongoWaifuStore) GetMany(ctx context.Context, ids []primitive.ObjectID) ([]Waifu, error) {
+	return findAll[Waifu](ctx, s.collection, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (s *mongoWaifuStore) List(ctx context.Context, filter WaifuFilter, listOptions ListOptions) ([]Waifu, error) {
+	query := bson.M{}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.AniToken != "" {
+		query["aniToken"] = filter.AniToken
+	}
+
+	findOptions := newestFirst(listOptions)
+	switch filter.Sort {
+	case WaifuSortTopRated:
+		findOptions.SetSort(bson.D{{Key: "ratingScore", Value: -1}, {Key: "createdTime", Value: -1}})
+	case WaifuSortElo:
+		findOptions.SetSort(bson.D{{Key: "elo", Value: -1}, {Key: "createdTime", Value: -1}})
+	}
+
+	return findAll[Waifu](ctx, s.collection, query, findOptions)
+}
+
+func (s *mongoWaifuStore) Insert(ctx context.Context, waifu *Waifu) error {
+	if waifu.ID.IsZero() {
+		waifu.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, waifu)
+	return err
+}
+
+func (s *mongoWaifuStore) Transition(ctx context.Context, id primitive.ObjectID, change WaifuStatusChange) error {
+	filter := bson.M{"_id": id, "status": change.From}
+	update := bson.M{
+		"$set":  bson.M{"status": change.To, "updatedTime": change.Time},
+		"$push": bson.M{"statusHistory": change},
+	}
+
+	result, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err := s.collection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrWaifuStatusChanged
+}
+
+func (s *mongoWaifuStore) AddRating(ctx context.Context, id primitive.ObjectID, stars int64, count int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	// The second stage sees the new sum and count, so the average and score
+	// never disagree with them.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"ratingSum":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$ratingSum", 0}}, stars}},
+			"ratingCount": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$ratingCount", 0}}, count}},
+			"updatedTime": updatedTime,
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"rating": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$ratingCount", 0}},
+				bson.M{"$divide": bson.A{"$ratingSum", "$ratingCount"}},
+				0,
+			}},
+			"ratingScore": bson.M{"$divide": bson.A{
+				bson.M{"$add": bson.A{ratingPriorMean * ratingPriorVotes, "$ratingSum"}},
+				bson.M{"$add": bson.A{ratingPriorVotes, "$ratingCount"}},
+			}},
+		}}},
+	}
+
+	var waifu Waifu
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&waifu)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &waifu, nil
+}
+
+func (s *mongoWaifuStore) AddFavorites(ctx context.Context, id primitive.ObjectID, delta int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	update := bson.M{
+		"$inc": bson.M{"favorites": delta},
+		"$set": bson.M{"updatedTime": updatedTime},
+	}
+
+	var waifu Waifu
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&waifu)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &waifu, nil
+}
+
+func (s *mongoWaifuStore) Random(ctx context.Context, status WaifuStatus) (*Waifu, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": status}}},
+		{{Key: "$sample", Value: bson.M{"size": 1}}},
+	}
+
+	cur, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	waifus := []Waifu{}
+	if err := cur.All(ctx, &waifus); err != nil {
+		return nil, err
+	}
+	if len(waifus) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &waifus[0], nil
+}
+
+func (s *mongoWaifuStore) NearestElo(ctx context.Context, status WaifuStatus, elo float64, excludeID primitive.ObjectID, n int64) ([]Waifu, error) {
+	below, err := findAll[Waifu](ctx, s.collection,
+		bson.M{"status": status, "_id": bson.M{"$ne": excludeID}, "elo": bson.M{"$lt": elo}},
+		options.Find().SetSort(bson.D{{Key: "elo", Value: -1}}).SetLimit(n))
+	if err != nil {
+		return nil, err
+	}
+
+	above, err := findAll[Waifu](ctx, s.collection,
+		bson.M{"status": status, "_id": bson.M{"$ne": excludeID}, "elo": bson.M{"$gte": elo}},
+		options.Find().SetSort(bson.D{{Key: "elo", Value: 1}}).SetLimit(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(below, above...), nil
+}
+
+// RecordMatch updates both waifus in a transaction, retried on write
+// conflicts, so a vote never moves one rating without the other. Standalone
+// servers, like a local one, can't run transactions. There both updates are
+// still applied as the same $inc either way, so concurrent votes add up
+// instead of overwriting each other.
+func (s *mongoWaifuStore) RecordMatch(ctx context.Context, winnerID primitive.ObjectID, loserID primitive.ObjectID, updatedTime utils.Timestamp) (*MatchResult, error) {
+	session, err := s.collection.Database().Client().StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	result, err := session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return s.recordMatch(ctx, winnerID, loserID, updatedTime)
+	})
+	if isTransactionsUnsupported(err) {
+		return s.recordMatch(ctx, winnerID, loserID, updatedTime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*MatchResult), nil
+}
+
+func (s *mongoWaifuStore) recordMatch(ctx context.Context, winnerID primitive.ObjectID, loserID primitive.ObjectID, updatedTime utils.Timestamp) (*MatchResult, error) {
+	winner, err := s.Get(ctx, winnerID)
+	if err != nil {
+		return nil, err
+	}
+	loser, err := s.Get(ctx, loserID)
+	if err != nil {
+		return nil, err
+	}
+
+	change := eloChange(winner.Elo, loser.Elo)
+
+	result := &MatchResult{EloChange: change}
+	updates := []struct {
+		id     primitive.ObjectID
+		update bson.M
+		into   *Waifu
+	}{
+		{winnerID, bson.M{"$inc": bson.M{"elo": change, "wins": 1}, "$set": bson.M{"updatedTime": updatedTime}}, &result.Winner},
+		{loserID, bson.M{"$inc": bson.M{"elo": -change, "losses": 1}, "$set": bson.M{"updatedTime": updatedTime}}, &result.Loser},
+	}
+
+	for _, u := range updates {
+		err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": u.id}, u.update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(u.into)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil, ErrNotFound
+			}
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Mongo refuses sessions with transactions outside replica sets and sharded
+// clusters with IllegalOperation.
+func isTransactionsUnsupported(err error) bool {
+	var commandErr mongo.CommandError
+	return errors.As(err, &commandErr) && commandErr.Code == 20
+}
+
+func (s *mongoWaifuStore) AddComments(ctx context.Context, id primitive.ObjectID, delta int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	update := bson.M{
+		"$inc": bson.M{"comments": delta},
+		"$set": bson.M{"updatedTime": updatedTime},
+	}
+
+	var waifu Waifu
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&waifu)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &waifu, nil
+}
+
+// AddTraitVote does what traitMedian does in the second stage, so the
+// median is always that of the histogram it's stored with.
+func (s *mongoWaifuStore) AddTraitVote(ctx context.Context, id primitive.ObjectID, trait string, score int64, replaced int64, updatedTime utils.Timestamp) (*Waifu, error) {
+	field := "traits." + trait
+	histogram := "$" + field + ".histogram"
+	votes := "$" + field + ".votes"
+	scores := bson.M{"$range": bson.A{0, len(emptyHistogram())}}
+
+	var added int64
+	if replaced == noTraitScore {
+		added = 1
+	}
+
+	// The 1-based positions of the middle votes, and the score each falls
+	// on as the votes are counted up.
+	low := bson.M{"$floor": bson.M{"$divide": bson.A{bson.M{"$add": bson.A{votes, 1}}, 2}}}
+	high := bson.M{"$add": bson.A{bson.M{"$floor": bson.M{"$divide": bson.A{votes, 2}}}, 1}}
+	reached := func(name string, position bson.M) bson.M {
+		return bson.M{"$cond": bson.A{
+			bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{"$$value." + name, -1}},
+				bson.M{"$gte": bson.A{"$$seen", position}},
+			}},
+			"$$this",
+			"$$value." + name,
+		}}
+	}
+	middle := bson.M{"$reduce": bson.M{
+		"input":        scores,
+		"initialValue": bson.M{"seen": 0, "low": -1, "high": -1},
+		"in": bson.M{"$let": bson.M{
+			"vars": bson.M{"seen": bson.M{"$add": bson.A{"$$value.seen", bson.M{"$arrayElemAt": bson.A{histogram, "$$this"}}}}},
+			"in":   bson.M{"seen": "$$seen", "low": reached("low", low), "high": reached("high", high)},
+		}},
+	}}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			field + ".histogram": bson.M{"$map": bson.M{
+				"input": scores,
+				"as":    "score",
+				"in": bson.M{"$add": bson.A{
+					bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{histogram, "$$score"}}, 0}},
+					bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$$score", score}}, 1, 0}},
+					bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$$score", replaced}}, -1, 0}},
+				}},
+			}},
+			field + ".votes": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{votes, 0}}, added}},
+			"updatedTime":    updatedTime,
+		}}},
+		{{Key: "$set", Value: bson.M{
+			field + ".median": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{votes, 0}},
+				bson.M{"$let": bson.M{
+					"vars": bson.M{"middle": middle},
+					"in":   bson.M{"$divide": bson.A{bson.M{"$add": bson.A{"$$middle.low", "$$middle.high"}}, 2}},
+				}},
+				0,
+			}},
+		}}},
+	}
+
+	var waifu Waifu
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&waifu)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &waifu, nil
+}
+
+type mongoRatingStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoRatingStore) Find(ctx context.Context, waifuId string, userIP string, aniToken string) (*WaifuRating, error) {
+	filter := bson.M{
+		"waifuId": waifuId,
+		"$or": []bson.M{
+			{"userIp": userIP},
+			{"aniToken": aniToken},
+		},
+	}
+
+	return findOne[WaifuRating](ctx, s.collection, filter)
+}
+
+func (s *mongoRatingStore) Insert(ctx context.Context, rating *WaifuRating) error {
+	if rating.ID.IsZero() {
+		rating.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, rating)
+	return err
+}
+
+func (s *mongoRatingStore) SetStars(ctx context.Context, id primitive.ObjectID, from int64, to int64, updatedTime utils.Timestamp) error {
+	filter := bson.M{"_id": id, "stars": from}
+	update := bson.M{"$set": bson.M{"stars": to, "updatedTime": updatedTime}}
+
+	result, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrRatingChanged
+	}
+
+	return nil
+}
+
+type mongoTraitStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTraitStore) List(ctx context.Context) ([]Trait, error) {
+	return findAll[Trait](ctx, s.collection, bson.M{}, options.Find().SetSort(bson.D{{Key: "createdTime", Value: 1}}))
+}
+
+// Insert relies on the unique key index.
+func (s *mongoTraitStore) Insert(ctx context.Context, trait *Trait) error {
+	if trait.ID.IsZero() {
+		trait.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, trait)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrTraitExists
+	}
+	return err
+}
+
+type mongoTraitVoteStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTraitVoteStore) Find(ctx context.Context, waifuId string, trait string, userIP string, aniToken string) (*WaifuTraitVote, error) {
+	filter := bson.M{
+		"waifuId": waifuId,
+		"trait":   trait,
+		"$or": []bson.M{
+			{"userIp": userIP},
+			{"aniToken": aniToken},
+		},
+	}
+
+	return findOne[WaifuTraitVote](ctx, s.collection, filter)
+}
+
+func (s *mongoTraitVoteStore) Insert(ctx context.Context, vote *WaifuTraitVote) error {
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, vote)
+	return err
+}
+
+func (s *mongoTraitVoteStore) SetScore(ctx context.Context, id primitive.ObjectID, from int64, to int64, updatedTime utils.Timestamp) error {
+	filter := bson.M{"_id": id, "score": from}
+	update := bson.M{"$set": bson.M{"score": to, "updatedTime": updatedTime}}
+
+	result, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrTraitVoteChanged
+	}
+
+	return nil
+}
+
+type mongoFavoriteStore struct {
+	collection *mongo.Collection
+}
+
+// Add relies on the unique waifuId+aniToken index, so two requests at once
+// can't both add the same favorite.
+func (s *mongoFavoriteStore) Add(ctx context.Context, favorite *WaifuFavorite) (bool, error) {
+	if favorite.ID.IsZero() {
+		favorite.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, favorite)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *mongoFavoriteStore) Remove(ctx context.Context, waifuId string, aniToken string) (bool, error) {
+	result, err := s.collection.DeleteOne(ctx, bson.M{"waifuId": waifuId, "aniToken": aniToken})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+func (s *mongoFavoriteStore) Has(ctx context.Context, waifuId string, aniToken string) (bool, error) {
+	count, err := s.collection.CountDocuments(ctx, bson.M{"waifuId": waifuId, "aniToken": aniToken}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *mongoFavoriteStore) List(ctx context.Context, filter FavoriteFilter, listOptions ListOptions) ([]WaifuFavorite, error) {
+	query := bson.M{}
+	if filter.AniToken != "" {
+		query["aniToken"] = filter.AniToken
+	}
+	if filter.UserID != "" {
+		query["userId"] = filter.UserID
+	}
+
+	return findAll[WaifuFavorite](ctx, s.collection, query, newestFirst(listOptions))
+}
+
+type mongoWarVoteStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoWarVoteStore) HasVoted(ctx context.Context, pair string, userIP string, aniToken string, since time.Time) (bool, error) {
+	filter := bson.M{
+		"pair":        pair,
+		"createdTime": bson.M{"$gte": utils.NewTimestamp(since)},
+		"$or": []bson.M{
+			{"userIp": userIP},
+			{"aniToken": aniToken},
+		},
+	}
+
+	count, err := s.collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Insert relies on the unique pair+aniToken+bucket index, so two requests at
+// once can't both count.
+func (s *mongoWarVoteStore) Insert(ctx context.Context, vote *WarVote) error {
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, vote)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrWarVoteExists
+	}
+	return err
+}
+
+func (s *mongoWarVoteStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *mongoWarVoteStore) SetEloChange(ctx context.Context, id primitive.ObjectID, eloChange float64) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"eloChange": eloChange}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoTournamentStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTournamentStore) Get(ctx context.Context, id primitive.ObjectID) (*Tournament, error) {
+	return findOne[Tournament](ctx, s.collection, bson.M{"_id": id})
+}
+
+func (s *mongoTournamentStore) List(ctx context.Context, listOptions ListOptions) ([]Tournament, error) {
+	return findAll[Tournament](ctx, s.collection, bson.M{}, newestFirst(listOptions))
+}
+
+func (s *mongoTournamentStore) Insert(ctx context.Context, tournament *Tournament) error {
+	if tournament.ID.IsZero() {
+		tournament.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, tournament)
+	return err
+}
+
+func (s *mongoTournamentStore) Due(ctx context.Context, now time.Time) ([]Tournament, error) {
+	filter := bson.M{"status": TournamentActive, "roundEndTime": bson.M{"$lte": utils.NewTimestamp(now)}}
+	return findAll[Tournament](ctx, s.collection, filter)
+}
+
+func (s *mongoTournamentStore) Replace(ctx context.Context, tournament *Tournament, round int64) error {
+	filter := bson.M{"_id": tournament.ID, "status": TournamentActive, "currentRound": round}
+
+	result, err := s.collection.ReplaceOne(ctx, filter, tournament)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+
+	count, err := s.collection.CountDocuments(ctx, bson.M{"_id": tournament.ID})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrTournamentChanged
+}
+
+// AddVote increments the slot in place. The filter keeps a vote from landing
+// after the round's window, when the scheduler may already be closing it.
+func (s *mongoTournamentStore) AddVote(ctx context.Context, id primitive.ObjectID, round int64, match int, slot int, votedTime utils.Timestamp) (*Tournament, error) {
+	filter := bson.M{
+		"_id":          id,
+		"status":       TournamentActive,
+		"currentRound": round,
+		"roundEndTime": bson.M{"$gt": votedTime},
+	}
+	update := bson.M{
+		"$inc": bson.M{fmt.Sprintf("rounds.%d.matches.%d.slots.%d.votes", round-1, match, slot): 1},
+		"$set": bson.M{"updatedTime": votedTime},
+	}
+
+	var tournament Tournament
+	err := s.collection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&tournament)
+	if err == nil {
+		return &tournament, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	count, err := s.collection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrNotFound
+	}
+	return nil, ErrVotingClosed
+}
+
+type mongoTournamentVoteStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTournamentVoteStore) HasVoted(ctx context.Context, tournamentId string, matchId string, userIP string, aniToken string) (bool, error) {
+	filter := bson.M{
+		"tournamentId": tournamentId,
+		"matchId":      matchId,
+		"$or": []bson.M{
+			{"userIp": userIP},
+			{"aniToken": aniToken},
+		},
+	}
+
+	count, err := s.collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *mongoTournamentVoteStore) Insert(ctx context.Context, vote *TournamentVote) error {
+	if vote.ID.IsZero() {
+		vote.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, vote)
+	return err
+}
+
+type mongoLeaderboardStore struct {
+	database   *mongo.Database
+	collection *mongo.Collection
+}
+
+// leaderboardSources says where each metric's events are and which of their
+// fields hold the waifu and the time.
+var leaderboardSources = map[LeaderboardMetric]struct {
+	collection string
+	waifuField string
+	timeField  string
+	match      bson.M
+}{
+	LeaderboardRating:    {collection: "waifuRatings", waifuField: "waifuId", timeField: "updatedTime"},
+	LeaderboardFavorites: {collection: "waifuFavorites", waifuField: "waifuId", timeField: "createdTime"},
+	LeaderboardComments:  {collection: "postComments", waifuField: "targetId", timeField: "createdTime", match: bson.M{"targetType": CommentOnWaifu}},
+}
+
+func (s *mongoLeaderboardStore) Tally(ctx context.Context, metric LeaderboardMetric, from time.Time, to time.Time) ([]WaifuTally, error) {
+	source, ok := leaderboardSources[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown leaderboard metric %q", metric)
+	}
+
+	period := bson.M{"$lt": utils.NewTimestamp(to)}
+	if !from.IsZero() {
+		period["$gte"] = utils.NewTimestamp(from)
+	}
+
+	match := bson.M{source.timeField: period}
+	for key, value := range source.match {
+		match[key] = value
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$" + source.waifuField,
+			"count": bson.M{"$sum": 1},
+			"sum":   bson.M{"$sum": "$stars"},
+		}}},
+	}
+
+	cur, err := s.database.Collection(source.collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	tallies := []WaifuTally{}
+	if err := cur.All(ctx, &tallies); err != nil {
+		return nil, err
+	}
+
+	return tallies, nil
+}
+
+func (s *mongoLeaderboardStore) Save(ctx context.Context, board *Leaderboard) error {
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": board.ID}, board, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoLeaderboardStore) Get(ctx context.Context, by LeaderboardMetric, window LeaderboardWindow) (*Leaderboard, error) {
+	return findOne[Leaderboard](ctx, s.collection, bson.M{"_id": leaderboardID(by, window)})
+}
+
+type mongoUploadStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoUploadStore) Insert(ctx context.Context, upload *Upload) error {
+	if upload.ID.IsZero() {
+		upload.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, upload)
+	return err
+}
+
+func (s *mongoUploadStore) Find(ctx context.Context, id primitive.ObjectID, aniToken string) (*Upload, error) {
+	return findOne[Upload](ctx, s.collection, bson.M{"_id": id, "aniToken": aniToken})
+}
+
+func (s *mongoUploadStore) Complete(ctx context.Context, upload *Upload) error {
+	update := bson.M{
+		"$set": bson.M{
+			"status":      UploadComplete,
+			"size":        upload.Size,
+			"url":         upload.URL,
+			"images":      upload.Images,
+			"videoMeta":   upload.VideoMeta,
+			"sha256":      upload.SHA256,
+			"updatedTime": upload.UpdatedTime,
+		},
+	}
+
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": upload.ID, "status": UploadPending}, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrUploadCompleted
+	}
+
+	return nil
+}
+
+func (s *mongoUploadStore) Claim(ctx context.Context, id primitive.ObjectID, aniToken string, updatedTime utils.Timestamp) (*Upload, error) {
+	filter := bson.M{"_id": id, "aniToken": aniToken, "status": UploadComplete}
+	update := bson.M{
+		"$set": bson.M{
+			"status":      UploadAttached,
+			"updatedTime": updatedTime,
+		},
+	}
+
+	var upload Upload
+	err := s.collection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&upload)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ErrUploadNotReady
+		}
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+func (s *mongoUploadStore) ListExpired(ctx context.Context, before time.Time, limit int64) ([]Upload, error) {
+	filter := bson.M{"status": UploadPending, "expiresTime": bson.M{"$lt": before}}
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "expiresTime", Value: 1}}).
+		SetLimit(limit)
+
+	return findAll[Upload](ctx, s.collection, filter, findOptions)
+}
+
+func (s *mongoUploadStore) Expire(ctx context.Context, id primitive.ObjectID, updatedTime utils.Timestamp) error {
+	update := bson.M{
+		"$set": bson.M{
+			"status":      UploadExpired,
+			"updatedTime": updatedTime,
+		},
+	}
+
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id, "status": UploadPending}, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrUploadCompleted
+	}
+
+	return nil
+}
+
+type mongoBannedMediaStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoBannedMediaStore) Insert(ctx context.Context, banned *BannedMedia) error {
+	if banned.ID.IsZero() {
+		banned.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, banned)
+	return err
+}
+
+func (s *mongoBannedMediaStore) List(ctx context.Context, listOptions ListOptions) ([]BannedMedia, error) {
+	return findAll[BannedMedia](ctx, s.collection, bson.M{}, newestFirst(listOptions))
+}
+
+func (s *mongoBannedMediaStore) FindBySHA256(ctx context.Context, sha256 string) (*BannedMedia, error) {
+	return findOne[BannedMedia](ctx, s.collection, bson.M{"sha256": sha256})
+}
+
+func (s *mongoBannedMediaStore) FindByImageHashBands(ctx context.Context, bands []string) ([]BannedMedia, error) {
+	return findAll[BannedMedia](ctx, s.collection, bson.M{"imageHashBands": bson.M{"$in": bands}})
+}
+
+type mongoBlockedUploadStore struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoBlockedUploadStore) Insert(ctx context.Context, blocked *BlockedUpload) error {
+	if blocked.ID.IsZero() {
+		blocked.ID = primitive.NewObjectID()
+	}
+
+	_, err := s.collection.InsertOne(ctx, blocked)
+	return err
+}
+
+func (s *mongoBlockedUploadStore) List(ctx context.Context, filter BlockedUploadFilter, listOptions ListOptions) ([]BlockedUpload, error) {
+	query := bson.M{}
+	if filter.Reviewed != nil {
+		query["reviewed"] = *filter.Reviewed
+	}
+
+	return findAll[BlockedUpload](ctx, s.collection, query, newestFirst(listOptions))
+}
+
+func (s *mongoBlockedUploadStore) MarkReviewed(ctx context.Context, id primitive.ObjectID, moderator string, updatedTime utils.Timestamp) error {
+	update := bson.M{
+		"$set": bson.M{
+			"reviewed":    true,
+			"reviewedBy":  moderator,
+			"updatedTime": updatedTime,
+		},
+	}
+
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type ListOptions struct {
+	Limit  int64
+	Offset int64
+}
+
+func parseListOptions(limit string, offset string) (ListOptions, error) {
+	limitInt, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil {
+		return ListOptions{}, err
+	}
+
+	offsetInt, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return ListOptions{}, err
+	}
+
+	return ListOptions{Limit: limitInt, Offset: offsetInt}, nil
+}
+
+// An empty field matches every post.
+type PostFilter struct {
+	UserID string
+}
+
+type PostCounter string
+
+const (
+	PostLikesCounter    PostCounter = "likes"
+	PostDislikesCounter PostCounter = "dislikes"
+	PostCommentsCounter PostCounter = "comments"
+)
+
+type PostImageHash struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	ImageHash string             `bson:"imageHash"`
+}
+
+// Lists are always newest first. Get returns ErrNotFound for a missing post.
+type PostStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Post, error)
+	GetMany(ctx context.Context, ids []primitive.ObjectID) ([]Post, error)
+	List(ctx context.Context, filter PostFilter, options ListOptions) ([]Post, error)
+	Count(ctx context.Context, filter PostFilter) (int64, error)
+	Insert(ctx context.Context, post *Post) error
+	Increment(ctx context.Context, id primitive.ObjectID, counter PostCounter, updatedTime utils.Timestamp) error
+	// RecentImageHashes returns the hashes of the latest window posts that
+	// have one, leaving out excludeID.
+	RecentImageHashes(ctx context.Context, window int64, excludeID primitive.ObjectID) ([]PostImageHash, error)
+}
+
+// Lists are newest first.
+type CommentStore interface {
+	ListByTarget(ctx context.Context, target CommentTarget, options ListOptions) ([]PostComment, error)
+	Insert(ctx context.Context, comment *PostComment) error
+}
+
+type VoteKind string
+
+const (
+	VoteLike    VoteKind = "like"
+	VoteDislike VoteKind = "dislike"
+)
+
+// PostVote is what gets stored for both kinds of vote, PostLike and
+// PostDislike convert to it directly.
+type PostVote struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	PostId      string             `bson:"postId" json:"postId"`
+	UserID      string             `bson:"userId" json:"userId"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
+
+	UserIP         string `bson:"userIp" json:"userIp"`
+	RecaptchaToken string `bson:"recaptchaToken,omitempty" json:"recaptchaToken"`
+	AniToken       string `bson:"aniToken" json:"aniToken"`
+}
+
+type VoteStore interface {
+	// HasVoted reports whether the IP or the token already cast this kind of
+	// vote on the post.
+	HasVoted(ctx context.Context, kind VoteKind, postId string, userIP string, aniToken string) (bool, error)
+	Insert(ctx context.Context, kind VoteKind, vote *PostVote) error
+}
+
+type WaifuSort string
+
+const (
+	WaifuSortNewest   WaifuSort = "new"
+	WaifuSortTopRated WaifuSort = "top" // by ratingScore, then newest
+	WaifuSortElo      WaifuSort = "elo" // by Waifu Wars Elo, then newest
+)
+
+// An empty field matches every waifu. Sort defaults to newest first.
+type WaifuFilter struct {
+	Status   WaifuStatus
+	AniToken string
+	Sort     WaifuSort
+}
+
+type WaifuStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Waifu, error)
+	// GetMany returns the waifus that exist out of ids, in no particular
+	// order.
+	GetMany(ctx context.Context, ids []primitive.ObjectID) ([]Waifu, error)
+	List(ctx context.Context, filter WaifuFilter, options ListOptions) ([]Waifu, error)
+	Insert(ctx context.Context, waifu *Waifu) error
+	// Transition sets the status to change.To and appends change to the
+	// history, but only while the status is still change.From. Otherwise it
+	// returns ErrWaifuStatusChanged, or ErrNotFound.
+	Transition(ctx context.Context, id primitive.ObjectID, change WaifuStatusChange) error
+	// AddRating adds stars to the rating sum and count to the number of
+	// ratings, recomputes the average and score in the same update and
+	// returns the updated waifu.
+	AddRating(ctx context.Context, id primitive.ObjectID, stars int64, count int64, updatedTime utils.Timestamp) (*Waifu, error)
+	// AddFavorites adds delta to the favorites counter and returns the
+	// updated waifu.
+	AddFavorites(ctx context.Context, id primitive.ObjectID, delta int64, updatedTime utils.Timestamp) (*Waifu, error)
+	// AddComments adds delta to the comments counter and returns the updated
+	// waifu.
+	AddComments(ctx context.Context, id primitive.ObjectID, delta int64, updatedTime utils.Timestamp) (*Waifu, error)
+	// Random returns a random waifu with the status, or ErrNotFound if there
+	// is none.
+	Random(ctx context.Context, status WaifuStatus) (*Waifu, error)
+	// NearestElo returns up to n waifus with the status on either side of
+	// elo, leaving out excludeID.
+	NearestElo(ctx context.Context, status WaifuStatus, elo float64, excludeID primitive.ObjectID, n int64) ([]Waifu, error)
+	// RecordMatch moves Elo from the loser to the winner, based on both
+	// ratings as they are when it runs, and counts the win and the loss.
+	RecordMatch(ctx context.Context, winnerID primitive.ObjectID, loserID primitive.ObjectID, updatedTime utils.Timestamp) (*MatchResult, error)
+	// AddTraitVote counts a score on the trait's histogram, taking back the
+	// replaced score unless it's noTraitScore, recomputes the median in the
+	// same update and returns the updated waifu.
+	AddTraitVote(ctx context.Context, id primitive.ObjectID, trait string, score int64, replaced int64, updatedTime utils.Timestamp) (*Waifu, error)
+}
+
+type RatingStore interface {
+	// Find returns the rating of the waifu by the IP or the token, or
+	// ErrNotFound.
+	Find(ctx context.Context, waifuId string, userIP string, aniToken string) (*WaifuRating, error)
+	Insert(ctx context.Context, rating *WaifuRating) error
+	// SetStars changes a rating from one number of stars to another, or
+	// returns ErrRatingChanged if it no longer has from stars.
+	SetStars(ctx context.Context, id primitive.ObjectID, from int64, to int64, updatedTime utils.Timestamp) error
+}
+
+// Exactly one of the fields is set.
+type FavoriteFilter struct {
+	AniToken string
+	UserID   string
+}
+
+// Lists are newest first. A token favorites a waifu at most once.
+type FavoriteStore interface {
+	// Add reports whether the favorite was added, false if the token
+	// already had it.
+	Add(ctx context.Context, favorite *WaifuFavorite) (bool, error)
+	// Remove reports whether there was a favorite to remove.
+	Remove(ctx context.Context, waifuId string, aniToken string) (bool, error)
+	Has(ctx context.Context, waifuId string, aniToken string) (bool, error)
+	List(ctx context.Context, filter FavoriteFilter, options ListOptions) ([]WaifuFavorite, error)
+}
+
+// Lists are oldest first, the order moderators defined them in.
+type TraitStore interface {
+	List(ctx context.Context) ([]Trait, error)
+	// Insert returns ErrTraitExists if the key is taken.
+	Insert(ctx context.Context, trait *Trait) error
+}
+
+type TraitVoteStore interface {
+	// Find returns the score on the waifu's trait by the IP or the token,
+	// or ErrNotFound.
+	Find(ctx context.Context, waifuId string, trait string, userIP string, aniToken string) (*WaifuTraitVote, error)
+	Insert(ctx context.Context, vote *WaifuTraitVote) error
+	// SetScore changes a vote from one score to another, or returns
+	// ErrTraitVoteChanged if it no longer has the from score.
+	SetScore(ctx context.Context, id primitive.ObjectID, from int64, to int64, updatedTime utils.Timestamp) error
+}
+
+type WarVoteStore interface {
+	// HasVoted reports whether the IP or the token voted on the pair since
+	// the given time.
+	HasVoted(ctx context.Context, pair string, userIP string, aniToken string, since time.Time) (bool, error)
+	// Insert returns ErrWarVoteExists when the token already voted on the
+	// pair in the vote's bucket.
+	Insert(ctx context.Context, vote *WarVote) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	SetEloChange(ctx context.Context, id primitive.ObjectID, eloChange float64) error
+}
+
+type TournamentStore interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*Tournament, error)
+	// List is newest first.
+	List(ctx context.Context, options ListOptions) ([]Tournament, error)
+	Insert(ctx context.Context, tournament *Tournament) error
+	// Due returns the active tournaments whose current round ended before
+	// now.
+	Due(ctx context.Context, now time.Time) ([]Tournament, error)
+	// Replace saves the tournament, but only while its current round is
+	// still round. Otherwise it returns ErrTournamentChanged.
+	Replace(ctx context.Context, tournament *Tournament, round int64) error
+	// AddVote counts a vote for a slot of a match in round, while that is
+	// the current round and its window hasn't ended at votedTime. Otherwise
+	// it returns ErrVotingClosed, or ErrNotFound. Returns the updated
+	// tournament.
+	AddVote(ctx context.Context, id primitive.ObjectID, round int64, match int, slot int, votedTime utils.Timestamp) (*Tournament, error)
+}
+
+type TournamentVoteStore interface {
+	// HasVoted reports whether the IP or the token already voted on the
+	// match.
+	HasVoted(ctx context.Context, tournamentId string, matchId string, userIP string, aniToken string) (bool, error)
+	Insert(ctx context.Context, vote *TournamentVote) error
+}
+
+type LeaderboardStore interface {
+	// Tally groups the metric's events from from up to to by waifu. A zero
+	// from counts everything before to.
+	Tally(ctx context.Context, metric LeaderboardMetric, from time.Time, to time.Time) ([]WaifuTally, error)
+	Save(ctx context.Context, board *Leaderboard) error
+	// Get returns ErrNotFound until the leaderboard was first saved.
+	Get(ctx context.Context, by LeaderboardMetric, window LeaderboardWindow) (*Leaderboard, error)
+}
+
+// Uploads go from pending to complete to attached.
+type UploadStore interface {
+	Insert(ctx context.Context, upload *Upload) error
+	// Find returns the upload if it was started with aniToken, or
+	// ErrNotFound.
+	Find(ctx context.Context, id primitive.ObjectID, aniToken string) (*Upload, error)
+	// Complete saves the processed file of a pending upload and marks it
+	// complete, or returns ErrUploadCompleted if it isn't pending anymore.
+	Complete(ctx context.Context, upload *Upload) error
+	// Claim marks a complete upload started with aniToken as attached and
+	// returns it, or returns ErrUploadNotReady.
+	Claim(ctx context.Context, id primitive.ObjectID, aniToken string, updatedTime utils.Timestamp) (*Upload, error)
+	// ListExpired returns up to limit pending uploads that expired before
+	// the given time, oldest first.
+	ListExpired(ctx context.Context, before time.Time, limit int64) ([]Upload, error)
+	// Expire marks a pending upload expired, or returns ErrUploadCompleted
+	// if it isn't pending anymore.
+	Expire(ctx context.Context, id primitive.ObjectID, updatedTime utils.Timestamp) error
+}
+
+type BannedMediaStore interface {
+	Insert(ctx context.Context, banned *BannedMedia) error
+	// List is newest first.
+	List(ctx context.Context, options ListOptions) ([]BannedMedia, error)
+	// FindBySHA256 returns the ban of the exact file, or ErrNotFound.
+	FindBySHA256(ctx context.Context, sha256 string) (*BannedMedia, error)
+	// FindByImageHashBands returns the bans that share at least one of the
+	// perceptual hash bands.
+	FindByImageHashBands(ctx context.Context, bands []string) ([]BannedMedia, error)
+}
+
+// A nil Reviewed matches both reviewed and unreviewed uploads.
+type BlockedUploadFilter struct {
+	Reviewed *bool
+}
+
+type BlockedUploadStore interface {
+	Insert(ctx context.Context, blocked *BlockedUpload) error
+	// List is newest first.
+	List(ctx context.Context, filter BlockedUploadFilter, options ListOptions) ([]BlockedUpload, error)
+	// MarkReviewed returns ErrNotFound for a missing blocked upload.
+	MarkReviewed(ctx context.Context, id primitive.ObjectID, moderator string, updatedTime utils.Timestamp) error
+}
+
+// Stores bundles the repositories the handlers work against.
+type Stores struct {
+	Posts           PostStore
+	Comments        CommentStore
+	Votes           VoteStore
+	Waifus          WaifuStore
+	Ratings         RatingStore
+	Favorites       FavoriteStore
+	Traits          TraitStore
+	TraitVotes      TraitVoteStore
+	Leaderboards    LeaderboardStore
+	WarVotes        WarVoteStore
+	Tournaments     TournamentStore
+	TournamentVotes TournamentVoteStore
+	Uploads         UploadStore
+	BannedMedia     BannedMediaStore
+	BlockedUploads  BlockedUploadStore
+}
@@ -0,0 +1,523 @@
+package lib
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The Mongo stores only run against a server named by MONGODB_TEST_URI, in
+// a scratch database that is dropped before and after every test.
+const testDatabase = "animoshiApiTest"
+
+var testTime = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// at is minutes after testTime. Mongo keeps milliseconds, so items that
+// have to sort apart are created at different minutes.
+func at(minutes int) utils.Timestamp {
+	return utils.NewTimestamp(testTime.Add(time.Duration(minutes) * time.Minute))
+}
+
+// runOnStores runs test on empty memory stores, and on Mongo when there is
+// one, so both implementations are held to the same behavior.
+func runOnStores(t *testing.T, test func(t *testing.T, stores Stores)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStores())
+	})
+
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		return
+	}
+
+	t.Run("mongo", func(t *testing.T) {
+		client := infra.ConnectToMongo(infra.MongoConfig{URI: uri, Database: testDatabase})
+		database := infra.Database(client)
+
+		drop := func() {
+			if err := database.Drop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		drop()
+		t.Cleanup(func() {
+			drop()
+			client.Disconnect(context.Background())
+		})
+
+		test(t, NewMongoStores(client))
+	})
+}
+
+func postTitles(posts []Post) []string {
+	titles := []string{}
+	for _, post := range posts {
+		titles = append(titles, post.Title)
+	}
+	return titles
+}
+
+func waifuNames(waifus []Waifu) []string {
+	names := []string{}
+	for _, waifu := range waifus {
+		names = append(names, waifu.Name)
+	}
+	return names
+}
+
+func TestPostStore(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+
+		posts := []Post{
+			{Title: "first", UserID: "user-1", ImageHash: "00000000000000ff", CreatedTime: at(0), UserIP: "1.2.3.4", AniToken: "token", RecaptchaToken: "captcha"},
+			{Title: "second", UserID: "user-2", CreatedTime: at(1)},
+			{Title: "third", UserID: "user-1", ImageHash: "000000000000ff00", CreatedTime: at(2)},
+		}
+		for i := range posts {
+			if err := stores.Posts.Insert(ctx, &posts[i]); err != nil {
+				t.Fatal(err)
+			}
+			if posts[i].ID.IsZero() {
+				t.Fatalf("Insert left %q without an ID", posts[i].Title)
+			}
+		}
+
+		post, err := stores.Posts.Get(ctx, posts[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if post.Title != "first" {
+			t.Errorf("Get = %q, want first", post.Title)
+		}
+		if post.UserIP != "" || post.AniToken != "" || post.RecaptchaToken != "" {
+			t.Errorf("Get kept the private fields: %+v", post)
+		}
+		if _, err := stores.Posts.Get(ctx, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a missing post = %v, want ErrNotFound", err)
+		}
+
+		many, err := stores.Posts.GetMany(ctx, []primitive.ObjectID{posts[0].ID, posts[2].ID, primitive.NewObjectID()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(many) != 2 {
+			t.Errorf("GetMany returned %d posts, want 2", len(many))
+		}
+
+		lists := []struct {
+			filter  PostFilter
+			options ListOptions
+			want    []string
+		}{
+			{PostFilter{}, ListOptions{}, []string{"third", "second", "first"}},
+			{PostFilter{}, ListOptions{Limit: 2}, []string{"third", "second"}},
+			{PostFilter{}, ListOptions{Limit: 2, Offset: 2}, []string{"first"}},
+			{PostFilter{}, ListOptions{Offset: 3}, []string{}},
+			{PostFilter{UserID: "user-1"}, ListOptions{}, []string{"third", "first"}},
+		}
+		for _, list := range lists {
+			got, err := stores.Posts.List(ctx, list.filter, list.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if titles := postTitles(got); !slices.Equal(titles, list.want) {
+				t.Errorf("List(%+v, %+v) = %v, want %v", list.filter, list.options, titles, list.want)
+			}
+			for _, post := range got {
+				if post.UserIP != "" || post.AniToken != "" || post.RecaptchaToken != "" {
+					t.Errorf("List kept the private fields: %+v", post)
+				}
+			}
+		}
+
+		for filter, want := range map[PostFilter]int64{{}: 3, {UserID: "user-1"}: 2, {UserID: "nobody"}: 0} {
+			if count, err := stores.Posts.Count(ctx, filter); err != nil || count != want {
+				t.Errorf("Count(%+v) = %d, %v, want %d", filter, count, err, want)
+			}
+		}
+
+		for _, counter := range []PostCounter{PostLikesCounter, PostLikesCounter, PostCommentsCounter} {
+			if err := stores.Posts.Increment(ctx, posts[1].ID, counter, at(3)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		post, err = stores.Posts.Get(ctx, posts[1].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if post.Likes != 2 || post.Dislikes != 0 || post.Comments != 1 || !post.UpdatedTime.Equal(at(3).Time) {
+			t.Errorf("after Increment: likes %d, dislikes %d, comments %d, updated %v", post.Likes, post.Dislikes, post.Comments, post.UpdatedTime)
+		}
+		if err := stores.Posts.Increment(ctx, primitive.NewObjectID(), PostLikesCounter, at(3)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Increment of a missing post = %v, want ErrNotFound", err)
+		}
+
+		hashes, err := stores.Posts.RecentImageHashes(ctx, 10, posts[2].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []PostImageHash{{ID: posts[0].ID, ImageHash: posts[0].ImageHash}}; !slices.Equal(hashes, want) {
+			t.Errorf("RecentImageHashes leaving out third = %v, want %v", hashes, want)
+		}
+
+		hashes, err = stores.Posts.RecentImageHashes(ctx, 1, primitive.NilObjectID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []PostImageHash{{ID: posts[2].ID, ImageHash: posts[2].ImageHash}}; !slices.Equal(hashes, want) {
+			t.Errorf("RecentImageHashes of the latest post = %v, want %v", hashes, want)
+		}
+	})
+}
+
+func TestCommentStore(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+
+		onPost := CommentTarget{Type: CommentOnPost, ID: "target-1"}
+		onWaifu := CommentTarget{Type: CommentOnWaifu, ID: "target-1"}
+
+		comments := []PostComment{
+			{TargetType: onPost.Type, TargetId: onPost.ID, Text: "first", CreatedTime: at(0), UserIP: "1.2.3.4", AniToken: "token", RecaptchaToken: "captcha"},
+			{TargetType: onPost.Type, TargetId: onPost.ID, Text: "second", CreatedTime: at(1)},
+			{TargetType: onWaifu.Type, TargetId: onWaifu.ID, Text: "on a waifu", CreatedTime: at(2)},
+		}
+		for i := range comments {
+			if err := stores.Comments.Insert(ctx, &comments[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lists := []struct {
+			target  CommentTarget
+			options ListOptions
+			want    []string
+		}{
+			{onPost, ListOptions{}, []string{"second", "first"}},
+			{onPost, ListOptions{Limit: 1, Offset: 1}, []string{"first"}},
+			{onWaifu, ListOptions{}, []string{"on a waifu"}},
+			{CommentTarget{Type: CommentOnPost, ID: "target-2"}, ListOptions{}, []string{}},
+		}
+		for _, list := range lists {
+			got, err := stores.Comments.ListByTarget(ctx, list.target, list.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			texts := []string{}
+			for _, comment := range got {
+				texts = append(texts, comment.Text)
+				if comment.UserIP != "" || comment.AniToken != "" || comment.RecaptchaToken != "" {
+					t.Errorf("ListByTarget kept the private fields: %+v", comment)
+				}
+			}
+			if !slices.Equal(texts, list.want) {
+				t.Errorf("ListByTarget(%+v, %+v) = %v, want %v", list.target, list.options, texts, list.want)
+			}
+		}
+	})
+}
+
+func TestVoteStore(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+
+		vote := PostVote{PostId: "post-1", CreatedTime: at(0), UserIP: "1.2.3.4", AniToken: "token"}
+		if err := stores.Votes.Insert(ctx, VoteLike, &vote); err != nil {
+			t.Fatal(err)
+		}
+
+		checks := []struct {
+			kind     VoteKind
+			postId   string
+			userIP   string
+			aniToken string
+			want     bool
+		}{
+			{VoteLike, "post-1", "1.2.3.4", "other-token", true},
+			{VoteLike, "post-1", "5.6.7.8", "token", true},
+			{VoteLike, "post-1", "5.6.7.8", "other-token", false},
+			{VoteLike, "post-2", "1.2.3.4", "token", false},
+			{VoteDislike, "post-1", "1.2.3.4", "token", false},
+		}
+		for _, check := range checks {
+			voted, err := stores.Votes.HasVoted(ctx, check.kind, check.postId, check.userIP, check.aniToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if voted != check.want {
+				t.Errorf("HasVoted(%s, %s, %s, %s) = %v, want %v", check.kind, check.postId, check.userIP, check.aniToken, voted, check.want)
+			}
+		}
+	})
+}
+
+func TestWaifuStore(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+		missing := primitive.NewObjectID()
+
+		waifus := []Waifu{
+			{Name: "pending", Status: WaifuPending, Elo: initialElo, RatingScore: 3, CreatedTime: at(0), AniToken: "token"},
+			{Name: "high", Status: WaifuApproved, Elo: 1600, RatingScore: 4, CreatedTime: at(1)},
+			{Name: "low", Status: WaifuApproved, Elo: 1400, RatingScore: 4, CreatedTime: at(2)},
+		}
+		for i := range waifus {
+			if err := stores.Waifus.Insert(ctx, &waifus[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pending, high, low := waifus[0].ID, waifus[1].ID, waifus[2].ID
+
+		if _, err := stores.Waifus.Get(ctx, missing); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of a missing waifu = %v, want ErrNotFound", err)
+		}
+		many, err := stores.Waifus.GetMany(ctx, []primitive.ObjectID{pending, low, missing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(many) != 2 {
+			t.Errorf("GetMany returned %d waifus, want 2", len(many))
+		}
+
+		lists := []struct {
+			filter  WaifuFilter
+			options ListOptions
+			want    []string
+		}{
+			{WaifuFilter{}, ListOptions{}, []string{"low", "high", "pending"}},
+			{WaifuFilter{Status: WaifuApproved}, ListOptions{}, []string{"low", "high"}},
+			{WaifuFilter{AniToken: "token"}, ListOptions{}, []string{"pending"}},
+			{WaifuFilter{Sort: WaifuSortTopRated}, ListOptions{}, []string{"low", "high", "pending"}},
+			{WaifuFilter{Sort: WaifuSortTopRated}, ListOptions{Limit: 1, Offset: 2}, []string{"pending"}},
+			{WaifuFilter{Status: WaifuApproved, Sort: WaifuSortElo}, ListOptions{}, []string{"high", "low"}},
+		}
+		for _, list := range lists {
+			got, err := stores.Waifus.List(ctx, list.filter, list.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := waifuNames(got); !slices.Equal(names, list.want) {
+				t.Errorf("List(%+v, %+v) = %v, want %v", list.filter, list.options, names, list.want)
+			}
+		}
+
+		change := WaifuStatusChange{From: WaifuPending, To: WaifuApproved, By: "moderator:alice", Time: at(3)}
+		if err := stores.Waifus.Transition(ctx, pending, change); err != nil {
+			t.Fatal(err)
+		}
+		waifu, err := stores.Waifus.Get(ctx, pending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waifu.Status != WaifuApproved || len(waifu.StatusHistory) != 1 || waifu.StatusHistory[0].By != change.By {
+			t.Errorf("after Transition: status %s, history %+v", waifu.Status, waifu.StatusHistory)
+		}
+		if err := stores.Waifus.Transition(ctx, pending, change); !errors.Is(err, ErrWaifuStatusChanged) {
+			t.Errorf("second Transition = %v, want ErrWaifuStatusChanged", err)
+		}
+		if err := stores.Waifus.Transition(ctx, missing, change); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Transition of a missing waifu = %v, want ErrNotFound", err)
+		}
+
+		if _, err := stores.Waifus.AddRating(ctx, low, 5, 1, at(4)); err != nil {
+			t.Fatal(err)
+		}
+		waifu, err = stores.Waifus.AddRating(ctx, low, 3, 1, at(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waifu.RatingSum != 8 || waifu.RatingCount != 2 || waifu.Rating != 4 || math.Abs(waifu.RatingScore-bayesianScore(8, 2)) > 1e-9 {
+			t.Errorf("after AddRating: sum %d, count %d, rating %v, score %v", waifu.RatingSum, waifu.RatingCount, waifu.Rating, waifu.RatingScore)
+		}
+
+		if _, err := stores.Waifus.AddFavorites(ctx, low, 1, at(4)); err != nil {
+			t.Fatal(err)
+		}
+		waifu, err = stores.Waifus.AddFavorites(ctx, low, -1, at(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waifu.Favorites != 0 {
+			t.Errorf("after AddFavorites: %d favorites, want 0", waifu.Favorites)
+		}
+
+		waifu, err = stores.Waifus.AddComments(ctx, low, 2, at(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waifu.Comments != 2 {
+			t.Errorf("after AddComments: %d comments, want 2", waifu.Comments)
+		}
+
+		if _, err := stores.Waifus.AddRating(ctx, missing, 5, 1, at(4)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddRating of a missing waifu = %v, want ErrNotFound", err)
+		}
+		if _, err := stores.Waifus.AddFavorites(ctx, missing, 1, at(4)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddFavorites of a missing waifu = %v, want ErrNotFound", err)
+		}
+		if _, err := stores.Waifus.AddComments(ctx, missing, 1, at(4)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddComments of a missing waifu = %v, want ErrNotFound", err)
+		}
+
+		waifu, err = stores.Waifus.Random(ctx, WaifuApproved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waifu.Status != WaifuApproved {
+			t.Errorf("Random(approved) = %s waifu", waifu.Status)
+		}
+		if _, err := stores.Waifus.Random(ctx, WaifuRejected); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Random(rejected) = %v, want ErrNotFound", err)
+		}
+
+		neighbors, err := stores.Waifus.NearestElo(ctx, WaifuApproved, 1450, primitive.NilObjectID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := waifuNames(neighbors); !slices.Equal(names, []string{"low", "pending"}) {
+			t.Errorf("NearestElo(1450, n 1) = %v, want [low pending]", names)
+		}
+		neighbors, err = stores.Waifus.NearestElo(ctx, WaifuApproved, initialElo, pending, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := waifuNames(neighbors); !slices.Equal(names, []string{"low", "high"}) {
+			t.Errorf("NearestElo leaving out pending = %v, want [low high]", names)
+		}
+
+		// The underdog winning moves more than K/2.
+		result, err := stores.Waifus.RecordMatch(ctx, low, high, at(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := eloChange(1400, 1600)
+		if math.Abs(result.EloChange-want) > 1e-9 || want <= eloK/2 {
+			t.Errorf("RecordMatch moved %v Elo, want %v", result.EloChange, want)
+		}
+		if math.Abs(result.Winner.Elo-(1400+want)) > 1e-9 || result.Winner.Wins != 1 {
+			t.Errorf("winner after RecordMatch: elo %v, wins %d", result.Winner.Elo, result.Winner.Wins)
+		}
+		loser, err := stores.Waifus.Get(ctx, high)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(loser.Elo-(1600-want)) > 1e-9 || loser.Losses != 1 {
+			t.Errorf("loser after RecordMatch: elo %v, losses %d", loser.Elo, loser.Losses)
+		}
+		if _, err := stores.Waifus.RecordMatch(ctx, low, missing, at(5)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("RecordMatch against a missing waifu = %v, want ErrNotFound", err)
+		}
+
+		votes := []struct {
+			score    int64
+			replaced int64
+			votes    int64
+			median   float64
+		}{
+			{7, noTraitScore, 1, 7},
+			{3, noTraitScore, 2, 5},
+			{9, noTraitScore, 3, 7},
+			{9, 3, 3, 9}, // the 3 changed its mind
+			{1, noTraitScore, 4, 8},
+		}
+		for _, vote := range votes {
+			waifu, err = stores.Waifus.AddTraitVote(ctx, low, "mommyMeter", vote.score, vote.replaced, at(6))
+			if err != nil {
+				t.Fatal(err)
+			}
+			meter := waifu.Traits["mommyMeter"]
+			if meter.Votes != vote.votes || meter.Median != vote.median {
+				t.Errorf("after voting %d over %d: %d votes, median %v, want %d, %v", vote.score, vote.replaced, meter.Votes, meter.Median, vote.votes, vote.median)
+			}
+		}
+		if histogram := waifu.Traits["mommyMeter"].Histogram; !slices.Equal(histogram, []int64{0, 1, 0, 0, 0, 0, 0, 1, 0, 2, 0}) {
+			t.Errorf("histogram = %v", histogram)
+		}
+		if _, err := stores.Waifus.AddTraitVote(ctx, missing, "mommyMeter", 5, noTraitScore, at(6)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddTraitVote of a missing waifu = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestWarVoteStore(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+
+		// Mongo holds to one vote per bucket through its index.
+		if mongoStore, ok := stores.WarVotes.(*mongoWarVoteStore); ok {
+			if err := uniqueWarVotes(ctx, mongoStore.collection.Database()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		vote := WarVote{Pair: "a:b", WinnerId: "a", LoserId: "b", CreatedTime: at(0), Bucket: 1, UserIP: "1.2.3.4", AniToken: "token"}
+		if err := stores.WarVotes.Insert(ctx, &vote); err != nil {
+			t.Fatal(err)
+		}
+
+		inserts := []struct {
+			vote WarVote
+			want error
+		}{
+			{WarVote{Pair: "a:b", Bucket: 1, AniToken: "token"}, ErrWarVoteExists},
+			{WarVote{Pair: "a:b", Bucket: 2, AniToken: "token"}, nil},
+			{WarVote{Pair: "a:c", Bucket: 1, AniToken: "token"}, nil},
+			{WarVote{Pair: "a:b", Bucket: 1, AniToken: "other-token"}, nil},
+			{WarVote{Pair: "a:b", AniToken: "token"}, nil}, // no cooldown
+			{WarVote{Pair: "a:b", AniToken: "token"}, nil},
+		}
+		for _, insert := range inserts {
+			if err := stores.WarVotes.Insert(ctx, &insert.vote); !errors.Is(err, insert.want) {
+				t.Errorf("Insert(%s, bucket %d, %s) = %v, want %v", insert.vote.Pair, insert.vote.Bucket, insert.vote.AniToken, err, insert.want)
+			}
+		}
+
+		checks := []struct {
+			pair     string
+			userIP   string
+			aniToken string
+			since    int
+			want     bool
+		}{
+			{"a:b", "1.2.3.4", "other-token", 0, true},
+			{"a:b", "5.6.7.8", "token", 0, true},
+			{"a:b", "1.2.3.4", "token", 1, false},
+			{"a:c", "1.2.3.4", "other-token", 0, false},
+		}
+		for _, check := range checks {
+			voted, err := stores.WarVotes.HasVoted(ctx, check.pair, check.userIP, check.aniToken, at(check.since).Time)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if voted != check.want {
+				t.Errorf("HasVoted(%s, %s, %s, at(%d)) = %v, want %v", check.pair, check.userIP, check.aniToken, check.since, voted, check.want)
+			}
+		}
+
+		if err := stores.WarVotes.SetEloChange(ctx, vote.ID, 16); err != nil {
+			t.Fatal(err)
+		}
+
+		// A deleted vote no longer holds its bucket.
+		if err := stores.WarVotes.Delete(ctx, vote.ID); err != nil {
+			t.Fatal(err)
+		}
+		again := WarVote{Pair: "a:b", Bucket: 1, AniToken: "token"}
+		if err := stores.WarVotes.Insert(ctx, &again); err != nil {
+			t.Errorf("Insert after Delete = %v", err)
+		}
+		if err := stores.WarVotes.SetEloChange(ctx, vote.ID, 16); !errors.Is(err, ErrNotFound) {
+			t.Errorf("SetEloChange of a deleted vote = %v, want ErrNotFound", err)
+		}
+	})
+}
@@ -0,0 +1,513 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type TournamentStatus string
+
+const (
+	TournamentActive   TournamentStatus = "active"
+	TournamentFinished TournamentStatus = "finished"
+)
+
+type RoundStatus string
+
+const (
+	RoundPending RoundStatus = "pending" // waiting for the previous round
+	RoundOpen    RoundStatus = "open"
+	RoundClosed  RoundStatus = "closed"
+)
+
+const (
+	minTournamentWaifus = 2
+	maxTournamentWaifus = 64
+	maxRoundHours       = 14 * 24
+)
+
+var (
+	// The round being closed was already closed by another instance.
+	ErrTournamentChanged = errors.New("the tournament was changed by someone else")
+	ErrVotingClosed      = errors.New("voting on this match is closed")
+)
+
+type TournamentConfig struct {
+	CheckInterval time.Duration `yaml:"checkInterval" env:"TOURNAMENT_CHECK_INTERVAL"` // how often rounds whose window is over get closed
+}
+
+var DefaultTournamentConfig = TournamentConfig{
+	CheckInterval: time.Minute,
+}
+
+type TournamentRequest struct {
+	Name       string           `json:"name"`
+	Season     string           `json:"season"`
+	WaifuIds   []string         `json:"waifuIds"` // in seed order, the first is seed 1
+	RoundHours int64            `json:"roundHours"`
+	StartTime  *utils.Timestamp `json:"startTime"` // now if left out
+}
+
+// TournamentEntrant is a waifu as she was when the tournament was created,
+// so the bracket still renders if she's renamed or taken down later.
+type TournamentEntrant struct {
+	Seed    int64  `bson:"seed" json:"seed"`
+	WaifuId string `bson:"waifuId" json:"waifuId"`
+	Name    string `bson:"name" json:"name"`
+	Image   string `bson:"image" json:"image"`
+}
+
+// An empty slot is a bye in the first round, or a winner that isn't known
+// yet in later ones.
+type TournamentSlot struct {
+	Seed    int64  `bson:"seed,omitempty" json:"seed,omitempty"`
+	WaifuId string `bson:"waifuId,omitempty" json:"waifuId,omitempty"`
+	Votes   int64  `bson:"votes" json:"votes"`
+}
+
+type TournamentMatch struct {
+	ID       string           `bson:"id" json:"id"`
+	Slots    []TournamentSlot `bson:"slots" json:"slots"` // always two
+	WinnerId string           `bson:"winnerId,omitempty" json:"winnerId,omitempty"`
+	Bye      bool             `bson:"bye,omitempty" json:"bye,omitempty"` // won without a vote
+}
+
+type TournamentRound struct {
+	Number    int64             `bson:"number" json:"number"`
+	Status    RoundStatus       `bson:"status" json:"status"`
+	StartTime *utils.Timestamp  `bson:"startTime,omitempty" json:"startTime,omitempty"`
+	EndTime   *utils.Timestamp  `bson:"endTime,omitempty" json:"endTime,omitempty"`
+	Matches   []TournamentMatch `bson:"matches" json:"matches"`
+}
+
+// Tournament holds the whole bracket. Every round exists from the start,
+// later ones fill up as winners advance.
+type Tournament struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"_id"`
+	Name         string              `bson:"name" json:"name"`
+	Season       string              `bson:"season" json:"season"`
+	Status       TournamentStatus    `bson:"status" json:"status"`
+	RoundHours   int64               `bson:"roundHours" json:"roundHours"`
+	Entrants     []TournamentEntrant `bson:"entrants" json:"entrants"`
+	Rounds       []TournamentRound   `bson:"rounds" json:"rounds"`
+	CurrentRound int64               `bson:"currentRound" json:"currentRound"`
+	WinnerId     string              `bson:"winnerId,omitempty" json:"winnerId,omitempty"`
+	CreatedBy    string              `bson:"createdBy" json:"createdBy"`
+	CreatedTime  utils.Timestamp     `bson:"createdTime" json:"createdTime"`
+	UpdatedTime  utils.Timestamp     `bson:"updatedTime" json:"updatedTime"`
+
+	// When the current round closes, what the scheduler looks for.
+	RoundEndTime utils.Timestamp `bson:"roundEndTime" json:"-"`
+}
+
+type TournamentVoteRequest struct {
+	MatchId        string `json:"matchId"`
+	WaifuId        string `json:"waifuId"`
+	RecaptchaToken string `json:"recaptchaToken"`
+	AniToken       string `json:"aniToken"`
+}
+
+type TournamentVote struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	TournamentId string             `bson:"tournamentId" json:"tournamentId"`
+	MatchId      string             `bson:"matchId" json:"matchId"`
+	WaifuId      string             `bson:"waifuId" json:"waifuId"`
+	CreatedTime  utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+
+	UserIP   string `bson:"userIp" json:"-"`
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+// clone copies the bracket too, so changing the copy leaves t alone.
+func (t Tournament) clone() Tournament {
+	t.Entrants = slices.Clone(t.Entrants)
+	t.Rounds = slices.Clone(t.Rounds)
+	for i, round := range t.Rounds {
+		round.Matches = slices.Clone(round.Matches)
+		for j, match := range round.Matches {
+			round.Matches[j].Slots = slices.Clone(match.Slots)
+		}
+		t.Rounds[i] = round
+	}
+	return t
+}
+
+func tournamentInFormat(tournament Tournament, format utils.TimestampFormat) Tournament {
+	tournament = tournament.clone()
+	tournament.CreatedTime = tournament.CreatedTime.In(format)
+	tournament.UpdatedTime = tournament.UpdatedTime.In(format)
+	for i, round := range tournament.Rounds {
+		if round.StartTime != nil {
+			startTime := round.StartTime.In(format)
+			tournament.Rounds[i].StartTime = &startTime
+		}
+		if round.EndTime != nil {
+			endTime := round.EndTime.In(format)
+			tournament.Rounds[i].EndTime = &endTime
+		}
+	}
+	return tournament
+}
+
+// bracketOrder lists the seeds in bracket order for size slots, so that
+// 1 meets size in the first round and 1 and 2 can only meet in the final.
+func bracketOrder(size int) []int64 {
+	order := []int64{1}
+	for len(order) < size {
+		next := make([]int64, 0, len(order)*2)
+		for _, seed := range order {
+			next = append(next, seed, int64(len(order)*2+1)-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// newBracket lays out every round. Missing seeds up to the next power of
+// two are byes, and the seeds they would have met go through right away.
+func newBracket(entrants []TournamentEntrant, start utils.Timestamp, roundHours int64) []TournamentRound {
+	size := 1
+	for size < len(entrants) {
+		size *= 2
+	}
+
+	var rounds []TournamentRound
+	for number, matches := int64(1), size/2; matches > 0; number, matches = number+1, matches/2 {
+		round := TournamentRound{Number: number, Status: RoundPending, Matches: make([]TournamentMatch, matches)}
+		for i := range round.Matches {
+			round.Matches[i] = TournamentMatch{
+				ID:    fmt.Sprintf("r%dm%d", number, i+1),
+				Slots: []TournamentSlot{{}, {}},
+			}
+		}
+		rounds = append(rounds, round)
+	}
+
+	order := bracketOrder(size)
+	first := &rounds[0]
+	for i := range first.Matches {
+		match := &first.Matches[i]
+		for slot, seed := range order[i*2 : i*2+2] {
+			if seed <= int64(len(entrants)) {
+				match.Slots[slot] = TournamentSlot{Seed: seed, WaifuId: entrants[seed-1].WaifuId}
+			}
+		}
+
+		if match.Slots[0].WaifuId == "" || match.Slots[1].WaifuId == "" {
+			match.Bye = true
+			match.WinnerId = match.Slots[0].WaifuId + match.Slots[1].WaifuId
+		}
+	}
+
+	end := utils.NewTimestamp(start.Add(time.Duration(roundHours) * time.Hour))
+	first.Status = RoundOpen
+	first.StartTime = &start
+	first.EndTime = &end
+
+	return rounds
+}
+
+// matchWinner is the slot with the most votes, the better seed on a tie.
+func matchWinner(match TournamentMatch) TournamentSlot {
+	a, b := match.Slots[0], match.Slots[1]
+	if match.WinnerId != "" {
+		if b.WaifuId == match.WinnerId {
+			return b
+		}
+		return a
+	}
+
+	if b.Votes > a.Votes || (b.Votes == a.Votes && b.Seed < a.Seed) {
+		return b
+	}
+	return a
+}
+
+// closeRound decides the current round and opens the next one, or finishes
+// the tournament after the final.
+func closeRound(tournament *Tournament, now utils.Timestamp) {
+	round := &tournament.Rounds[tournament.CurrentRound-1]
+	round.Status = RoundClosed
+
+	var next *TournamentRound
+	if int(tournament.CurrentRound) < len(tournament.Rounds) {
+		next = &tournament.Rounds[tournament.CurrentRound]
+	}
+
+	for i := range round.Matches {
+		winner := matchWinner(round.Matches[i])
+		round.Matches[i].WinnerId = winner.WaifuId
+
+		if next != nil {
+			next.Matches[i/2].Slots[i%2] = TournamentSlot{Seed: winner.Seed, WaifuId: winner.WaifuId}
+		}
+	}
+
+	tournament.UpdatedTime = now
+
+	if next == nil {
+		tournament.Status = TournamentFinished
+		tournament.WinnerId = round.Matches[0].WinnerId
+		return
+	}
+
+	end := utils.NewTimestamp(now.Add(time.Duration(tournament.RoundHours) * time.Hour))
+	next.Status = RoundOpen
+	next.StartTime = &now
+	next.EndTime = &end
+	tournament.CurrentRound++
+	tournament.RoundEndTime = end
+}
+
+// CloseDueRounds closes every round whose voting window is over.
+func CloseDueRounds(ctx context.Context, stores Stores, now utils.Timestamp) error {
+	due, err := stores.Tournaments.Due(ctx, now.Time)
+	if err != nil {
+		return err
+	}
+
+	for _, tournament := range due {
+		round := tournament.CurrentRound
+		closeRound(&tournament, now)
+
+		err := stores.Tournaments.Replace(ctx, &tournament, round)
+		if err != nil && !errors.Is(err, ErrTournamentChanged) {
+			return fmt.Errorf("closing round %d of tournament %s: %w", round, tournament.ID.Hex(), err)
+		}
+	}
+
+	return nil
+}
+
+// RunTournamentScheduler closes due rounds right away and then every
+// CheckInterval until ctx is done. Instances racing for the same round are
+// fine, only the first one's result is saved.
+func RunTournamentScheduler(ctx context.Context, stores Stores, config TournamentConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := CloseDueRounds(ctx, stores, utils.Now()); err != nil {
+			log.Println("Error closing tournament rounds:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func CreateTournament(c echo.Context, stores Stores, tournamentRequest *TournamentRequest) error {
+	now := utils.Now()
+
+	name := sanitizeInput(tournamentRequest.Name)
+	if name == "" {
+		return utils.ValidationFailed("name", "Name is required!")
+	}
+	if len(name) > 100 {
+		return utils.ValidationFailed("name", "Name is too long")
+	}
+
+	if len(tournamentRequest.Season) > 50 {
+		return utils.ValidationFailed("season", "Season is too long")
+	}
+
+	if tournamentRequest.RoundHours < 1 || tournamentRequest.RoundHours > maxRoundHours {
+		return utils.ValidationFailed("roundHours", fmt.Sprintf("Rounds must last between 1 and %d hours", maxRoundHours))
+	}
+
+	count := len(tournamentRequest.WaifuIds)
+	if count < minTournamentWaifus || count > maxTournamentWaifus {
+		return utils.ValidationFailed("waifuIds", fmt.Sprintf("A tournament needs between %d and %d waifus", minTournamentWaifus, maxTournamentWaifus))
+	}
+
+	ids := make([]primitive.ObjectID, 0, count)
+	for _, id := range tournamentRequest.WaifuIds {
+		waifuID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return utils.ValidationFailed("waifuIds", "Invalid waifu id "+id)
+		}
+		if slices.Contains(ids, waifuID) {
+			return utils.ValidationFailed("waifuIds", "Waifu "+id+" is seeded twice")
+		}
+		ids = append(ids, waifuID)
+	}
+
+	found, err := stores.Waifus.GetMany(c.Request().Context(), ids)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	byID := make(map[primitive.ObjectID]Waifu, len(found))
+	for _, waifu := range found {
+		byID[waifu.ID] = waifu
+	}
+
+	entrants := make([]TournamentEntrant, 0, count)
+	for i, id := range ids {
+		waifu, ok := byID[id]
+		if !ok || waifu.Status != WaifuApproved {
+			return utils.ValidationFailed("waifuIds", "Waifu "+id.Hex()+" isn't an approved waifu")
+		}
+		entrants = append(entrants, TournamentEntrant{Seed: int64(i + 1), WaifuId: id.Hex(), Name: waifu.Name, Image: waifu.Image})
+	}
+
+	start := now
+	if tournamentRequest.StartTime != nil && tournamentRequest.StartTime.After(now.Time) {
+		start = utils.NewTimestamp(tournamentRequest.StartTime.Time)
+	}
+
+	tournament := Tournament{
+		ID:           primitive.NewObjectID(),
+		Name:         name,
+		Season:       sanitizeInput(tournamentRequest.Season),
+		Status:       TournamentActive,
+		RoundHours:   tournamentRequest.RoundHours,
+		Entrants:     entrants,
+		Rounds:       newBracket(entrants, start, tournamentRequest.RoundHours),
+		CurrentRound: 1,
+		CreatedBy:    "moderator:" + utils.GetModerator(c),
+		CreatedTime:  now,
+		UpdatedTime:  now,
+	}
+	tournament.RoundEndTime = *tournament.Rounds[0].EndTime
+
+	if err := stores.Tournaments.Insert(c.Request().Context(), &tournament); err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, tournamentInFormat(tournament, utils.ResponseTimestampFormat(c)))
+}
+
+// GetTournaments lists tournaments newest first, with their brackets.
+func GetTournaments(c echo.Context, stores Stores) error {
+	listOptions, err := waifuListOptions(c)
+	if err != nil {
+		return err
+	}
+
+	tournaments, err := stores.Tournaments.List(c.Request().Context(), listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	for i, tournament := range tournaments {
+		tournaments[i] = tournamentInFormat(tournament, format)
+	}
+
+	return c.JSON(http.StatusOK, tournaments)
+}
+
+func GetTournament(c echo.Context, stores Stores, id string) error {
+	tournamentID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Tournament not found")
+	}
+
+	tournament, err := stores.Tournaments.Get(c.Request().Context(), tournamentID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Tournament not found")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, tournamentInFormat(*tournament, utils.ResponseTimestampFormat(c)))
+}
+
+// VoteTournament counts a vote for one side of a match in the open round.
+// A voter, by IP or token, votes once per match.
+func VoteTournament(c echo.Context, stores Stores, id string, voteRequest *TournamentVoteRequest) error {
+	now := utils.Now()
+
+	if voteRequest.AniToken == "" {
+		return utils.ValidationFailed("aniToken", "Token is required!")
+	}
+
+	if err := utils.CheckRecaptcha(voteRequest.RecaptchaToken); err != nil {
+		return err
+	}
+
+	tournamentID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Tournament not found")
+	}
+
+	tournament, err := stores.Tournaments.Get(c.Request().Context(), tournamentID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Tournament not found")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	matchIndex, slotIndex := -1, -1
+	round := tournament.Rounds[tournament.CurrentRound-1]
+	for i, match := range round.Matches {
+		if match.ID != voteRequest.MatchId {
+			continue
+		}
+		matchIndex = i
+		for j, slot := range match.Slots {
+			if slot.WaifuId != "" && slot.WaifuId == voteRequest.WaifuId {
+				slotIndex = j
+			}
+		}
+	}
+
+	if matchIndex < 0 {
+		return utils.Conflict(utils.CodeVotingClosed, "This match isn't open for voting")
+	}
+	if slotIndex < 0 {
+		return utils.ValidationFailed("waifuId", "That waifu isn't in this match")
+	}
+	if tournament.Status != TournamentActive || round.Matches[matchIndex].Bye || now.Before(round.StartTime.Time) || !now.Before(round.EndTime.Time) {
+		return utils.Conflict(utils.CodeVotingClosed, "This match isn't open for voting")
+	}
+
+	vote := TournamentVote{
+		ID:           primitive.NewObjectID(),
+		TournamentId: id,
+		MatchId:      voteRequest.MatchId,
+		WaifuId:      voteRequest.WaifuId,
+		CreatedTime:  now,
+		UserIP:       utils.GetUserIP(c),
+		AniToken:     voteRequest.AniToken,
+	}
+
+	voted, err := stores.TournamentVotes.HasVoted(c.Request().Context(), id, vote.MatchId, vote.UserIP, vote.AniToken)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+	if voted {
+		return utils.Conflict(utils.CodeAlreadyVoted, "You have already voted on this match")
+	}
+
+	updated, err := stores.Tournaments.AddVote(c.Request().Context(), tournamentID, tournament.CurrentRound, matchIndex, slotIndex, now)
+	if err != nil {
+		if errors.Is(err, ErrVotingClosed) {
+			return utils.Conflict(utils.CodeVotingClosed, "This match isn't open for voting")
+		}
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Tournament not found")
+		}
+		return utils.InternalError(err, "Failed to count the vote")
+	}
+
+	if err := stores.TournamentVotes.Insert(c.Request().Context(), &vote); err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, updated.Rounds[updated.CurrentRound-1].Matches[matchIndex])
+}
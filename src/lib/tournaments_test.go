@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testTournament is a tournament of count waifus the way CreateTournament
+// sets one up, with w1 as seed 1. Its first round ends at(roundMinutes).
+func testTournament(count int, roundMinutes int) Tournament {
+	entrants := make([]TournamentEntrant, count)
+	for i := range entrants {
+		entrants[i] = TournamentEntrant{Seed: int64(i + 1), WaifuId: fmt.Sprintf("w%d", i+1)}
+	}
+
+	tournament := Tournament{
+		ID:           primitive.NewObjectID(),
+		Name:         "Cup",
+		Status:       TournamentActive,
+		RoundHours:   1,
+		Entrants:     entrants,
+		Rounds:       newBracket(entrants, at(roundMinutes-60), 1),
+		CurrentRound: 1,
+		CreatedTime:  at(0),
+		UpdatedTime:  at(0),
+	}
+	tournament.RoundEndTime = *tournament.Rounds[0].EndTime
+	return tournament
+}
+
+// matchSeeds lists the seeds of every match of a round, 0 for an empty slot.
+func matchSeeds(round TournamentRound) [][2]int64 {
+	seeds := [][2]int64{}
+	for _, match := range round.Matches {
+		seeds = append(seeds, [2]int64{match.Slots[0].Seed, match.Slots[1].Seed})
+	}
+	return seeds
+}
+
+func TestBracketOrder(t *testing.T) {
+	if got, want := bracketOrder(8), []int64{1, 8, 4, 5, 2, 7, 3, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bracketOrder(8) = %v, want %v", got, want)
+	}
+}
+
+func TestNewBracket(t *testing.T) {
+	tests := []struct {
+		entrants int
+		rounds   int
+		first    [][2]int64
+		byes     []string // winners of the first round decided up front
+	}{
+		{3, 2, [][2]int64{{1, 0}, {2, 3}}, []string{"w1", ""}},
+		{5, 3, [][2]int64{{1, 0}, {4, 5}, {2, 0}, {3, 0}}, []string{"w1", "", "w2", "w3"}},
+		{8, 3, [][2]int64{{1, 8}, {4, 5}, {2, 7}, {3, 6}}, []string{"", "", "", ""}},
+	}
+
+	for _, test := range tests {
+		tournament := testTournament(test.entrants, 60)
+		rounds := tournament.Rounds
+
+		if len(rounds) != test.rounds {
+			t.Errorf("%d entrants: %d rounds, want %d", test.entrants, len(rounds), test.rounds)
+			continue
+		}
+		if got := matchSeeds(rounds[0]); !reflect.DeepEqual(got, test.first) {
+			t.Errorf("%d entrants: first round %v, want %v", test.entrants, got, test.first)
+		}
+
+		for i, match := range rounds[0].Matches {
+			if match.WinnerId != test.byes[i] || match.Bye != (test.byes[i] != "") {
+				t.Errorf("%d entrants: match %s won by %q (bye %v), want %q", test.entrants, match.ID, match.WinnerId, match.Bye, test.byes[i])
+			}
+		}
+
+		if rounds[0].Status != RoundOpen || !rounds[0].EndTime.Equal(at(60).Time) {
+			t.Errorf("%d entrants: first round %s until %v", test.entrants, rounds[0].Status, rounds[0].EndTime)
+		}
+		for _, round := range rounds[1:] {
+			if round.Status != RoundPending || round.StartTime != nil {
+				t.Errorf("%d entrants: round %d is %s from %v", test.entrants, round.Number, round.Status, round.StartTime)
+			}
+		}
+	}
+}
+
+// With no votes every match goes to the better seed, so seeds 1 and 2
+// have to be the last two standing and must not meet any earlier.
+func TestBracketSeedsOneAndTwoMeetInTheFinal(t *testing.T) {
+	for count := 2; count <= maxTournamentWaifus; count++ {
+		tournament := testTournament(count, 60)
+
+		for tournament.Status == TournamentActive {
+			round := tournament.Rounds[tournament.CurrentRound-1]
+			final := int(round.Number) == len(tournament.Rounds)
+
+			for _, match := range round.Matches {
+				met := match.Slots[0].Seed*match.Slots[1].Seed == 2
+				if met != final {
+					t.Fatalf("%d entrants: round %d match %v", count, round.Number, matchSeeds(round))
+				}
+			}
+
+			closeRound(&tournament, at(int(round.Number)*60))
+		}
+
+		if tournament.WinnerId != "w1" {
+			t.Errorf("%d entrants: won by %s, want w1", count, tournament.WinnerId)
+		}
+	}
+}
+
+func TestMatchWinner(t *testing.T) {
+	tests := []struct {
+		name  string
+		match TournamentMatch
+		want  string
+	}{
+		{"more votes", TournamentMatch{Slots: []TournamentSlot{{Seed: 1, WaifuId: "w1", Votes: 2}, {Seed: 8, WaifuId: "w8", Votes: 3}}}, "w8"},
+		{"tie goes to the better seed", TournamentMatch{Slots: []TournamentSlot{{Seed: 5, WaifuId: "w5", Votes: 3}, {Seed: 4, WaifuId: "w4", Votes: 3}}}, "w4"},
+		{"tie without votes", TournamentMatch{Slots: []TournamentSlot{{Seed: 4, WaifuId: "w4"}, {Seed: 5, WaifuId: "w5"}}}, "w4"},
+		{"bye", TournamentMatch{Slots: []TournamentSlot{{}, {Seed: 2, WaifuId: "w2"}}, WinnerId: "w2", Bye: true}, "w2"},
+	}
+
+	for _, test := range tests {
+		if got := matchWinner(test.match); got.WaifuId != test.want {
+			t.Errorf("%s: won by %s, want %s", test.name, got.WaifuId, test.want)
+		}
+	}
+}
+
+func TestCloseRound(t *testing.T) {
+	tournament := testTournament(3, 60)
+
+	closeRound(&tournament, at(60))
+
+	first, final := tournament.Rounds[0], tournament.Rounds[1]
+	if first.Status != RoundClosed || first.Matches[0].WinnerId != "w1" || first.Matches[1].WinnerId != "w2" {
+		t.Errorf("first round %s, won by %s and %s", first.Status, first.Matches[0].WinnerId, first.Matches[1].WinnerId)
+	}
+	if got := matchSeeds(final); !reflect.DeepEqual(got, [][2]int64{{1, 2}}) {
+		t.Errorf("final %v, want [[1 2]]", got)
+	}
+	if tournament.CurrentRound != 2 || final.Status != RoundOpen || !final.StartTime.Equal(at(60).Time) || !tournament.RoundEndTime.Equal(at(120).Time) {
+		t.Errorf("round %d is %s from %v, ends %v", tournament.CurrentRound, final.Status, final.StartTime, tournament.RoundEndTime)
+	}
+
+	// Closing the final finishes the tournament.
+	tournament.Rounds[1].Matches[0].Slots[1].Votes = 1
+	closeRound(&tournament, at(120))
+
+	if tournament.Status != TournamentFinished || tournament.WinnerId != "w2" {
+		t.Errorf("tournament %s, won by %s", tournament.Status, tournament.WinnerId)
+	}
+	if tournament.CurrentRound != 2 || tournament.Rounds[1].Status != RoundClosed || tournament.Rounds[1].Matches[0].WinnerId != "w2" {
+		t.Errorf("final %+v", tournament.Rounds[1])
+	}
+}
+
+func TestCloseDueRounds(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+
+		due := testTournament(4, 10)
+		running := testTournament(4, 30)
+		for _, tournament := range []*Tournament{&due, &running} {
+			if err := stores.Tournaments.Insert(ctx, tournament); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := CloseDueRounds(ctx, stores, at(20)); err != nil {
+			t.Fatal(err)
+		}
+
+		get := func(id primitive.ObjectID) *Tournament {
+			tournament, err := stores.Tournaments.Get(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tournament
+		}
+
+		closed := get(due.ID)
+		if closed.CurrentRound != 2 || closed.Rounds[0].Status != RoundClosed || !closed.RoundEndTime.Equal(at(80).Time) {
+			t.Errorf("due tournament in round %d until %v", closed.CurrentRound, closed.RoundEndTime)
+		}
+		if got := matchSeeds(closed.Rounds[1]); !reflect.DeepEqual(got, [][2]int64{{1, 2}}) {
+			t.Errorf("final %v, want [[1 2]]", got)
+		}
+		if open := get(running.ID); open.CurrentRound != 1 || open.Rounds[0].Status != RoundOpen {
+			t.Errorf("running tournament in round %d, %s", open.CurrentRound, open.Rounds[0].Status)
+		}
+
+		// Once the final is over the tournament is finished and no longer due.
+		if err := CloseDueRounds(ctx, stores, at(80)); err != nil {
+			t.Fatal(err)
+		}
+		if finished := get(due.ID); finished.Status != TournamentFinished || finished.WinnerId != "w1" {
+			t.Errorf("tournament %s, won by %s", finished.Status, finished.WinnerId)
+		}
+		if left, err := stores.Tournaments.Due(ctx, at(24*60).Time); err != nil || len(left) != 1 || left[0].ID != running.ID {
+			t.Errorf("due afterwards: %d tournaments, %v", len(left), err)
+		}
+	})
+}
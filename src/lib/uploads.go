@@ -0,0 +1,312 @@
+package lib
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/utils"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	UploadPending  = "pending"
+	UploadComplete = "complete"
+	UploadAttached = "attached"
+	UploadExpired  = "expired" // never completed, the staged file is gone
+)
+
+// How long the presigned URL, and so the whole upload, stays valid.
+const uploadExpiry = 15 * time.Minute
+
+// How many expired uploads a sweep cleans up at most, the rest wait for the
+// next one.
+const uploadSweepBatch = 100
+
+type DirectUploadConfig struct {
+	SweepInterval time.Duration `yaml:"sweepInterval" env:"UPLOAD_SWEEP_INTERVAL"` // how often staged files of expired uploads are deleted
+}
+
+var DefaultDirectUploadConfig = DirectUploadConfig{
+	SweepInterval: 5 * time.Minute,
+}
+
+type UploadRequest struct {
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	AniToken    string `json:"aniToken"`
+}
+
+type UploadCompleteRequest struct {
+	AniToken string `json:"aniToken"`
+}
+
+type Upload struct {
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"_id"`
+	Key         string               `bson:"key" json:"key"`
+	ContentType string               `bson:"contentType" json:"contentType"`
+	Size        int64                `bson:"size" json:"size"`
+	Status      string               `bson:"status" json:"status"`
+	URL         string               `bson:"url,omitempty" json:"url"`
+	Images      *utils.ImageSet      `bson:"images,omitempty" json:"images,omitempty"`
+	VideoMeta   *utils.VideoMetadata `bson:"videoMeta,omitempty" json:"videoMeta,omitempty"`
+	SHA256      string               `bson:"sha256,omitempty" json:"sha256,omitempty"`
+	CreatedTime utils.Timestamp      `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp      `bson:"updatedTime" json:"updatedTime"`
+	ExpiresTime utils.Timestamp      `bson:"expiresTime" json:"expiresTime"`
+
+	UserIP   string `bson:"userIp" json:"-"`
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+type UploadResponse struct {
+	ID        primitive.ObjectID   `json:"_id"`
+	Status    string               `json:"status"`
+	URL       string               `json:"url,omitempty"`
+	Images    *utils.ImageSet      `json:"images,omitempty"`
+	VideoMeta *utils.VideoMetadata `json:"videoMeta,omitempty"`
+}
+
+type PresignedUploadResponse struct {
+	ID          primitive.ObjectID `json:"_id"`
+	UploadURL   string             `json:"uploadUrl"`
+	Method      string             `json:"method"`
+	Headers     map[string]string  `json:"headers"`
+	ExpiresTime utils.Timestamp    `json:"expiresTime"`
+}
+
+var errDirectUploadsOff = utils.NewProblem(http.StatusNotImplemented, utils.CodeNotImplemented, "Direct uploads need an S3-compatible storage backend with a staging bucket")
+
+var (
+	ErrUploadNotFound  = errors.New("upload not found")
+	ErrUploadNotReady  = errors.New("upload is not complete or was already used")
+	ErrUploadCompleted = errors.New("upload was already completed")
+)
+
+func NewUpload(c echo.Context, stores Stores, store infra.Storage, uploadRequest *UploadRequest) error {
+	presigner, ok := store.(infra.Presigner)
+	if !ok {
+		return errDirectUploadsOff
+	}
+
+	if uploadRequest.AniToken == "" {
+		return utils.ValidationFailed("aniToken", "Token is required!")
+	}
+
+	maxBytes := utils.CurrentUploadLimits().MaxBytes(uploadRequest.ContentType)
+	if maxBytes == 0 {
+		return utils.ValidationFailed("contentType", "Invalid file type. Only JPG, PNG, WEBP, GIF, MP4 and WEBM are allowed.")
+	}
+
+	if uploadRequest.Size <= 0 || uploadRequest.Size > maxBytes {
+		return utils.ValidationFailed("size", "Invalid file size")
+	}
+
+	now := utils.Now()
+
+	upload := Upload{
+		ID:          primitive.NewObjectID(),
+		Key:         "uploads/" + uuid.New().String(),
+		ContentType: uploadRequest.ContentType,
+		Size:        uploadRequest.Size,
+		Status:      UploadPending,
+		CreatedTime: now,
+		UpdatedTime: now,
+		ExpiresTime: utils.NewTimestamp(now.Add(uploadExpiry)),
+		UserIP:      utils.GetUserIP(c),
+		AniToken:    uploadRequest.AniToken,
+	}
+
+	uploadURL, err := presigner.PresignPut(upload.Key, upload.ContentType, upload.Size, uploadExpiry)
+	if err != nil {
+		if errors.Is(err, infra.ErrNoStaging) {
+			return errDirectUploadsOff
+		}
+		return utils.InternalError(err, "Failed to create upload")
+	}
+
+	if err := stores.Uploads.Insert(c.Request().Context(), &upload); err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, PresignedUploadResponse{
+		ID:          upload.ID,
+		UploadURL:   uploadURL,
+		Method:      http.MethodPut,
+		Headers:     map[string]string{"Content-Type": upload.ContentType, "Content-Length": strconv.FormatInt(upload.Size, 10)},
+		ExpiresTime: upload.ExpiresTime.In(utils.ResponseTimestampFormat(c)),
+	})
+}
+
+// CompleteUpload runs the object the client staged through the same
+// sanitization pipeline as multipart uploads and stores the result. Only
+// then can a post reference it.
+func CompleteUpload(c echo.Context, stores Stores, store infra.Storage, id string, completeRequest *UploadCompleteRequest) error {
+	ctx := c.Request().Context()
+
+	presigner, ok := store.(infra.Presigner)
+	if !ok {
+		return errDirectUploadsOff
+	}
+
+	uploadID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Upload not found")
+	}
+
+	upload, err := stores.Uploads.Find(ctx, uploadID, completeRequest.AniToken)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Upload not found")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	if upload.Status != UploadPending {
+		return utils.Conflict(utils.CodeConflict, "Upload was already completed")
+	}
+
+	if time.Now().After(upload.ExpiresTime.Time) {
+		return utils.NewProblem(http.StatusGone, utils.CodeUploadExpired, "Upload has expired")
+	}
+
+	object, err := presigner.GetStaged(ctx, upload.Key)
+	if err != nil {
+		if errors.Is(err, infra.ErrObjectNotFound) {
+			return utils.Conflict(utils.CodeConflict, "File has not been uploaded yet")
+		}
+		return utils.InternalError(err, "Failed to read upload")
+	}
+	defer object.Close()
+
+	// Whatever happens below, the raw file goes away.
+	defer func() {
+		if err := presigner.DeleteStaged(context.Background(), upload.Key); err != nil {
+			log.Println("Error deleting staged upload:", err)
+		}
+	}()
+
+	sanitized, err := utils.SanitizeUpload(object, utils.CurrentUploadLimits())
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidUpload) {
+			return utils.NewProblem(http.StatusBadRequest, utils.CodeInvalidUpload, err.Error())
+		}
+		return utils.InternalError(err, "Failed to process file")
+	}
+
+	if sanitized.ContentType != upload.ContentType {
+		return utils.NewProblem(http.StatusBadRequest, utils.CodeInvalidUpload, "File does not match the declared content type")
+	}
+
+	err = CheckBannedMedia(ctx, stores, MediaCheck{
+		SHA256:    sanitized.SHA256,
+		ImageHash: sanitized.PerceptualHash,
+		Source:    MediaSourceUpload,
+		UserIP:    utils.GetUserIP(c),
+		AniToken:  upload.AniToken,
+	})
+	if err != nil {
+		if errors.Is(err, ErrBannedMedia) {
+			return utils.NewProblem(http.StatusBadRequest, utils.CodeBannedMedia, "This file is not allowed")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	upload.SHA256 = sanitized.SHA256
+
+	if sanitized.IsVideo() {
+		key := utils.NewObjectName(sanitized.Extension)
+		if err := store.Put(ctx, key, bytes.NewReader(sanitized.Data), sanitized.ContentType); err != nil {
+			return utils.InternalError(err, "Failed to upload file")
+		}
+		upload.URL = store.URL(key)
+		upload.VideoMeta = sanitized.Video
+	} else {
+		images, err := utils.UploadImageSet(ctx, store, sanitized)
+		if err != nil {
+			return utils.InternalError(err, "Failed to upload file")
+		}
+		upload.URL = images.Original.URL
+		upload.Images = images
+	}
+
+	upload.Size = int64(len(sanitized.Data))
+	upload.UpdatedTime = utils.Now()
+
+	if err := stores.Uploads.Complete(ctx, upload); err != nil {
+		if errors.Is(err, ErrUploadCompleted) {
+			return utils.Conflict(utils.CodeConflict, "Upload was already completed")
+		}
+		return utils.InternalError(err, "Failed to complete upload")
+	}
+
+	return c.JSON(http.StatusOK, UploadResponse{
+		ID:        upload.ID,
+		Status:    UploadComplete,
+		URL:       upload.URL,
+		Images:    upload.Images,
+		VideoMeta: upload.VideoMeta,
+	})
+}
+
+// ClaimUpload marks a completed upload as attached and returns it, so the
+// same upload can't end up on two posts.
+func ClaimUpload(ctx context.Context, stores Stores, id string, aniToken string) (*Upload, error) {
+	uploadID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrUploadNotFound
+	}
+
+	return stores.Uploads.Claim(ctx, uploadID, aniToken, utils.Now())
+}
+
+// SweepExpiredUploads deletes the staged files of uploads that expired
+// before they were completed. Their presigned URLs have run out, so nothing
+// can be put there again. Each upload is marked expired first, so one that
+// is being completed right now is either left alone or fails to complete.
+func SweepExpiredUploads(ctx context.Context, stores Stores, presigner infra.Presigner, now time.Time) error {
+	expired, err := stores.Uploads.ListExpired(ctx, now, uploadSweepBatch)
+	if err != nil {
+		return err
+	}
+
+	for _, upload := range expired {
+		if err := stores.Uploads.Expire(ctx, upload.ID, utils.NewTimestamp(now)); err != nil {
+			if errors.Is(err, ErrUploadCompleted) {
+				continue
+			}
+			return err
+		}
+
+		if err := presigner.DeleteStaged(ctx, upload.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunUploadSweeper sweeps expired uploads right away and then every
+// interval, until ctx is done.
+func RunUploadSweeper(ctx context.Context, stores Stores, presigner infra.Presigner, config DirectUploadConfig) {
+	ticker := time.NewTicker(config.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := SweepExpiredUploads(ctx, stores, presigner, time.Now()); err != nil {
+			log.Println("Error sweeping expired uploads:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
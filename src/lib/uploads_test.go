@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryStaging stands in for a staging bucket.
+type memoryStaging struct {
+	objects *infra.MemoryStorage
+}
+
+func (s memoryStaging) PresignPut(key string, contentType string, size int64, expires time.Duration) (string, error) {
+	return "memory://staging/" + key, nil
+}
+
+func (s memoryStaging) GetStaged(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, _, err := s.objects.Get(ctx, key)
+	return body, err
+}
+
+func (s memoryStaging) DeleteStaged(ctx context.Context, key string) error {
+	return s.objects.Delete(ctx, key)
+}
+
+func TestSweepExpiredUploads(t *testing.T) {
+	runOnStores(t, func(t *testing.T, stores Stores) {
+		ctx := context.Background()
+		staging := memoryStaging{objects: infra.NewMemoryStorage("memory://")}
+
+		uploads := []Upload{
+			{Key: "uploads/expired", Status: UploadPending, ExpiresTime: at(0)},
+			{Key: "uploads/running", Status: UploadPending, ExpiresTime: at(20)},
+			{Key: "uploads/completed", Status: UploadComplete, ExpiresTime: at(0)},
+		}
+		for i := range uploads {
+			uploads[i].AniToken = "token"
+			if err := stores.Uploads.Insert(ctx, &uploads[i]); err != nil {
+				t.Fatal(err)
+			}
+			if err := staging.objects.Put(ctx, uploads[i].Key, strings.NewReader("raw"), "image/png"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := SweepExpiredUploads(ctx, stores, staging, at(10).Time); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]struct {
+			status string
+			staged bool
+		}{
+			"uploads/expired":   {UploadExpired, false},
+			"uploads/running":   {UploadPending, true},
+			"uploads/completed": {UploadComplete, true},
+		}
+		for _, upload := range uploads {
+			found, err := stores.Uploads.Find(ctx, upload.ID, "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = staging.GetStaged(ctx, upload.Key)
+			staged := err == nil
+			if err != nil && !errors.Is(err, infra.ErrObjectNotFound) {
+				t.Fatal(err)
+			}
+
+			if found.Status != want[upload.Key].status || staged != want[upload.Key].staged {
+				t.Errorf("%s: status %s, staged %v, want %+v", upload.Key, found.Status, staged, want[upload.Key])
+			}
+		}
+
+		// Sweeping again finds nothing left to do.
+		if expired, err := stores.Uploads.ListExpired(ctx, at(10).Time, uploadSweepBatch); err != nil || len(expired) != 0 {
+			t.Errorf("ListExpired after the sweep = %d uploads, %v", len(expired), err)
+		}
+		if err := stores.Uploads.Expire(ctx, uploads[0].ID, utils.Now()); !errors.Is(err, ErrUploadCompleted) {
+			t.Errorf("Expire of an expired upload = %v, want ErrUploadCompleted", err)
+		}
+	})
+}
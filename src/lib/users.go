@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// Profiles only show the latest few favorites, the rest are paged through
+// /users/:id/favorites/waifus.
+const profileFavoriteWaifus = 10
+
+// UserProfile is everything public about a user ID.
+type UserProfile struct {
+	UserID         string        `json:"userId"`
+	PostCount      int64         `json:"postCount"`
+	FavoriteWaifus []PublicWaifu `json:"favoriteWaifus"`
+}
+
+func GetUserProfile(c echo.Context, stores Stores, userId string) error {
+	if userId == "" {
+		return utils.BadRequest("Invalid params")
+	}
+
+	postCount, err := stores.Posts.Count(c.Request().Context(), PostFilter{UserID: userId})
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	favorites, err := favoriteWaifus(c, stores, FavoriteFilter{UserID: userId}, ListOptions{Limit: profileFavoriteWaifus})
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, UserProfile{
+		UserID:         userId,
+		PostCount:      postCount,
+		FavoriteWaifus: favorites,
+	})
+}
@@ -0,0 +1,211 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+)
+
+type WaifuFavoriteRequest struct {
+	UserID         string `json:"userId"`
+	RecaptchaToken string `json:"recaptchaToken"`
+	AniToken       string `json:"aniToken"`
+}
+
+// WaifuFavorite is kept per token. UserID is optional and is what makes the
+// favorite show up on that user's public profile.
+type WaifuFavorite struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	WaifuId     string             `bson:"waifuId" json:"waifuId"`
+	UserID      string             `bson:"userId,omitempty" json:"userId,omitempty"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+type WaifuFavoriteResponse struct {
+	WaifuId    string `json:"waifuId"`
+	IsFavorite bool   `json:"isFavorite"`
+	Favorites  int64  `json:"favorites"`
+}
+
+func approvedWaifu(c echo.Context, stores Stores, id string) (*Waifu, error) {
+	waifuID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.NotFound("Waifu not found")
+	}
+
+	waifu, err := stores.Waifus.Get(c.Request().Context(), waifuID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, utils.NotFound("Waifu not found")
+		}
+		return nil, utils.InternalError(err, "Error fetching waifu data")
+	}
+
+	if waifu.Status != WaifuApproved {
+		return nil, utils.NotFound("Waifu not found")
+	}
+
+	return waifu, nil
+}
+
+// FavoriteWaifu adds the waifu to the token's favorites. Favoriting twice
+// is not an error, the counter only moves when a favorite is added.
+func FavoriteWaifu(c echo.Context, stores Stores, id string, favoriteRequest *WaifuFavoriteRequest) error {
+	now := utils.Now()
+
+	if len(favoriteRequest.UserID) > 128 {
+		return utils.ValidationFailed("userId", "UserId is too long")
+	}
+
+	if favoriteRequest.AniToken == "" {
+		return utils.ValidationFailed("aniToken", "Token is required!")
+	}
+
+	if err := utils.CheckRecaptcha(favoriteRequest.RecaptchaToken); err != nil {
+		return err
+	}
+
+	waifu, err := approvedWaifu(c, stores, id)
+	if err != nil {
+		return err
+	}
+
+	favorite := WaifuFavorite{
+		ID:          primitive.NewObjectID(),
+		WaifuId:     id,
+		UserID:      sanitizeInput(favoriteRequest.UserID),
+		CreatedTime: now,
+		AniToken:    favoriteRequest.AniToken,
+	}
+
+	added, err := stores.Favorites.Add(c.Request().Context(), &favorite)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	if added {
+		waifu, err = stores.Waifus.AddFavorites(c.Request().Context(), waifu.ID, 1, now)
+		if err != nil {
+			return utils.InternalError(err, "Failed to update waifu counters")
+		}
+	}
+
+	return c.JSON(http.StatusOK, WaifuFavoriteResponse{WaifuId: id, IsFavorite: true, Favorites: waifu.Favorites})
+}
+
+// UnfavoriteWaifu removes the waifu from the token's favorites, if it's
+// there. Waifus that were taken down can still be removed.
+func UnfavoriteWaifu(c echo.Context, stores Stores, id string, aniToken string) error {
+	if aniToken == "" {
+		return utils.ValidationFailed("X-Ani-Token", "Token is required!")
+	}
+
+	waifuID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Waifu not found")
+	}
+
+	removed, err := stores.Favorites.Remove(c.Request().Context(), id, aniToken)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	var waifu *Waifu
+	if removed {
+		waifu, err = stores.Waifus.AddFavorites(c.Request().Context(), waifuID, -1, utils.Now())
+	} else {
+		waifu, err = stores.Waifus.Get(c.Request().Context(), waifuID)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Waifu not found")
+		}
+		return utils.InternalError(err, "Failed to update waifu counters")
+	}
+
+	return c.JSON(http.StatusOK, WaifuFavoriteResponse{WaifuId: id, IsFavorite: false, Favorites: waifu.Favorites})
+}
+
+// GetFavoriteWaifus lists the token's favorite waifus, most recently
+// favorited first.
+func GetFavoriteWaifus(c echo.Context, stores Stores, aniToken string) error {
+	if aniToken == "" {
+		return utils.ValidationFailed("X-Ani-Token", "Token is required!")
+	}
+
+	return listFavoriteWaifus(c, stores, FavoriteFilter{AniToken: aniToken})
+}
+
+// GetUserFavoriteWaifus lists the waifus favorited under a public user ID.
+func GetUserFavoriteWaifus(c echo.Context, stores Stores, userId string) error {
+	if userId == "" {
+		return utils.BadRequest("Invalid params")
+	}
+
+	return listFavoriteWaifus(c, stores, FavoriteFilter{UserID: userId})
+}
+
+func listFavoriteWaifus(c echo.Context, stores Stores, filter FavoriteFilter) error {
+	listOptions, err := waifuListOptions(c)
+	if err != nil {
+		return err
+	}
+
+	waifus, err := favoriteWaifus(c, stores, filter, listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, waifus)
+}
+
+// favoriteWaifus loads a page of favorites and the waifus they point at,
+// in the order they were favorited. Waifus that aren't public anymore are
+// left out, so a page can come back short.
+func favoriteWaifus(c echo.Context, stores Stores, filter FavoriteFilter, listOptions ListOptions) ([]PublicWaifu, error) {
+	favorites, err := stores.Favorites.List(c.Request().Context(), filter, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(favorites))
+	for _, favorite := range favorites {
+		if id, err := primitive.ObjectIDFromHex(favorite.WaifuId); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	found, err := stores.Waifus.GetMany(c.Request().Context(), ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[primitive.ObjectID]Waifu, len(found))
+	for _, waifu := range found {
+		byID[waifu.ID] = waifu
+	}
+
+	// Listing by token lists the viewer's own favorites.
+	isFavorite := true
+
+	format := utils.ResponseTimestampFormat(c)
+	waifus := make([]PublicWaifu, 0, len(ids))
+	for _, id := range ids {
+		waifu, ok := byID[id]
+		if !ok || waifu.Status != WaifuApproved {
+			continue
+		}
+
+		response := newPublicWaifu(waifu, format)
+		if filter.AniToken != "" {
+			response.IsFavorite = &isFavorite
+		}
+		waifus = append(waifus, response)
+	}
+
+	return waifus, nil
+}
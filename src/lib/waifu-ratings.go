@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+)
+
+// The Bayesian score pulls a waifu's average towards ratingPriorMean as if
+// it had ratingPriorVotes extra ratings of that value, so a single 5 star
+// rating doesn't outrank dozens of 4s. Changing either means recomputing
+// ratingScore on every waifu.
+const (
+	ratingPriorMean  = 3.0
+	ratingPriorVotes = 5.0
+
+	minStars = 1
+	maxStars = 5
+)
+
+func bayesianScore(sum int64, count int64) float64 {
+	return (ratingPriorMean*ratingPriorVotes + float64(sum)) / (ratingPriorVotes + float64(count))
+}
+
+func averageRating(sum int64, count int64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(sum) / float64(count)
+}
+
+// ErrRatingChanged is returned when a rating was changed by another request
+// between reading and updating it.
+var ErrRatingChanged = errors.New("the rating was changed by another request")
+
+type WaifuRatingRequest struct {
+	Stars          int64  `json:"stars"`
+	RecaptchaToken string `json:"recaptchaToken"`
+	AniToken       string `json:"aniToken"`
+}
+
+type WaifuRating struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	WaifuId     string             `bson:"waifuId" json:"waifuId"`
+	Stars       int64              `bson:"stars" json:"stars"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
+
+	UserIP   string `bson:"userIp" json:"-"`
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+// WaifuRatingResponse is the voter's rating along with the waifu's totals
+// after it was counted.
+type WaifuRatingResponse struct {
+	ID          primitive.ObjectID `json:"_id"`
+	WaifuId     string             `json:"waifuId"`
+	Stars       int64              `json:"stars"`
+	Rating      float64            `json:"rating"`
+	RatingCount int64              `json:"ratingCount"`
+	RatingScore float64            `json:"ratingScore"`
+	CreatedTime utils.Timestamp    `json:"createdTime"`
+	UpdatedTime utils.Timestamp    `json:"updatedTime"`
+}
+
+// RateWaifu records the voter's stars for a waifu. Voters are told apart by
+// IP and token like post likes, but rating again changes the earlier rating
+// instead of being refused.
+func RateWaifu(c echo.Context, stores Stores, id string, ratingRequest *WaifuRatingRequest) error {
+	now := utils.Now()
+
+	if ratingRequest.Stars < minStars || ratingRequest.Stars > maxStars {
+		return utils.ValidationFailed("stars", "Stars must be between 1 and 5")
+	}
+
+	if err := utils.CheckRecaptcha(ratingRequest.RecaptchaToken); err != nil {
+		return err
+	}
+
+	waifuID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Waifu not found")
+	}
+
+	waifu, err := stores.Waifus.Get(c.Request().Context(), waifuID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Waifu not found")
+		}
+		return utils.InternalError(err, "Error fetching waifu data")
+	}
+
+	// Only waifus that are listed can be rated.
+	if waifu.Status != WaifuApproved {
+		return utils.NotFound("Waifu not found")
+	}
+
+	userIP := utils.GetUserIP(c)
+
+	rating, err := stores.Ratings.Find(c.Request().Context(), id, userIP, ratingRequest.AniToken)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		rating = &WaifuRating{
+			ID:          primitive.NewObjectID(),
+			WaifuId:     id,
+			Stars:       ratingRequest.Stars,
+			CreatedTime: now,
+			UpdatedTime: now,
+			UserIP:      userIP,
+			AniToken:    ratingRequest.AniToken,
+		}
+
+		if err := stores.Ratings.Insert(c.Request().Context(), rating); err != nil {
+			return utils.InternalError(err, "Database error")
+		}
+
+		waifu, err = stores.Waifus.AddRating(c.Request().Context(), waifuID, rating.Stars, 1, now)
+	case err != nil:
+		return utils.InternalError(err, "Database error")
+	default:
+		previous := rating.Stars
+		if err := stores.Ratings.SetStars(c.Request().Context(), rating.ID, previous, ratingRequest.Stars, now); err != nil {
+			if errors.Is(err, ErrRatingChanged) {
+				return utils.Conflict(utils.CodeConflict, "Your rating was changed by another request, try again")
+			}
+			return utils.InternalError(err, "Database error")
+		}
+
+		rating.Stars = ratingRequest.Stars
+		rating.UpdatedTime = now
+
+		waifu, err = stores.Waifus.AddRating(c.Request().Context(), waifuID, rating.Stars-previous, 0, now)
+	}
+	if err != nil {
+		return utils.InternalError(err, "Failed to update waifu rating")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	response := WaifuRatingResponse{
+		ID:          rating.ID,
+		WaifuId:     rating.WaifuId,
+		Stars:       rating.Stars,
+		Rating:      waifu.Rating,
+		RatingCount: waifu.RatingCount,
+		RatingScore: waifu.RatingScore,
+		CreatedTime: rating.CreatedTime.In(format),
+		UpdatedTime: rating.UpdatedTime.In(format),
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"errors"
+	"fmt"
+)
+
+type WaifuStatus string
+
+const (
+	WaifuDraft    WaifuStatus = "draft"
+	WaifuPending  WaifuStatus = "pending"  // submitted, waiting for a moderator
+	WaifuApproved WaifuStatus = "approved" // public
+	WaifuRejected WaifuStatus = "rejected"
+	WaifuArchived WaifuStatus = "archived" // was public, taken down
+)
+
+var WaifuStatuses = []WaifuStatus{WaifuDraft, WaifuPending, WaifuApproved, WaifuRejected, WaifuArchived}
+
+// waifuTransitions is the only place that decides which status can follow
+// which. Rejected and archived waifus go back through review.
+var waifuTransitions = map[WaifuStatus][]WaifuStatus{
+	WaifuDraft:    {WaifuPending, WaifuArchived},
+	WaifuPending:  {WaifuApproved, WaifuRejected, WaifuDraft},
+	WaifuApproved: {WaifuArchived},
+	WaifuRejected: {WaifuPending, WaifuArchived},
+	WaifuArchived: {WaifuPending},
+}
+
+var (
+	ErrInvalidWaifuTransition = errors.New("invalid status change")
+	// The status changed between reading the waifu and updating it.
+	ErrWaifuStatusChanged = errors.New("the waifu's status was changed by someone else")
+)
+
+func ParseWaifuStatus(value string) (WaifuStatus, bool) {
+	for _, status := range WaifuStatuses {
+		if string(status) == value {
+			return status, true
+		}
+	}
+	return "", false
+}
+
+func (s WaifuStatus) CanTransitionTo(next WaifuStatus) bool {
+	for _, allowed := range waifuTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// WaifuStatusChange is one entry of a waifu's status history. By names who
+// made it, "moderator:<name>" or "user:<id>".
+type WaifuStatusChange struct {
+	From   WaifuStatus     `bson:"from" json:"from"`
+	To     WaifuStatus     `bson:"to" json:"to"`
+	By     string          `bson:"by" json:"by"`
+	Reason string          `bson:"reason,omitempty" json:"reason,omitempty"`
+	Time   utils.Timestamp `bson:"time" json:"time"`
+}
+
+// newStatusChange builds the history entry for moving a waifu from one
+// status to another, or fails with ErrInvalidWaifuTransition.
+func newStatusChange(from WaifuStatus, to WaifuStatus, by string, reason string) (WaifuStatusChange, error) {
+	if !from.CanTransitionTo(to) {
+		return WaifuStatusChange{}, fmt.Errorf("%w: %s waifus can't be moved to %s", ErrInvalidWaifuTransition, from, to)
+	}
+
+	return WaifuStatusChange{
+		From:   from,
+		To:     to,
+		By:     by,
+		Reason: reason,
+		Time:   utils.Now(),
+	}, nil
+}
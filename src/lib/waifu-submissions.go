@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+)
+
+type WaifuRequest struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Image          string `json:"image"`
+	SourceURL      string `json:"sourceUrl,omitempty"`
+	UserID         string `json:"userId"`
+	RecaptchaToken string `json:"recaptchaToken"`
+	AniToken       string `json:"aniToken"`
+
+	Images      *utils.ImageSet `json:"images,omitempty"`
+	MediaSha256 string          `json:"-"`
+}
+
+// WaifuSubmission is how submitters see their own waifus. Reason is the one
+// given with the latest status change, usually why it was rejected.
+type WaifuSubmission struct {
+	ID          primitive.ObjectID `json:"_id"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Image       string             `json:"image"`
+	Images      *utils.ImageSet    `json:"images,omitempty"`
+	Status      WaifuStatus        `json:"status"`
+	Reason      string             `json:"reason,omitempty"`
+	CreatedTime utils.Timestamp    `json:"createdTime"`
+	UpdatedTime utils.Timestamp    `json:"updatedTime"`
+}
+
+func newWaifuSubmission(waifu Waifu, format utils.TimestampFormat) WaifuSubmission {
+	submission := WaifuSubmission{
+		ID:          waifu.ID,
+		Name:        waifu.Name,
+		Description: waifu.Description,
+		Image:       waifu.Image,
+		Images:      waifu.Images,
+		Status:      waifu.Status,
+		CreatedTime: waifu.CreatedTime.In(format),
+		UpdatedTime: waifu.UpdatedTime.In(format),
+	}
+
+	if len(waifu.StatusHistory) > 0 {
+		latest := waifu.StatusHistory[len(waifu.StatusHistory)-1]
+		if latest.To == waifu.Status {
+			submission.Reason = latest.Reason
+		}
+	}
+
+	return submission
+}
+
+// SubmitWaifu stores a user's waifu for review. It only shows up in
+// /waifus once a moderator approves it.
+func SubmitWaifu(c echo.Context, stores Stores, waifuRequest *WaifuRequest) error {
+	if len(waifuRequest.Name) == 0 {
+		return utils.ValidationFailed("name", "Name is required!")
+	}
+
+	if len(waifuRequest.Name) > 100 {
+		return utils.ValidationFailed("name", "Name is too long")
+	}
+
+	if len(waifuRequest.Description) > 1000 {
+		return utils.ValidationFailed("description", "Description is too long! Only 1000 characters are allowed!")
+	}
+
+	if len(waifuRequest.UserID) > 128 {
+		return utils.ValidationFailed("userId", "UserId is too long")
+	}
+
+	if waifuRequest.Image == "" {
+		return utils.ValidationFailed("file", "An image is required")
+	}
+
+	if waifuRequest.AniToken == "" {
+		return utils.ValidationFailed("aniToken", "Token is required!")
+	}
+
+	userID := sanitizeInput(waifuRequest.UserID)
+	submitter := userID
+	if submitter == "" {
+		submitter = "anonymous"
+	}
+
+	// Submissions start out as drafts that are sent for review right away,
+	// so the history shows the same step a resubmitted draft would.
+	change, err := newStatusChange(WaifuDraft, WaifuPending, "user:"+submitter, "")
+	if err != nil {
+		return utils.InternalError(err, "Failed to submit waifu")
+	}
+
+	waifu := Waifu{
+		ID:            primitive.NewObjectID(),
+		Name:          sanitizeInput(waifuRequest.Name),
+		Description:   sanitizeInput(waifuRequest.Description),
+		Image:         waifuRequest.Image,
+		Images:        waifuRequest.Images,
+		SourceURL:     waifuRequest.SourceURL,
+		MediaSha256:   waifuRequest.MediaSha256,
+		UserId:        userID,
+		RatingScore:   bayesianScore(0, 0),
+		Elo:           initialElo,
+		CreatedTime:   change.Time,
+		UpdatedTime:   change.Time,
+		Status:        WaifuPending,
+		StatusHistory: []WaifuStatusChange{change},
+		UserIP:        utils.GetUserIP(c),
+		AniToken:      waifuRequest.AniToken,
+	}
+
+	if err := stores.Waifus.Insert(c.Request().Context(), &waifu); err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	return c.JSON(http.StatusOK, newWaifuSubmission(waifu, utils.ResponseTimestampFormat(c)))
+}
+
+// GetWaifuSubmissions lists the waifus submitted with aniToken, whatever
+// their status.
+func GetWaifuSubmissions(c echo.Context, stores Stores, aniToken string) error {
+	if aniToken == "" {
+		return utils.ValidationFailed("X-Ani-Token", "Token is required!")
+	}
+
+	listOptions, err := waifuListOptions(c)
+	if err != nil {
+		return err
+	}
+
+	waifus, err := stores.Waifus.List(c.Request().Context(), WaifuFilter{AniToken: aniToken}, listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	submissions := make([]WaifuSubmission, 0, len(waifus))
+	for _, waifu := range waifus {
+		submissions = append(submissions, newWaifuSubmission(waifu, format))
+	}
+
+	return c.JSON(http.StatusOK, submissions)
+}
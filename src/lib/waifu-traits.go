@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+const (
+	minTraitScore = 0
+	maxTraitScore = 10
+
+	// noTraitScore is passed to WaifuStore.AddTraitVote for a voter's first
+	// vote on a trait, when there is no earlier score to take back.
+	noTraitScore = -1
+)
+
+// Trait keys end up in waifu field paths, so they're kept to letters and
+// digits, like mommyMeter.
+var traitKeyPattern = regexp.MustCompile(`^[a-z][a-zA-Z0-9]{0,31}$`)
+
+var (
+	// ErrTraitExists is returned when a trait with the key was already
+	// defined.
+	ErrTraitExists = errors.New("a trait with this key already exists")
+	// ErrTraitVoteChanged is returned when a trait vote was changed by
+	// another request between reading and updating it.
+	ErrTraitVoteChanged = errors.New("the trait vote was changed by another request")
+)
+
+// Trait is a meter the community scores waifus on, like the mommy meter.
+// Moderators define them.
+type Trait struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	Key         string             `bson:"key" json:"key"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description" json:"description"`
+	CreatedBy   string             `bson:"createdBy" json:"createdBy"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+}
+
+type TraitRequest struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// TraitMeter is how a waifu was scored on one trait.
+type TraitMeter struct {
+	Votes     int64   `bson:"votes" json:"votes"`
+	Histogram []int64 `bson:"histogram" json:"histogram"` // votes for each score, 0 to 10
+	Median    float64 `bson:"median" json:"median"`
+}
+
+// emptyHistogram has a bucket for every score.
+func emptyHistogram() []int64 {
+	return make([]int64, maxTraitScore-minTraitScore+1)
+}
+
+// traitMedian is the middle score of the histogram, halfway between the two
+// middle ones for an even number of votes, 0 without votes.
+func traitMedian(histogram []int64) float64 {
+	var votes int64
+	for _, count := range histogram {
+		votes += count
+	}
+	if votes == 0 {
+		return 0
+	}
+
+	// The 1-based positions of the middle votes, the same one when votes
+	// is odd.
+	low, high := (votes+1)/2, votes/2+1
+	lowScore, highScore := -1, -1
+
+	var seen int64
+	for score, count := range histogram {
+		seen += count
+		if lowScore < 0 && seen >= low {
+			lowScore = score
+		}
+		if highScore < 0 && seen >= high {
+			highScore = score
+			break
+		}
+	}
+
+	return float64(lowScore+highScore) / 2
+}
+
+type WaifuTraitVoteRequest struct {
+	Scores         map[string]int64 `json:"scores"`
+	RecaptchaToken string           `json:"recaptchaToken"`
+	AniToken       string           `json:"aniToken"`
+}
+
+type WaifuTraitVote struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	WaifuId     string             `bson:"waifuId" json:"waifuId"`
+	Trait       string             `bson:"trait" json:"trait"`
+	Score       int64              `bson:"score" json:"score"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
+
+	UserIP   string `bson:"userIp" json:"-"`
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+// WaifuTraitVoteResponse is the voter's scores along with the waifu's meters
+// after they were counted.
+type WaifuTraitVoteResponse struct {
+	WaifuId string                `json:"waifuId"`
+	Scores  map[string]int64      `json:"scores"`
+	Traits  map[string]TraitMeter `json:"traits"`
+}
+
+func GetTraits(c echo.Context, stores Stores) error {
+	traits, err := stores.Traits.List(c.Request().Context())
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	for i := range traits {
+		traits[i].CreatedTime = traits[i].CreatedTime.In(format)
+	}
+
+	return c.JSON(http.StatusOK, traits)
+}
+
+func CreateTrait(c echo.Context, stores Stores, traitRequest *TraitRequest) error {
+	if !traitKeyPattern.MatchString(traitRequest.Key) {
+		return utils.ValidationFailed("key", "Key must start with a lowercase letter and only have letters and digits, up to 32")
+	}
+
+	name := sanitizeInput(traitRequest.Name)
+	if name == "" {
+		return utils.ValidationFailed("name", "Name is required")
+	}
+	if len(name) > 100 {
+		return utils.ValidationFailed("name", "Name is too long")
+	}
+
+	if len(traitRequest.Description) > 500 {
+		return utils.ValidationFailed("description", "Description is too long")
+	}
+
+	trait := Trait{
+		ID:          primitive.NewObjectID(),
+		Key:         traitRequest.Key,
+		Name:        name,
+		Description: sanitizeInput(traitRequest.Description),
+		CreatedBy:   "moderator:" + utils.GetModerator(c),
+		CreatedTime: utils.Now(),
+	}
+
+	if err := stores.Traits.Insert(c.Request().Context(), &trait); err != nil {
+		if errors.Is(err, ErrTraitExists) {
+			return utils.Conflict(utils.CodeConflict, "A trait with this key already exists")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	trait.CreatedTime = trait.CreatedTime.In(utils.ResponseTimestampFormat(c))
+	return c.JSON(http.StatusOK, trait)
+}
+
+// VoteWaifuTraits records the voter's 0 to 10 score on each trait sent.
+// Like ratings, voters are told apart by IP and token and voting again
+// changes the earlier score.
+func VoteWaifuTraits(c echo.Context, stores Stores, id string, voteRequest *WaifuTraitVoteRequest) error {
+	now := utils.Now()
+
+	if len(voteRequest.Scores) == 0 {
+		return utils.ValidationFailed("scores", "At least one score is required")
+	}
+
+	traits, err := stores.Traits.List(c.Request().Context())
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	keys := make([]string, 0, len(voteRequest.Scores))
+	for key, score := range voteRequest.Scores {
+		if !slices.ContainsFunc(traits, func(trait Trait) bool { return trait.Key == key }) {
+			return utils.ValidationFailed("scores", "Unknown trait "+key)
+		}
+		if score < minTraitScore || score > maxTraitScore {
+			return utils.ValidationFailed("scores", "Scores must be between 0 and 10")
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	if err := utils.CheckRecaptcha(voteRequest.RecaptchaToken); err != nil {
+		return err
+	}
+
+	waifu, err := approvedWaifu(c, stores, id)
+	if err != nil {
+		return err
+	}
+
+	userIP := utils.GetUserIP(c)
+
+	for _, key := range keys {
+		score := voteRequest.Scores[key]
+
+		vote, err := stores.TraitVotes.Find(c.Request().Context(), id, key, userIP, voteRequest.AniToken)
+		replaced := int64(noTraitScore)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			vote = &WaifuTraitVote{
+				ID:          primitive.NewObjectID(),
+				WaifuId:     id,
+				Trait:       key,
+				Score:       score,
+				CreatedTime: now,
+				UpdatedTime: now,
+				UserIP:      userIP,
+				AniToken:    voteRequest.AniToken,
+			}
+
+			if err := stores.TraitVotes.Insert(c.Request().Context(), vote); err != nil {
+				return utils.InternalError(err, "Database error")
+			}
+		case err != nil:
+			return utils.InternalError(err, "Database error")
+		case vote.Score == score:
+			continue
+		default:
+			replaced = vote.Score
+			if err := stores.TraitVotes.SetScore(c.Request().Context(), vote.ID, replaced, score, now); err != nil {
+				if errors.Is(err, ErrTraitVoteChanged) {
+					return utils.Conflict(utils.CodeConflict, "Your vote was changed by another request, try again")
+				}
+				return utils.InternalError(err, "Database error")
+			}
+		}
+
+		waifu, err = stores.Waifus.AddTraitVote(c.Request().Context(), waifu.ID, key, score, replaced, now)
+		if err != nil {
+			return utils.InternalError(err, "Failed to update trait meters")
+		}
+	}
+
+	return c.JSON(http.StatusOK, WaifuTraitVoteResponse{
+		WaifuId: id,
+		Scores:  voteRequest.Scores,
+		Traits:  waifu.Traits,
+	})
+}
@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"animoshi-api-go/src/utils"
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+const (
+	initialElo = 1500.0
+	eloK       = 32.0
+
+	// A matchup is drawn from this many waifus on either side of the
+	// first one's Elo.
+	matchupCandidates = 10
+)
+
+type WarsConfig struct {
+	VoteCooldown time.Duration `yaml:"voteCooldown" env:"WARS_VOTE_COOLDOWN"` // how long before a voter can vote on the same pair again
+}
+
+var DefaultWarsConfig = WarsConfig{
+	VoteCooldown: 24 * time.Hour,
+}
+
+var warsConfig = DefaultWarsConfig
+
+// ErrWarVoteExists is returned when the token already voted on the pair in
+// the same cooldown bucket.
+var ErrWarVoteExists = errors.New("already voted on this pair")
+
+func ConfigureWars(config WarsConfig) {
+	warsConfig = config
+}
+
+// eloChange is how many points the winner takes from the loser.
+func eloChange(winnerElo float64, loserElo float64) float64 {
+	expected := 1 / (1 + math.Pow(10, (loserElo-winnerElo)/400))
+	return eloK * (1 - expected)
+}
+
+// voteBucket numbers the cooldown windows. A token gets one vote per pair
+// and bucket, which the store holds to even when requests race. Without a
+// cooldown there is no bucket and no limit.
+func voteBucket(t time.Time, cooldown time.Duration) int64 {
+	if cooldown <= 0 {
+		return 0
+	}
+	return t.UnixNano() / int64(cooldown)
+}
+
+// matchupWeights is how likely each candidate is to be drawn against a
+// waifu at elo: 1 at the same Elo, 1/2 at 200 points away and so on.
+func matchupWeights(elo float64, candidates []Waifu) []float64 {
+	weights := make([]float64, len(candidates))
+	for i, candidate := range candidates {
+		distance := (candidate.Elo - elo) / 200
+		weights[i] = 1 / (1 + distance*distance)
+	}
+	return weights
+}
+
+// pairKey is the same whichever way round the two waifus are.
+func pairKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + ":" + b
+}
+
+type WarVoteRequest struct {
+	WinnerId       string `json:"winnerId"`
+	LoserId        string `json:"loserId"`
+	RecaptchaToken string `json:"recaptchaToken"`
+	AniToken       string `json:"aniToken"`
+}
+
+type WarVote struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	Pair        string             `bson:"pair" json:"-"`
+	WinnerId    string             `bson:"winnerId" json:"winnerId"`
+	LoserId     string             `bson:"loserId" json:"loserId"`
+	EloChange   float64            `bson:"eloChange" json:"eloChange"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	Bucket      int64              `bson:"bucket,omitempty" json:"-"`
+
+	UserIP   string `bson:"userIp" json:"-"`
+	AniToken string `bson:"aniToken" json:"-"`
+}
+
+// MatchResult is how a vote changed both waifus.
+type MatchResult struct {
+	EloChange float64
+	Winner    Waifu
+	Loser     Waifu
+}
+
+type Matchup struct {
+	Waifus []PublicWaifu `json:"waifus"`
+}
+
+type WarVoteResponse struct {
+	WinnerId  string  `json:"winnerId"`
+	LoserId   string  `json:"loserId"`
+	EloChange float64 `json:"eloChange"`
+	WinnerElo float64 `json:"winnerElo"`
+	LoserElo  float64 `json:"loserElo"`
+}
+
+type EloLeaderboardEntry struct {
+	Rank    int64   `json:"rank"`
+	WaifuId string  `json:"waifuId"`
+	Name    string  `json:"name"`
+	Image   string  `json:"image"`
+	Elo     float64 `json:"elo"`
+	Wins    int64   `json:"wins"`
+	Losses  int64   `json:"losses"`
+}
+
+// GetMatchup picks a random approved waifu and an opponent among those with
+// the closest Elo, the closer the likelier.
+func GetMatchup(c echo.Context, stores Stores) error {
+	first, err := stores.Waifus.Random(c.Request().Context(), WaifuApproved)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("There aren't enough waifus for a matchup")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	candidates, err := stores.Waifus.NearestElo(c.Request().Context(), WaifuApproved, first.Elo, first.ID, matchupCandidates)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+	if len(candidates) == 0 {
+		return utils.NotFound("There aren't enough waifus for a matchup")
+	}
+
+	weights := matchupWeights(first.Elo, candidates)
+	var total float64
+	for _, weight := range weights {
+		total += weight
+	}
+
+	second := candidates[len(candidates)-1]
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick < weight {
+			second = candidates[i]
+			break
+		}
+		pick -= weight
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	waifus := []PublicWaifu{newPublicWaifu(*first, format), newPublicWaifu(second, format)}
+	rand.Shuffle(len(waifus), func(i, j int) { waifus[i], waifus[j] = waifus[j], waifus[i] })
+
+	return c.JSON(http.StatusOK, Matchup{Waifus: waifus})
+}
+
+// VoteWar records which of two waifus won and moves Elo from the loser to
+// the winner. A voter, by IP or token, can vote on a pair once per cooldown.
+// The vote is stored before Elo moves, so racing requests can't both count.
+func VoteWar(c echo.Context, stores Stores, voteRequest *WarVoteRequest) error {
+	now := utils.Now()
+
+	if voteRequest.WinnerId == voteRequest.LoserId {
+		return utils.ValidationFailed("loserId", "A waifu can't face herself")
+	}
+
+	if voteRequest.AniToken == "" {
+		return utils.ValidationFailed("aniToken", "Token is required!")
+	}
+
+	if err := utils.CheckRecaptcha(voteRequest.RecaptchaToken); err != nil {
+		return err
+	}
+
+	winner, err := approvedWaifu(c, stores, voteRequest.WinnerId)
+	if err != nil {
+		return err
+	}
+	loser, err := approvedWaifu(c, stores, voteRequest.LoserId)
+	if err != nil {
+		return err
+	}
+
+	vote := WarVote{
+		ID:          primitive.NewObjectID(),
+		Pair:        pairKey(voteRequest.WinnerId, voteRequest.LoserId),
+		WinnerId:    voteRequest.WinnerId,
+		LoserId:     voteRequest.LoserId,
+		CreatedTime: now,
+		Bucket:      voteBucket(now.Time, warsConfig.VoteCooldown),
+		UserIP:      utils.GetUserIP(c),
+		AniToken:    voteRequest.AniToken,
+	}
+
+	since := now.Add(-warsConfig.VoteCooldown)
+	voted, err := stores.WarVotes.HasVoted(c.Request().Context(), vote.Pair, vote.UserIP, vote.AniToken, since)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+	if voted {
+		return utils.Conflict(utils.CodeAlreadyVoted, "You have already voted on this matchup recently")
+	}
+
+	if err := stores.WarVotes.Insert(c.Request().Context(), &vote); err != nil {
+		if errors.Is(err, ErrWarVoteExists) {
+			return utils.Conflict(utils.CodeAlreadyVoted, "You have already voted on this matchup recently")
+		}
+		return utils.InternalError(err, "Database error")
+	}
+
+	result, err := stores.Waifus.RecordMatch(c.Request().Context(), winner.ID, loser.ID, now)
+	if err != nil {
+		// The vote didn't count, so it mustn't hold the voter back either.
+		if deleteErr := stores.WarVotes.Delete(context.Background(), vote.ID); deleteErr != nil {
+			log.Println("Error removing war vote:", deleteErr)
+		}
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Waifu not found")
+		}
+		return utils.InternalError(err, "Failed to update Elo ratings")
+	}
+
+	// Elo has moved by now, the vote only keeps a record of how much.
+	if err := stores.WarVotes.SetEloChange(c.Request().Context(), vote.ID, result.EloChange); err != nil {
+		log.Println("Error recording war vote Elo change:", err)
+	}
+
+	return c.JSON(http.StatusOK, WarVoteResponse{
+		WinnerId:  vote.WinnerId,
+		LoserId:   vote.LoserId,
+		EloChange: result.EloChange,
+		WinnerElo: result.Winner.Elo,
+		LoserElo:  result.Loser.Elo,
+	})
+}
+
+func GetEloLeaderboard(c echo.Context, stores Stores) error {
+	listOptions, err := waifuListOptions(c)
+	if err != nil {
+		return err
+	}
+
+	waifus, err := stores.Waifus.List(c.Request().Context(), WaifuFilter{Status: WaifuApproved, Sort: WaifuSortElo}, listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	entries := make([]EloLeaderboardEntry, 0, len(waifus))
+	for i, waifu := range waifus {
+		entries = append(entries, EloLeaderboardEntry{
+			Rank:    listOptions.Offset + int64(i) + 1,
+			WaifuId: waifu.ID.Hex(),
+			Name:    waifu.Name,
+			Image:   waifu.Image,
+			Elo:     waifu.Elo,
+			Wins:    waifu.Wins,
+			Losses:  waifu.Losses,
+		})
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
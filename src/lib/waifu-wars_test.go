@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEloChange(t *testing.T) {
+	tests := []struct {
+		winner, loser float64
+		want          float64
+	}{
+		{1500, 1500, 16},
+		{1900, 1500, 32 / 11.0}, // the favorite expects to win 10 to 1
+		{1500, 1900, 320 / 11.0},
+		{1500, 2700, eloK * (1 - 1/(1+math.Pow(10, 3)))},
+	}
+
+	for _, test := range tests {
+		got := eloChange(test.winner, test.loser)
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("eloChange(%v, %v) = %v, want %v", test.winner, test.loser, got, test.want)
+		}
+
+		// Whoever wins, the two outcomes add up to K.
+		if sum := got + eloChange(test.loser, test.winner); math.Abs(sum-eloK) > 1e-9 {
+			t.Errorf("eloChange(%v, %v) and back add up to %v, want %v", test.winner, test.loser, sum, eloK)
+		}
+	}
+}
+
+func TestMatchupWeights(t *testing.T) {
+	candidates := []Waifu{{Elo: 1500}, {Elo: 1700}, {Elo: 1100}, {Elo: 1300}}
+
+	weights := matchupWeights(1500, candidates)
+	want := []float64{1, 0.5, 0.2, 0.5}
+	for i := range want {
+		if math.Abs(weights[i]-want[i]) > 1e-9 {
+			t.Errorf("weight at Elo %v = %v, want %v", candidates[i].Elo, weights[i], want[i])
+		}
+	}
+
+	if weights := matchupWeights(1500, nil); len(weights) != 0 {
+		t.Errorf("no candidates got weights %v", weights)
+	}
+}
+
+func TestVoteBucket(t *testing.T) {
+	day := 24 * time.Hour
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	if voteBucket(start, day) != voteBucket(start.Add(day-time.Nanosecond), day) {
+		t.Error("a day's votes fell in different buckets")
+	}
+	if voteBucket(start, day) == voteBucket(start.Add(day), day) {
+		t.Error("votes a day apart fell in the same bucket")
+	}
+	if bucket := voteBucket(start, 0); bucket != 0 {
+		t.Errorf("bucket without a cooldown = %d, want 0", bucket)
+	}
+}
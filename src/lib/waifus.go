@@ -1,17 +1,12 @@
 package lib
 
 import (
-	"animoshi-api-go/src/infra"
 	"animoshi-api-go/src/utils"
 	"context"
 	"errors"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"log"
 	"net/http"
-	"strconv"
 )
 
 type Waifu struct {
@@ -19,66 +14,274 @@ type Waifu struct {
 	Name        string             `bson:"name" json:"name"`
 	Description string             `bson:"description" json:"description"`
 	Image       string             `bson:"image" json:"image"`
+	Images      *utils.ImageSet    `bson:"images,omitempty" json:"images,omitempty"`
+	SourceURL   string             `bson:"sourceUrl,omitempty" json:"sourceUrl,omitempty"`
+	MediaSha256 string             `bson:"mediaSha256,omitempty" json:"-"`
 	UserId      string             `bson:"userId" json:"userId"`
-	CreatedTime string             `bson:"createdTime" json:"createdTime"`
-	UpdatedTime string             `bson:"updatedTime" json:"updatedTime"`
-	Rating      int64              `bson:"rating" json:"rating"`
+	CreatedTime utils.Timestamp    `bson:"createdTime" json:"createdTime"`
+	UpdatedTime utils.Timestamp    `bson:"updatedTime" json:"updatedTime"`
+	Rating      float64            `bson:"rating" json:"rating"` // average stars, 0 until rated
+	RatingCount int64              `bson:"ratingCount" json:"ratingCount"`
+	RatingSum   int64              `bson:"ratingSum" json:"-"`
+	RatingScore float64            `bson:"ratingScore" json:"ratingScore"` // see bayesianScore
 	Favorites   int64              `bson:"favorites" json:"favorites"`
-	Status      int64              `bson:"status" json:"status"`
-	MommyMeter  string             `bson:"mommyMeter" json:"mommyMeter"`
-	Comments    string             `bson:"comments" json:"comments"`
+	Comments    int64              `bson:"comments" json:"comments"`
+	Elo         float64            `bson:"elo" json:"elo"` // Waifu Wars, see eloChange
+	Wins        int64              `bson:"wins" json:"wins"`
+	Losses      int64              `bson:"losses" json:"losses"`
+	Status      WaifuStatus        `bson:"status" json:"status"`
+	MommyMeter  string             `bson:"mommyMeter" json:"mommyMeter"` // free-form, set by the submitter
+
+	// Community trait meters by trait key, only those voted on.
+	Traits map[string]TraitMeter `bson:"traits,omitempty" json:"traits,omitempty"`
+
+	// Only shown to moderators.
+	StatusHistory []WaifuStatusChange `bson:"statusHistory,omitempty" json:"statusHistory,omitempty"`
+
+	// Set on submitted waifus, never sent.
+	UserIP   string `bson:"userIp,omitempty" json:"-"`
+	AniToken string `bson:"aniToken,omitempty" json:"-"`
+}
+
+type WaifuStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
 }
 
-func GetWaifu(c echo.Context, client *mongo.Client) error {
-	collection := client.Database("animoshiApi").Collection("waifus")
+// PublicWaifu is what everyone but moderators sees of a waifu.
+type PublicWaifu struct {
+	ID          primitive.ObjectID    `json:"_id"`
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	Image       string                `json:"image"`
+	Images      *utils.ImageSet       `json:"images,omitempty"`
+	SourceURL   string                `json:"sourceUrl,omitempty"`
+	UserId      string                `json:"userId"`
+	CreatedTime utils.Timestamp       `json:"createdTime"`
+	UpdatedTime utils.Timestamp       `json:"updatedTime"`
+	Rating      float64               `json:"rating"`
+	RatingCount int64                 `json:"ratingCount"`
+	RatingScore float64               `json:"ratingScore"`
+	Favorites   int64                 `json:"favorites"`
+	Comments    int64                 `json:"comments"`
+	Elo         float64               `json:"elo"`
+	Wins        int64                 `json:"wins"`
+	Losses      int64                 `json:"losses"`
+	Status      WaifuStatus           `json:"status"`
+	MommyMeter  string                `json:"mommyMeter"`
+	Traits      map[string]TraitMeter `json:"traits,omitempty"`
+
+	// Only set for a viewer who sent their token.
+	IsFavorite *bool `json:"isFavorite,omitempty"`
+}
+
+// ModerationWaifu is a waifu with its status history, for moderators.
+type ModerationWaifu struct {
+	PublicWaifu
+	StatusHistory []WaifuStatusChange `json:"statusHistory"`
+}
+
+func newPublicWaifu(waifu Waifu, format utils.TimestampFormat) PublicWaifu {
+	return PublicWaifu{
+		ID:          waifu.ID,
+		Name:        waifu.Name,
+		Description: waifu.Description,
+		Image:       waifu.Image,
+		Images:      waifu.Images,
+		SourceURL:   waifu.SourceURL,
+		UserId:      waifu.UserId,
+		CreatedTime: waifu.CreatedTime.In(format),
+		UpdatedTime: waifu.UpdatedTime.In(format),
+		Rating:      waifu.Rating,
+		RatingCount: waifu.RatingCount,
+		RatingScore: waifu.RatingScore,
+		Favorites:   waifu.Favorites,
+		Comments:    waifu.Comments,
+		Elo:         waifu.Elo,
+		Wins:        waifu.Wins,
+		Losses:      waifu.Losses,
+		Status:      waifu.Status,
+		MommyMeter:  waifu.MommyMeter,
+		Traits:      waifu.Traits,
+	}
+}
+
+func newModerationWaifu(waifu Waifu, format utils.TimestampFormat) ModerationWaifu {
+	history := make([]WaifuStatusChange, 0, len(waifu.StatusHistory))
+	for _, change := range waifu.StatusHistory {
+		change.Time = change.Time.In(format)
+		history = append(history, change)
+	}
+
+	return ModerationWaifu{
+		PublicWaifu:   newPublicWaifu(waifu, format),
+		StatusHistory: history,
+	}
+}
 
-	if !utils.ValidateQueryParams(c, []string{"id"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID is required"})
+// GetWaifu also tells the viewer whether it's one of their favorites when
+// they send their token.
+func GetWaifu(c echo.Context, stores Stores, id string, viewerToken string) error {
+	if id == "" {
+		return utils.ValidationFailed("id", "ID is required")
 	}
 
-	idParam := c.QueryParam("id")
-	waifuID, err := primitive.ObjectIDFromHex(idParam)
+	waifuID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Waifu not found")
+	}
 
-	var waifu map[string]interface{}
-	err = collection.FindOne(context.TODO(), bson.M{"_id": waifuID}).Decode(&waifu)
+	waifu, err := stores.Waifus.Get(c.Request().Context(), waifuID)
 	if err != nil {
-		log.Println(err)
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Waifu not found"})
+		if errors.Is(err, ErrNotFound) {
+			return utils.NotFound("Waifu not found")
 		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching waifu data"})
+		return utils.InternalError(err, "Error fetching waifu data")
 	}
 
-	return c.JSON(http.StatusOK, waifu)
+	// Drafts, submissions and taken down waifus aren't public.
+	if waifu.Status != WaifuApproved {
+		return utils.NotFound("Waifu not found")
+	}
+
+	response := newPublicWaifu(*waifu, utils.ResponseTimestampFormat(c))
+
+	if viewerToken != "" {
+		isFavorite, err := stores.Favorites.Has(c.Request().Context(), id, viewerToken)
+		if err != nil {
+			return utils.InternalError(err, "Database error")
+		}
+		response.IsFavorite = &isFavorite
+	}
+
+	return c.JSON(http.StatusOK, response)
 }
 
-func GetWaifus(c echo.Context, client *mongo.Client) error {
-	offset := c.QueryParam("offset")
-	limit := c.QueryParam("limit")
+func GetWaifus(c echo.Context, stores Stores) error {
+	return listWaifus(c, stores, WaifuApproved, newPublicWaifu)
+}
 
+// GetModerationWaifus lists waifus of any status, with their history.
+func GetModerationWaifus(c echo.Context, stores Stores) error {
+	var status WaifuStatus
+	if value := c.QueryParam("status"); value != "" {
+		parsed, ok := ParseWaifuStatus(value)
+		if !ok {
+			return utils.ValidationFailed("status", "Unknown status")
+		}
+		status = parsed
+	}
+
+	return listWaifus(c, stores, status, newModerationWaifu)
+}
+
+func waifuListOptions(c echo.Context) (ListOptions, error) {
 	if !utils.ValidateQueryParams(c, []string{"limit", "offset"}) {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid params"})
+		return ListOptions{}, utils.BadRequest("Invalid params")
+	}
+
+	listOptions, err := parseListOptions(c.QueryParam("limit"), c.QueryParam("offset"))
+	if err != nil {
+		return ListOptions{}, utils.BadRequest("Invalid params")
 	}
 
-	limitInt, err := strconv.Atoi(limit)
+	if listOptions.Limit > 20 {
+		return ListOptions{}, utils.ValidationFailed("limit", "Limit cant be more than 20")
+	}
+
+	return listOptions, nil
+}
+
+// listWaifus takes an optional sort, "new" (the default) or "top".
+func listWaifus[T any](c echo.Context, stores Stores, status WaifuStatus, present func(Waifu, utils.TimestampFormat) T) error {
+	listOptions, err := waifuListOptions(c)
 	if err != nil {
 		return err
 	}
 
-	if limitInt > 20 {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Limit cant be more than 20"})
+	sort := WaifuSortNewest
+	switch value := WaifuSort(c.QueryParam("sort")); value {
+	case "", WaifuSortNewest:
+	case WaifuSortTopRated:
+		sort = value
+	default:
+		return utils.ValidationFailed("sort", "Sort must be new or top")
+	}
+
+	waifus, err := stores.Waifus.List(c.Request().Context(), WaifuFilter{Status: status, Sort: sort}, listOptions)
+	if err != nil {
+		return utils.InternalError(err, "Database error")
+	}
+
+	format := utils.ResponseTimestampFormat(c)
+	responses := make([]T, 0, len(waifus))
+	for _, waifu := range waifus {
+		responses = append(responses, present(waifu, format))
+	}
+
+	return c.JSON(http.StatusOK, responses)
+}
+
+// TransitionWaifu moves a waifu to another status if the state machine
+// allows it, and records who did it and why.
+func TransitionWaifu(ctx context.Context, stores Stores, id primitive.ObjectID, to WaifuStatus, by string, reason string) (*Waifu, error) {
+	waifu, err := stores.Waifus.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	change, err := newStatusChange(waifu.Status, to, by, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stores.Waifus.Transition(ctx, id, change); err != nil {
+		return nil, err
+	}
+
+	waifu.Status = to
+	waifu.UpdatedTime = change.Time
+	waifu.StatusHistory = append(waifu.StatusHistory, change)
+
+	return waifu, nil
+}
+
+// transitionProblem maps the errors of TransitionWaifu onto responses.
+func transitionProblem(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return utils.NotFound("Waifu not found")
+	case errors.Is(err, ErrInvalidWaifuTransition):
+		return utils.Conflict(utils.CodeInvalidTransition, err.Error())
+	case errors.Is(err, ErrWaifuStatusChanged):
+		return utils.Conflict(utils.CodeConflict, "The waifu was changed by someone else, reload and try again")
+	}
+	return utils.InternalError(err, "Database error")
+}
+
+func UpdateWaifuStatus(c echo.Context, stores Stores, id string, statusRequest *WaifuStatusRequest) error {
+	waifuID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.NotFound("Waifu not found")
+	}
+
+	to, ok := ParseWaifuStatus(statusRequest.Status)
+	if !ok {
+		return utils.ValidationFailed("status", "Unknown status")
+	}
+
+	if len(statusRequest.Reason) > 500 {
+		return utils.ValidationFailed("reason", "Reason is too long")
+	}
+
+	if to == WaifuRejected && statusRequest.Reason == "" {
+		return utils.ValidationFailed("reason", "A reason is required to reject a waifu")
 	}
 
-	waifus, err := infra.FindAllFromCollection(infra.FindAllCollectionsParams{
-		CollectionName: "waifus",
-		Client:         client,
-		Filter:         bson.D{{"status", "APPROVED"}},
-		Limit:          limit,
-		Offset:         offset,
-	})
+	waifu, err := TransitionWaifu(c.Request().Context(), stores, waifuID, to, "moderator:"+utils.GetModerator(c), sanitizeInput(statusRequest.Reason))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return transitionProblem(err)
 	}
 
-	return c.JSON(http.StatusOK, waifus)
+	return c.JSON(http.StatusOK, newModerationWaifu(*waifu, utils.ResponseTimestampFormat(c)))
 }
@@ -0,0 +1,16 @@
+package openapi
+
+import (
+	_ "embed"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+//go:embed docs.html
+var docsPage []byte
+
+// ServeDocs serves the API reference page. It loads openapi.json relative to
+// its own path, so both have to be mounted next to each other.
+func ServeDocs(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMETextHTMLCharsetUTF8, docsPage)
+}
@@ -0,0 +1,163 @@
+package openapi
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The subset of OpenAPI 3.0 this API needs. Only what's set is written out.
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Servers    []Server             `json:"servers,omitempty"`
+	Tags       []Tag                `json:"tags,omitempty"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+
+	// echo route ("GET /v1/posts/:id") -> operation, for validation and
+	// route checks.
+	operations map[string]*Operation
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // path or query
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+func NewDocument(info Info) *Document {
+	return &Document{
+		OpenAPI:    "3.0.3",
+		Info:       info,
+		Paths:      map[string]*PathItem{},
+		Components: Components{Schemas: map[string]*Schema{}},
+		operations: map[string]*Operation{},
+	}
+}
+
+var echoParam = regexp.MustCompile(`:(\w+)`)
+
+func routeKey(method string, path string) string {
+	return strings.ToUpper(method) + " " + path
+}
+
+// Add documents the route registered in echo as method and path, e.g.
+// "GET", "/v1/posts/:id". Adding the same route twice panics, it's always a
+// mistake in the document.
+func (d *Document) Add(method string, path string, operation *Operation) {
+	key := routeKey(method, path)
+	if _, ok := d.operations[key]; ok {
+		panic("openapi: " + key + " is documented twice")
+	}
+	d.operations[key] = operation
+
+	specPath := echoParam.ReplaceAllString(path, "{$1}")
+	item, ok := d.Paths[specPath]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[specPath] = item
+	}
+	(*item)[strings.ToLower(method)] = operation
+}
+
+// Operation returns the documented operation for an echo route.
+func (d *Document) Operation(method string, path string) (*Operation, bool) {
+	operation, ok := d.operations[routeKey(method, path)]
+	return operation, ok
+}
+
+// Undocumented lists the registered routes that have no operation in the
+// document. Paths in ignore are skipped, as are echo's own not-found routes.
+func (d *Document) Undocumented(routes []*echo.Route, ignore ...string) []string {
+	ignored := map[string]bool{}
+	for _, path := range ignore {
+		ignored[path] = true
+	}
+
+	var missing []string
+	for _, route := range routes {
+		if ignored[route.Path] || route.Method == echo.RouteNotFound {
+			continue
+		}
+		if _, ok := d.Operation(route.Method, route.Path); !ok {
+			missing = append(missing, routeKey(route.Method, route.Path))
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+// CheckRoutes fails when a registered route is missing from the document,
+// so new routes can't ship without a spec entry.
+func (d *Document) CheckRoutes(routes []*echo.Route, ignore ...string) error {
+	if missing := d.Undocumented(routes, ignore...); len(missing) > 0 {
+		return fmt.Errorf("routes missing from the OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (d *Document) ServeJSON(c echo.Context) error {
+	return c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,213 @@
+package openapi
+
+import (
+	"animoshi-api-go/src/utils"
+	"encoding"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+func String() *Schema  { return &Schema{Type: "string"} }
+func Integer() *Schema { return &Schema{Type: "integer", Format: "int64"} }
+func Number() *Schema  { return &Schema{Type: "number", Format: "double"} }
+func Boolean() *Schema { return &Schema{Type: "boolean"} }
+
+func ArrayOf(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+func MapOf(values *Schema) *Schema {
+	return &Schema{Type: "object", AdditionalProperties: values}
+}
+
+// Object builds an inline object schema, required lists the property names
+// that must be present.
+func Object(properties map[string]*Schema, required ...string) *Schema {
+	return &Schema{Type: "object", Properties: properties, Required: required}
+}
+
+// Binary is a file part of a multipart body.
+func Binary() *Schema { return &Schema{Type: "string", Format: "binary"} }
+
+// ObjectID is a Mongo id in its hex form.
+func ObjectID() *Schema {
+	return String().Matching("^[0-9a-fA-F]{24}$").Describe("Object id, 24 hex characters")
+}
+
+func (s *Schema) Describe(description string) *Schema {
+	s.Description = description
+	return s
+}
+
+func (s *Schema) Formatted(format string) *Schema {
+	s.Format = format
+	return s
+}
+
+func (s *Schema) Min(minimum float64) *Schema {
+	s.Minimum = &minimum
+	return s
+}
+
+func (s *Schema) Max(maximum float64) *Schema {
+	s.Maximum = &maximum
+	return s
+}
+
+func (s *Schema) MinLen(length int) *Schema {
+	s.MinLength = &length
+	return s
+}
+
+func (s *Schema) MaxLen(length int) *Schema {
+	s.MaxLength = &length
+	return s
+}
+
+func (s *Schema) Matching(pattern string) *Schema {
+	s.Pattern = pattern
+	s.pattern = regexp.MustCompile(pattern)
+	return s
+}
+
+func (s *Schema) OneOf(values ...interface{}) *Schema {
+	s.Enum = values
+	return s
+}
+
+const componentPrefix = "#/components/schemas/"
+
+func ref(name string) *Schema {
+	return &Schema{Ref: componentPrefix + name}
+}
+
+// Named registers schema as a component and returns a reference to it.
+func (d *Document) Named(name string, schema *Schema) *Schema {
+	d.Components.Schemas[name] = schema
+	return ref(name)
+}
+
+// Model describes the JSON form of v, a struct value, from its json tags.
+// Named structs become components, fields without omitempty are required
+// since they're always written.
+func (d *Document) Model(v interface{}) *Schema {
+	return d.schemaOf(reflect.TypeOf(v))
+}
+
+var (
+	objectIDType      = reflect.TypeOf(primitive.ObjectID{})
+	timestampType     = reflect.TypeOf(utils.Timestamp{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (d *Document) schemaOf(t reflect.Type) *Schema {
+	if t == objectIDType {
+		return ObjectID()
+	}
+	if t == timestampType {
+		return String().Formatted("date-time").Describe("ISO-8601, milliseconds as a string on the legacy routes")
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := d.schemaOf(t.Elem())
+		if schema.Ref != "" {
+			return schema
+		}
+		schema.Nullable = true
+		return schema
+	case reflect.String:
+		return String()
+	case reflect.Bool:
+		return Boolean()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Integer()
+	case reflect.Float32, reflect.Float64:
+		return Number()
+	case reflect.Slice, reflect.Array:
+		return ArrayOf(d.schemaOf(t.Elem()))
+	case reflect.Map:
+		return MapOf(d.schemaOf(t.Elem()))
+	case reflect.Struct:
+		if t.Implements(textMarshalerType) {
+			return String()
+		}
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+		if _, ok := d.Components.Schemas[t.Name()]; !ok {
+			// Reserve the name first so self-referencing types terminate.
+			d.Components.Schemas[t.Name()] = &Schema{}
+			d.Components.Schemas[t.Name()] = d.structSchema(t)
+		}
+		return ref(t.Name())
+	}
+
+	return &Schema{}
+}
+
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	schema := Object(map[string]*Schema{})
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			// Embedded structs are flattened, like encoding/json does.
+			embedded := d.structSchema(field.Type)
+			for name, property := range embedded.Properties {
+				schema.Properties[name] = property
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = d.schemaOf(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	return schema
+}
+
+// resolve follows a component reference.
+func (d *Document) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = d.Components.Schemas[strings.TrimPrefix(schema.Ref, componentPrefix)]
+	}
+	return schema
+}
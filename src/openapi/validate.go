@@ -0,0 +1,309 @@
+package openapi
+
+import (
+	"animoshi-api-go/src/utils"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidateRequests checks path and query parameters and the body of every
+// documented route against the document before the handler runs. Routes
+// that aren't documented pass through untouched.
+func (d *Document) ValidateRequests() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			operation, ok := d.Operation(c.Request().Method, c.Path())
+			if !ok {
+				return next(c)
+			}
+
+			var errs []utils.FieldError
+
+			for _, parameter := range operation.Parameters {
+				var raw string
+				switch parameter.In {
+				case "path":
+					raw = c.Param(parameter.Name)
+				case "header":
+					raw = c.Request().Header.Get(parameter.Name)
+				default:
+					raw = c.QueryParam(parameter.Name)
+				}
+
+				if raw == "" {
+					if parameter.Required {
+						errs = append(errs, utils.FieldError{Field: parameter.Name, Message: parameter.Name + " is required"})
+					}
+					continue
+				}
+
+				d.validate(parameter.Schema, d.coerce(parameter.Schema, raw), parameter.Name, &errs)
+			}
+
+			if operation.RequestBody != nil {
+				if err := d.validateBody(c, operation.RequestBody, &errs); err != nil {
+					return err
+				}
+			}
+
+			if len(errs) == 1 {
+				return utils.ValidationFailed(errs[0].Field, errs[0].Message)
+			}
+			if len(errs) > 1 {
+				problem := utils.NewProblem(http.StatusBadRequest, utils.CodeValidationFailed, "Validation failed")
+				for _, fieldError := range errs {
+					problem.WithField(fieldError.Field, fieldError.Message)
+				}
+				return problem
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func (d *Document) validateBody(c echo.Context, body *RequestBody, errs *[]utils.FieldError) error {
+	request := c.Request()
+
+	accepted := make([]string, 0, len(body.Content))
+	for name := range body.Content {
+		accepted = append(accepted, name)
+	}
+	sort.Strings(accepted)
+
+	contentType := request.Header.Get(echo.HeaderContentType)
+	if contentType == "" && request.ContentLength <= 0 {
+		// No body at all, only the required fields can be wrong.
+		if body.Required && len(accepted) > 0 {
+			d.validate(body.Content[accepted[0]].Schema, map[string]interface{}{}, "", errs)
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return utils.BadRequest("Invalid Content-Type")
+	}
+
+	content, ok := body.Content[mediaType]
+	if !ok {
+		return utils.NewProblem(http.StatusUnsupportedMediaType, utils.CodeInvalidRequest,
+			"Content-Type must be one of "+strings.Join(accepted, ", "))
+	}
+
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		raw, err := io.ReadAll(request.Body)
+		if err != nil {
+			return utils.BadRequest("Could not read the request body")
+		}
+		// The handler binds the body again.
+		request.Body = io.NopCloser(bytes.NewReader(raw))
+
+		var value interface{} = map[string]interface{}{}
+		if len(bytes.TrimSpace(raw)) > 0 {
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return utils.BadRequest("Request body is not valid JSON")
+			}
+		}
+
+		d.validate(content.Schema, value, "", errs)
+	case echo.MIMEApplicationForm, echo.MIMEMultipartForm:
+		form, err := c.FormParams()
+		if err != nil {
+			return utils.BadRequest("Invalid form body")
+		}
+
+		d.validateForm(c, d.resolve(content.Schema), form, errs)
+	}
+
+	return nil
+}
+
+// validateForm checks a form body against an object schema, values are
+// strings so they're converted to the property's type first.
+func (d *Document) validateForm(c echo.Context, schema *Schema, form map[string][]string, errs *[]utils.FieldError) {
+	if schema == nil {
+		return
+	}
+
+	present := map[string]bool{}
+	for name, values := range form {
+		present[name] = len(values) > 0 && values[0] != ""
+	}
+	if multipartForm, err := c.MultipartForm(); err == nil {
+		for name, files := range multipartForm.File {
+			present[name] = len(files) > 0
+		}
+	}
+
+	for _, name := range schema.Required {
+		if !present[name] {
+			*errs = append(*errs, utils.FieldError{Field: name, Message: name + " is required"})
+		}
+	}
+
+	for _, name := range propertyNames(schema) {
+		property := d.resolve(schema.Properties[name])
+		if property.Format == "binary" || len(form[name]) == 0 || form[name][0] == "" {
+			continue
+		}
+		d.validate(property, d.coerce(property, form[name][0]), name, errs)
+	}
+}
+
+// coerce turns a parameter or form value into the type its schema asks for.
+// Values that don't convert are left as strings and fail the type check.
+func (d *Document) coerce(schema *Schema, raw string) interface{} {
+	switch d.resolve(schema).Type {
+	case "integer", "number":
+		if number, err := strconv.ParseFloat(raw, 64); err == nil {
+			return number
+		}
+	case "boolean":
+		if value, err := strconv.ParseBool(raw); err == nil {
+			return value
+		}
+	}
+	return raw
+}
+
+// propertyNames sorts the properties so errors come out in a stable order.
+func propertyNames(schema *Schema) []string {
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fieldName(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func describe(field string) string {
+	if field == "" {
+		return "body"
+	}
+	return field
+}
+
+// validate checks a decoded JSON value against schema and appends a field
+// error for every rule it breaks.
+func (d *Document) validate(schema *Schema, value interface{}, field string, errs *[]utils.FieldError) {
+	schema = d.resolve(schema)
+	if schema == nil {
+		return
+	}
+
+	fail := func(message string) {
+		*errs = append(*errs, utils.FieldError{Field: field, Message: describe(field) + " " + message})
+	}
+
+	if value == nil {
+		if !schema.Nullable && schema.Type != "" {
+			fail("must not be null")
+		}
+		return
+	}
+
+	switch schema.Type {
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		length := utf8.RuneCountInString(text)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			fail(fmt.Sprintf("must be at least %d characters", *schema.MinLength))
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			fail(fmt.Sprintf("must be at most %d characters", *schema.MaxLength))
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(text) {
+			fail("has an invalid format")
+		}
+	case "integer", "number":
+		number, ok := value.(float64)
+		if !ok {
+			fail("must be a number")
+			return
+		}
+		if schema.Type == "integer" && number != math.Trunc(number) {
+			fail("must be a whole number")
+			return
+		}
+		if schema.Minimum != nil && number < *schema.Minimum {
+			fail("must be at least " + strconv.FormatFloat(*schema.Minimum, 'f', -1, 64))
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			fail("must be at most " + strconv.FormatFloat(*schema.Maximum, 'f', -1, 64))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be true or false")
+			return
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		for i, item := range items {
+			d.validate(schema.Items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				*errs = append(*errs, utils.FieldError{Field: fieldName(field, name), Message: fieldName(field, name) + " is required"})
+			}
+		}
+		// Unknown members are ignored, the handlers never read them.
+		for _, name := range propertyNames(schema) {
+			if member, ok := object[name]; ok {
+				d.validate(schema.Properties[name], member, fieldName(field, name), errs)
+			}
+		}
+		if schema.AdditionalProperties != nil {
+			for name, member := range object {
+				if _, known := schema.Properties[name]; !known {
+					d.validate(schema.AdditionalProperties, member, fieldName(field, name), errs)
+				}
+			}
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return
+			}
+		}
+		options := make([]string, 0, len(schema.Enum))
+		for _, allowed := range schema.Enum {
+			options = append(options, fmt.Sprint(allowed))
+		}
+		fail("must be one of " + strings.Join(options, ", "))
+	}
+}
@@ -0,0 +1,60 @@
+package routes
+
+import (
+	"animoshi-api-go/src/utils"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// When the /v1 API shipped and the old paths became aliases.
+var legacyDeprecatedSince = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+var legacySunset time.Time
+
+// ConfigureLegacyRoutes sets the date after which the pre-/v1 paths may be
+// removed. It is sent in the Sunset header.
+func ConfigureLegacyRoutes(sunset time.Time) {
+	legacySunset = sunset
+}
+
+var successorParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// deprecated marks a pre-/v1 route. successor is the /v1 path that replaces
+// it, {name} placeholders are filled from the path or query params.
+func deprecated(successor string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			complete := true
+			link := successorParam.ReplaceAllStringFunc(successor, func(placeholder string) string {
+				name := placeholder[1 : len(placeholder)-1]
+				value := c.Param(name)
+				if value == "" {
+					value = c.QueryParam(name)
+				}
+				if value == "" {
+					complete = false
+				}
+				return url.PathEscape(value)
+			})
+
+			// Clients of the old paths expect millisecond timestamps.
+			utils.UseMillisTimestamps(c)
+
+			header := c.Response().Header()
+			header.Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedSince.Unix(), 10))
+			if !legacySunset.IsZero() {
+				header.Set("Sunset", legacySunset.UTC().Format(http.TimeFormat))
+			}
+			// Ids sent in the body can't be filled in, skip the link then.
+			if complete {
+				header.Add("Link", "<"+link+`>; rel="successor-version"`)
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package routes
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
+	"bytes"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// submittedMedia is the image or video attached to a form, already
+// sanitized, checked against banned media and stored.
+type submittedMedia struct {
+	ImageURL  string
+	SourceURL string
+	Images    *utils.ImageSet
+	VideoURL  string
+	VideoMeta *utils.VideoMetadata
+	SHA256    string
+}
+
+func errVideoNotAllowed() error {
+	return utils.ValidationFailed("file", "Only images are allowed here")
+}
+
+// receiveMedia takes the media of a multipart form from one of, in order,
+// an "image" URL to copy, an uploaded "file", or the "uploadId" of a
+// finished direct upload. It returns nil without error when there is none.
+func receiveMedia(c echo.Context, stores lib.Stores, store infra.Storage, userId string, aniToken string, allowVideo bool) (*submittedMedia, error) {
+	image := c.FormValue("image")
+	uploadId := c.FormValue("uploadId")
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		file = nil
+	}
+
+	media := &submittedMedia{}
+
+	if len(image) > 0 {
+		if len(image) > 500 {
+			return nil, utils.ValidationFailed("image", "Image is too long")
+		}
+
+		// Remote images are copied into our storage instead of being
+		// hotlinked, the original URL is kept as sourceUrl.
+		mirrored, upload, err := lib.MirrorRemoteImage(c.Request().Context(), stores, store, image, lib.MediaCheck{
+			UserID:   userId,
+			UserIP:   utils.GetUserIP(c),
+			AniToken: aniToken,
+		})
+		if err != nil {
+			if errors.Is(err, lib.ErrBannedMedia) {
+				return nil, utils.NewProblem(http.StatusBadRequest, utils.CodeBannedMedia, "This file is not allowed")
+			}
+			if errors.Is(err, utils.ErrRemoteFetch) || errors.Is(err, utils.ErrInvalidUpload) {
+				return nil, err
+			}
+			return nil, utils.InternalError(err, "Failed to upload file")
+		}
+
+		media.Images = mirrored
+		media.ImageURL = mirrored.Original.URL
+		media.SourceURL = image
+		media.SHA256 = upload.SHA256
+	} else if file != nil {
+		if file.Size > utils.CurrentUploadLimits().MaxVideoBytes {
+			return nil, utils.NewProblem(http.StatusRequestEntityTooLarge, utils.CodePayloadTooLarge, "File size exceeds 50MB")
+		}
+
+		src, err := file.Open()
+		if err != nil {
+			return nil, utils.InternalError(err, "Failed to open file")
+		}
+		defer src.Close()
+
+		// Never trust the client's Content-Type, the pipeline sniffs the
+		// real type and strips metadata before anything is stored.
+		upload, err := utils.SanitizeUpload(src, utils.CurrentUploadLimits())
+		if err != nil {
+			if errors.Is(err, utils.ErrInvalidUpload) {
+				return nil, err
+			}
+			return nil, utils.InternalError(err, "Failed to process file")
+		}
+
+		if upload.IsVideo() && !allowVideo {
+			return nil, errVideoNotAllowed()
+		}
+
+		err = lib.CheckBannedMedia(c.Request().Context(), stores, lib.MediaCheck{
+			SHA256:    upload.SHA256,
+			ImageHash: upload.PerceptualHash,
+			Source:    lib.MediaSourceUpload,
+			UserID:    userId,
+			UserIP:    utils.GetUserIP(c),
+			AniToken:  aniToken,
+		})
+		if err != nil {
+			if errors.Is(err, lib.ErrBannedMedia) {
+				return nil, utils.NewProblem(http.StatusBadRequest, utils.CodeBannedMedia, "This file is not allowed")
+			}
+			return nil, utils.InternalError(err, "Database error")
+		}
+
+		media.SHA256 = upload.SHA256
+
+		if upload.IsVideo() {
+			key := utils.NewObjectName(upload.Extension)
+			if err := store.Put(c.Request().Context(), key, bytes.NewReader(upload.Data), upload.ContentType); err != nil {
+				return nil, utils.InternalError(err, "Failed to upload file")
+			}
+			media.VideoURL = store.URL(key)
+			media.VideoMeta = upload.Video
+		} else {
+			media.Images, err = utils.UploadImageSet(c.Request().Context(), store, upload)
+			if err != nil {
+				return nil, utils.InternalError(err, "Failed to upload file")
+			}
+			media.ImageURL = media.Images.Original.URL
+		}
+	} else if uploadId != "" {
+		// Files that went straight to the bucket were already sanitized by
+		// POST /uploads/:id/complete.
+		upload, err := lib.ClaimUpload(c.Request().Context(), stores, uploadId, aniToken)
+		if err != nil {
+			if errors.Is(err, lib.ErrUploadNotFound) {
+				return nil, utils.NotFound("Upload not found")
+			}
+			if errors.Is(err, lib.ErrUploadNotReady) {
+				return nil, utils.Conflict(utils.CodeConflict, err.Error())
+			}
+			return nil, utils.InternalError(err, "Database error")
+		}
+
+		if upload.VideoMeta != nil && !allowVideo {
+			return nil, errVideoNotAllowed()
+		}
+
+		media.SHA256 = upload.SHA256
+
+		if upload.VideoMeta != nil {
+			media.VideoURL = upload.URL
+			media.VideoMeta = upload.VideoMeta
+		} else {
+			media.ImageURL = upload.URL
+			media.Images = upload.Images
+		}
+	} else {
+		return nil, nil
+	}
+
+	return media, nil
+}
@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
+	"github.com/labstack/echo/v4"
+)
+
+func SetupModerationRoutes(e *echo.Echo, stores lib.Stores, moderators map[string]string) {
+	requireModerator := utils.RequireModerator(moderators)
+	moderation := e.Group("/v1/moderation", requireModerator)
+
+	getBannedMedia := func(c echo.Context) error {
+		return lib.GetBannedMedia(c, stores)
+	}
+
+	getBlockedUploads := func(c echo.Context) error {
+		return lib.GetBlockedUploads(c, stores)
+	}
+
+	banPostMedia := func(c echo.Context) error {
+		bannedMediaRequest := new(lib.BannedMediaRequest)
+
+		if err := c.Bind(bannedMediaRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.BanPostMedia(c, stores, bannedMediaRequest)
+	}
+
+	reviewBlockedUpload := func(c echo.Context) error {
+		return lib.ReviewBlockedUpload(c, stores, c.Param("id"))
+	}
+
+	getWaifus := func(c echo.Context) error {
+		return lib.GetModerationWaifus(c, stores)
+	}
+
+	updateWaifuStatus := func(c echo.Context) error {
+		statusRequest := new(lib.WaifuStatusRequest)
+
+		if err := c.Bind(statusRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.UpdateWaifuStatus(c, stores, c.Param("id"), statusRequest)
+	}
+
+	createTournament := func(c echo.Context) error {
+		tournamentRequest := new(lib.TournamentRequest)
+
+		if err := c.Bind(tournamentRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.CreateTournament(c, stores, tournamentRequest)
+	}
+
+	createTrait := func(c echo.Context) error {
+		traitRequest := new(lib.TraitRequest)
+
+		if err := c.Bind(traitRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.CreateTrait(c, stores, traitRequest)
+	}
+
+	// GET ROUTES
+	moderation.GET("/banned-media", getBannedMedia)
+	moderation.GET("/blocked-uploads", getBlockedUploads)
+	moderation.GET("/waifus", getWaifus)
+
+	// POST ROUTES
+	moderation.POST("/banned-media", banPostMedia)
+	moderation.POST("/blocked-uploads/:id/review", reviewBlockedUpload)
+	moderation.POST("/waifus/:id/status", updateWaifuStatus)
+	moderation.POST("/tournaments", createTournament)
+	moderation.POST("/traits", createTrait)
+}
@@ -0,0 +1,629 @@
+package routes
+
+import (
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/openapi"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+// APIDocument describes every route the Setup functions register. The
+// server refuses to start when a route is missing here, see
+// openapi.Document.CheckRoutes.
+func APIDocument() *openapi.Document {
+	doc := openapi.NewDocument(openapi.Info{
+		Title:       "Animoshi API",
+		Version:     "1.0.0",
+		Description: "Errors are application/problem+json documents with a stable code. Routes outside /v1 are deprecated aliases.",
+	})
+	doc.Tags = []openapi.Tag{
+		{Name: "posts"},
+		{Name: "waifus"},
+		{Name: "users", Description: "Public profiles, by the userId sent with posts and favorites."},
+		{Name: "tournaments", Description: "Single-elimination brackets, created by moderators."},
+		{Name: "uploads"},
+		{Name: "moderation", Description: "Needs a moderator token."},
+		{Name: "meta"},
+	}
+	doc.Components.SecuritySchemes = map[string]openapi.SecurityScheme{
+		"moderatorToken": {Type: "http", Scheme: "bearer", Description: "A moderator token from the server config."},
+	}
+
+	problem := doc.Named("Problem", openapi.Object(map[string]*openapi.Schema{
+		"type":      openapi.String(),
+		"title":     openapi.String(),
+		"status":    openapi.Integer(),
+		"detail":    openapi.String(),
+		"instance":  openapi.String(),
+		"code":      openapi.String().Describe("Stable error code, e.g. validation_failed or already_voted"),
+		"requestId": openapi.String(),
+		"errors": openapi.ArrayOf(openapi.Object(map[string]*openapi.Schema{
+			"field":   openapi.String(),
+			"message": openapi.String(),
+		}, "field", "message")),
+		"error": openapi.String().Describe("Same as detail, kept for older clients"),
+	}, "type", "title", "status", "code"))
+
+	api := &documentBuilder{doc: doc, problem: problem}
+	api.posts()
+	api.waifus()
+	api.users()
+	api.tournaments()
+	api.uploads()
+	api.moderation()
+	api.meta()
+
+	return doc
+}
+
+type documentBuilder struct {
+	doc     *openapi.Document
+	problem *openapi.Schema
+}
+
+func (b *documentBuilder) responses(description string, schema *openapi.Schema, errorStatuses ...int) map[string]openapi.Response {
+	responses := map[string]openapi.Response{
+		"200": {Description: description, Content: map[string]openapi.MediaType{
+			echo.MIMEApplicationJSON: {Schema: schema},
+		}},
+	}
+
+	for _, status := range append(errorStatuses, http.StatusTooManyRequests, http.StatusInternalServerError) {
+		responses[strconv.Itoa(status)] = openapi.Response{
+			Description: http.StatusText(status),
+			Content: map[string]openapi.MediaType{
+				"application/problem+json": {Schema: b.problem},
+			},
+		}
+	}
+
+	return responses
+}
+
+// legacy documents a deprecated alias, it points at the /v1 route instead
+// of repeating its description.
+func legacy(operation *openapi.Operation, successor string) *openapi.Operation {
+	operation.Deprecated = true
+	operation.Description = "Deprecated, use " + successor + " instead."
+	return operation
+}
+
+func pathParam(name string, schema *openapi.Schema) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "path", Required: true, Schema: schema}
+}
+
+func queryParam(name string, required bool, schema *openapi.Schema) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "query", Required: required, Schema: schema}
+}
+
+func headerParam(name string, required bool, schema *openapi.Schema) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "header", Required: required, Schema: schema}
+}
+
+func listParams() []openapi.Parameter {
+	return []openapi.Parameter{
+		queryParam("limit", true, openapi.Integer().Min(0).Max(20).Describe("Page size, at most 20")),
+		queryParam("offset", true, openapi.Integer().Min(0)),
+	}
+}
+
+// jsonBody is a body read with c.Bind, which takes JSON or a urlencoded form.
+func jsonBody(schema *openapi.Schema) *openapi.RequestBody {
+	return &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+		echo.MIMEApplicationJSON: {Schema: schema},
+		echo.MIMEApplicationForm: {Schema: schema},
+	}}
+}
+
+// aniTokenHeader identifies the viewer on routes without a body.
+func aniTokenHeader(required bool) openapi.Parameter {
+	return headerParam("X-Ani-Token", required, openapi.String().Describe("The viewer's aniToken"))
+}
+
+func waifuSortParam() openapi.Parameter {
+	return queryParam("sort", false, openapi.String().OneOf(string(lib.WaifuSortNewest), string(lib.WaifuSortTopRated)).
+		Describe("new (default) or top, by the Bayesian weighted rating"))
+}
+
+func userID() *openapi.Schema {
+	return openapi.String().MaxLen(128)
+}
+
+// commentBody is the same for every comment target, on /v1 the target is
+// in the path.
+func commentBody() *openapi.Schema {
+	return openapi.Object(map[string]*openapi.Schema{
+		"text":           openapi.String().MaxLen(1000),
+		"userId":         userID(),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "recaptchaToken")
+}
+
+func (b *documentBuilder) posts() {
+	doc := b.doc
+
+	post := doc.Model(lib.PostResponse{})
+	posts := openapi.ArrayOf(post)
+	comments := openapi.ArrayOf(doc.Model(lib.PostCommentResponse{}))
+	similar := openapi.ArrayOf(doc.Model(lib.SimilarPost{}))
+
+	newPostForm := doc.Named("NewPost", openapi.Object(map[string]*openapi.Schema{
+		"title":          openapi.String().MaxLen(100),
+		"content":        openapi.String().MaxLen(500),
+		"image":          openapi.String().MaxLen(500).Matching("^https://").Describe("Remote image to copy, instead of file or uploadId"),
+		"file":           openapi.Binary().Describe("Image or video to upload"),
+		"uploadId":       openapi.ObjectID().Describe("A completed direct upload"),
+		"nsfwToggle":     openapi.Integer().OneOf(0, 1),
+		"userId":         userID(),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "title", "recaptchaToken", "aniToken"))
+	newPostBody := &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+		echo.MIMEMultipartForm:   {Schema: newPostForm},
+		echo.MIMEApplicationForm: {Schema: newPostForm},
+	}}
+
+	newComment := doc.Named("NewComment", commentBody())
+	legacyCommentBody := commentBody()
+	legacyCommentBody.Properties["postId"] = openapi.ObjectID()
+	legacyCommentBody.Required = append(legacyCommentBody.Required, "postId")
+	legacyComment := doc.Named("LegacyNewComment", legacyCommentBody)
+
+	voteProperties := func() map[string]*openapi.Schema {
+		return map[string]*openapi.Schema{
+			"recaptchaToken": openapi.String(),
+			"aniToken":       openapi.String(),
+		}
+	}
+	vote := doc.Named("Vote", openapi.Object(voteProperties(), "recaptchaToken"))
+	legacyVoteProperties := voteProperties()
+	legacyVoteProperties["postId"] = openapi.ObjectID()
+	legacyVote := doc.Named("LegacyVote", openapi.Object(legacyVoteProperties, "postId", "recaptchaToken"))
+	like := doc.Model(lib.PostLikeResponse{})
+	dislike := doc.Model(lib.PostDislikeResponse{})
+
+	postID := pathParam("id", openapi.ObjectID())
+	maxDistance := queryParam("maxDistance", false, openapi.Integer().Min(0).Max(20).Describe("Max Hamming distance between image hashes"))
+
+	listPosts := func(id string) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "List posts, newest first",
+			Parameters: listParams(),
+			Responses:  b.responses("A page of posts", posts, http.StatusBadRequest),
+		}
+	}
+	getPost := func(id string, idParam openapi.Parameter) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "Get a post",
+			Parameters: []openapi.Parameter{idParam},
+			Responses:  b.responses("The post", post, http.StatusBadRequest, http.StatusNotFound),
+		}
+	}
+	listComments := func(id string, idParam openapi.Parameter) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "List a post's comments, newest first",
+			Parameters: append([]openapi.Parameter{idParam}, listParams()...),
+			Responses:  b.responses("A page of comments", comments, http.StatusBadRequest),
+		}
+	}
+	userPosts := func(id string, idParam openapi.Parameter) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "List a user's posts, newest first",
+			Parameters: append([]openapi.Parameter{idParam}, listParams()...),
+			Responses:  b.responses("A page of posts", posts, http.StatusBadRequest),
+		}
+	}
+	userPostCount := func(id string, idParam openapi.Parameter) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "Count a user's posts",
+			Parameters: []openapi.Parameter{idParam},
+			Responses:  b.responses("The number of posts", openapi.Integer(), http.StatusBadRequest),
+		}
+	}
+	createPost := func(id string) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "Create a post",
+			RequestBody: newPostBody,
+			Responses: b.responses("The new post", post, http.StatusBadRequest, http.StatusForbidden,
+				http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge),
+		}
+	}
+	createComment := func(id string, params []openapi.Parameter, body *openapi.Schema) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: "Comment on a post",
+			Parameters:  params,
+			RequestBody: jsonBody(body),
+			Responses:   b.responses("The new comment", doc.Model(lib.PostCommentResponse{}), http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound),
+		}
+	}
+	castVote := func(id string, summary string, params []openapi.Parameter, body *openapi.Schema, response *openapi.Schema) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"posts"}, Summary: summary,
+			Parameters:  params,
+			RequestBody: jsonBody(body),
+			Responses:   b.responses("The vote", response, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict),
+		}
+	}
+
+	doc.Add(http.MethodGet, "/v1/posts", listPosts("listPosts"))
+	doc.Add(http.MethodGet, "/v1/posts/:id", getPost("getPost", postID))
+	doc.Add(http.MethodGet, "/v1/posts/:id/comments", listComments("listPostComments", postID))
+	doc.Add(http.MethodGet, "/v1/posts/:id/similar", &openapi.Operation{
+		OperationID: "listSimilarPosts", Tags: []string{"posts"}, Summary: "Find posts with a similar image",
+		Parameters: []openapi.Parameter{postID, maxDistance},
+		Responses:  b.responses("Up to 20 similar posts, closest first", similar, http.StatusBadRequest, http.StatusNotFound),
+	})
+	doc.Add(http.MethodGet, "/v1/users/:id/posts", userPosts("listUserPosts", pathParam("id", userID())))
+	doc.Add(http.MethodGet, "/v1/users/:id/posts/count", userPostCount("countUserPosts", pathParam("id", userID())))
+	doc.Add(http.MethodPost, "/v1/posts", createPost("createPost"))
+	doc.Add(http.MethodPost, "/v1/posts/:id/comments", createComment("createPostComment", []openapi.Parameter{postID}, newComment))
+	doc.Add(http.MethodPost, "/v1/posts/:id/likes", castVote("likePost", "Like a post", []openapi.Parameter{postID}, vote, like))
+	doc.Add(http.MethodPost, "/v1/posts/:id/dislikes", castVote("dislikePost", "Dislike a post", []openapi.Parameter{postID}, vote, dislike))
+
+	doc.Add(http.MethodGet, "/post", legacy(getPost("legacyGetPost", queryParam("id", true, openapi.ObjectID())), "GET /v1/posts/{id}"))
+	doc.Add(http.MethodGet, "/posts", legacy(listPosts("legacyListPosts"), "GET /v1/posts"))
+	doc.Add(http.MethodGet, "/postsByUserId", legacy(userPosts("legacyListUserPosts", queryParam("userId", true, userID())), "GET /v1/users/{id}/posts"))
+	doc.Add(http.MethodGet, "/postCountByUserId", legacy(userPostCount("legacyCountUserPosts", queryParam("userId", true, userID())), "GET /v1/users/{id}/posts/count"))
+	doc.Add(http.MethodGet, "/postComments", legacy(listComments("legacyListPostComments", queryParam("postId", true, openapi.ObjectID())), "GET /v1/posts/{id}/comments"))
+	doc.Add(http.MethodPost, "/post", legacy(createPost("legacyCreatePost"), "POST /v1/posts"))
+	doc.Add(http.MethodPost, "/comment", legacy(createComment("legacyCreatePostComment", nil, legacyComment), "POST /v1/posts/{id}/comments"))
+	doc.Add(http.MethodPost, "/likePost", legacy(castVote("legacyLikePost", "Like a post", nil, legacyVote, like), "POST /v1/posts/{id}/likes"))
+	doc.Add(http.MethodPost, "/dislikePost", legacy(castVote("legacyDislikePost", "Dislike a post", nil, legacyVote, dislike), "POST /v1/posts/{id}/dislikes"))
+}
+
+func (b *documentBuilder) waifus() {
+	doc := b.doc
+
+	waifu := doc.Model(lib.PublicWaifu{})
+	submission := doc.Model(lib.WaifuSubmission{})
+	comment := doc.Model(lib.PostCommentResponse{})
+	newComment := doc.Named("NewComment", commentBody())
+
+	newWaifuForm := doc.Named("NewWaifu", openapi.Object(map[string]*openapi.Schema{
+		"name":           openapi.String().MaxLen(100),
+		"description":    openapi.String().MaxLen(1000),
+		"image":          openapi.String().MaxLen(500).Matching("^https://").Describe("Remote image to copy, instead of file or uploadId"),
+		"file":           openapi.Binary().Describe("Image to upload, videos aren't accepted"),
+		"uploadId":       openapi.ObjectID().Describe("A completed direct upload of an image"),
+		"userId":         userID(),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "name", "recaptchaToken", "aniToken"))
+	favorite := doc.Named("Favorite", openapi.Object(map[string]*openapi.Schema{
+		"userId":         userID().Describe("Shows the favorite on this user's profile"),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "recaptchaToken", "aniToken"))
+	favoriteResponse := doc.Model(lib.WaifuFavoriteResponse{})
+	rate := doc.Named("Rate", openapi.Object(map[string]*openapi.Schema{
+		"stars":          openapi.Integer().Min(1).Max(5),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "stars", "recaptchaToken"))
+	warVote := doc.Named("WarVote", openapi.Object(map[string]*openapi.Schema{
+		"winnerId":       openapi.ObjectID(),
+		"loserId":        openapi.ObjectID(),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "winnerId", "loserId", "recaptchaToken", "aniToken"))
+	newWaifuBody := &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{
+		echo.MIMEMultipartForm:   {Schema: newWaifuForm},
+		echo.MIMEApplicationForm: {Schema: newWaifuForm},
+	}}
+
+	listWaifus := func(id string) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"waifus"}, Summary: "List approved waifus, newest or top rated first",
+			Parameters: append(listParams(), waifuSortParam()),
+			Responses:  b.responses("A page of waifus", openapi.ArrayOf(waifu), http.StatusBadRequest),
+		}
+	}
+	getWaifu := func(id string, idParam openapi.Parameter) *openapi.Operation {
+		return &openapi.Operation{
+			OperationID: id, Tags: []string{"waifus"}, Summary: "Get a waifu",
+			Description: "isFavorite is only included when the viewer sends their token.",
+			Parameters:  []openapi.Parameter{idParam, aniTokenHeader(false)},
+			Responses:   b.responses("The waifu", waifu, http.StatusBadRequest, http.StatusNotFound),
+		}
+	}
+
+	metrics := make([]interface{}, 0, len(lib.LeaderboardMetrics))
+	for _, metric := range lib.LeaderboardMetrics {
+		metrics = append(metrics, string(metric))
+	}
+	windows := make([]interface{}, 0, len(lib.LeaderboardWindows))
+	for _, window := range lib.LeaderboardWindows {
+		windows = append(windows, string(window))
+	}
+
+	doc.Add(http.MethodGet, "/v1/waifus", listWaifus("listWaifus"))
+	doc.Add(http.MethodGet, "/v1/waifus/leaderboard", &openapi.Operation{
+		OperationID: "getWaifuLeaderboard", Tags: []string{"waifus"}, Summary: "Get a waifu leaderboard",
+		Description: "Ranked by ratings, favorites or comments made within the window, recomputed on a schedule. " +
+			"change compares each rank with the previous period, or with a week ago for all time.",
+		Parameters: []openapi.Parameter{
+			queryParam("by", false, openapi.String().OneOf(metrics...).Describe("rating (default), favorites or comments")),
+			queryParam("window", false, openapi.String().OneOf(windows...).Describe("week (default), month or all")),
+		},
+		Responses: b.responses("The leaderboard", doc.Model(lib.Leaderboard{}), http.StatusBadRequest, http.StatusNotFound),
+	})
+	doc.Add(http.MethodGet, "/v1/waifus/wars/matchup", &openapi.Operation{
+		OperationID: "getWaifuMatchup", Tags: []string{"waifus"}, Summary: "Get a random pair of approved waifus to vote on",
+		Description: "The second waifu is drawn from those with an Elo close to the first one's, the closer the likelier.",
+		Responses:   b.responses("Two waifus in random order", doc.Model(lib.Matchup{}), http.StatusNotFound),
+	})
+	doc.Add(http.MethodGet, "/v1/waifus/wars/leaderboard", &openapi.Operation{
+		OperationID: "getWaifuEloLeaderboard", Tags: []string{"waifus"}, Summary: "List approved waifus by Waifu Wars Elo, highest first",
+		Parameters: listParams(),
+		Responses:  b.responses("A page of the leaderboard", openapi.ArrayOf(doc.Model(lib.EloLeaderboardEntry{})), http.StatusBadRequest),
+	})
+	doc.Add(http.MethodGet, "/v1/waifus/traits", &openapi.Operation{
+		OperationID: "listWaifuTraits", Tags: []string{"waifus"}, Summary: "List the traits waifus can be scored on",
+		Responses: b.responses("Every trait, in the order they were added", openapi.ArrayOf(doc.Model(lib.Trait{}))),
+	})
+	doc.Add(http.MethodGet, "/v1/waifus/submissions", &openapi.Operation{
+		OperationID: "listWaifuSubmissions", Tags: []string{"waifus"}, Summary: "List your submitted waifus and their status, newest first",
+		Parameters: append([]openapi.Parameter{aniTokenHeader(true)}, listParams()...),
+		Responses:  b.responses("A page of submissions", openapi.ArrayOf(submission), http.StatusBadRequest),
+	})
+	doc.Add(http.MethodGet, "/v1/waifus/:id", getWaifu("getWaifu", pathParam("id", openapi.ObjectID())))
+	doc.Add(http.MethodGet, "/v1/waifus/:id/comments", &openapi.Operation{
+		OperationID: "listWaifuComments", Tags: []string{"waifus"}, Summary: "List a waifu's comments, newest first",
+		Parameters: append([]openapi.Parameter{pathParam("id", openapi.ObjectID())}, listParams()...),
+		Responses:  b.responses("A page of comments", openapi.ArrayOf(comment), http.StatusBadRequest),
+	})
+	doc.Add(http.MethodPost, "/v1/waifus", &openapi.Operation{
+		OperationID: "submitWaifu", Tags: []string{"waifus"}, Summary: "Submit a waifu for review",
+		Description: "The waifu is pending until a moderator approves it, only then is it listed.",
+		RequestBody: newWaifuBody,
+		Responses: b.responses("The submission", submission, http.StatusBadRequest, http.StatusForbidden,
+			http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge),
+	})
+	doc.Add(http.MethodPost, "/v1/waifus/:id/ratings", &openapi.Operation{
+		OperationID: "rateWaifu", Tags: []string{"waifus"}, Summary: "Rate a waifu from 1 to 5 stars",
+		Description: "Rating the same waifu again from the same IP or token changes the earlier rating.",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(rate),
+		Responses: b.responses("The rating and the waifu's new totals", doc.Model(lib.WaifuRatingResponse{}),
+			http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict),
+	})
+
+	doc.Add(http.MethodPost, "/v1/waifus/:id/traits", &openapi.Operation{
+		OperationID: "voteWaifuTraits", Tags: []string{"waifus"}, Summary: "Score a waifu on one or more traits from 0 to 10",
+		Description: "Scoring the same trait again from the same IP or token changes the earlier score.",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(doc.Named("TraitVote", openapi.Object(map[string]*openapi.Schema{
+			"scores":         openapi.MapOf(openapi.Integer().Min(0).Max(10)).Describe("Scores by trait key"),
+			"recaptchaToken": openapi.String(),
+			"aniToken":       openapi.String(),
+		}, "scores", "recaptchaToken"))),
+		Responses: b.responses("The scores and the waifu's trait meters", doc.Model(lib.WaifuTraitVoteResponse{}),
+			http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict),
+	})
+	doc.Add(http.MethodPost, "/v1/waifus/:id/favorite", &openapi.Operation{
+		OperationID: "favoriteWaifu", Tags: []string{"waifus"}, Summary: "Add a waifu to your favorites",
+		Description: "Favoriting a waifu that already is one of yours changes nothing.",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(favorite),
+		Responses:   b.responses("The waifu's favorite count", favoriteResponse, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound),
+	})
+	doc.Add(http.MethodDelete, "/v1/waifus/:id/favorite", &openapi.Operation{
+		OperationID: "unfavoriteWaifu", Tags: []string{"waifus"}, Summary: "Remove a waifu from your favorites",
+		Parameters: []openapi.Parameter{pathParam("id", openapi.ObjectID()), aniTokenHeader(true)},
+		Responses:  b.responses("The waifu's favorite count", favoriteResponse, http.StatusBadRequest, http.StatusNotFound),
+	})
+	doc.Add(http.MethodPost, "/v1/waifus/:id/comments", &openapi.Operation{
+		OperationID: "createWaifuComment", Tags: []string{"waifus"}, Summary: "Comment on a waifu",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(newComment),
+		Responses:   b.responses("The new comment", comment, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound),
+	})
+	doc.Add(http.MethodPost, "/v1/waifus/wars/votes", &openapi.Operation{
+		OperationID: "voteWaifuWar", Tags: []string{"waifus"}, Summary: "Vote for the winner of a matchup",
+		Description: "The winner takes Elo from the loser. The same IP or token can vote on a pair again once the cooldown is over.",
+		RequestBody: jsonBody(warVote),
+		Responses: b.responses("Both waifus' new Elo", doc.Model(lib.WarVoteResponse{}),
+			http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict),
+	})
+	doc.Add(http.MethodGet, "/v1/user/favorites/waifus", &openapi.Operation{
+		OperationID: "listFavoriteWaifus", Tags: []string{"waifus"}, Summary: "List your favorite waifus, most recently favorited first",
+		Parameters: append([]openapi.Parameter{aniTokenHeader(true)}, listParams()...),
+		Responses:  b.responses("A page of waifus", openapi.ArrayOf(waifu), http.StatusBadRequest),
+	})
+
+	doc.Add(http.MethodGet, "/waifu", legacy(getWaifu("legacyGetWaifu", queryParam("id", true, openapi.ObjectID())), "GET /v1/waifus/{id}"))
+	doc.Add(http.MethodGet, "/waifus", legacy(listWaifus("legacyListWaifus"), "GET /v1/waifus"))
+}
+
+func (b *documentBuilder) users() {
+	doc := b.doc
+
+	doc.Add(http.MethodGet, "/v1/users/:id", &openapi.Operation{
+		OperationID: "getUserProfile", Tags: []string{"users"}, Summary: "Get a user's public profile",
+		Description: "Includes the user's latest favorite waifus.",
+		Parameters:  []openapi.Parameter{pathParam("id", userID())},
+		Responses:   b.responses("The profile", doc.Model(lib.UserProfile{}), http.StatusBadRequest),
+	})
+	doc.Add(http.MethodGet, "/v1/users/:id/favorites/waifus", &openapi.Operation{
+		OperationID: "listUserFavoriteWaifus", Tags: []string{"users"}, Summary: "List a user's favorite waifus, most recently favorited first",
+		Parameters: append([]openapi.Parameter{pathParam("id", userID())}, listParams()...),
+		Responses:  b.responses("A page of waifus", openapi.ArrayOf(doc.Model(lib.PublicWaifu{})), http.StatusBadRequest),
+	})
+}
+
+func (b *documentBuilder) tournaments() {
+	doc := b.doc
+
+	tournament := doc.Model(lib.Tournament{})
+	vote := doc.Named("TournamentVote", openapi.Object(map[string]*openapi.Schema{
+		"matchId":        openapi.String().Describe("A match of the open round, e.g. r1m3"),
+		"waifuId":        openapi.ObjectID().Describe("The side voted for"),
+		"recaptchaToken": openapi.String(),
+		"aniToken":       openapi.String(),
+	}, "matchId", "waifuId", "recaptchaToken", "aniToken"))
+
+	doc.Add(http.MethodGet, "/v1/tournaments", &openapi.Operation{
+		OperationID: "listTournaments", Tags: []string{"tournaments"}, Summary: "List tournaments with their brackets, newest first",
+		Parameters: listParams(),
+		Responses:  b.responses("A page of tournaments", openapi.ArrayOf(tournament), http.StatusBadRequest),
+	})
+	doc.Add(http.MethodGet, "/v1/tournaments/:id", &openapi.Operation{
+		OperationID: "getTournament", Tags: []string{"tournaments"}, Summary: "Get a tournament and its whole bracket",
+		Description: "Every round is listed from the start. Slots of later rounds fill in as the scheduler closes rounds.",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		Responses:   b.responses("The tournament", tournament, http.StatusBadRequest, http.StatusNotFound),
+	})
+	doc.Add(http.MethodPost, "/v1/tournaments/:id/votes", &openapi.Operation{
+		OperationID: "voteTournament", Tags: []string{"tournaments"}, Summary: "Vote for a side of a match in the open round",
+		Description: "The same IP or token votes once per match. Ties go to the better seed.",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(vote),
+		Responses: b.responses("The match with its new vote counts", doc.Model(lib.TournamentMatch{}),
+			http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict),
+	})
+}
+
+func (b *documentBuilder) uploads() {
+	doc := b.doc
+
+	newUpload := doc.Named("NewUpload", openapi.Object(map[string]*openapi.Schema{
+		"contentType": openapi.String().Describe("image/jpeg, image/png, image/webp, image/gif, video/mp4 or video/webm"),
+		"size":        openapi.Integer().Min(1).Describe("File size in bytes"),
+		"aniToken":    openapi.String(),
+	}, "contentType", "size", "aniToken"))
+	completeUpload := doc.Named("CompleteUpload", openapi.Object(map[string]*openapi.Schema{
+		"aniToken": openapi.String(),
+	}, "aniToken"))
+
+	doc.Add(http.MethodPost, "/v1/uploads", &openapi.Operation{
+		OperationID: "createUpload", Tags: []string{"uploads"}, Summary: "Start a direct upload to storage",
+		Description: "Returns a presigned URL to PUT exactly size bytes to, with the returned headers, then call the complete route before expiresTime. The file isn't public until it's completed.",
+		RequestBody: jsonBody(newUpload),
+		Responses:   b.responses("Where to upload the file", doc.Model(lib.PresignedUploadResponse{}), http.StatusBadRequest, http.StatusNotImplemented),
+	})
+	doc.Add(http.MethodPost, "/v1/uploads/:id/complete", &openapi.Operation{
+		OperationID: "completeUpload", Tags: []string{"uploads"}, Summary: "Check and process a finished direct upload",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(completeUpload),
+		Responses:   b.responses("The processed upload", doc.Model(lib.UploadResponse{}), http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusGone, http.StatusNotImplemented),
+	})
+}
+
+func (b *documentBuilder) moderation() {
+	doc := b.doc
+
+	security := []map[string][]string{{"moderatorToken": {}}}
+	authErrors := []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden}
+
+	bannedMedia := doc.Model(lib.BannedMedia{})
+	banMedia := doc.Named("BanMedia", openapi.Object(map[string]*openapi.Schema{
+		"postId": openapi.ObjectID().Describe("Post whose media gets banned"),
+		"reason": openapi.String().MaxLen(500),
+	}, "postId"))
+
+	doc.Add(http.MethodGet, "/v1/moderation/banned-media", &openapi.Operation{
+		OperationID: "listBannedMedia", Tags: []string{"moderation"}, Summary: "List banned media",
+		Parameters: listParams(),
+		Responses:  b.responses("A page of banned media", openapi.ArrayOf(bannedMedia), authErrors...),
+		Security:   security,
+	})
+	doc.Add(http.MethodGet, "/v1/moderation/blocked-uploads", &openapi.Operation{
+		OperationID: "listBlockedUploads", Tags: []string{"moderation"}, Summary: "List uploads that matched banned media",
+		Parameters: append(listParams(), queryParam("reviewed", false, openapi.Boolean())),
+		Responses:  b.responses("A page of blocked uploads", openapi.ArrayOf(doc.Model(lib.BlockedUpload{})), authErrors...),
+		Security:   security,
+	})
+	doc.Add(http.MethodPost, "/v1/moderation/banned-media", &openapi.Operation{
+		OperationID: "banPostMedia", Tags: []string{"moderation"}, Summary: "Ban the media of a post",
+		RequestBody: jsonBody(banMedia),
+		Responses:   b.responses("The ban", bannedMedia, append(authErrors, http.StatusNotFound)...),
+		Security:    security,
+	})
+	doc.Add(http.MethodPost, "/v1/moderation/blocked-uploads/:id/review", &openapi.Operation{
+		OperationID: "reviewBlockedUpload", Tags: []string{"moderation"}, Summary: "Mark a blocked upload as reviewed",
+		Parameters: []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		Responses:  b.responses("Reviewed", message(), append(authErrors, http.StatusNotFound)...),
+		Security:   security,
+	})
+
+	statuses := make([]interface{}, 0, len(lib.WaifuStatuses))
+	for _, status := range lib.WaifuStatuses {
+		statuses = append(statuses, string(status))
+	}
+
+	waifu := doc.Model(lib.ModerationWaifu{})
+	doc.Add(http.MethodGet, "/v1/moderation/waifus", &openapi.Operation{
+		OperationID: "listModerationWaifus", Tags: []string{"moderation"}, Summary: "List waifus of any status, with their status history",
+		Parameters: append(listParams(), queryParam("status", false, openapi.String().OneOf(statuses...)), waifuSortParam()),
+		Responses:  b.responses("A page of waifus", openapi.ArrayOf(waifu), authErrors...),
+		Security:   security,
+	})
+	doc.Add(http.MethodPost, "/v1/moderation/waifus/:id/status", &openapi.Operation{
+		OperationID: "updateWaifuStatus", Tags: []string{"moderation"}, Summary: "Move a waifu to another status",
+		Description: "draft → pending or archived; pending → approved, rejected or draft; approved → archived; rejected → pending or archived; archived → pending.",
+		Parameters:  []openapi.Parameter{pathParam("id", openapi.ObjectID())},
+		RequestBody: jsonBody(doc.Named("WaifuStatusChangeRequest", openapi.Object(map[string]*openapi.Schema{
+			"status": openapi.String().OneOf(statuses...),
+			"reason": openapi.String().MaxLen(500).Describe("Required when rejecting"),
+		}, "status"))),
+		Responses: b.responses("The waifu in its new status", waifu, append(authErrors, http.StatusNotFound, http.StatusConflict)...),
+		Security:  security,
+	})
+	doc.Add(http.MethodPost, "/v1/moderation/tournaments", &openapi.Operation{
+		OperationID: "createTournament", Tags: []string{"moderation", "tournaments"}, Summary: "Create a single-elimination tournament",
+		Description: "Seeds that don't fill the bracket up to a power of two are byes for the top seeds. " +
+			"The first round opens at startTime, each round lasts roundHours and the next one opens when it closes.",
+		RequestBody: jsonBody(doc.Named("NewTournament", openapi.Object(map[string]*openapi.Schema{
+			"name":       openapi.String().MinLen(1).MaxLen(100),
+			"season":     openapi.String().MaxLen(50).Describe("e.g. Winter 2027"),
+			"waifuIds":   openapi.ArrayOf(openapi.ObjectID()).Describe("2 to 64 approved waifus in seed order, the first is seed 1"),
+			"roundHours": openapi.Integer().Min(1).Max(14 * 24),
+			"startTime":  openapi.String().Formatted("date-time").Describe("Defaults to now"),
+		}, "name", "waifuIds", "roundHours"))),
+		Responses: b.responses("The tournament", doc.Model(lib.Tournament{}), authErrors...),
+		Security:  security,
+	})
+	doc.Add(http.MethodPost, "/v1/moderation/traits", &openapi.Operation{
+		OperationID: "createWaifuTrait", Tags: []string{"moderation"}, Summary: "Add a trait waifus can be scored on",
+		RequestBody: jsonBody(doc.Named("NewTrait", openapi.Object(map[string]*openapi.Schema{
+			"key":         openapi.String().Matching("^[a-z][a-zA-Z0-9]{0,31}$").Describe("e.g. mommyMeter, the key of the waifu's meter"),
+			"name":        openapi.String().MinLen(1).MaxLen(100),
+			"description": openapi.String().MaxLen(500),
+		}, "key", "name"))),
+		Responses: b.responses("The trait", doc.Model(lib.Trait{}), append(authErrors, http.StatusConflict)...),
+		Security:  security,
+	})
+}
+
+func message() *openapi.Schema {
+	return openapi.Object(map[string]*openapi.Schema{"message": openapi.String()}, "message")
+}
+
+func (b *documentBuilder) meta() {
+	doc := b.doc
+
+	doc.Add(http.MethodGet, "/", &openapi.Operation{
+		OperationID: "healthCheck", Tags: []string{"meta"}, Summary: "Health check",
+		Responses: b.responses("The server is up", message()),
+	})
+	doc.Add(http.MethodGet, "/openapi.json", &openapi.Operation{
+		OperationID: "getOpenAPIDocument", Tags: []string{"meta"}, Summary: "This document",
+		Responses: b.responses("OpenAPI 3 document", &openapi.Schema{Type: "object"}),
+	})
+	doc.Add(http.MethodGet, "/docs", &openapi.Operation{
+		OperationID: "getDocs", Tags: []string{"meta"}, Summary: "Human-readable API reference",
+		Responses: map[string]openapi.Response{
+			"200": {Description: "HTML page rendering this document", Content: map[string]openapi.MediaType{
+				echo.MIMETextHTML: {Schema: openapi.String()},
+			}},
+		},
+	})
+}
+
+// SetupDocsRoutes serves the document and a reference page rendering it.
+func SetupDocsRoutes(e *echo.Echo, doc *openapi.Document) {
+	e.GET("/openapi.json", doc.ServeJSON)
+	e.GET("/docs", openapi.ServeDocs)
+}
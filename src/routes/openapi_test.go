@@ -0,0 +1,16 @@
+package routes
+
+import "testing"
+
+func TestEveryRouteIsDocumented(t *testing.T) {
+	e, _, _ := newTestServer(t)
+
+	doc := APIDocument()
+	SetupDocsRoutes(e, doc)
+
+	// Same check server.go runs at startup, so a missing spec entry fails
+	// here before it fails a deploy.
+	if err := doc.CheckRoutes(e.Routes(), "/media*"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,116 +1,47 @@
 package routes
 
 import (
+	"animoshi-api-go/src/infra"
 	"animoshi-api-go/src/lib"
 	"animoshi-api-go/src/utils"
 	"fmt"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/mongo"
-	"net/http"
 	"strconv"
 )
 
-func SetupPostRoutes(e *echo.Echo, client *mongo.Client) {
-	// GET ROUTES
-	e.GET("/post", func(c echo.Context) error {
-		return lib.GetPost(c, client)
-	})
-
-	e.GET("/posts", func(c echo.Context) error {
-		return lib.GetPosts(c, client)
-	})
-
-	e.GET("/postsByUserId", func(c echo.Context) error {
-		return lib.GetPostsByUserId(c, client)
-	})
-
-	e.GET("/postCountByUserId", func(c echo.Context) error {
-		return lib.GetPostCountByUserId(c, client)
-	})
-
-	e.GET("/postComments", func(c echo.Context) error {
-		return lib.GetPostCommentsByPostId(c, client)
-	})
+func SetupPostRoutes(e *echo.Echo, stores lib.Stores, store infra.Storage) {
+	v1 := e.Group("/v1")
 
-	// POST ROUTES
-	e.POST("/post", func(c echo.Context) error {
+	newPost := func(c echo.Context) error {
 		title := c.FormValue("title")
 		content := c.FormValue("content")
-		image := c.FormValue("image")
 		nsfwToggle := c.FormValue("nsfwToggle")
 		userId := c.FormValue("userId")
 		recaptchaToken := c.FormValue("recaptchaToken")
 		aniToken := c.FormValue("aniToken")
 
 		if len(content) > 500 {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Content is too long"})
+			return utils.ValidationFailed("content", "Content is too long")
 		}
 
 		if len(userId) > 128 {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "UserId is too long"})
-		}
-
-		if recaptchaToken == "" {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Recaptcha token is required"})
-		}
-
-		valid, err := utils.VerifyRecaptcha(recaptchaToken)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
+			return utils.ValidationFailed("userId", "UserId is too long")
 		}
 
-		if !valid {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invalid Recaptcha Token"})
+		if err := utils.CheckRecaptcha(recaptchaToken); err != nil {
+			return err
 		}
 
 		if aniToken == "" {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Token is required!"})
+			return utils.ValidationFailed("aniToken", "Token is required!")
 		}
 
-		var fileURL string
-		var imageURL string
-
-		file, err := c.FormFile("file")
+		media, err := receiveMedia(c, stores, store, userId, aniToken, true)
 		if err != nil {
-			print("No File Uploaded!")
-		} else {
-			if file.Size > 8*1024*1024 { // 8MB
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "File size exceeds 5MB"})
-			}
-
-			contentType := file.Header.Get("Content-Type")
-			validTypes := map[string]bool{
-				"image/jpeg": true,
-				"image/png":  true,
-				"image/gif":  true,
-				"image/webp": true,
-			}
-
-			if !validTypes[contentType] {
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid file type. Only JPG, PNG, WEBP and GIF are allowed."})
-			}
-
-			if err == nil {
-				src, err := file.Open()
-				if err != nil {
-					return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to open file"})
-				}
-				defer src.Close()
-
-				// Upload to S3 and get URL (assuming you have a function like uploadToS3)
-				fileURL, err = utils.UploadToS3(src, file)
-				if err != nil {
-					return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to upload file"})
-				}
-			}
+			return err
 		}
-
-		if len(image) > 0 {
-			imageURL = image
-		} else if len(fileURL) > 0 {
-			imageURL = fileURL
-		} else {
-			imageURL = ""
+		if media == nil {
+			media = &submittedMedia{}
 		}
 
 		nsfwToggleInt, err := strconv.ParseInt(nsfwToggle, 10, 64)
@@ -121,59 +52,123 @@ func SetupPostRoutes(e *echo.Echo, client *mongo.Client) {
 		post := lib.PostRequest{
 			Title:          title,
 			Content:        content,
-			Image:          imageURL,
+			Image:          media.ImageURL,
+			SourceURL:      media.SourceURL,
+			Video:          media.VideoURL,
+			VideoMeta:      media.VideoMeta,
+			Images:         media.Images,
+			MediaSha256:    media.SHA256,
 			NsfwToggle:     nsfwToggleInt,
 			UserID:         userId,
 			RecaptchaToken: recaptchaToken,
 			AniToken:       aniToken,
 		}
 
-		if err := lib.NewPost(c, client, &post); err != nil {
+		if err := lib.NewPost(c, stores, &post); err != nil {
 			return err
 		}
 
 		return nil
-	})
+	}
 
-	e.POST("/comment", func(c echo.Context) error {
+	newPostComment := func(c echo.Context) error {
 		postComment := new(lib.PostComment)
 
 		if err := c.Bind(postComment); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return utils.BadRequest("Invalid request")
 		}
 
-		if err := lib.NewPostComment(c, client, postComment); err != nil {
-			return err
+		// On /v1 the post comes from the path, the old route has it in the body.
+		postId := postComment.PostId
+		if id := c.Param("id"); id != "" {
+			postId = id
 		}
 
-		return nil
-	})
+		return lib.NewComment(c, stores, lib.CommentTarget{Type: lib.CommentOnPost, ID: postId}, postComment)
+	}
 
-	e.POST("/likePost", func(c echo.Context) error {
+	likePost := func(c echo.Context) error {
 		postLike := new(lib.PostLike)
 
 		if err := c.Bind(postLike); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return utils.BadRequest("Invalid request")
 		}
 
-		if err := lib.LikePost(c, client, postLike); err != nil {
-			return err
+		if id := c.Param("id"); id != "" {
+			postLike.PostId = id
 		}
 
-		return nil
-	})
+		return lib.LikePost(c, stores, postLike)
+	}
 
-	e.POST("/dislikePost", func(c echo.Context) error {
+	dislikePost := func(c echo.Context) error {
 		postDislike := new(lib.PostDislike)
 
 		if err := c.Bind(postDislike); err != nil {
-			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+			return utils.BadRequest("Invalid request")
 		}
 
-		if err := lib.DislikePost(c, client, postDislike); err != nil {
-			return err
+		if id := c.Param("id"); id != "" {
+			postDislike.PostId = id
 		}
 
-		return nil
+		return lib.DislikePost(c, stores, postDislike)
+	}
+
+	// GET ROUTES
+	v1.GET("/posts", func(c echo.Context) error {
+		return lib.GetPosts(c, stores)
+	})
+
+	v1.GET("/posts/:id", func(c echo.Context) error {
+		return lib.GetPost(c, stores, c.Param("id"))
 	})
+
+	v1.GET("/posts/:id/comments", func(c echo.Context) error {
+		return lib.GetComments(c, stores, lib.CommentTarget{Type: lib.CommentOnPost, ID: c.Param("id")})
+	})
+
+	v1.GET("/posts/:id/similar", func(c echo.Context) error {
+		return lib.GetSimilarPosts(c, stores, c.Param("id"))
+	})
+
+	v1.GET("/users/:id/posts", func(c echo.Context) error {
+		return lib.GetPostsByUserId(c, stores, c.Param("id"))
+	})
+
+	v1.GET("/users/:id/posts/count", func(c echo.Context) error {
+		return lib.GetPostCountByUserId(c, stores, c.Param("id"))
+	})
+
+	// POST ROUTES
+	v1.POST("/posts", newPost)
+	v1.POST("/posts/:id/comments", newPostComment)
+	v1.POST("/posts/:id/likes", likePost)
+	v1.POST("/posts/:id/dislikes", dislikePost)
+
+	// LEGACY ROUTES
+	e.GET("/post", func(c echo.Context) error {
+		return lib.GetPost(c, stores, c.QueryParam("id"))
+	}, deprecated("/v1/posts/{id}"))
+
+	e.GET("/posts", func(c echo.Context) error {
+		return lib.GetPosts(c, stores)
+	}, deprecated("/v1/posts"))
+
+	e.GET("/postsByUserId", func(c echo.Context) error {
+		return lib.GetPostsByUserId(c, stores, c.QueryParam("userId"))
+	}, deprecated("/v1/users/{userId}/posts"))
+
+	e.GET("/postCountByUserId", func(c echo.Context) error {
+		return lib.GetPostCountByUserId(c, stores, c.QueryParam("userId"))
+	}, deprecated("/v1/users/{userId}/posts/count"))
+
+	e.GET("/postComments", func(c echo.Context) error {
+		return lib.GetComments(c, stores, lib.CommentTarget{Type: lib.CommentOnPost, ID: c.QueryParam("postId")})
+	}, deprecated("/v1/posts/{postId}/comments"))
+
+	e.POST("/post", newPost, deprecated("/v1/posts"))
+	e.POST("/comment", newPostComment, deprecated("/v1/posts/{postId}/comments"))
+	e.POST("/likePost", likePost, deprecated("/v1/posts/{postId}/likes"))
+	e.POST("/dislikePost", dislikePost, deprecated("/v1/posts/{postId}/dislikes"))
 }
@@ -0,0 +1,344 @@
+package routes
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	testModeratorToken = "moderator-token"
+	testAniToken       = "viewer-ani-token"
+	testRecaptchaToken = "viewer-recaptcha-token"
+	testUserID         = "user-1"
+)
+
+// stagingStorage is memory storage with a staging area for direct uploads.
+type stagingStorage struct {
+	*infra.MemoryStorage
+	staged *infra.MemoryStorage
+}
+
+const stagingURL = "memory://staging/"
+
+func (s stagingStorage) PresignPut(key string, contentType string, size int64, expires time.Duration) (string, error) {
+	return stagingURL + key, nil
+}
+
+func (s stagingStorage) GetStaged(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, _, err := s.staged.Get(ctx, key)
+	return body, err
+}
+
+func (s stagingStorage) DeleteStaged(ctx context.Context, key string) error {
+	return s.staged.Delete(ctx, key)
+}
+
+// newTestServer sets every API route up on memory stores, the way server.go
+// does, with recaptcha checks always passing.
+func newTestServer(t *testing.T) (*echo.Echo, lib.Stores, stagingStorage) {
+	t.Helper()
+
+	recaptcha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true,"score":0.9}`))
+	}))
+	t.Cleanup(recaptcha.Close)
+
+	utils.ConfigureRecaptcha(utils.RecaptchaConfig{MinScore: 0.5, VerifyURL: recaptcha.URL})
+	t.Cleanup(func() { utils.ConfigureRecaptcha(utils.DefaultRecaptchaConfig) })
+
+	stores := lib.NewMemoryStores()
+	store := stagingStorage{
+		MemoryStorage: infra.NewMemoryStorage("memory://"),
+		staged:        infra.NewMemoryStorage(stagingURL),
+	}
+
+	e := echo.New()
+	e.HTTPErrorHandler = utils.HTTPErrorHandler
+
+	SetupPostRoutes(e, stores, store)
+	SetupWaifuRoutes(e, stores, store)
+	SetupUserRoutes(e, stores)
+	SetupTournamentRoutes(e, stores)
+	SetupUploadRoutes(e, stores, store)
+	SetupModerationRoutes(e, stores, map[string]string{testModeratorToken: "alice"})
+
+	return e, stores, store
+}
+
+type response struct {
+	request string
+	body    string
+}
+
+// testClient sends requests to the test server and keeps every response,
+// so tests can check everything the API sent back.
+type testClient struct {
+	t         *testing.T
+	e         *echo.Echo
+	responses []response
+}
+
+func (c *testClient) serve(req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Authorization", "Bearer "+testModeratorToken)
+	req.Header.Set("X-Ani-Token", testAniToken)
+
+	rec := httptest.NewRecorder()
+	c.e.ServeHTTP(rec, req)
+	c.responses = append(c.responses, response{req.Method + " " + req.URL.String(), rec.Body.String()})
+	return rec
+}
+
+// postJSON sends body and decodes the response into out, if given.
+func (c *testClient) postJSON(path string, body interface{}, out interface{}) {
+	c.t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := c.serve(req)
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("POST %s: %d %s", path, rec.Code, rec.Body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// postForm sends a multipart form, with an image file if given, and
+// returns the response.
+func (c *testClient) postForm(path string, fields map[string]string, file []byte) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	if file != nil {
+		part, err := form.CreateFormFile("file", "image.png")
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		part.Write(file)
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return c.serve(req)
+}
+
+// testImage is a black and white PNG. Perceptual hashes only see the
+// layout, so images meant to differ need different dark parts.
+func testImage(t *testing.T, dark func(x, y int) bool) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if dark(x, y) {
+				img.Set(x, y, color.Black)
+			} else {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type testData struct {
+	postID       string
+	waifuID      string
+	tournamentID string
+}
+
+// seed fills the stores through the API, so everything that gets stored
+// along with who sent it is there to leak.
+func seed(c *testClient, stores lib.Stores, staged *infra.MemoryStorage) testData {
+	t := c.t
+	t.Helper()
+
+	var data testData
+	var created struct {
+		ID string `json:"_id"`
+	}
+
+	leftHalf := testImage(t, func(x, y int) bool { return x < 32 })
+	postFields := map[string]string{
+		"title":          "Title",
+		"content":        "Content",
+		"nsfwToggle":     "0",
+		"userId":         testUserID,
+		"recaptchaToken": testRecaptchaToken,
+		"aniToken":       testAniToken,
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := c.postForm("/v1/posts", postFields, leftHalf)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /v1/posts: %d %s", rec.Code, rec.Body)
+		}
+		if i == 0 {
+			json.Unmarshal(rec.Body.Bytes(), &created)
+			data.postID = created.ID
+		}
+	}
+
+	comment := map[string]string{"text": "Nice", "userId": testUserID, "recaptchaToken": testRecaptchaToken, "aniToken": testAniToken}
+	vote := map[string]string{"userId": testUserID, "recaptchaToken": testRecaptchaToken, "aniToken": testAniToken}
+	c.postJSON("/v1/posts/"+data.postID+"/comments", comment, nil)
+	c.postJSON("/v1/posts/"+data.postID+"/likes", vote, nil)
+
+	// A post made from a direct upload.
+	uploaded := testImage(t, func(x, y int) bool { return y/8%2 == 0 })
+	var presigned lib.PresignedUploadResponse
+	c.postJSON("/v1/uploads", map[string]interface{}{"contentType": "image/png", "size": len(uploaded), "aniToken": testAniToken}, &presigned)
+	key := strings.TrimPrefix(presigned.UploadURL, stagingURL)
+	if err := staged.Put(context.Background(), key, bytes.NewReader(uploaded), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	c.postJSON("/v1/uploads/"+presigned.ID.Hex()+"/complete", map[string]string{"aniToken": testAniToken}, nil)
+
+	uploadFields := map[string]string{"uploadId": presigned.ID.Hex()}
+	for name, value := range postFields {
+		uploadFields[name] = value
+	}
+	if rec := c.postForm("/v1/posts", uploadFields, nil); rec.Code != http.StatusOK {
+		t.Fatalf("POST /v1/posts with an upload: %d %s", rec.Code, rec.Body)
+	}
+
+	// Posting banned media again records a blocked upload.
+	c.postJSON("/v1/moderation/banned-media", map[string]string{"postId": data.postID, "reason": "Test"}, nil)
+	if rec := c.postForm("/v1/posts", postFields, leftHalf); rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST /v1/posts with banned media: %d %s", rec.Code, rec.Body)
+	}
+
+	waifuFields := map[string]string{
+		"name":           "Waifu",
+		"description":    "Description",
+		"userId":         testUserID,
+		"recaptchaToken": testRecaptchaToken,
+		"aniToken":       testAniToken,
+	}
+
+	var waifuIDs []string
+	layouts := []func(x, y int) bool{
+		func(x, y int) bool { return x/8%2 == 0 },
+		func(x, y int) bool { return x > y },
+	}
+	for _, dark := range layouts {
+		rec := c.postForm("/v1/waifus", waifuFields, testImage(t, dark))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /v1/waifus: %d %s", rec.Code, rec.Body)
+		}
+		json.Unmarshal(rec.Body.Bytes(), &created)
+		waifuIDs = append(waifuIDs, created.ID)
+
+		c.postJSON("/v1/moderation/waifus/"+created.ID+"/status", map[string]string{"status": string(lib.WaifuApproved)}, nil)
+	}
+	data.waifuID = waifuIDs[0]
+
+	c.postJSON("/v1/waifus/"+data.waifuID+"/ratings", map[string]interface{}{"stars": 5, "recaptchaToken": testRecaptchaToken, "aniToken": testAniToken}, nil)
+	c.postJSON("/v1/waifus/"+data.waifuID+"/favorite", vote, nil)
+	c.postJSON("/v1/waifus/"+data.waifuID+"/comments", comment, nil)
+	c.postJSON("/v1/moderation/traits", map[string]string{"key": "mommyMeter", "name": "Mommy meter"}, nil)
+	c.postJSON("/v1/waifus/"+data.waifuID+"/traits", map[string]interface{}{"scores": map[string]int{"mommyMeter": 7}, "recaptchaToken": testRecaptchaToken, "aniToken": testAniToken}, nil)
+	c.postJSON("/v1/waifus/wars/votes", map[string]string{"winnerId": waifuIDs[0], "loserId": waifuIDs[1], "recaptchaToken": testRecaptchaToken, "aniToken": testAniToken}, nil)
+
+	var tournament lib.Tournament
+	c.postJSON("/v1/moderation/tournaments", map[string]interface{}{"name": "Cup", "waifuIds": waifuIDs, "roundHours": 24}, &tournament)
+	data.tournamentID = tournament.ID.Hex()
+
+	match := tournament.Rounds[0].Matches[0]
+	c.postJSON("/v1/tournaments/"+data.tournamentID+"/votes", map[string]string{"matchId": match.ID, "waifuId": match.Slots[0].WaifuId, "recaptchaToken": testRecaptchaToken, "aniToken": testAniToken}, nil)
+
+	if err := lib.RefreshLeaderboards(context.Background(), stores, lib.DefaultLeaderboardConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// getURL fills in the path parameters and the query every GET route needs.
+func getURL(path string, data testData) string {
+	replacer := strings.NewReplacer(
+		"/v1/posts/:id", "/v1/posts/"+data.postID,
+		"/v1/waifus/:id", "/v1/waifus/"+data.waifuID,
+		"/v1/users/:id", "/v1/users/"+testUserID,
+		"/v1/tournaments/:id", "/v1/tournaments/"+data.tournamentID,
+	)
+
+	query := url.Values{
+		"limit":  {"10"},
+		"offset": {"0"},
+		"by":     {string(lib.LeaderboardRating)},
+		"window": {string(lib.LeaderboardAllTime)},
+		"userId": {testUserID},
+		"postId": {data.postID},
+	}
+	switch path {
+	case "/post":
+		query.Set("id", data.postID)
+	case "/waifu":
+		query.Set("id", data.waifuID)
+	}
+
+	return replacer.Replace(path) + "?" + query.Encode()
+}
+
+func TestResponsesHidePrivateFields(t *testing.T) {
+	e, stores, store := newTestServer(t)
+	c := &testClient{t: t, e: e}
+	data := seed(c, stores, store.staged)
+
+	for _, route := range e.Routes() {
+		if route.Method != http.MethodGet {
+			continue
+		}
+
+		target := getURL(route.Path, data)
+		rec := c.serve(httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s: %d %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	// What the seeding POSTs sent back is checked along with the GETs.
+	private := []string{`"userIp"`, `"aniToken"`, `"recaptchaToken"`, testAniToken, testRecaptchaToken}
+	for _, response := range c.responses {
+		for _, field := range private {
+			if strings.Contains(response.body, field) {
+				t.Errorf("%s sends %s: %s", response.request, field, response.body)
+			}
+		}
+	}
+}
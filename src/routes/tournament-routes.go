@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
+	"github.com/labstack/echo/v4"
+)
+
+func SetupTournamentRoutes(e *echo.Echo, stores lib.Stores) {
+	v1 := e.Group("/v1")
+
+	voteTournament := func(c echo.Context) error {
+		voteRequest := new(lib.TournamentVoteRequest)
+
+		if err := c.Bind(voteRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.VoteTournament(c, stores, c.Param("id"), voteRequest)
+	}
+
+	// GET ROUTES
+	v1.GET("/tournaments", func(c echo.Context) error {
+		return lib.GetTournaments(c, stores)
+	})
+
+	v1.GET("/tournaments/:id", func(c echo.Context) error {
+		return lib.GetTournament(c, stores, c.Param("id"))
+	})
+
+	// POST ROUTES
+	v1.POST("/tournaments/:id/votes", voteTournament)
+}
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
+	"github.com/labstack/echo/v4"
+)
+
+func SetupUploadRoutes(e *echo.Echo, stores lib.Stores, store infra.Storage) {
+	v1 := e.Group("/v1")
+
+	newUpload := func(c echo.Context) error {
+		uploadRequest := new(lib.UploadRequest)
+
+		if err := c.Bind(uploadRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.NewUpload(c, stores, store, uploadRequest)
+	}
+
+	completeUpload := func(c echo.Context) error {
+		completeRequest := new(lib.UploadCompleteRequest)
+
+		if err := c.Bind(completeRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.CompleteUpload(c, stores, store, c.Param("id"), completeRequest)
+	}
+
+	// POST ROUTES
+	v1.POST("/uploads", newUpload)
+	v1.POST("/uploads/:id/complete", completeUpload)
+}
@@ -0,0 +1,19 @@
+package routes
+
+import (
+	"animoshi-api-go/src/lib"
+	"github.com/labstack/echo/v4"
+)
+
+func SetupUserRoutes(e *echo.Echo, stores lib.Stores) {
+	v1 := e.Group("/v1")
+
+	// GET ROUTES
+	v1.GET("/users/:id", func(c echo.Context) error {
+		return lib.GetUserProfile(c, stores, c.Param("id"))
+	})
+
+	v1.GET("/users/:id/favorites/waifus", func(c echo.Context) error {
+		return lib.GetUserFavoriteWaifus(c, stores, c.Param("id"))
+	})
+}
@@ -1,18 +1,179 @@
 package routes
 
 import (
+	"animoshi-api-go/src/infra"
 	"animoshi-api-go/src/lib"
+	"animoshi-api-go/src/utils"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func SetupWaifuRoutes(e *echo.Echo, client *mongo.Client) {
+func SetupWaifuRoutes(e *echo.Echo, stores lib.Stores, store infra.Storage) {
+	v1 := e.Group("/v1")
+
+	newWaifu := func(c echo.Context) error {
+		name := c.FormValue("name")
+		description := c.FormValue("description")
+		userId := c.FormValue("userId")
+		recaptchaToken := c.FormValue("recaptchaToken")
+		aniToken := c.FormValue("aniToken")
+
+		// Checked before the image is stored, so a bad form doesn't leave
+		// files behind.
+		if len(name) == 0 {
+			return utils.ValidationFailed("name", "Name is required!")
+		}
+
+		if len(name) > 100 {
+			return utils.ValidationFailed("name", "Name is too long")
+		}
+
+		if len(description) > 1000 {
+			return utils.ValidationFailed("description", "Description is too long! Only 1000 characters are allowed!")
+		}
+
+		if len(userId) > 128 {
+			return utils.ValidationFailed("userId", "UserId is too long")
+		}
+
+		if err := utils.CheckRecaptcha(recaptchaToken); err != nil {
+			return err
+		}
+
+		if aniToken == "" {
+			return utils.ValidationFailed("aniToken", "Token is required!")
+		}
+
+		media, err := receiveMedia(c, stores, store, userId, aniToken, false)
+		if err != nil {
+			return err
+		}
+		if media == nil {
+			return utils.ValidationFailed("file", "An image is required")
+		}
+
+		waifu := lib.WaifuRequest{
+			Name:           name,
+			Description:    description,
+			Image:          media.ImageURL,
+			SourceURL:      media.SourceURL,
+			Images:         media.Images,
+			MediaSha256:    media.SHA256,
+			UserID:         userId,
+			RecaptchaToken: recaptchaToken,
+			AniToken:       aniToken,
+		}
+
+		return lib.SubmitWaifu(c, stores, &waifu)
+	}
+
+	rateWaifu := func(c echo.Context) error {
+		ratingRequest := new(lib.WaifuRatingRequest)
+
+		if err := c.Bind(ratingRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.RateWaifu(c, stores, c.Param("id"), ratingRequest)
+	}
+
+	favoriteWaifu := func(c echo.Context) error {
+		favoriteRequest := new(lib.WaifuFavoriteRequest)
+
+		if err := c.Bind(favoriteRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.FavoriteWaifu(c, stores, c.Param("id"), favoriteRequest)
+	}
+
+	voteTraits := func(c echo.Context) error {
+		voteRequest := new(lib.WaifuTraitVoteRequest)
+
+		if err := c.Bind(voteRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.VoteWaifuTraits(c, stores, c.Param("id"), voteRequest)
+	}
+
+	newWaifuComment := func(c echo.Context) error {
+		comment := new(lib.PostComment)
+
+		if err := c.Bind(comment); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.NewComment(c, stores, lib.CommentTarget{Type: lib.CommentOnWaifu, ID: c.Param("id")}, comment)
+	}
+
+	voteWar := func(c echo.Context) error {
+		voteRequest := new(lib.WarVoteRequest)
+
+		if err := c.Bind(voteRequest); err != nil {
+			return utils.BadRequest("Invalid request")
+		}
+
+		return lib.VoteWar(c, stores, voteRequest)
+	}
+
+	getFavoriteWaifus := func(c echo.Context) error {
+		return lib.GetFavoriteWaifus(c, stores, c.Request().Header.Get("X-Ani-Token"))
+	}
+
 	// GET ROUTES
-	e.GET("/waifu", func(c echo.Context) error {
-		return lib.GetWaifu(c, client)
+	v1.GET("/waifus", func(c echo.Context) error {
+		return lib.GetWaifus(c, stores)
 	})
 
-	e.GET("/waifus", func(c echo.Context) error {
-		return lib.GetWaifus(c, client)
+	v1.GET("/waifus/leaderboard", func(c echo.Context) error {
+		return lib.GetLeaderboard(c, stores)
+	})
+
+	v1.GET("/waifus/wars/matchup", func(c echo.Context) error {
+		return lib.GetMatchup(c, stores)
+	})
+
+	v1.GET("/waifus/wars/leaderboard", func(c echo.Context) error {
+		return lib.GetEloLeaderboard(c, stores)
+	})
+
+	v1.GET("/waifus/traits", func(c echo.Context) error {
+		return lib.GetTraits(c, stores)
+	})
+
+	v1.GET("/waifus/submissions", func(c echo.Context) error {
+		return lib.GetWaifuSubmissions(c, stores, c.Request().Header.Get("X-Ani-Token"))
 	})
+
+	v1.GET("/user/favorites/waifus", getFavoriteWaifus)
+
+	v1.GET("/waifus/:id", func(c echo.Context) error {
+		return lib.GetWaifu(c, stores, c.Param("id"), c.Request().Header.Get("X-Ani-Token"))
+	})
+
+	v1.GET("/waifus/:id/comments", func(c echo.Context) error {
+		return lib.GetComments(c, stores, lib.CommentTarget{Type: lib.CommentOnWaifu, ID: c.Param("id")})
+	})
+
+	// POST ROUTES
+	v1.POST("/waifus", newWaifu)
+	v1.POST("/waifus/:id/ratings", rateWaifu)
+	v1.POST("/waifus/:id/favorite", favoriteWaifu)
+	v1.POST("/waifus/:id/traits", voteTraits)
+	v1.POST("/waifus/:id/comments", newWaifuComment)
+	v1.POST("/waifus/wars/votes", voteWar)
+
+	// DELETE ROUTES
+	v1.DELETE("/waifus/:id/favorite", func(c echo.Context) error {
+		return lib.UnfavoriteWaifu(c, stores, c.Param("id"), c.Request().Header.Get("X-Ani-Token"))
+	})
+
+	// LEGACY ROUTES
+	e.GET("/waifu", func(c echo.Context) error {
+		return lib.GetWaifu(c, stores, c.QueryParam("id"), c.Request().Header.Get("X-Ani-Token"))
+	}, deprecated("/v1/waifus/{id}"))
+
+	e.GET("/waifus", func(c echo.Context) error {
+		return lib.GetWaifus(c, stores)
+	}, deprecated("/v1/waifus"))
 }
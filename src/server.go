@@ -1,42 +1,114 @@
 package main
 
 import (
+	"animoshi-api-go/src/config"
 	"animoshi-api-go/src/infra"
+	"animoshi-api-go/src/lib"
 	"animoshi-api-go/src/routes"
+	"animoshi-api-go/src/utils"
+	"context"
+	"flag"
+	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/time/rate"
+	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
 var client *mongo.Client
 
 func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [migrate [up|status]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	log.Printf("Effective config:\n%s", cfg.Redacted())
+
+	utils.ConfigureUploadLimits(cfg.Uploads)
+	utils.ConfigureRecaptcha(cfg.Recaptcha)
+	lib.ConfigureDuplicateImages(cfg.Duplicates)
+	lib.ConfigureWars(cfg.Wars)
+	routes.ConfigureLegacyRoutes(cfg.LegacySunsetTime())
+	utils.ConfigureTimestamps(utils.TimestampFormat(cfg.Server.Timestamps))
+
+	// Already checked by Validate.
+	moderators, _ := utils.ParseModerators(cfg.Moderators)
+
 	e := echo.New()
+	e.HTTPErrorHandler = utils.HTTPErrorHandler
+
+	e.Use(middleware.RequestID())
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"http://localhost:5173", "http://localhost:4173", "http://localhost:3000", "https://animoshi-svelte-frontend-zvxn.vercel.app/"},
-		AllowMethods: []string{http.MethodGet, http.MethodPost},
+		AllowOrigins:  cfg.Server.CORSOrigins,
+		AllowMethods:  []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		ExposeHeaders: []string{echo.HeaderXRequestID, "Deprecation", "Sunset", "Link"},
 	}))
 
-	client = infra.ConnectToMongo()
+	client = infra.ConnectToMongo(cfg.Mongo)
+
+	if flag.Arg(0) == "migrate" {
+		migrate(client, flag.Arg(1))
+		return
+	}
+
+	if cfg.Mongo.AutoMigrate {
+		if _, err := infra.RunMigrations(context.Background(), client, lib.Migrations); err != nil {
+			log.Fatal("Error running migrations: ", err)
+		}
+	}
+
+	store, err := infra.NewStorage(cfg.Storage)
+	if err != nil {
+		log.Fatal("Error creating media storage:", err)
+	}
+
+	// The local backend has nothing in front of it, so serve the files ourselves.
+	if localStore, ok := store.(*infra.LocalStorage); ok {
+		e.Static("/media", localStore.Root)
+	}
 
-	// Rate limiter configuration: 5 requests per second with a burst of 10
 	limiter := middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
 		Skipper: middleware.DefaultSkipper,
 		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
-			Rate:      rate.Limit(5),   // 5 request per second
-			Burst:     10,              // Allow only 10 request at a time
-			ExpiresIn: 5 * time.Minute, // Expiration for stored request data
+			Rate:      rate.Limit(cfg.RateLimit.Rate),
+			Burst:     cfg.RateLimit.Burst,
+			ExpiresIn: cfg.RateLimit.ExpiresIn,
 		}),
 	})
 
 	e.Use(limiter)
 
-	routes.SetupPostRoutes(e, client)
-	routes.SetupWaifuRoutes(e, client)
+	// Requests are checked against the spec before they reach a handler.
+	apiDocument := routes.APIDocument()
+	e.Use(apiDocument.ValidateRequests())
+
+	stores := lib.NewMongoStores(client)
+
+	go lib.RunLeaderboardRefresher(context.Background(), stores, cfg.Leaderboards)
+	go lib.RunTournamentScheduler(context.Background(), stores, cfg.Tournaments)
+	if presigner, ok := store.(infra.Presigner); ok {
+		go lib.RunUploadSweeper(context.Background(), stores, presigner, cfg.DirectUploads)
+	}
+
+	routes.SetupPostRoutes(e, stores, store)
+	routes.SetupWaifuRoutes(e, stores, store)
+	routes.SetupUserRoutes(e, stores)
+	routes.SetupTournamentRoutes(e, stores)
+	routes.SetupUploadRoutes(e, stores, store)
+	routes.SetupModerationRoutes(e, stores, moderators)
+	routes.SetupDocsRoutes(e, apiDocument)
 
 	e.GET("/", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, map[string]string{
@@ -44,5 +116,38 @@ func main() {
 		})
 	})
 
-	e.Logger.Fatal(e.Start(":1323"))
+	if err := apiDocument.CheckRoutes(e.Routes(), "/media*"); err != nil {
+		log.Fatal(err)
+	}
+
+	e.Logger.Fatal(e.Start(":" + cfg.Server.Port))
+}
+
+// migrate runs the pending migrations, or with "status" lists them, and
+// exits.
+func migrate(client *mongo.Client, command string) {
+	ctx := context.Background()
+
+	switch command {
+	case "", "up":
+		ran, err := infra.RunMigrations(ctx, client, lib.Migrations)
+		if err != nil {
+			log.Fatal("Error running migrations: ", err)
+		}
+		fmt.Printf("Applied %d migration(s)\n", len(ran))
+	case "status":
+		statuses, err := infra.GetMigrationStatus(ctx, client, lib.Migrations)
+		if err != nil {
+			log.Fatal("Error reading migrations: ", err)
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedTime.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-50s %s\n", status.Version, status.Name, state)
+		}
+	default:
+		log.Fatalf("Unknown migrate command %q, use up or status", command)
+	}
 }
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash is computed on a small copy of the image, the result is the same
+// to the eye and it keeps the O(components * pixels) loop cheap.
+const blurhashSampleSize = 32
+
+// EncodeBlurhash returns the blurhash (https://blurha.sh) of img using
+// xComponents * yComponents DCT components (each between 1 and 9).
+func EncodeBlurhash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return ""
+	}
+
+	sampleWidth, sampleHeight := width, height
+	if width > blurhashSampleSize || height > blurhashSampleSize {
+		if width >= height {
+			sampleWidth = blurhashSampleSize
+			sampleHeight = max(1, height*blurhashSampleSize/width)
+		} else {
+			sampleHeight = blurhashSampleSize
+			sampleWidth = max(1, width*blurhashSampleSize/height)
+		}
+	}
+
+	sample := image.NewRGBA(image.Rect(0, 0, sampleWidth, sampleHeight))
+	draw.ApproxBiLinear.Scale(sample, sample.Bounds(), img, bounds, draw.Src, nil)
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var r, g, b float64
+			for y := 0; y < sampleHeight; y++ {
+				for x := 0; x < sampleWidth; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(sampleWidth)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(sampleHeight))
+
+					pixel := sample.Pix[y*sample.Stride+x*4:]
+					r += basis * srgbToLinear(pixel[0])
+					g += basis * srgbToLinear(pixel[1])
+					b += basis * srgbToLinear(pixel[2])
+				}
+			}
+
+			scale := 1 / float64(sampleWidth*sampleHeight)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	var hash strings.Builder
+
+	sizeFlag := (xComponents - 1) + (yComponents-1)*9
+	hash.WriteString(encodeBase83(sizeFlag, 1))
+
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for _, component := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(component))
+			}
+		}
+
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+
+	for _, factor := range factors[1:] {
+		quant := func(value float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quant(factor[0])*19*19+quant(factor[1])*19+quant(factor[2]), 2))
+	}
+
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(result)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
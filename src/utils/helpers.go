@@ -1,12 +1,20 @@
 package utils
 
 import (
+	"fmt"
 	"net"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
+// NewObjectName returns a random storage key. The client's filename is never
+// used, only the extension we detected from the file contents.
+func NewObjectName(extension string) string {
+	return fmt.Sprintf("%s.%s", uuid.New().String(), extension)
+}
+
 func GetUserIP(c echo.Context) string {
 	// Check for X-Forwarded-For header (in case of proxy)
 	xForwardedFor := c.Request().Header.Get("X-Forwarded-For")
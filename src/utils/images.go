@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"animoshi-api-go/src/infra"
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/google/uuid"
+	"golang.org/x/image/draw"
+)
+
+type ImageVariant struct {
+	URL    string `bson:"url" json:"url"`
+	Width  int    `bson:"width" json:"width"`
+	Height int    `bson:"height" json:"height"`
+}
+
+type ImageSet struct {
+	Original  ImageVariant `bson:"original" json:"original"`
+	Thumbnail ImageVariant `bson:"thumbnail" json:"thumbnail"`
+	Medium    ImageVariant `bson:"medium" json:"medium"`
+	Large     ImageVariant `bson:"large" json:"large"`
+	Blurhash  string       `bson:"blurhash" json:"blurhash"`
+	Width     int          `bson:"width" json:"width"`
+	Height    int          `bson:"height" json:"height"`
+
+	// Perceptual hash (see DHash), empty when the image couldn't be decoded.
+	Hash string `bson:"hash,omitempty" json:"-"`
+}
+
+// Target widths of the generated variants. Images are never upscaled, a
+// variant wider than the original just points at the original.
+const (
+	thumbnailWidth = 320
+	mediumWidth    = 800
+	largeWidth     = 1600
+)
+
+// UploadImageSet stores a sanitized image together with its thumbnail,
+// medium and large variants under a shared random name and returns their
+// URLs, the image dimensions and a blurhash placeholder.
+func UploadImageSet(ctx context.Context, store infra.Storage, upload *SanitizedUpload) (*ImageSet, error) {
+	baseName := uuid.New().String()
+
+	originalKey := baseName + "." + upload.Extension
+	if err := store.Put(ctx, originalKey, bytes.NewReader(upload.Data), upload.ContentType); err != nil {
+		return nil, err
+	}
+
+	original := ImageVariant{URL: store.URL(originalKey), Width: upload.Width, Height: upload.Height}
+	images := &ImageSet{
+		Original:  original,
+		Thumbnail: original,
+		Medium:    original,
+		Large:     original,
+		Width:     upload.Width,
+		Height:    upload.Height,
+	}
+
+	// Animated WebP can't be decoded in pure Go, so it only gets the original.
+	if upload.Image == nil {
+		return images, nil
+	}
+
+	images.Blurhash = EncodeBlurhash(upload.Image, 4, 3)
+	images.Hash = upload.PerceptualHash
+
+	// Variants are resized from a single frame and would come out still, so
+	// animated GIFs keep the original at every size too. The placeholder and
+	// hash above are of the first frame.
+	if upload.Frames > 1 {
+		return images, nil
+	}
+
+	variants := []struct {
+		suffix string
+		width  int
+		target *ImageVariant
+	}{
+		{"thumb", thumbnailWidth, &images.Thumbnail},
+		{"medium", mediumWidth, &images.Medium},
+		{"large", largeWidth, &images.Large},
+	}
+
+	for _, variant := range variants {
+		if variant.width >= upload.Width {
+			continue
+		}
+
+		resized := resizeToWidth(upload.Image, variant.width)
+
+		data, contentType, extension, err := encodeVariant(resized)
+		if err != nil {
+			return nil, err
+		}
+
+		key := baseName + "-" + variant.suffix + "." + extension
+		if err := store.Put(ctx, key, bytes.NewReader(data), contentType); err != nil {
+			return nil, err
+		}
+
+		*variant.target = ImageVariant{
+			URL:    store.URL(key),
+			Width:  resized.Bounds().Dx(),
+			Height: resized.Bounds().Dy(),
+		}
+	}
+
+	return images, nil
+}
+
+func resizeToWidth(img image.Image, width int) *image.RGBA {
+	bounds := img.Bounds()
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+
+	return resized
+}
+
+// encodeVariant writes opaque images as JPEG and keeps PNG for anything with
+// transparency.
+func encodeVariant(img *image.RGBA) ([]byte, string, string, error) {
+	var out bytes.Buffer
+
+	if img.Opaque() {
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 82}); err != nil {
+			return nil, "", "", err
+		}
+		return out.Bytes(), "image/jpeg", "jpg", nil
+	}
+
+	if err := png.Encode(&out, img); err != nil {
+		return nil, "", "", err
+	}
+	return out.Bytes(), "image/png", "png", nil
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"animoshi-api-go/src/infra"
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func encodeGIF(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		frame.SetColorIndex(i%width, 0, 1)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, animation); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestUploadImageSetGIF(t *testing.T) {
+	store := infra.NewMemoryStorage("http://localhost/media")
+
+	for _, test := range []struct {
+		name     string
+		frames   int
+		variants bool
+	}{
+		{"still", 1, true},
+		{"animated", 3, false},
+	} {
+		upload, err := SanitizeUpload(bytes.NewReader(encodeGIF(t, 1000, 100, test.frames)), DefaultUploadLimits)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		images, err := UploadImageSet(context.Background(), store, upload)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		resized := images.Thumbnail.URL != images.Original.URL
+		if resized != test.variants {
+			t.Errorf("%s: thumbnail %v, original %v", test.name, images.Thumbnail, images.Original)
+		}
+		if images.Blurhash == "" {
+			t.Errorf("%s: no blurhash", test.name)
+		}
+	}
+}
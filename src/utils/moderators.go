@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ParseModerators turns name:token entries into a token -> name map.
+func ParseModerators(entries []string) (map[string]string, error) {
+	moderators := map[string]string{}
+
+	for _, entry := range entries {
+		name, token, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("moderator entry must look like name:token")
+		}
+		moderators[token] = name
+	}
+
+	return moderators, nil
+}
+
+// RequireModerator only lets through requests with an "Authorization: Bearer
+// <token>" header matching one of the moderator tokens. The moderator's
+// name is stored in the context under "moderator".
+func RequireModerator(moderators map[string]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				return NewProblem(http.StatusUnauthorized, CodeUnauthorized, "Moderator token is required")
+			}
+
+			for moderatorToken, name := range moderators {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(moderatorToken)) == 1 {
+					c.Set("moderator", name)
+					return next(c)
+				}
+			}
+
+			return NewProblem(http.StatusForbidden, CodeForbidden, "Invalid moderator token")
+		}
+	}
+}
+
+func GetModerator(c echo.Context) string {
+	name, _ := c.Get("moderator").(string)
+	return name
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Stable, machine-readable error codes. Clients should branch on these, the
+// detail text is for people and may change.
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeValidationFailed  = "validation_failed"
+	CodeRecaptchaFailed   = "recaptcha_failed"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeNotFound          = "not_found"
+	CodeMethodNotAllowed  = "method_not_allowed"
+	CodeConflict          = "conflict"
+	CodeInvalidTransition = "invalid_transition"
+	CodeAlreadyVoted      = "already_voted"
+	CodeVotingClosed      = "voting_closed"
+	CodeDuplicateImage    = "duplicate_image"
+	CodeUploadExpired     = "upload_expired"
+	CodeInvalidUpload     = "invalid_upload"
+	CodeBannedMedia       = "banned_media"
+	CodeRemoteFetch       = "remote_fetch_failed"
+	CodePayloadTooLarge   = "payload_too_large"
+	CodeRateLimited       = "rate_limited"
+	CodeNotImplemented    = "not_implemented"
+	CodeInternal          = "internal_error"
+)
+
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is an RFC 7807 problem details object. Handlers return it as an
+// error and HTTPErrorHandler writes it out.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	extensions map[string]interface{}
+	cause      error
+}
+
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func BadRequest(detail string) *Problem {
+	return NewProblem(http.StatusBadRequest, CodeInvalidRequest, detail)
+}
+
+func ValidationFailed(field string, message string) *Problem {
+	return NewProblem(http.StatusBadRequest, CodeValidationFailed, message).WithField(field, message)
+}
+
+func NotFound(detail string) *Problem {
+	return NewProblem(http.StatusNotFound, CodeNotFound, detail)
+}
+
+func Conflict(code string, detail string) *Problem {
+	return NewProblem(http.StatusConflict, code, detail)
+}
+
+// InternalError keeps err for the logs, the client only sees detail.
+func InternalError(err error, detail string) *Problem {
+	problem := NewProblem(http.StatusInternalServerError, CodeInternal, detail)
+	problem.cause = err
+	return problem
+}
+
+// FromValidationError turns the errors of validator.Struct into one problem
+// with a field entry per failed rule.
+func FromValidationError(err error) *Problem {
+	problem := NewProblem(http.StatusBadRequest, CodeValidationFailed, "Validation failed")
+
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		for _, fieldError := range validationErrors {
+			problem.WithField(fieldError.Field(), "failed the "+fieldError.Tag()+" check")
+		}
+	}
+
+	return problem
+}
+
+func (p *Problem) WithField(field string, message string) *Problem {
+	p.Errors = append(p.Errors, FieldError{Field: field, Message: message})
+	return p
+}
+
+// With adds an extension member, e.g. the id of the post a duplicate points to.
+func (p *Problem) With(key string, value interface{}) *Problem {
+	if p.extensions == nil {
+		p.extensions = map[string]interface{}{}
+	}
+	p.extensions[key] = value
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.cause != nil {
+		return p.Detail + ": " + p.cause.Error()
+	}
+	return p.Detail
+}
+
+func (p *Problem) Unwrap() error {
+	return p.cause
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	body, err := json.Marshal((*problem)(p))
+	if err != nil {
+		return nil, err
+	}
+
+	// Older clients read the message from "error", keep it until they move
+	// over to detail.
+	members := map[string]interface{}{"error": p.Detail}
+	for key, value := range p.extensions {
+		members[key] = value
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range members {
+		if _, taken := fields[key]; taken {
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[key] = encoded
+	}
+
+	return json.Marshal(fields)
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusNotImplemented:
+		return CodeNotImplemented
+	}
+
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// problemFromError maps whatever a handler or middleware returned onto a
+// problem. Anything unknown is a 500 and its message is not shown.
+func problemFromError(err error) *Problem {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		return problem
+	}
+
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		detail := http.StatusText(httpError.Code)
+		if message, ok := httpError.Message.(string); ok && httpError.Code < 500 {
+			detail = message
+		}
+		problem = NewProblem(httpError.Code, codeForStatus(httpError.Code), detail)
+		problem.cause = httpError.Internal
+		return problem
+	}
+
+	switch {
+	case errors.Is(err, ErrInvalidUpload):
+		return NewProblem(http.StatusBadRequest, CodeInvalidUpload, err.Error())
+	case errors.Is(err, ErrRemoteFetch):
+		return NewProblem(http.StatusBadRequest, CodeRemoteFetch, err.Error())
+	}
+
+	return InternalError(err, "Something went wrong")
+}
+
+// HTTPErrorHandler writes every error as application/problem+json with the
+// request id attached, so a report can be matched with the logs.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	// A handler may return a problem it shares with other requests, so it's
+	// copied before this request's details go in.
+	problem := *problemFromError(err)
+	problem.Instance = c.Request().URL.Path
+	problem.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	if problem.Status >= 500 {
+		log.Printf("request %s %s %s failed: %v", problem.RequestID, c.Request().Method, c.Request().URL.Path, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, MIMEApplicationProblemJSON)
+
+	if strings.EqualFold(c.Request().Method, http.MethodHead) {
+		err = c.NoContent(problem.Status)
+	} else {
+		err = c.JSON(problem.Status, &problem)
+	}
+	if err != nil {
+		log.Println("Error writing error response:", err)
+	}
+}
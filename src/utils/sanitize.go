@@ -0,0 +1,674 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/image/webp"
+)
+
+type UploadLimits struct {
+	MaxImageBytes     int64   `yaml:"maxImageBytes" env:"UPLOAD_MAX_IMAGE_BYTES"`
+	MaxVideoBytes     int64   `yaml:"maxVideoBytes" env:"UPLOAD_MAX_VIDEO_BYTES"`
+	MaxVideoDuration  float64 `yaml:"maxVideoDuration" env:"UPLOAD_MAX_VIDEO_DURATION"`   // seconds
+	MaxImageDimension int     `yaml:"maxImageDimension" env:"UPLOAD_MAX_IMAGE_DIMENSION"` // max width or height in pixels
+	MaxImagePixels    int64   `yaml:"maxImagePixels" env:"UPLOAD_MAX_IMAGE_PIXELS"`       // max width * height of a single frame
+	MaxFrames         int     `yaml:"maxFrames" env:"UPLOAD_MAX_FRAMES"`                  // max frames in an animated GIF/WebP
+	MaxTotalPixels    int64   `yaml:"maxTotalPixels" env:"UPLOAD_MAX_TOTAL_PIXELS"`       // max width * height * frames
+}
+
+var DefaultUploadLimits = UploadLimits{
+	MaxImageBytes:     8 * 1024 * 1024,  // 8MB
+	MaxVideoBytes:     50 * 1024 * 1024, // 50MB
+	MaxVideoDuration:  60,
+	MaxImageDimension: 10000,
+	MaxImagePixels:    40000000,
+	MaxFrames:         300,
+	MaxTotalPixels:    400000000,
+}
+
+var uploadLimits = DefaultUploadLimits
+
+func ConfigureUploadLimits(limits UploadLimits) {
+	uploadLimits = limits
+}
+
+// CurrentUploadLimits returns the limits set at startup.
+func CurrentUploadLimits() UploadLimits {
+	return uploadLimits
+}
+
+type SanitizedUpload struct {
+	ContentType string
+	Extension   string
+	Data        []byte
+	Width       int
+	Height      int
+	Frames      int
+	Video       *VideoMetadata
+
+	// Decoded (first frame of the) image, nil for videos and animated WebP.
+	Image image.Image
+
+	// SHA-256 of the bytes as they were uploaded and perceptual hash of the
+	// image (empty when Image is nil), used for blocklists and reposts.
+	SHA256         string
+	PerceptualHash string
+}
+
+func (u *SanitizedUpload) IsVideo() bool {
+	return u.Video != nil
+}
+
+var (
+	ErrInvalidUpload = errors.New("invalid upload")
+
+	errUploadTooLarge    = fmt.Errorf("%w: file is too large", ErrInvalidUpload)
+	errUploadType        = fmt.Errorf("%w: only JPG, PNG, WEBP, GIF, MP4 and WEBM are allowed", ErrInvalidUpload)
+	errUploadCorrupt     = fmt.Errorf("%w: file could not be decoded", ErrInvalidUpload)
+	errUploadDimensions  = fmt.Errorf("%w: image dimensions are too large", ErrInvalidUpload)
+	errUploadFrames      = fmt.Errorf("%w: animation has too many frames", ErrInvalidUpload)
+	errUploadVideoLength = fmt.Errorf("%w: video is too long", ErrInvalidUpload)
+)
+
+var uploadExtensions = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+	"video/mp4":  "mp4",
+	"video/webm": "webm",
+}
+
+// MaxBytes returns the size limit for a content type, or 0 when the type
+// isn't accepted at all.
+func (l UploadLimits) MaxBytes(contentType string) int64 {
+	if _, ok := uploadExtensions[contentType]; !ok {
+		return 0
+	}
+	if strings.HasPrefix(contentType, "video/") {
+		return l.MaxVideoBytes
+	}
+	return l.MaxImageBytes
+}
+
+// SanitizeUpload detects the real type of an uploaded file from its bytes,
+// checks it against limits and returns a copy that is safe to store. Images
+// are re-encoded (or, for WebP, rewritten chunk by chunk) and videos have
+// their metadata blanked out, so that EXIF, XMP, locations and other
+// metadata never reach storage. Every error caused by the file
+// wraps ErrInvalidUpload, others are failures to re-encode it.
+func SanitizeUpload(r io.Reader, limits UploadLimits) (*SanitizedUpload, error) {
+	maxBytes := limits.MaxImageBytes
+	if limits.MaxVideoBytes > maxBytes {
+		maxBytes = limits.MaxVideoBytes
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, errUploadCorrupt
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, errUploadTooLarge
+	}
+
+	contentType := mimetype.Detect(data).String()
+	extension, ok := uploadExtensions[contentType]
+	if !ok {
+		return nil, errUploadType
+	}
+
+	digest := sha256.Sum256(data)
+	upload := &SanitizedUpload{
+		ContentType: contentType,
+		Extension:   extension,
+		SHA256:      hex.EncodeToString(digest[:]),
+	}
+
+	if contentType == "video/mp4" || contentType == "video/webm" {
+		if int64(len(data)) > limits.MaxVideoBytes {
+			return nil, errUploadTooLarge
+		}
+
+		metadata, err := ParseVideoMetadata(bytes.NewReader(data), int64(len(data)))
+		if err != nil || "video/"+metadata.Container != contentType {
+			return nil, errUploadCorrupt
+		}
+
+		// The parsers reject a missing duration, this keeps a zero one from
+		// ever passing the limit.
+		if metadata.Duration <= 0 {
+			return nil, errUploadCorrupt
+		}
+		if metadata.Duration > limits.MaxVideoDuration {
+			return nil, errUploadVideoLength
+		}
+
+		// data backs nothing else, it's stripped in place.
+		if err := stripVideoMetadata(data, metadata.Container); err != nil {
+			return nil, errUploadCorrupt
+		}
+
+		upload.Data = data
+		upload.Width = int(metadata.Width)
+		upload.Height = int(metadata.Height)
+		upload.Frames = 1
+		upload.Video = metadata
+		return upload, nil
+	}
+
+	if int64(len(data)) > limits.MaxImageBytes {
+		return nil, errUploadTooLarge
+	}
+
+	switch contentType {
+	case "image/jpeg":
+		err = sanitizeJPEG(upload, data, limits)
+	case "image/png":
+		err = sanitizePNG(upload, data, limits)
+	case "image/gif":
+		err = sanitizeGIF(upload, data, limits)
+	case "image/webp":
+		err = sanitizeWebP(upload, data, limits)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if upload.Image != nil {
+		upload.PerceptualHash = FormatImageHash(DHash(upload.Image))
+	}
+
+	return upload, nil
+}
+
+func checkImageLimits(width, height, frames int, limits UploadLimits) error {
+	if width <= 0 || height <= 0 || frames <= 0 {
+		return errUploadCorrupt
+	}
+
+	if width > limits.MaxImageDimension || height > limits.MaxImageDimension {
+		return errUploadDimensions
+	}
+
+	pixels := int64(width) * int64(height)
+	if pixels > limits.MaxImagePixels {
+		return errUploadDimensions
+	}
+
+	if frames > limits.MaxFrames {
+		return errUploadFrames
+	}
+
+	if pixels*int64(frames) > limits.MaxTotalPixels {
+		return errUploadFrames
+	}
+
+	return nil
+}
+
+func sanitizeJPEG(upload *SanitizedUpload, data []byte, limits UploadLimits) error {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errUploadCorrupt
+	}
+
+	if err := checkImageLimits(config.Width, config.Height, 1, limits); err != nil {
+		return err
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return errUploadCorrupt
+	}
+
+	// The orientation lives in the EXIF block we are about to drop, so bake
+	// it into the pixels first.
+	img = applyOrientation(img, jpegOrientation(data))
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: 90}); err != nil {
+		return fmt.Errorf("re-encoding jpeg: %w", err)
+	}
+
+	upload.Data = out.Bytes()
+	upload.Image = img
+	upload.Width = img.Bounds().Dx()
+	upload.Height = img.Bounds().Dy()
+	upload.Frames = 1
+	return nil
+}
+
+func sanitizePNG(upload *SanitizedUpload, data []byte, limits UploadLimits) error {
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errUploadCorrupt
+	}
+
+	if err := checkImageLimits(config.Width, config.Height, 1, limits); err != nil {
+		return err
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return errUploadCorrupt
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return fmt.Errorf("re-encoding png: %w", err)
+	}
+
+	upload.Data = out.Bytes()
+	upload.Image = img
+	upload.Width = config.Width
+	upload.Height = config.Height
+	upload.Frames = 1
+	return nil
+}
+
+func sanitizeGIF(upload *SanitizedUpload, data []byte, limits UploadLimits) error {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errUploadCorrupt
+	}
+
+	// Count frames from the block structure before decoding any of them.
+	frames, err := countGIFFrames(data)
+	if err != nil {
+		return err
+	}
+
+	if err := checkImageLimits(config.Width, config.Height, frames, limits); err != nil {
+		return err
+	}
+
+	animation, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return errUploadCorrupt
+	}
+
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, animation); err != nil {
+		return fmt.Errorf("re-encoding gif: %w", err)
+	}
+
+	upload.Data = out.Bytes()
+	upload.Image = animation.Image[0]
+	upload.Width = config.Width
+	upload.Height = config.Height
+	upload.Frames = len(animation.Image)
+	return nil
+}
+
+func countGIFFrames(data []byte) (int, error) {
+	if len(data) < 13 {
+		return 0, errUploadCorrupt
+	}
+
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 * (1 << (int(data[10]&0x07) + 1))
+	}
+
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return errUploadCorrupt
+			}
+			blockSize := int(data[pos])
+			pos++
+			if blockSize == 0 {
+				return nil
+			}
+			pos += blockSize
+		}
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return 0, errUploadCorrupt
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 * (1 << (int(flags&0x07) + 1))
+			}
+			pos++ // LZW minimum code size
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, errUploadCorrupt
+		}
+	}
+
+	return frames, nil
+}
+
+// WebP has no encoder in pure Go, so instead of re-encoding we rebuild the
+// RIFF container keeping only the chunks needed to render the image.
+var webpKeptChunks = map[string]bool{
+	"VP8 ": true,
+	"VP8L": true,
+	"VP8X": true,
+	"ALPH": true,
+	"ANIM": true,
+	"ANMF": true,
+}
+
+const (
+	webpFlagICC   = 0x20
+	webpFlagAlpha = 0x10
+	webpFlagEXIF  = 0x08
+	webpFlagXMP   = 0x04
+	webpFlagAnim  = 0x02
+)
+
+func sanitizeWebP(upload *SanitizedUpload, data []byte, limits UploadLimits) error {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errUploadCorrupt
+	}
+
+	riffEnd := 8 + int64(binary.LittleEndian.Uint32(data[4:8]))
+	if riffEnd > int64(len(data)) {
+		return errUploadCorrupt
+	}
+
+	var out bytes.Buffer
+	out.WriteString("RIFF\x00\x00\x00\x00WEBP")
+
+	width, height, frames := 0, 0, 0
+	animated := false
+	var animationFrames [][]byte
+
+	for pos := int64(12); pos+8 <= riffEnd; {
+		chunkType := string(data[pos : pos+4])
+		chunkSize := int64(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		paddedSize := chunkSize + chunkSize&1
+		if pos+8+chunkSize > riffEnd {
+			return errUploadCorrupt
+		}
+		payload := data[pos+8 : pos+8+chunkSize]
+
+		switch chunkType {
+		case "VP8X":
+			if chunkSize < 10 {
+				return errUploadCorrupt
+			}
+			animated = payload[0]&webpFlagAnim != 0
+			width = int(uint32(payload[4])|uint32(payload[5])<<8|uint32(payload[6])<<16) + 1
+			height = int(uint32(payload[7])|uint32(payload[8])<<8|uint32(payload[9])<<16) + 1
+		case "ANMF":
+			frames++
+			animationFrames = append(animationFrames, payload)
+		case "VP8 ", "VP8L":
+			frames++
+		}
+
+		if webpKeptChunks[chunkType] {
+			start := out.Len()
+			out.Write(data[pos : pos+8+chunkSize])
+			if paddedSize != chunkSize {
+				out.WriteByte(0)
+			}
+			if chunkType == "VP8X" {
+				out.Bytes()[start+8] &^= webpFlagICC | webpFlagEXIF | webpFlagXMP
+			}
+		}
+
+		pos += 8 + paddedSize
+	}
+
+	if !animated {
+		// Still images go through the decoder so a truncated or malformed
+		// bitstream is rejected here rather than in someone's browser.
+		config, err := webp.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return errUploadCorrupt
+		}
+
+		if err := checkImageLimits(config.Width, config.Height, 1, limits); err != nil {
+			return err
+		}
+
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			return errUploadCorrupt
+		}
+		upload.Image = img
+
+		width, height, frames = config.Width, config.Height, 1
+	} else {
+		if err := checkImageLimits(width, height, frames, limits); err != nil {
+			return err
+		}
+
+		// The decoder only reads still images, so every frame is decoded on
+		// its own. Limits are checked first so this work stays bounded.
+		for _, frame := range animationFrames {
+			if err := checkWebPFrame(frame, width, height); err != nil {
+				return err
+			}
+		}
+	}
+
+	sanitized := out.Bytes()
+	binary.LittleEndian.PutUint32(sanitized[4:8], uint32(len(sanitized)-8))
+
+	upload.Data = sanitized
+	upload.Width = width
+	upload.Height = height
+	upload.Frames = frames
+	return nil
+}
+
+// checkWebPFrame decodes the payload of an ANMF chunk, a frame header
+// followed by an optional ALPH chunk and a VP8 or VP8L bitstream, by
+// wrapping it in a still WebP of its own. The frame has to fit on the
+// canvas.
+func checkWebPFrame(frame []byte, canvasWidth, canvasHeight int) error {
+	if len(frame) < 16 {
+		return errUploadCorrupt
+	}
+
+	uint24 := func(b []byte) int {
+		return int(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
+	}
+	x, y := 2*uint24(frame[0:3]), 2*uint24(frame[3:6])
+	width, height := uint24(frame[6:9])+1, uint24(frame[9:12])+1
+	if x+width > canvasWidth || y+height > canvasHeight {
+		return errUploadCorrupt
+	}
+
+	var alpha, bitstream []byte
+	for pos := 16; pos+8 <= len(frame); {
+		chunkType := string(frame[pos : pos+4])
+		chunkSize := int(binary.LittleEndian.Uint32(frame[pos+4 : pos+8]))
+		if chunkSize < 0 || pos+8+chunkSize > len(frame) {
+			return errUploadCorrupt
+		}
+		chunk := frame[pos : pos+8+chunkSize]
+
+		switch chunkType {
+		case "ALPH":
+			alpha = chunk
+		case "VP8 ", "VP8L":
+			bitstream = chunk
+		}
+
+		pos += 8 + chunkSize + chunkSize&1
+	}
+	if bitstream == nil {
+		return errUploadCorrupt
+	}
+
+	var still bytes.Buffer
+	still.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	writeChunk := func(chunk []byte) {
+		still.Write(chunk)
+		if len(chunk)&1 != 0 {
+			still.WriteByte(0)
+		}
+	}
+	if alpha != nil {
+		// A lossy frame keeps its alpha in a separate chunk, which the
+		// decoder only reads from an extended file.
+		header := make([]byte, 18)
+		copy(header, "VP8X")
+		binary.LittleEndian.PutUint32(header[4:8], 10)
+		header[8] = webpFlagAlpha
+		putUint24 := func(b []byte, v int) { b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16) }
+		putUint24(header[12:15], width-1)
+		putUint24(header[15:18], height-1)
+		writeChunk(header)
+		writeChunk(alpha)
+	}
+	writeChunk(bitstream)
+
+	data := still.Bytes()
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil || img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+		return errUploadCorrupt
+	}
+
+	return nil
+}
+
+// jpegOrientation returns the EXIF orientation tag (1-8) of a JPEG, or 1
+// when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan / end of image
+			return 1
+		}
+
+		segmentLength := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		segmentEnd := pos + 2 + segmentLength
+		if segmentLength < 2 || segmentEnd > len(data) {
+			return 1
+		}
+
+		segment := data[pos+4 : segmentEnd]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+
+		pos = segmentEnd
+	}
+
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// applyOrientation rotates/flips img so that it displays upright without
+// the EXIF orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			out.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,270 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+)
+
+// bitWriter writes VP8L's least significant bit first stream.
+type bitWriter struct {
+	data  []byte
+	nbits int
+}
+
+func (w *bitWriter) write(value uint32, n int) {
+	for i := 0; i < n; i++ {
+		if w.nbits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(value>>i&1) << (w.nbits % 8)
+		w.nbits++
+	}
+}
+
+// solidVP8L is a lossless bitstream of a single colour. Every prefix code
+// has one symbol, so the pixels take no bits at all.
+func solidVP8L(width, height int, argb [4]byte) []byte {
+	w := &bitWriter{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	w.write(1, 1) // alpha is used
+	w.write(0, 3) // version
+	w.write(0, 1) // no transform
+	w.write(0, 1) // no color cache
+	w.write(0, 1) // no meta prefix codes
+
+	// Green, red, blue, alpha, then distance.
+	for _, symbol := range []byte{argb[2], argb[1], argb[3], argb[0], 0} {
+		w.write(1, 1) // simple code
+		w.write(0, 1) // one symbol
+		w.write(1, 1) // of 8 bits
+		w.write(uint32(symbol), 8)
+	}
+
+	return chunk("VP8L", w.data)
+}
+
+func chunk(chunkType string, payload []byte) []byte {
+	out := append([]byte(chunkType), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(payload)))
+	out = append(out, payload...)
+	if len(payload)&1 != 0 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+type webpFrame struct {
+	x, y, width, height int
+	bitstream           []byte
+}
+
+func animatedWebP(width, height int, frames []webpFrame) []byte {
+	header := make([]byte, 10)
+	header[0] = webpFlagAnim | webpFlagAlpha
+	putUint24(header[4:7], width-1)
+	putUint24(header[7:10], height-1)
+
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", header)...)
+	body = append(body, chunk("ANIM", make([]byte, 6))...)
+	for _, frame := range frames {
+		payload := make([]byte, 16)
+		putUint24(payload[0:3], frame.x/2)
+		putUint24(payload[3:6], frame.y/2)
+		putUint24(payload[6:9], frame.width-1)
+		putUint24(payload[9:12], frame.height-1)
+		putUint24(payload[12:15], 100)
+		body = append(body, chunk("ANMF", append(payload, frame.bitstream...))...)
+	}
+
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestSanitizeAnimatedWebP(t *testing.T) {
+	red := solidVP8L(4, 4, [4]byte{0xff, 0xff, 0, 0})
+	blue := solidVP8L(2, 2, [4]byte{0xff, 0, 0, 0xff})
+
+	upload, err := SanitizeUpload(bytes.NewReader(animatedWebP(4, 4, []webpFrame{
+		{0, 0, 4, 4, red},
+		{2, 2, 2, 2, blue},
+	})), DefaultUploadLimits)
+	if err != nil {
+		t.Fatalf("valid animation: %v", err)
+	}
+	if upload.ContentType != "image/webp" || upload.Frames != 2 || upload.Width != 4 || upload.Height != 4 {
+		t.Errorf("got %s %dx%d with %d frames", upload.ContentType, upload.Width, upload.Height, upload.Frames)
+	}
+
+	corrupt := append([]byte{}, red...)
+	corrupt[8] = 0 // not the VP8L signature
+
+	rejected := map[string][]byte{
+		"corrupt frame": animatedWebP(4, 4, []webpFrame{
+			{0, 0, 4, 4, red},
+			{0, 0, 4, 4, corrupt},
+		}),
+		"frame outside the canvas": animatedWebP(4, 4, []webpFrame{
+			{2, 2, 4, 4, red},
+		}),
+		"frame size doesn't match its bitstream": animatedWebP(4, 4, []webpFrame{
+			{0, 0, 2, 2, red},
+		}),
+		"no frames": animatedWebP(4, 4, nil),
+	}
+
+	for name, data := range rejected {
+		if _, err := SanitizeUpload(bytes.NewReader(data), DefaultUploadLimits); !errors.Is(err, ErrInvalidUpload) {
+			t.Errorf("%s: got %v, want ErrInvalidUpload", name, err)
+		}
+	}
+}
+
+func box(boxType string, payloads ...[]byte) []byte {
+	out := append(make([]byte, 4), boxType...)
+	for _, payload := range payloads {
+		out = append(out, payload...)
+	}
+	binary.BigEndian.PutUint32(out[0:4], uint32(len(out)))
+	return out
+}
+
+// mvhdBox is a version 0 movie header, duration in milliseconds.
+func mvhdBox(duration uint32) []byte {
+	payload := make([]byte, 100)
+	binary.BigEndian.PutUint32(payload[12:16], 1000)
+	binary.BigEndian.PutUint32(payload[16:20], duration)
+	return box("mvhd", payload)
+}
+
+func videoTrak(width, height uint32) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:80], width<<16)
+	binary.BigEndian.PutUint32(tkhd[80:84], height<<16)
+
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:12], "vide")
+
+	return box("trak", box("tkhd", tkhd), box("mdia", box("hdlr", hdlr)))
+}
+
+func mp4File(moovChildren ...[]byte) []byte {
+	out := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	out = append(out, box("moov", moovChildren...)...)
+	return append(out, box("mdat", []byte("frames"))...)
+}
+
+// ebml encodes an element with an eight byte size.
+func ebml(id uint64, payloads ...[]byte) []byte {
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+
+	var payload []byte
+	for _, p := range payloads {
+		payload = append(payload, p...)
+	}
+
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(payload)))
+	size[0] = 0x01
+	return append(append(out, size...), payload...)
+}
+
+func ebmlUint(id uint64, value uint64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, value))
+}
+
+func ebmlFloat(id uint64, value float64) []byte {
+	return ebml(id, binary.BigEndian.AppendUint64(nil, math.Float64bits(value)))
+}
+
+// webmFile is a WebM file with a segment of the given elements.
+func webmFile(segment ...[]byte) []byte {
+	header := ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte("webm")))
+	return append(header, ebml(mkvSegmentID, segment...)...)
+}
+
+func webmInfo(duration float64, children ...[]byte) []byte {
+	return ebml(mkvInfoID, append([][]byte{ebmlUint(mkvTimecodeScale, 1000000), ebmlFloat(mkvDurationID, duration)}, children...)...)
+}
+
+func webmTracks(width, height uint64) []byte {
+	video := ebml(mkvVideoID, ebmlUint(mkvPixelWidthID, width), ebmlUint(mkvPixelHeightID, height))
+	return ebml(mkvTracksID, ebml(mkvTrackEntryID, video))
+}
+
+// unknownSizeCluster is a cluster the way streaming recorders write it,
+// ending where the next top level element starts.
+func unknownSizeCluster(children ...[]byte) []byte {
+	out := []byte{0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	for _, child := range children {
+		out = append(out, child...)
+	}
+	return out
+}
+
+const testLocation = "+52.3700+004.8900/"
+
+func TestSanitizeVideoStripsMetadata(t *testing.T) {
+	location := box("\xa9xyz", []byte{0, 18, 0x15, 0xc7}, []byte(testLocation))
+	keys := box("keys", []byte("com.apple.quicktime.location.ISO6709"))
+	xmp := box("uuid", []byte(mp4XMPUUID), []byte("<x:xmpmeta>"+testLocation+"</x:xmpmeta>"))
+
+	videos := map[string][]byte{
+		"mp4": append(mp4File(
+			mvhdBox(5000),
+			videoTrak(640, 360),
+			box("udta", location),
+			box("meta", keys, box("ilst", []byte(testLocation))),
+		), xmp...),
+		"webm": webmFile(
+			webmInfo(5000, ebml(mkvTitleID, []byte("Recorded at "+testLocation))),
+			webmTracks(640, 360),
+			unknownSizeCluster(ebml(0xA3, []byte("frames"))),
+			ebml(mkvTagsID, ebml(0x7373, []byte("LOCATION "+testLocation), make([]byte, 200))),
+		),
+	}
+
+	for container, data := range videos {
+		original := append([]byte{}, data...)
+
+		upload, err := SanitizeUpload(bytes.NewReader(data), DefaultUploadLimits)
+		if err != nil {
+			t.Fatalf("%s: %v", container, err)
+		}
+
+		if bytes.Contains(upload.Data, []byte(testLocation)) {
+			t.Errorf("%s: the location reached the sanitized file", container)
+		}
+		if len(upload.Data) != len(original) || !bytes.Contains(upload.Data, []byte("frames")) {
+			t.Errorf("%s: the streams moved or went missing", container)
+		}
+
+		// What's left is still a valid file of the same video.
+		metadata, err := ParseVideoMetadata(bytes.NewReader(upload.Data), int64(len(upload.Data)))
+		if err != nil {
+			t.Fatalf("%s: sanitized file doesn't parse: %v", container, err)
+		}
+		if *metadata != *upload.Video || metadata.Duration != 5 || metadata.Width != 640 {
+			t.Errorf("%s: sanitized file reads as %+v, want %+v", container, metadata, upload.Video)
+		}
+
+		digest := sha256.Sum256(original)
+		if upload.SHA256 != hex.EncodeToString(digest[:]) {
+			t.Errorf("%s: SHA256 isn't of the file as uploaded", container)
+		}
+	}
+}
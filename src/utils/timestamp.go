@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"time"
+)
+
+type TimestampFormat string
+
+const (
+	TimestampISO    TimestampFormat = "iso"
+	TimestampMillis TimestampFormat = "ms" // millisecond strings, how timestamps used to be sent
+)
+
+// ISO-8601 in UTC with milliseconds, the precision BSON dates keep.
+const isoTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is stored as a native BSON date and sent as ISO-8601, or as a
+// millisecond string for clients that still expect one (see In).
+//
+// Documents written before the switch hold millisecond strings, those are
+// still read so old and migrated documents can live side by side.
+type Timestamp struct {
+	time.Time
+	format TimestampFormat
+}
+
+func Now() Timestamp {
+	return NewTimestamp(time.Now())
+}
+
+// NewTimestamp truncates t to milliseconds, so a value reads back from Mongo
+// exactly as it was written.
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t.UTC().Truncate(time.Millisecond)}
+}
+
+func TimestampFromMillis(ms int64) Timestamp {
+	return NewTimestamp(time.UnixMilli(ms))
+}
+
+// In returns a copy that is written to JSON in format.
+func (t Timestamp) In(format TimestampFormat) Timestamp {
+	t.format = format
+	return t
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.format == TimestampMillis {
+		return json.Marshal(strconv.FormatInt(t.UnixMilli(), 10))
+	}
+	return json.Marshal(t.UTC().Format(isoTimestampLayout))
+}
+
+// UnmarshalJSON takes either format, and bare numbers of milliseconds.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*t = Timestamp{}
+		return nil
+	}
+
+	var ms int64
+	if err := json.Unmarshal(data, &ms); err == nil {
+		*t = TimestampFromMillis(ms)
+		return nil
+	}
+
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("timestamp must be a string or a number: %w", err)
+	}
+	if text == "" {
+		*t = Timestamp{}
+		return nil
+	}
+
+	if ms, err := strconv.ParseInt(text, 10, 64); err == nil {
+		*t = TimestampFromMillis(ms)
+		return nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return fmt.Errorf("timestamp must be ISO-8601 or milliseconds: %w", err)
+	}
+	*t = NewTimestamp(parsed)
+	return nil
+}
+
+func (t Timestamp) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(primitive.NewDateTimeFromTime(t.Time))
+}
+
+func (t *Timestamp) UnmarshalBSONValue(valueType bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: valueType, Value: data}
+
+	switch valueType {
+	case bsontype.DateTime:
+		*t = NewTimestamp(value.Time())
+	case bsontype.String:
+		// Written before timestamps were dates.
+		text := value.StringValue()
+		if text == "" {
+			*t = Timestamp{}
+			return nil
+		}
+		ms, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return fmt.Errorf("timestamp %q is not in milliseconds: %w", text, err)
+		}
+		*t = TimestampFromMillis(ms)
+	case bsontype.Int64:
+		*t = TimestampFromMillis(value.Int64())
+	case bsontype.Int32:
+		*t = TimestampFromMillis(int64(value.Int32()))
+	case bsontype.Double:
+		*t = TimestampFromMillis(int64(value.Double()))
+	case bsontype.Null, bsontype.Undefined:
+		*t = Timestamp{}
+	default:
+		return fmt.Errorf("cannot read a timestamp from BSON %s", valueType)
+	}
+
+	return nil
+}
+
+var defaultTimestampFormat = TimestampISO
+
+// ConfigureTimestamps sets the format sent on /v1. Setting it to ms keeps
+// every client on the old format while they move over.
+func ConfigureTimestamps(format TimestampFormat) {
+	defaultTimestampFormat = format
+}
+
+const millisTimestampsKey = "millisTimestamps"
+
+// UseMillisTimestamps makes the rest of the request answer with millisecond
+// strings, for routes whose clients predate ISO timestamps.
+func UseMillisTimestamps(c echo.Context) {
+	c.Set(millisTimestampsKey, true)
+}
+
+// ResponseTimestampFormat is the format timestamps in the response to c
+// should be written in.
+func ResponseTimestampFormat(c echo.Context) TimestampFormat {
+	if millis, _ := c.Get(millisTimestampsKey).(bool); millis {
+		return TimestampMillis
+	}
+	return defaultTimestampFormat
+}
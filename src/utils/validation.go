@@ -27,14 +27,30 @@ func ValidateQueryParams(context echo.Context, fields []string) bool {
 	return true
 }
 
+type RecaptchaConfig struct {
+	Secret    string  `yaml:"secret" env:"RECAPTCHA_SECRET" secret:"true"`
+	MinScore  float64 `yaml:"minScore" env:"RECAPTCHA_MIN_SCORE"`
+	VerifyURL string  `yaml:"verifyUrl" env:"RECAPTCHA_VERIFY_URL"`
+}
+
+var DefaultRecaptchaConfig = RecaptchaConfig{
+	MinScore:  0.5,
+	VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+var recaptchaConfig = DefaultRecaptchaConfig
+
+func ConfigureRecaptcha(config RecaptchaConfig) {
+	recaptchaConfig = config
+}
+
 func VerifyRecaptcha(token string) (bool, error) {
-	verifyURL := "https://www.google.com/recaptcha/api/siteverify"
 	data := url.Values{
-		"secret":   {""},
+		"secret":   {recaptchaConfig.Secret},
 		"response": {token},
 	}
 
-	resp, err := http.PostForm(verifyURL, data)
+	resp, err := http.PostForm(recaptchaConfig.VerifyURL, data)
 	if err != nil {
 		return false, fmt.Errorf("failed to verify reCAPTCHA: %w", err)
 	}
@@ -53,8 +69,8 @@ func VerifyRecaptcha(token string) (bool, error) {
 
 	print(recaptchaResponse.Score)
 
-	// Reject if score is less than 0.5
-	if recaptchaResponse.Score < 0.5 {
+	// Reject if score is less than the configured minimum
+	if recaptchaResponse.Score < recaptchaConfig.MinScore {
 		return false, nil
 	}
 
@@ -62,3 +78,22 @@ func VerifyRecaptcha(token string) (bool, error) {
 
 	return recaptchaResponse.Success, nil
 }
+
+// CheckRecaptcha verifies token and returns a problem describing why it was
+// rejected, or nil.
+func CheckRecaptcha(token string) error {
+	if token == "" {
+		return ValidationFailed("recaptchaToken", "Recaptcha token is required")
+	}
+
+	valid, err := VerifyRecaptcha(token)
+	if err != nil {
+		return InternalError(err, "Could not verify Recaptcha token")
+	}
+
+	if !valid {
+		return NewProblem(http.StatusForbidden, CodeRecaptchaFailed, "Invalid Recaptcha Token")
+	}
+
+	return nil
+}
@@ -0,0 +1,735 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+type VideoMetadata struct {
+	Container string  `bson:"container" json:"container"`
+	Duration  float64 `bson:"duration" json:"duration"`
+	Width     int64   `bson:"width" json:"width"`
+	Height    int64   `bson:"height" json:"height"`
+}
+
+var ErrUnsupportedVideo = errors.New("unsupported or corrupt video container")
+
+// Upper bound on the number of boxes/elements walked, so a crafted file
+// can't make the parser spin through millions of tiny entries.
+const maxVideoElements = 10000
+
+// ParseVideoMetadata reads the container headers of an MP4 or WebM file and
+// returns its duration (in seconds) and the dimensions of the first video track.
+func ParseVideoMetadata(r io.ReaderAt, size int64) (*VideoMetadata, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, ErrUnsupportedVideo
+	}
+
+	if string(header[4:8]) == "ftyp" {
+		return parseMP4(r, size)
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) == ebmlHeaderID {
+		return parseWebM(r, size)
+	}
+
+	return nil, ErrUnsupportedVideo
+}
+
+// stripVideoMetadata blanks out everything in a parsed video that describes
+// it rather than plays it, like where it was recorded. The metadata is
+// overwritten in place with padding of the same size, so no offset into the
+// file moves and the streams stay untouched. data is modified.
+func stripVideoMetadata(data []byte, container string) error {
+	switch container {
+	case "mp4":
+		count := 0
+		return stripMP4Metadata(data, 0, int64(len(data)), &count)
+	case "webm":
+		return stripWebMMetadata(data)
+	default:
+		return ErrUnsupportedVideo
+	}
+}
+
+// MP4 / ISO base media file format
+
+type mp4Box struct {
+	boxType   string
+	start     int64 // start of the box header
+	offset    int64 // start of the box payload
+	size      int64 // payload size
+	nextStart int64
+}
+
+// readMP4Boxes lists the boxes laid out back to back in [start, end).
+func readMP4Boxes(r io.ReaderAt, start, end int64, count *int) ([]mp4Box, error) {
+	var boxes []mp4Box
+	header := make([]byte, 16)
+
+	for pos := start; pos+8 <= end; {
+		*count++
+		if *count > maxVideoElements {
+			return nil, ErrUnsupportedVideo
+		}
+
+		if _, err := r.ReadAt(header[:8], pos); err != nil {
+			return nil, ErrUnsupportedVideo
+		}
+
+		boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch boxSize {
+		case 0:
+			boxSize = end - pos
+		case 1:
+			if _, err := r.ReadAt(header[8:16], pos+8); err != nil {
+				return nil, ErrUnsupportedVideo
+			}
+			large := binary.BigEndian.Uint64(header[8:16])
+			if large > math.MaxInt64 {
+				return nil, ErrUnsupportedVideo
+			}
+			boxSize = int64(large)
+			headerSize = 16
+		}
+
+		if boxSize < headerSize || pos+boxSize > end {
+			return nil, ErrUnsupportedVideo
+		}
+
+		boxes = append(boxes, mp4Box{
+			boxType:   boxType,
+			start:     pos,
+			offset:    pos + headerSize,
+			size:      boxSize - headerSize,
+			nextStart: pos + boxSize,
+		})
+		pos += boxSize
+	}
+
+	return boxes, nil
+}
+
+func findMP4Box(boxes []mp4Box, boxType string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].boxType == boxType {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+func parseMP4(r io.ReaderAt, size int64) (*VideoMetadata, error) {
+	count := 0
+	topLevel, err := readMP4Boxes(r, 0, size, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	moov := findMP4Box(topLevel, "moov")
+	if moov == nil {
+		return nil, ErrUnsupportedVideo
+	}
+
+	moovChildren, err := readMP4Boxes(r, moov.offset, moov.nextStart, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	mvhd := findMP4Box(moovChildren, "mvhd")
+	if mvhd == nil {
+		return nil, ErrUnsupportedVideo
+	}
+
+	duration, err := parseMVHD(r, mvhd)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &VideoMetadata{Container: "mp4", Duration: duration}
+
+	for _, trak := range moovChildren {
+		if trak.boxType != "trak" {
+			continue
+		}
+
+		trakChildren, err := readMP4Boxes(r, trak.offset, trak.nextStart, &count)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isMP4VideoTrack(r, trakChildren, &count) {
+			continue
+		}
+
+		tkhd := findMP4Box(trakChildren, "tkhd")
+		if tkhd == nil {
+			continue
+		}
+
+		width, height, err := parseTKHD(r, tkhd)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata.Width = width
+		metadata.Height = height
+		break
+	}
+
+	if metadata.Width == 0 || metadata.Height == 0 {
+		return nil, fmt.Errorf("%w: no video track found", ErrUnsupportedVideo)
+	}
+
+	return metadata, nil
+}
+
+func isMP4VideoTrack(r io.ReaderAt, trakChildren []mp4Box, count *int) bool {
+	mdia := findMP4Box(trakChildren, "mdia")
+	if mdia == nil {
+		return false
+	}
+
+	mdiaChildren, err := readMP4Boxes(r, mdia.offset, mdia.nextStart, count)
+	if err != nil {
+		return false
+	}
+
+	hdlr := findMP4Box(mdiaChildren, "hdlr")
+	if hdlr == nil || hdlr.size < 12 {
+		return false
+	}
+
+	// version/flags (4), pre_defined (4), handler_type (4)
+	handler := make([]byte, 4)
+	if _, err := r.ReadAt(handler, hdlr.offset+8); err != nil {
+		return false
+	}
+
+	return string(handler) == "vide"
+}
+
+func parseMVHD(r io.ReaderAt, mvhd *mp4Box) (float64, error) {
+	if mvhd.size < 32 {
+		return 0, ErrUnsupportedVideo
+	}
+
+	buf := make([]byte, 32)
+	if _, err := r.ReadAt(buf, mvhd.offset); err != nil {
+		return 0, ErrUnsupportedVideo
+	}
+
+	var timescale uint32
+	var duration uint64
+
+	switch buf[0] {
+	case 0:
+		timescale = binary.BigEndian.Uint32(buf[12:16])
+		duration = uint64(binary.BigEndian.Uint32(buf[16:20]))
+	case 1:
+		timescale = binary.BigEndian.Uint32(buf[20:24])
+		duration = binary.BigEndian.Uint64(buf[24:32])
+	default:
+		return 0, ErrUnsupportedVideo
+	}
+
+	if timescale == 0 {
+		return 0, ErrUnsupportedVideo
+	}
+
+	// All ones means the duration isn't known, e.g. a fragmented file.
+	if duration == 0 || (buf[0] == 0 && duration == math.MaxUint32) || duration == math.MaxUint64 {
+		return 0, fmt.Errorf("%w: missing duration", ErrUnsupportedVideo)
+	}
+
+	return float64(duration) / float64(timescale), nil
+}
+
+func parseTKHD(r io.ReaderAt, tkhd *mp4Box) (int64, int64, error) {
+	if tkhd.size < 1 {
+		return 0, 0, ErrUnsupportedVideo
+	}
+
+	version := make([]byte, 1)
+	if _, err := r.ReadAt(version, tkhd.offset); err != nil {
+		return 0, 0, ErrUnsupportedVideo
+	}
+
+	// Width and height are the last two 16.16 fixed point fields of the box.
+	dimensionsOffset := int64(76)
+	if version[0] == 1 {
+		dimensionsOffset = 88
+	}
+
+	if tkhd.size < dimensionsOffset+8 {
+		return 0, 0, ErrUnsupportedVideo
+	}
+
+	buf := make([]byte, 8)
+	if _, err := r.ReadAt(buf, tkhd.offset+dimensionsOffset); err != nil {
+		return 0, 0, ErrUnsupportedVideo
+	}
+
+	width := int64(binary.BigEndian.Uint32(buf[0:4]) >> 16)
+	height := int64(binary.BigEndian.Uint32(buf[4:8]) >> 16)
+
+	return width, height, nil
+}
+
+// XMP packets are stored in a uuid box with this extended type.
+const mp4XMPUUID = "\xbe\x7a\xcf\xcb\x97\xa9\x42\xe8\x9c\x71\x99\x94\x91\xe3\xaf\xac"
+
+// stripMP4Metadata turns user data (udta, where the ©xyz location lives),
+// metadata (meta, QuickTime keys and iTunes tags) and XMP boxes into free
+// boxes, in the file and in moov and its tracks.
+func stripMP4Metadata(data []byte, start, end int64, count *int) error {
+	boxes, err := readMP4Boxes(bytes.NewReader(data), start, end, count)
+	if err != nil {
+		return err
+	}
+
+	for _, box := range boxes {
+		switch box.boxType {
+		case "udta", "meta":
+			blankMP4Box(data, box)
+		case "uuid":
+			if box.size >= 16 && string(data[box.offset:box.offset+16]) == mp4XMPUUID {
+				blankMP4Box(data, box)
+			}
+		case "moov", "trak":
+			if err := stripMP4Metadata(data, box.offset, box.nextStart, count); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func blankMP4Box(data []byte, box mp4Box) {
+	copy(data[box.start+4:], "free")
+	clear(data[box.offset:box.nextStart])
+}
+
+// WebM / Matroska (EBML)
+
+const (
+	ebmlHeaderID     = 0x1A45DFA3
+	ebmlDocTypeID    = 0x4282
+	ebmlVoidID       = 0xEC
+	mkvSegmentID     = 0x18538067
+	mkvInfoID        = 0x1549A966
+	mkvTimecodeScale = 0x2AD7B1
+	mkvDurationID    = 0x4489
+	mkvTracksID      = 0x1654AE6B
+	mkvTrackEntryID  = 0xAE
+	mkvVideoID       = 0xE0
+	mkvPixelWidthID  = 0xB0
+	mkvPixelHeightID = 0xBA
+	mkvClusterID     = 0x1F43B675
+	mkvTitleID       = 0x7BA9
+	mkvSeekHeadID    = 0x114D9B74
+	mkvChaptersID    = 0x1043A770
+	mkvCuesID        = 0x1C53BB6B
+	mkvAttachmentsID = 0x1941A469
+	mkvTagsID        = 0x1254C367
+)
+
+// The elements that can follow each other in a segment. A cluster of
+// unknown size ends where the next of these starts.
+var mkvTopLevelIDs = map[uint64]bool{
+	mkvSeekHeadID:    true,
+	mkvInfoID:        true,
+	mkvTracksID:      true,
+	mkvChaptersID:    true,
+	mkvClusterID:     true,
+	mkvCuesID:        true,
+	mkvAttachmentsID: true,
+	mkvTagsID:        true,
+}
+
+type ebmlElement struct {
+	id          uint64
+	start       int64 // start of the element ID
+	offset      int64 // start of the element payload
+	size        int64 // payload size, -1 when unknown
+	unknownSize bool
+}
+
+// readVint decodes an EBML variable length integer. When keepMarker is set
+// the length marker bit is kept, which is how element IDs are written.
+func readVint(r io.ReaderAt, pos int64, keepMarker bool) (uint64, int, bool, error) {
+	first := make([]byte, 1)
+	if _, err := r.ReadAt(first, pos); err != nil {
+		return 0, 0, false, ErrUnsupportedVideo
+	}
+
+	length := 1
+	mask := byte(0x80)
+	for length <= 8 && first[0]&mask == 0 {
+		mask >>= 1
+		length++
+	}
+	if length > 8 {
+		return 0, 0, false, ErrUnsupportedVideo
+	}
+
+	buf := make([]byte, length)
+	if _, err := r.ReadAt(buf, pos); err != nil {
+		return 0, 0, false, ErrUnsupportedVideo
+	}
+
+	if !keepMarker {
+		buf[0] &= mask - 1
+	}
+
+	var value uint64
+	allOnes := true
+	for i, b := range buf {
+		value = value<<8 | uint64(b)
+		if i == 0 {
+			if b != mask-1 {
+				allOnes = false
+			}
+		} else if b != 0xFF {
+			allOnes = false
+		}
+	}
+
+	return value, length, !keepMarker && allOnes, nil
+}
+
+func readEBMLElement(r io.ReaderAt, pos int64) (ebmlElement, error) {
+	id, idLength, _, err := readVint(r, pos, true)
+	if err != nil {
+		return ebmlElement{}, err
+	}
+
+	size, sizeLength, unknown, err := readVint(r, pos+int64(idLength), false)
+	if err != nil {
+		return ebmlElement{}, err
+	}
+
+	if size > math.MaxInt64 {
+		return ebmlElement{}, ErrUnsupportedVideo
+	}
+
+	element := ebmlElement{
+		id:          id,
+		start:       pos,
+		offset:      pos + int64(idLength) + int64(sizeLength),
+		size:        int64(size),
+		unknownSize: unknown,
+	}
+	if unknown {
+		element.size = -1
+	}
+
+	return element, nil
+}
+
+// walkEBML calls fn for every direct child of the byte range [start, end).
+// Returning false from fn stops the walk.
+func walkEBML(r io.ReaderAt, start, end int64, count *int, fn func(ebmlElement) (bool, error)) error {
+	for pos := start; pos < end; {
+		*count++
+		if *count > maxVideoElements {
+			return ErrUnsupportedVideo
+		}
+
+		element, err := readEBMLElement(r, pos)
+		if err != nil {
+			return err
+		}
+
+		if !element.unknownSize && element.offset+element.size > end {
+			return ErrUnsupportedVideo
+		}
+
+		more, err := fn(element)
+		if err != nil {
+			return err
+		}
+		if !more || element.unknownSize {
+			return nil
+		}
+
+		pos = element.offset + element.size
+	}
+
+	return nil
+}
+
+func readEBMLUint(r io.ReaderAt, element ebmlElement) (uint64, error) {
+	if element.size < 1 || element.size > 8 {
+		return 0, ErrUnsupportedVideo
+	}
+
+	buf := make([]byte, element.size)
+	if _, err := r.ReadAt(buf, element.offset); err != nil {
+		return 0, ErrUnsupportedVideo
+	}
+
+	var value uint64
+	for _, b := range buf {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func readEBMLFloat(r io.ReaderAt, element ebmlElement) (float64, error) {
+	buf := make([]byte, element.size)
+
+	switch element.size {
+	case 4:
+		if _, err := r.ReadAt(buf, element.offset); err != nil {
+			return 0, ErrUnsupportedVideo
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 8:
+		if _, err := r.ReadAt(buf, element.offset); err != nil {
+			return 0, ErrUnsupportedVideo
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	default:
+		return 0, ErrUnsupportedVideo
+	}
+}
+
+func parseWebM(r io.ReaderAt, size int64) (*VideoMetadata, error) {
+	count := 0
+
+	header, err := readEBMLElement(r, 0)
+	if err != nil || header.id != ebmlHeaderID || header.unknownSize {
+		return nil, ErrUnsupportedVideo
+	}
+
+	docType := ""
+	err = walkEBML(r, header.offset, header.offset+header.size, &count, func(element ebmlElement) (bool, error) {
+		if element.id == ebmlDocTypeID && element.size > 0 && element.size <= 32 {
+			buf := make([]byte, element.size)
+			if _, err := r.ReadAt(buf, element.offset); err != nil {
+				return false, ErrUnsupportedVideo
+			}
+			docType = string(buf)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if docType != "webm" {
+		return nil, fmt.Errorf("%w: unexpected doc type %q", ErrUnsupportedVideo, docType)
+	}
+
+	segment, err := readEBMLElement(r, header.offset+header.size)
+	if err != nil || segment.id != mkvSegmentID {
+		return nil, ErrUnsupportedVideo
+	}
+
+	segmentEnd := size
+	if !segment.unknownSize && segment.offset+segment.size < size {
+		segmentEnd = segment.offset + segment.size
+	}
+
+	timecodeScale := uint64(1000000)
+	var rawDuration float64
+	metadata := &VideoMetadata{Container: "webm"}
+
+	err = walkEBML(r, segment.offset, segmentEnd, &count, func(element ebmlElement) (bool, error) {
+		switch element.id {
+		case mkvInfoID:
+			return true, walkEBML(r, element.offset, element.offset+element.size, &count, func(child ebmlElement) (bool, error) {
+				var err error
+				switch child.id {
+				case mkvTimecodeScale:
+					timecodeScale, err = readEBMLUint(r, child)
+				case mkvDurationID:
+					rawDuration, err = readEBMLFloat(r, child)
+				}
+				return true, err
+			})
+		case mkvTracksID:
+			return true, walkEBML(r, element.offset, element.offset+element.size, &count, func(entry ebmlElement) (bool, error) {
+				if entry.id != mkvTrackEntryID || metadata.Width != 0 {
+					return true, nil
+				}
+				return true, walkEBML(r, entry.offset, entry.offset+entry.size, &count, func(child ebmlElement) (bool, error) {
+					if child.id != mkvVideoID {
+						return true, nil
+					}
+					return false, walkEBML(r, child.offset, child.offset+child.size, &count, func(video ebmlElement) (bool, error) {
+						if video.id != mkvPixelWidthID && video.id != mkvPixelHeightID {
+							return true, nil
+						}
+
+						value, err := readEBMLUint(r, video)
+						if err != nil || value > math.MaxInt32 {
+							return false, ErrUnsupportedVideo
+						}
+
+						if video.id == mkvPixelWidthID {
+							metadata.Width = int64(value)
+						} else {
+							metadata.Height = int64(value)
+						}
+						return true, nil
+					})
+				})
+			})
+		case mkvClusterID:
+			// Info and Tracks come before the first cluster in any file we accept.
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if metadata.Width == 0 || metadata.Height == 0 {
+		return nil, fmt.Errorf("%w: no video track found", ErrUnsupportedVideo)
+	}
+
+	if rawDuration <= 0 || math.IsNaN(rawDuration) || math.IsInf(rawDuration, 0) {
+		return nil, fmt.Errorf("%w: missing duration", ErrUnsupportedVideo)
+	}
+
+	metadata.Duration = rawDuration * float64(timecodeScale) / 1e9
+
+	return metadata, nil
+}
+
+// stripWebMMetadata turns tags (where recorders put the location),
+// attachments and the title into Void elements, wherever they are in the
+// segment.
+func stripWebMMetadata(data []byte) error {
+	r := bytes.NewReader(data)
+	size := int64(len(data))
+	count := 0
+
+	header, err := readEBMLElement(r, 0)
+	if err != nil || header.id != ebmlHeaderID || header.unknownSize {
+		return ErrUnsupportedVideo
+	}
+
+	segment, err := readEBMLElement(r, header.offset+header.size)
+	if err != nil || segment.id != mkvSegmentID {
+		return ErrUnsupportedVideo
+	}
+
+	segmentEnd := size
+	if !segment.unknownSize && segment.offset+segment.size < size {
+		segmentEnd = segment.offset + segment.size
+	}
+
+	for pos := segment.offset; pos < segmentEnd; {
+		count++
+		if count > maxVideoElements {
+			return ErrUnsupportedVideo
+		}
+
+		element, err := readEBMLElement(r, pos)
+		if err != nil {
+			return err
+		}
+
+		// Recorders that stream leave the size of clusters open, those are
+		// walked block by block to find where they end.
+		if element.unknownSize {
+			if element.id != mkvClusterID {
+				return ErrUnsupportedVideo
+			}
+			pos, err = endOfUnknownCluster(r, element.offset, segmentEnd, &count)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		end := element.offset + element.size
+		if end > segmentEnd {
+			return ErrUnsupportedVideo
+		}
+
+		switch element.id {
+		case mkvTagsID, mkvAttachmentsID:
+			if err := blankEBMLElement(data, element); err != nil {
+				return err
+			}
+		case mkvInfoID:
+			err := walkEBML(r, element.offset, end, &count, func(child ebmlElement) (bool, error) {
+				if child.id == mkvTitleID && !child.unknownSize {
+					return true, blankEBMLElement(data, child)
+				}
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		pos = end
+	}
+
+	return nil
+}
+
+func endOfUnknownCluster(r io.ReaderAt, start, end int64, count *int) (int64, error) {
+	for pos := start; pos < end; {
+		*count++
+		if *count > maxVideoElements {
+			return 0, ErrUnsupportedVideo
+		}
+
+		element, err := readEBMLElement(r, pos)
+		if err != nil {
+			return 0, err
+		}
+		if mkvTopLevelIDs[element.id] {
+			return pos, nil
+		}
+		if element.unknownSize || element.offset+element.size > end {
+			return 0, ErrUnsupportedVideo
+		}
+
+		pos = element.offset + element.size
+	}
+
+	return end, nil
+}
+
+// blankEBMLElement overwrites an element with a Void element of the same
+// length, its size written in one byte when it fits and in eight otherwise.
+func blankEBMLElement(data []byte, element ebmlElement) error {
+	if element.unknownSize {
+		return ErrUnsupportedVideo
+	}
+
+	start, end := element.start, element.offset+element.size
+	length := end - start
+	clear(data[start:end])
+	data[start] = ebmlVoidID
+
+	if payload := length - 2; payload < 0x7F {
+		data[start+1] = 0x80 | byte(payload)
+		return nil
+	}
+
+	// At 129 bytes or more there is room for the wider header.
+	payload := length - 9
+	data[start+1] = 0x01
+	for i := int64(0); i < 7; i++ {
+		data[start+8-i] = byte(payload >> (8 * i))
+	}
+	return nil
+}
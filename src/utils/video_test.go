@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+// largeBox is a box with a 64-bit size.
+func largeBox(boxType string, size uint64, payload []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, 1)
+	out = append(out, boxType...)
+	out = binary.BigEndian.AppendUint64(out, size)
+	return append(out, payload...)
+}
+
+// mvhdBoxV1 is a version 1 movie header, duration in milliseconds.
+func mvhdBoxV1(duration uint64) []byte {
+	payload := make([]byte, 112)
+	payload[0] = 1
+	binary.BigEndian.PutUint32(payload[20:24], 1000)
+	binary.BigEndian.PutUint64(payload[24:32], duration)
+	return box("mvhd", payload)
+}
+
+// unknownSizeSegment is a segment that runs to the end of the file.
+func unknownSizeSegment(children ...[]byte) []byte {
+	out := ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte("webm")))
+	out = append(out, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	for _, child := range children {
+		out = append(out, child...)
+	}
+	return out
+}
+
+func TestParseVideoMetadata(t *testing.T) {
+	mp4 := mp4File(mvhdBox(5000), videoTrak(640, 360))
+	webm := webmFile(webmInfo(5000), webmTracks(640, 360))
+
+	// The same file up to the mdat box, for swapping in a different one.
+	beforeMdat := mp4[: len(mp4)-14 : len(mp4)-14]
+
+	// moov comes right after ftyp.
+	moov := binary.BigEndian.Uint32(mp4[0:4])
+
+	// The moov box with its size field pointing past the end of the file.
+	oversized := append([]byte{}, mp4...)
+	binary.BigEndian.PutUint32(oversized[moov:moov+4], uint32(len(mp4)))
+
+	// A box too small to hold its own header.
+	undersized := append([]byte{}, mp4...)
+	binary.BigEndian.PutUint32(undersized[moov:moov+4], 4)
+
+	tests := []struct {
+		name string
+		data []byte
+		want *VideoMetadata // nil when the file must be rejected
+	}{
+		{"mp4", mp4, &VideoMetadata{Container: "mp4", Duration: 5, Width: 640, Height: 360}},
+		{"mp4 version 1 header", mp4File(mvhdBoxV1(5000), videoTrak(640, 360)), &VideoMetadata{Container: "mp4", Duration: 5, Width: 640, Height: 360}},
+		{"mp4 truncated in moov", mp4[:40], nil},
+		{"mp4 truncated in mdat", mp4[:len(mp4)-2], nil},
+		{"mp4 64-bit box size", append(beforeMdat, largeBox("mdat", 22, []byte("frames"))...), &VideoMetadata{Container: "mp4", Duration: 5, Width: 640, Height: 360}},
+		{"mp4 64-bit box size over int64", append(beforeMdat, largeBox("mdat", math.MaxUint64, []byte("frames"))...), nil},
+		{"mp4 64-bit box size past the end", append(beforeMdat, largeBox("mdat", 1<<40, []byte("frames"))...), nil},
+		{"mp4 box size past the end", oversized, nil},
+		{"mp4 box size under the header", undersized, nil},
+		{"mp4 without moov", box("ftyp", []byte("isom")), nil},
+		{"mp4 without mvhd", mp4File(videoTrak(640, 360)), nil},
+		{"mp4 without tkhd", mp4File(mvhdBox(5000), box("trak", box("mdia", box("hdlr", make([]byte, 24))))), nil},
+		{"mp4 zero duration", mp4File(mvhdBox(0), videoTrak(640, 360)), nil},
+		{"mp4 unknown duration", mp4File(mvhdBox(math.MaxUint32), videoTrak(640, 360)), nil},
+		{"webm", webm, &VideoMetadata{Container: "webm", Duration: 5, Width: 640, Height: 360}},
+		{"webm truncated", webm[:len(webm)-4], nil},
+		{"webm unknown size segment", unknownSizeSegment(webmInfo(5000), webmTracks(640, 360)), &VideoMetadata{Container: "webm", Duration: 5, Width: 640, Height: 360}},
+		{"webm unknown size cluster", webmFile(webmInfo(5000), webmTracks(640, 360), unknownSizeCluster(ebml(0xA3, []byte("frames")))), &VideoMetadata{Container: "webm", Duration: 5, Width: 640, Height: 360}},
+		{"webm child past its parent", webmFile(ebml(mkvInfoID, []byte{0x44, 0x89, 0x88, 0, 0, 0, 0}), webmTracks(640, 360)), nil},
+		{"webm without duration", webmFile(ebml(mkvInfoID, ebmlUint(mkvTimecodeScale, 1000000)), webmTracks(640, 360)), nil},
+		{"webm zero duration", webmFile(webmInfo(0), webmTracks(640, 360)), nil},
+		{"webm without tracks", webmFile(webmInfo(5000)), nil},
+		{"webm wrong doc type", append(ebml(ebmlHeaderID, ebml(ebmlDocTypeID, []byte("matroska"))), ebml(mkvSegmentID, webmInfo(5000), webmTracks(640, 360))...), nil},
+	}
+
+	for _, test := range tests {
+		metadata, err := ParseVideoMetadata(bytes.NewReader(test.data), int64(len(test.data)))
+
+		if test.want == nil {
+			if !errors.Is(err, ErrUnsupportedVideo) {
+				t.Errorf("%s: got %+v, %v, want ErrUnsupportedVideo", test.name, metadata, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if *metadata != *test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, metadata, test.want)
+		}
+	}
+}
+
+func TestSanitizeVideoDuration(t *testing.T) {
+	limits := DefaultUploadLimits
+	limits.MaxVideoDuration = 10
+
+	tests := []struct {
+		duration uint32 // milliseconds
+		want     error
+	}{
+		{10000, nil},
+		{10001, errUploadVideoLength},
+		{0, errUploadCorrupt},
+	}
+
+	for _, test := range tests {
+		for _, data := range [][]byte{
+			mp4File(mvhdBox(test.duration), videoTrak(640, 360)),
+			webmFile(webmInfo(float64(test.duration)), webmTracks(640, 360)),
+		} {
+			_, err := SanitizeUpload(bytes.NewReader(data), limits)
+			if err != test.want {
+				t.Errorf("%d ms: got %v, want %v", test.duration, err, test.want)
+			}
+		}
+	}
+}